@@ -7,13 +7,13 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/headers"
 	"golang.org/x/crypto/nacl/secretbox"
-	"gopkg.in/yaml.v2"
 
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
@@ -37,138 +37,228 @@ func decrypt(key string, byts []byte) ([]byte, error) {
 	return decrypted, nil
 }
 
-func loadFromFile(fpath string, conf *Conf) (bool, error) {
-	// rtsp-simple-server.yml is optional
-	// other configuration files are not
-	if fpath == "rtsp-simple-server.yml" {
-		if _, err := os.Stat(fpath); err != nil {
-			return false, nil
-		}
+// checkNonExistentFields checks that a generic map doesn't contain parameters
+// that are not in the reference struct, and returns all of them.
+func checkNonExistentFields(what interface{}, ref interface{}) ValidationErrors {
+	if what == nil {
+		return nil
 	}
 
-	byts, err := ioutil.ReadFile(fpath)
-	if err != nil {
-		return true, err
+	ma, ok := what.(map[string]interface{})
+	if !ok {
+		return ValidationErrors{{Err: fmt.Errorf("not a map")}}
 	}
 
-	if key, ok := os.LookupEnv("RTSP_CONFKEY"); ok {
-		byts, err = decrypt(key, byts)
-		if err != nil {
-			return true, err
-		}
-	}
+	var errs ValidationErrors
 
-	// load YAML config into a generic map
-	var temp interface{}
-	err = yaml.Unmarshal(byts, &temp)
-	if err != nil {
-		return true, err
-	}
+	for k, v := range ma {
+		fi := func() reflect.Type {
+			rr := reflect.TypeOf(ref)
+			for i := 0; i < rr.NumField(); i++ {
+				f := rr.Field(i)
+				if f.Tag.Get("json") == k {
+					return f.Type
+				}
+			}
+			return nil
+		}()
+		if fi == nil {
+			errs.add(k, fmt.Errorf("non-existent parameter: '%s'", k))
+			continue
+		}
 
-	// convert interface{} keys into string keys to avoid JSON errors
-	var convert func(i interface{}) interface{}
-	convert = func(i interface{}) interface{} {
-		switch x := i.(type) {
-		case map[interface{}]interface{}:
-			m2 := map[string]interface{}{}
-			for k, v := range x {
-				m2[k.(string)] = convert(v)
+		if fi == reflect.TypeOf(map[string]*PathConf{}) && v != nil {
+			ma2, ok := v.(map[string]interface{})
+			if !ok {
+				errs.add(k, fmt.Errorf("parameter %s is not a map", k))
+				continue
 			}
-			return m2
 
-		case []interface{}:
-			a2 := make([]interface{}, len(x))
-			for i, v := range x {
-				a2[i] = convert(v)
+			for k2, v2 := range ma2 {
+				for _, e := range checkNonExistentFields(v2, reflect.Zero(fi.Elem().Elem()).Interface()) {
+					field := k + "." + k2
+					if e.Field != "" {
+						field += "." + e.Field
+					}
+					errs.add(field, fmt.Errorf("parameter %s, key %s: %s", k, k2, e.Err))
+				}
 			}
-			return a2
 		}
+	}
 
-		return i
+	return errs
+}
+
+// decodeFields decodes a generic map into the struct rv, one parameter at a time,
+// and returns the parameters that can't be decoded.
+func decodeFields(what interface{}, rv reflect.Value, prefix string) ValidationErrors {
+	ma, ok := what.(map[string]interface{})
+	if !ok {
+		return nil
 	}
-	temp = convert(temp)
 
-	// check for non-existent parameters
-	var checkNonExistentFields func(what interface{}, ref interface{}) error
-	checkNonExistentFields = func(what interface{}, ref interface{}) error {
-		if what == nil {
-			return nil
-		}
+	var errs ValidationErrors
+	rt := rv.Type()
 
-		ma, ok := what.(map[string]interface{})
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		key := f.Tag.Get("json")
+
+		v, ok := ma[key]
 		if !ok {
-			return fmt.Errorf("not a map")
+			continue
 		}
 
-		for k, v := range ma {
-			fi := func() reflect.Type {
-				rr := reflect.TypeOf(ref)
-				for i := 0; i < rr.NumField(); i++ {
-					f := rr.Field(i)
-					if f.Tag.Get("json") == k {
-						return f.Type
-					}
-				}
-				return nil
-			}()
-			if fi == nil {
-				return fmt.Errorf("non-existent parameter: '%s'", k)
+		if f.Type == reflect.TypeOf(map[string]*PathConf{}) {
+			ma2, ok := v.(map[string]interface{})
+			if !ok {
+				continue
 			}
 
-			if fi == reflect.TypeOf(map[string]*PathConf{}) && v != nil {
-				ma2, ok := v.(map[string]interface{})
-				if !ok {
-					return fmt.Errorf("parameter %s is not a map", k)
+			paths := make(map[string]*PathConf)
+			for name, v2 := range ma2 {
+				if v2 == nil {
+					paths[name] = nil
+					continue
 				}
 
-				for k2, v2 := range ma2 {
-					err := checkNonExistentFields(v2, reflect.Zero(fi.Elem().Elem()).Interface())
-					if err != nil {
-						return fmt.Errorf("parameter %s, key %s: %s", k, k2, err)
-					}
-				}
+				pconf := &PathConf{}
+				errs = append(errs, decodeFields(v2, reflect.ValueOf(pconf).Elem(), prefix+key+"."+name+".")...)
+				paths[name] = pconf
 			}
+
+			rv.Field(i).Set(reflect.ValueOf(paths))
+			continue
 		}
-		return nil
+
+		byts, err := json.Marshal(v)
+		if err != nil {
+			errs.add(prefix+key, err)
+			continue
+		}
+
+		// decode into a new value, in order to replace existing maps and slices
+		nv := reflect.New(f.Type)
+		err = json.Unmarshal(byts, nv.Interface())
+		if err != nil {
+			errs.add(prefix+key, err)
+			continue
+		}
+
+		rv.Field(i).Set(nv.Elem())
 	}
-	err = checkNonExistentFields(temp, Conf{})
+
+	return errs
+}
+
+// loadFileInto reads a configuration file, checks it for non-existent
+// parameters and decodes it into dest. The returned error is filled when
+// the file can't be read or parsed; errors related to parameters are all
+// returned in errs.
+func loadFileInto(fpath string, dest interface{}) (ValidationErrors, error) {
+	byts, err := ioutil.ReadFile(fpath)
 	if err != nil {
-		return true, err
+		return nil, err
+	}
+
+	if key, ok := os.LookupEnv("RTSP_CONFKEY"); ok {
+		byts, err = decrypt(key, byts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// convert the generic map into JSON
-	byts, err = json.Marshal(temp)
+	// load the configuration file into a generic map
+	temp, err := FormatFromPath(fpath).unmarshal(byts)
 	if err != nil {
-		return true, err
+		return nil, err
 	}
+	temp = stringKeys(temp)
+
+	// check for non-existent parameters
+	errs := checkNonExistentFields(temp, reflect.ValueOf(dest).Elem().Interface())
+
+	// load the parameters
+	errs = append(errs, decodeFields(temp, reflect.ValueOf(dest).Elem(), "")...)
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
 
-	// load the configuration from JSON
-	err = json.Unmarshal(byts, conf)
+	return errs, nil
+}
+
+// DecodeJSON decodes parameters in JSON format into conf, replacing only
+// the parameters that are present. The returned error is filled when byts
+// can't be parsed; non-existent parameters and parameters that can't be decoded
+// are all returned in errs and are not applied.
+func (conf *Conf) DecodeJSON(byts []byte) (ValidationErrors, error) {
+	var temp interface{}
+	err := json.Unmarshal(byts, &temp)
 	if err != nil {
-		return true, err
+		return nil, err
+	}
+
+	errs := checkNonExistentFields(temp, *conf)
+	errs = append(errs, decodeFields(temp, reflect.ValueOf(conf).Elem(), "")...)
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+
+	return errs, nil
+}
+
+func loadFromFile(fpath string, conf *Conf) (bool, ValidationErrors, error) {
+	// rtsp-simple-server.yml is optional
+	// other configuration files are not
+	if fpath == "rtsp-simple-server.yml" {
+		if _, err := os.Stat(fpath); err != nil {
+			return false, nil, nil
+		}
 	}
 
-	return true, nil
+	errs, err := loadFileInto(fpath, conf)
+	return true, errs, err
 }
 
 // Conf is a configuration.
 type Conf struct {
 	// general
-	LogLevel                  LogLevel        `json:"logLevel"`
-	LogDestinations           LogDestinations `json:"logDestinations"`
-	LogFile                   string          `json:"logFile"`
-	ReadTimeout               StringDuration  `json:"readTimeout"`
-	WriteTimeout              StringDuration  `json:"writeTimeout"`
-	ReadBufferCount           int             `json:"readBufferCount"`
-	ExternalAuthenticationURL string          `json:"externalAuthenticationURL"`
-	API                       bool            `json:"api"`
-	APIAddress                string          `json:"apiAddress"`
-	Metrics                   bool            `json:"metrics"`
-	MetricsAddress            string          `json:"metricsAddress"`
-	PPROF                     bool            `json:"pprof"`
-	PPROFAddress              string          `json:"pprofAddress"`
-	RunOnConnect              string          `json:"runOnConnect"`
-	RunOnConnectRestart       bool            `json:"runOnConnectRestart"`
+	LogLevel                       LogLevel           `json:"logLevel"`
+	LogComponentLevels             LogComponentLevels `json:"logComponentLevels"`
+	LogFormat                      LogFormat          `json:"logFormat"`
+	LogDestinations                LogDestinations    `json:"logDestinations"`
+	LogFile                        string             `json:"logFile"`
+	LogFileMaxSize                 StringSize         `json:"logFileMaxSize"`
+	LogFileMaxAge                  StringDuration     `json:"logFileMaxAge"`
+	LogFileMaxBackups              int                `json:"logFileMaxBackups"`
+	LogFileCompress                bool               `json:"logFileCompress"`
+	ReadTimeout                    StringDuration     `json:"readTimeout"`
+	WriteTimeout                   StringDuration     `json:"writeTimeout"`
+	ReadBufferCount                int                `json:"readBufferCount"`
+	DrainTimeout                   StringDuration     `json:"drainTimeout"`
+	BanDuration                    StringDuration     `json:"banDuration"`
+	AuthFailureLimit               int                `json:"authFailureLimit"`
+	AuthFailurePeriod              StringDuration     `json:"authFailurePeriod"`
+	AuthFailureBanDuration         StringDuration     `json:"authFailureBanDuration"`
+	PathsDir                       string             `json:"pathsDir"`
+	ExternalAuthenticationURL      string             `json:"externalAuthenticationURL"`
+	ExternalAuthenticationCacheTTL StringDuration     `json:"externalAuthenticationCacheTTL"`
+	API                            bool               `json:"api"`
+	APIAddress                     string             `json:"apiAddress"`
+	APIPersist                     bool               `json:"apiPersist"`
+	APILogStream                   bool               `json:"apiLogStream"`
+	Metrics                        bool               `json:"metrics"`
+	MetricsAddress                 string             `json:"metricsAddress"`
+	PPROF                          bool               `json:"pprof"`
+	PPROFAddress                   string             `json:"pprofAddress"`
+	RunOnConnect                   string             `json:"runOnConnect"`
+	RunOnConnectRestart            bool               `json:"runOnConnectRestart"`
+	RunOnDisconnect                string             `json:"runOnDisconnect"`
+	RunOnRestartPause              StringDuration     `json:"runOnRestartPause"`
+	RunOnRestartMaxPause           StringDuration     `json:"runOnRestartMaxPause"`
+	RunOnMaxRestarts               int                `json:"runOnMaxRestarts"`
 
 	// RTSP
 	RTSPDisable       bool        `json:"rtspDisable"`
@@ -191,13 +281,15 @@ type Conf struct {
 	RTMPAddress string `json:"rtmpAddress"`
 
 	// HLS
-	HLSDisable         bool           `json:"hlsDisable"`
-	HLSAddress         string         `json:"hlsAddress"`
-	HLSAlwaysRemux     bool           `json:"hlsAlwaysRemux"`
-	HLSSegmentCount    int            `json:"hlsSegmentCount"`
-	HLSSegmentDuration StringDuration `json:"hlsSegmentDuration"`
-	HLSSegmentMaxSize  StringSize     `json:"hlsSegmentMaxSize"`
-	HLSAllowOrigin     string         `json:"hlsAllowOrigin"`
+	HLSDisable          bool             `json:"hlsDisable"`
+	HLSAddress          string           `json:"hlsAddress"`
+	HLSAlwaysRemux      bool             `json:"hlsAlwaysRemux"`
+	HLSSegmentCount     int              `json:"hlsSegmentCount"`
+	HLSSegmentDuration  StringDuration   `json:"hlsSegmentDuration"`
+	HLSSegmentMaxSize   StringSize       `json:"hlsSegmentMaxSize"`
+	HLSSegmentDirectory string           `json:"hlsSegmentDirectory"`
+	HLSAllowOrigin      string           `json:"hlsAllowOrigin"`
+	HLSVariantGroups    HLSVariantGroups `json:"hlsVariantGroups"`
 
 	// paths
 	Paths map[string]*PathConf `json:"paths"`
@@ -207,10 +299,21 @@ type Conf struct {
 func Load(fpath string) (*Conf, bool, error) {
 	conf := &Conf{}
 
-	found, err := loadFromFile(fpath, conf)
+	found, errs, err := loadFromFile(fpath, conf)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(errs) != 0 {
+		return nil, false, errs[0].Err
+	}
+
+	errs, err = loadPathsDir(conf, fpath)
 	if err != nil {
 		return nil, false, err
 	}
+	if len(errs) != 0 {
+		return nil, false, errs[0].Err
+	}
 
 	err = loadFromEnvironment("RTSP", conf)
 	if err != nil {
@@ -225,12 +328,76 @@ func Load(fpath string) (*Conf, bool, error) {
 	return conf, found, nil
 }
 
+// LoadFile loads a Conf from the configuration file only, without paths
+// loaded from pathsDir and parameters overridden by environment variables.
+func LoadFile(fpath string) (*Conf, error) {
+	conf := &Conf{}
+
+	_, errs, err := loadFromFile(fpath, conf)
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) != 0 {
+		return nil, errs[0].Err
+	}
+
+	err = conf.CheckAndFillMissing()
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// LoadAndValidate loads a Conf and returns all the errors found in it.
+// The returned error is filled when the configuration can't be loaded at all.
+func LoadAndValidate(fpath string) (ValidationErrors, error) {
+	conf := &Conf{}
+
+	_, errs, err := loadFromFile(fpath, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	pathsDirErrs, err := loadPathsDir(conf, fpath)
+	if err != nil {
+		return nil, err
+	}
+	errs = append(errs, pathsDirErrs...)
+
+	errs = append(errs, loadFromEnvironmentAll("RTSP", conf)...)
+
+	errs = append(errs, conf.Validate()...)
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+
+	return errs, nil
+}
+
 // CheckAndFillMissing checks the configuration for errors and fills missing parameters.
 func (conf *Conf) CheckAndFillMissing() error {
+	errs := conf.checkAndFillMissing()
+	if len(errs) != 0 {
+		return errs[0].Err
+	}
+	return nil
+}
+
+// checkAndFillMissing fills missing parameters and returns all the errors found.
+func (conf *Conf) checkAndFillMissing() ValidationErrors {
+	var errs ValidationErrors
+
 	if conf.LogLevel == 0 {
 		conf.LogLevel = LogLevel(logger.Info)
 	}
 
+	err := conf.LogComponentLevels.check()
+	if err != nil {
+		errs.add("logComponentLevels", err)
+	}
+
 	if len(conf.LogDestinations) == 0 {
 		conf.LogDestinations = LogDestinations{logger.DestinationStdout: {}}
 	}
@@ -251,13 +418,49 @@ func (conf *Conf) CheckAndFillMissing() error {
 		conf.ReadBufferCount = 512
 	}
 
+	if conf.BanDuration == 0 {
+		conf.BanDuration = 10 * StringDuration(time.Minute)
+	}
+
+	if conf.AuthFailurePeriod == 0 {
+		conf.AuthFailurePeriod = StringDuration(time.Minute)
+	}
+
+	if conf.AuthFailureBanDuration == 0 {
+		conf.AuthFailureBanDuration = 10 * StringDuration(time.Minute)
+	}
+
+	if conf.RunOnRestartPause == 0 {
+		conf.RunOnRestartPause = 5 * StringDuration(time.Second)
+	}
+
+	if conf.RunOnRestartMaxPause == 0 {
+		conf.RunOnRestartMaxPause = conf.RunOnRestartPause
+	}
+
+	if conf.RunOnRestartMaxPause < conf.RunOnRestartPause {
+		errs.add("runOnRestartMaxPause", fmt.Errorf("'runOnRestartMaxPause' can't be lower than 'runOnRestartPause'"))
+	}
+
+	if conf.RunOnMaxRestarts < 0 {
+		errs.add("runOnMaxRestarts", fmt.Errorf("'runOnMaxRestarts' can't be negative"))
+	}
+
+	if conf.AuthFailureLimit < 0 {
+		errs.add("authFailureLimit", fmt.Errorf("'authFailureLimit' can't be negative"))
+	}
+
 	if conf.ExternalAuthenticationURL != "" {
 		if !strings.HasPrefix(conf.ExternalAuthenticationURL, "http://") &&
 			!strings.HasPrefix(conf.ExternalAuthenticationURL, "https://") {
-			return fmt.Errorf("'externalAuthenticationURL' must be a HTTP URL")
+			errs.add("externalAuthenticationURL", fmt.Errorf("'externalAuthenticationURL' must be a HTTP URL"))
 		}
 	}
 
+	if conf.ExternalAuthenticationCacheTTL < 0 {
+		errs.add("externalAuthenticationCacheTTL", fmt.Errorf("'externalAuthenticationCacheTTL' can't be negative"))
+	}
+
 	if conf.APIAddress == "" {
 		conf.APIAddress = "127.0.0.1:9997"
 	}
@@ -280,11 +483,11 @@ func (conf *Conf) CheckAndFillMissing() error {
 
 	if conf.Encryption == EncryptionStrict {
 		if _, ok := conf.Protocols[Protocol(gortsplib.TransportUDP)]; ok {
-			return fmt.Errorf("strict encryption can't be used with the UDP transport protocol")
+			errs.add("encryption", fmt.Errorf("strict encryption can't be used with the UDP transport protocol"))
 		}
 
 		if _, ok := conf.Protocols[Protocol(gortsplib.TransportUDPMulticast)]; ok {
-			return fmt.Errorf("strict encryption can't be used with the UDP-multicast transport protocol")
+			errs.add("encryption", fmt.Errorf("strict encryption can't be used with the UDP-multicast transport protocol"))
 		}
 	}
 
@@ -370,11 +573,28 @@ func (conf *Conf) CheckAndFillMissing() error {
 			pconf = conf.Paths[name]
 		}
 
-		err := pconf.checkAndFillMissing(conf, name)
-		if err != nil {
-			return err
+		for _, e := range pconf.checkAndFillMissing(conf, name) {
+			field := "paths." + name
+			if e.Field != "" {
+				field += "." + e.Field
+			}
+			errs.add(field, e.Err)
 		}
 	}
 
-	return nil
+	for name, pconf := range conf.Paths {
+		if pconf.Alias != "" {
+			err := pconf.checkAlias(conf.Paths)
+			if err != nil {
+				errs.add("paths."+name, err)
+			}
+		}
+	}
+
+	err = conf.HLSVariantGroups.check(conf.Paths)
+	if err != nil {
+		errs.add("hlsVariantGroups", err)
+	}
+
+	return errs
 }
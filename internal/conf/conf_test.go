@@ -3,9 +3,12 @@ package conf
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -16,8 +19,8 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
-func writeTempFile(byts []byte) (string, error) {
-	tmpf, err := ioutil.TempFile(os.TempDir(), "rtsp-")
+func writeTempFile(ext string, byts []byte) (string, error) {
+	tmpf, err := ioutil.TempFile(os.TempDir(), "rtsp-*"+ext)
 	if err != nil {
 		return "", err
 	}
@@ -33,9 +36,9 @@ func writeTempFile(byts []byte) (string, error) {
 
 func TestConfFromFile(t *testing.T) {
 	func() {
-		tmpf, err := writeTempFile([]byte("logLevel: debug\n" +
-			"paths:\n" +
-			"  cam1:\n" +
+		tmpf, err := writeTempFile("", []byte("logLevel: debug\n"+
+			"paths:\n"+
+			"  cam1:\n"+
 			"    runOnDemandStartTimeout: 5s\n"))
 		require.NoError(t, err)
 		defer os.Remove(tmpf)
@@ -58,7 +61,7 @@ func TestConfFromFile(t *testing.T) {
 	}()
 
 	func() {
-		tmpf, err := writeTempFile([]byte(``))
+		tmpf, err := writeTempFile("", []byte(``))
 		require.NoError(t, err)
 		defer os.Remove(tmpf)
 
@@ -67,7 +70,7 @@ func TestConfFromFile(t *testing.T) {
 	}()
 
 	func() {
-		tmpf, err := writeTempFile([]byte(`paths:`))
+		tmpf, err := writeTempFile("", []byte(`paths:`))
 		require.NoError(t, err)
 		defer os.Remove(tmpf)
 
@@ -76,8 +79,8 @@ func TestConfFromFile(t *testing.T) {
 	}()
 
 	func() {
-		tmpf, err := writeTempFile([]byte(
-			"paths:\n" +
+		tmpf, err := writeTempFile("", []byte(
+			"paths:\n"+
 				"  mypath:\n"))
 		require.NoError(t, err)
 		defer os.Remove(tmpf)
@@ -94,7 +97,7 @@ func TestConfFromFileAndEnv(t *testing.T) {
 	os.Setenv("RTSP_PROTOCOLS", "tcp")
 	defer os.Unsetenv("RTSP_PROTOCOLS")
 
-	tmpf, err := writeTempFile([]byte("{}"))
+	tmpf, err := writeTempFile("", []byte("{}"))
 	require.NoError(t, err)
 	defer os.Remove(tmpf)
 
@@ -156,7 +159,7 @@ func TestConfEncryption(t *testing.T) {
 	os.Setenv("RTSP_CONFKEY", key)
 	defer os.Unsetenv("RTSP_CONFKEY")
 
-	tmpf, err := writeTempFile([]byte(encryptedConf))
+	tmpf, err := writeTempFile("", []byte(encryptedConf))
 	require.NoError(t, err)
 	defer os.Remove(tmpf)
 
@@ -171,9 +174,69 @@ func TestConfEncryption(t *testing.T) {
 	require.Equal(t, true, ok)
 }
 
+func TestConfFormats(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		ext  string
+		byts string
+	}{
+		{
+			"json",
+			".json",
+			`{"logLevel": "debug", "readBufferCount": 1024, "protocols": ["tcp"], ` +
+				`"paths": {"cam1": {"runOnDemandStartTimeout": "5s"}, "cam2": null}}`,
+		},
+		{
+			"toml",
+			".toml",
+			"logLevel = \"debug\"\n" +
+				"readBufferCount = 1024\n" +
+				"protocols = [\"tcp\"]\n" +
+				"[paths.cam1]\n" +
+				"runOnDemandStartTimeout = \"5s\"\n" +
+				"[paths.cam2]\n",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			os.Setenv("RTSP_PATHS_CAM1_RUNONDEMANDCLOSEAFTER", "3s")
+			defer os.Unsetenv("RTSP_PATHS_CAM1_RUNONDEMANDCLOSEAFTER")
+
+			tmpf, err := writeTempFile(ca.ext, []byte(ca.byts))
+			require.NoError(t, err)
+			defer os.Remove(tmpf)
+
+			conf, hasFile, err := Load(tmpf)
+			require.NoError(t, err)
+			require.Equal(t, true, hasFile)
+
+			require.Equal(t, LogLevel(logger.Debug), conf.LogLevel)
+			require.Equal(t, 1024, conf.ReadBufferCount)
+			require.Equal(t, Protocols{Protocol(gortsplib.TransportTCP): {}}, conf.Protocols)
+			require.Equal(t, 5*StringDuration(time.Second), conf.Paths["cam1"].RunOnDemandStartTimeout)
+			require.Equal(t, 3*StringDuration(time.Second), conf.Paths["cam1"].RunOnDemandCloseAfter)
+			_, ok := conf.Paths["cam2"]
+			require.Equal(t, true, ok)
+
+			conf.ReadBufferCount = 2048
+			conf.Paths["cam2"].ReadUser = "myuser"
+			conf.Paths["cam2"].ReadPass = "mypass"
+
+			byts, err := conf.MarshalFormat([]byte(ca.byts), FormatFromPath(tmpf))
+			require.NoError(t, err)
+
+			err = WriteFile(tmpf, byts)
+			require.NoError(t, err)
+
+			conf2, _, err := Load(tmpf)
+			require.NoError(t, err)
+			require.Equal(t, conf, conf2)
+		})
+	}
+}
+
 func TestConfErrorNonExistentParameter(t *testing.T) {
 	func() {
-		tmpf, err := writeTempFile([]byte(`invalid: param`))
+		tmpf, err := writeTempFile("", []byte(`invalid: param`))
 		require.NoError(t, err)
 		defer os.Remove(tmpf)
 
@@ -182,8 +245,8 @@ func TestConfErrorNonExistentParameter(t *testing.T) {
 	}()
 
 	func() {
-		tmpf, err := writeTempFile([]byte("paths:\n" +
-			"  mypath:\n" +
+		tmpf, err := writeTempFile("", []byte("paths:\n"+
+			"  mypath:\n"+
 			"    invalid: parameter\n"))
 		require.NoError(t, err)
 		defer os.Remove(tmpf)
@@ -192,3 +255,436 @@ func TestConfErrorNonExistentParameter(t *testing.T) {
 		require.EqualError(t, err, "parameter paths, key mypath: non-existent parameter: 'invalid'")
 	}()
 }
+
+func TestConfHLSVariantGroups(t *testing.T) {
+	func() {
+		tmpf, err := writeTempFile("", []byte("hlsVariantGroups:\n"+
+			"  mycam: [mycam_high, mycam_low]\n"))
+		require.NoError(t, err)
+		defer os.Remove(tmpf)
+
+		conf, _, err := Load(tmpf)
+		require.NoError(t, err)
+		require.Equal(t, HLSVariantGroups{
+			"mycam": {"mycam_high", "mycam_low"},
+		}, conf.HLSVariantGroups)
+		require.Equal(t, true, conf.HLSVariantGroups.Contains("mycam_low"))
+		require.Equal(t, false, conf.HLSVariantGroups.Contains("mycam"))
+	}()
+
+	func() {
+		os.Setenv("RTSP_HLSVARIANTGROUPS", "mycam:mycam_high,mycam_low;other:other_high")
+		defer os.Unsetenv("RTSP_HLSVARIANTGROUPS")
+
+		conf, _, err := Load("rtsp-simple-server.yml")
+		require.NoError(t, err)
+		require.Equal(t, HLSVariantGroups{
+			"mycam": {"mycam_high", "mycam_low"},
+			"other": {"other_high"},
+		}, conf.HLSVariantGroups)
+	}()
+
+	func() {
+		tmpf, err := writeTempFile("", []byte("hlsVariantGroups:\n"+
+			"  mycam: [mycam_high, mycam_low]\n"+
+			"paths:\n"+
+			"  mycam:\n"))
+		require.NoError(t, err)
+		defer os.Remove(tmpf)
+
+		_, _, err = Load(tmpf)
+		require.EqualError(t, err, "HLS variant group name 'mycam' is already used by a path")
+	}()
+}
+
+func TestConfMarshal(t *testing.T) {
+	existing := []byte("# log level\n" +
+		"logLevel: debug\n" +
+		"protocols: [udp, tcp]\n" +
+		"encryption: \"no\"\n" +
+		"paths:\n" +
+		"  all:\n" +
+		"    # read user\n" +
+		"    readUser: myuser\n" +
+		"    readPass: mypass\n" +
+		"  cam1:\n" +
+		"    source: rtsp://localhost:8554/mystream\n" +
+		"  cam2:\n")
+
+	tmpf, err := writeTempFile("", existing)
+	require.NoError(t, err)
+	defer os.Remove(tmpf)
+
+	conf, _, err := Load(tmpf)
+	require.NoError(t, err)
+
+	conf.ReadBufferCount = 1024
+	conf.Paths["cam1"].SourceOnDemand = true
+	delete(conf.Paths, "cam2")
+	conf.Paths["cam3"] = &PathConf{RunOnInit: "ffmpeg -i test"}
+	err = conf.CheckAndFillMissing()
+	require.NoError(t, err)
+
+	byts, err := conf.Marshal(existing)
+	require.NoError(t, err)
+	require.Equal(t, "# log level\n"+
+		"logLevel: debug\n"+
+		"protocols: [udp, tcp]\n"+
+		"encryption: \"no\"\n"+
+		"paths:\n"+
+		"  all:\n"+
+		"    # read user\n"+
+		"    readUser: myuser\n"+
+		"    readPass: mypass\n"+
+		"  cam1:\n"+
+		"    source: rtsp://localhost:8554/mystream\n"+
+		"    sourceOnDemand: true\n"+
+		"  cam3:\n"+
+		"    runOnInit: ffmpeg -i test\n"+
+		"readBufferCount: 1024\n", string(byts))
+
+	err = WriteFile(tmpf, byts)
+	require.NoError(t, err)
+
+	conf2, _, err := Load(tmpf)
+	require.NoError(t, err)
+	require.Equal(t, conf, conf2)
+}
+
+func TestConfApplyChanges(t *testing.T) {
+	os.Setenv("RTSP_PROTOCOLS", "tcp")
+	defer os.Unsetenv("RTSP_PROTOCOLS")
+	os.Setenv("RTSP_PATHS_CAM1_READUSER", "myuser")
+	defer os.Unsetenv("RTSP_PATHS_CAM1_READUSER")
+	os.Setenv("RTSP_PATHS_CAM1_READPASS", "mypass")
+	defer os.Unsetenv("RTSP_PATHS_CAM1_READPASS")
+
+	existing := []byte("paths:\n" +
+		"  cam1:\n" +
+		"    source: rtsp://localhost:8554/mystream\n" +
+		"  cam2:\n")
+
+	tmpf, err := writeTempFile("", existing)
+	require.NoError(t, err)
+	defer os.Remove(tmpf)
+
+	oldConf, _, err := Load(tmpf)
+	require.NoError(t, err)
+
+	newConf, _, err := Load(tmpf)
+	require.NoError(t, err)
+	newConf.ReadBufferCount = 1024
+	newConf.Paths["cam1"].SourceOnDemand = true
+	delete(newConf.Paths, "cam2")
+
+	fileConf, err := LoadFile(tmpf)
+	require.NoError(t, err)
+
+	err = fileConf.ApplyChanges(oldConf, newConf)
+	require.NoError(t, err)
+
+	byts, err := fileConf.Marshal(existing)
+	require.NoError(t, err)
+	require.Equal(t, "paths:\n"+
+		"  cam1:\n"+
+		"    source: rtsp://localhost:8554/mystream\n"+
+		"    sourceOnDemand: true\n"+
+		"readBufferCount: 1024\n", string(byts))
+}
+
+func TestConfLogLevels(t *testing.T) {
+	func() {
+		tmpf, err := writeTempFile("", []byte("logComponentLevels:\n"+
+			"  rtsp: debug\n"+
+			"paths:\n"+
+			"  cam1:\n"+
+			"    logLevel: warn\n"+
+			"  cam2:\n"+
+			"    logLevel:\n"))
+		require.NoError(t, err)
+		defer os.Remove(tmpf)
+
+		conf, _, err := Load(tmpf)
+		require.NoError(t, err)
+		require.Equal(t, LogComponentLevels{"rtsp": LogLevel(logger.Debug)}, conf.LogComponentLevels)
+		require.Equal(t, LogLevel(logger.Warn), conf.Paths["cam1"].LogLevel)
+		require.Equal(t, LogLevel(0), conf.Paths["cam2"].LogLevel)
+	}()
+
+	func() {
+		os.Setenv("RTSP_LOGCOMPONENTLEVELS", "rtmp:warn,hls:error")
+		defer os.Unsetenv("RTSP_LOGCOMPONENTLEVELS")
+
+		conf, _, err := Load("rtsp-simple-server.yml")
+		require.NoError(t, err)
+		require.Equal(t, LogComponentLevels{
+			"rtmp": LogLevel(logger.Warn),
+			"hls":  LogLevel(logger.Error),
+		}, conf.LogComponentLevels)
+	}()
+
+	func() {
+		tmpf, err := writeTempFile("", []byte("logComponentLevels:\n"+
+			"  invalid: debug\n"))
+		require.NoError(t, err)
+		defer os.Remove(tmpf)
+
+		_, _, err = Load(tmpf)
+		require.EqualError(t, err, "invalid log component 'invalid'; "+
+			"available components are rtsp, rtsps, rtmp, hls, api, metrics, pprof")
+	}()
+}
+
+func TestConfValidate(t *testing.T) {
+	tmpf, err := writeTempFile("", []byte("runOnMaxRestarts: -1\n"+
+		"rtmpAddress: :8554\n"+
+		"encryption: optional\n"+
+		"serverCert: /nonexisting.crt\n"+
+		"invalid: yes\n"+
+		"readTimeout: invalid\n"+
+		"paths:\n"+
+		"  ~^(invalid:\n"+
+		"  mypath:\n"+
+		"    source: rtsp://invalid url\n"+
+		"    maxSessionDuration: -1s\n"+
+		"    invalid: yes\n"))
+	require.NoError(t, err)
+	defer os.Remove(tmpf)
+
+	errs, err := LoadAndValidate(tmpf)
+	require.NoError(t, err)
+
+	var fields []string
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	require.Equal(t, []string{
+		"invalid",
+		"paths.mypath.invalid",
+		"paths.mypath.maxSessionDuration",
+		"paths.mypath.source",
+		"paths.~^(invalid",
+		"readTimeout",
+		"rtmpAddress",
+		"runOnMaxRestarts",
+		"serverCert",
+	}, fields)
+}
+
+func TestConfValidationErrorJSON(t *testing.T) {
+	byts, err := json.Marshal(ValidationError{
+		Field: "paths.\U0001F600",
+		Err:   fmt.Errorf("invalid \x01 value"),
+	})
+	require.NoError(t, err)
+
+	var dec struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+	err = json.Unmarshal(byts, &dec)
+	require.NoError(t, err)
+	require.Equal(t, "paths.\U0001F600", dec.Field)
+	require.Equal(t, "invalid \x01 value", dec.Message)
+}
+
+func TestConfPathAliases(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{
+			"non existent",
+			"paths:\n" +
+				"  legacy:\n" +
+				"    alias: cam1\n",
+			"alias 'cam1' points to a path which doesn't exist",
+		},
+		{
+			"alias of alias",
+			"paths:\n" +
+				"  cam1:\n" +
+				"  legacy1:\n" +
+				"    alias: cam1\n" +
+				"  legacy2:\n" +
+				"    alias: legacy1\n",
+			"alias 'legacy1' points to another alias",
+		},
+		{
+			"source",
+			"paths:\n" +
+				"  cam1:\n" +
+				"  legacy:\n" +
+				"    source: rtsp://localhost:8554/mypath\n" +
+				"    alias: cam1\n",
+			"'alias' can't be used with a source; set the source in the aliased path",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			tmpf, err := writeTempFile("", []byte(ca.conf))
+			require.NoError(t, err)
+			defer os.Remove(tmpf)
+
+			_, _, err = Load(tmpf)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+
+	tmpf, err := writeTempFile("", []byte("paths:\n"+
+		"  cam1:\n"+
+		"  legacy:\n"+
+		"    alias: cam1\n"))
+	require.NoError(t, err)
+	defer os.Remove(tmpf)
+
+	conf, _, err := Load(tmpf)
+	require.NoError(t, err)
+	require.Equal(t, "cam1", conf.Paths["legacy"].Alias)
+}
+
+func TestConfRegexpGroups(t *testing.T) {
+	require.Equal(t, "rtsp://10.0.0.12/stream/a",
+		ExpandGroups("rtsp://10.0.0.$G1/stream/${G2}", []string{"cam12_a", "12", "a"}))
+	require.Equal(t, "rtsp://host/$G3", ExpandGroups("rtsp://host/$G3", []string{"cam", "1"}))
+
+	pconf := &PathConf{
+		Source:   "rtsp://$G1.cams.local/stream",
+		Fallback: "/other/$G1",
+	}
+	require.NoError(t, pconf.CheckURLGroups([]string{"cam1", "1"}))
+	for _, m := range []string{"evil.com/x", "evil.com:554", "user@evil.com", "x?y", "x#y"} {
+		require.Error(t, pconf.CheckURLGroups([]string{"cam" + m, m}))
+	}
+
+	pconf = &PathConf{Fallback: "/other/$G1"}
+	require.NoError(t, pconf.CheckURLGroups([]string{"camsub/1", "sub/1"}))
+
+	func() {
+		tmpf, err := writeTempFile("", []byte("paths:\n"+
+			"  ~^cam(\\d+)$:\n"+
+			"    source: rtsp://10.0.0.$G1/stream\n"+
+			"    sourceOnDemand: yes\n"+
+			"    fallback: /other$G1\n"))
+		require.NoError(t, err)
+		defer os.Remove(tmpf)
+
+		_, _, err = Load(tmpf)
+		require.NoError(t, err)
+	}()
+
+	func() {
+		tmpf, err := writeTempFile("", []byte("paths:\n"+
+			"  ~^cam(\\d+)$:\n"+
+			"    source: rtsp://10.0.0.$G1/stream\n"))
+		require.NoError(t, err)
+		defer os.Remove(tmpf)
+
+		_, _, err = Load(tmpf)
+		require.EqualError(t, err, "a path with a regular expression (or path 'all') "+
+			"can have a RTSP source only if 'sourceOnDemand' is enabled")
+	}()
+}
+
+func TestConfPathsDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "rtsp-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = os.Mkdir(filepath.Join(dir, "cams"), 0o755)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "cams", "cam1.yml"),
+		[]byte("source: rtsp://localhost:8554/mystream\n"), 0o644)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "cam2.json"),
+		[]byte(`{"readUser": "myuser", "readPass": "mypass"}`), 0o644)
+	require.NoError(t, err)
+
+	existing := []byte("pathsDir: " + dir + "\n" +
+		"paths:\n" +
+		"  cam3: {}\n")
+
+	tmpf, err := writeTempFile("", existing)
+	require.NoError(t, err)
+	defer os.Remove(tmpf)
+
+	conf, _, err := Load(tmpf)
+	require.NoError(t, err)
+	require.Equal(t, "rtsp://localhost:8554/mystream", conf.Paths["cams/cam1"].Source)
+	require.Equal(t, Credential("myuser"), conf.Paths["cam2"].ReadUser)
+	_, ok := conf.Paths["cam3"]
+	require.Equal(t, true, ok)
+
+	// paths of the directory are not written into the configuration file
+	err = conf.SavePathsDir(tmpf, conf, conf, nil)
+	require.NoError(t, err)
+	byts, err := conf.Marshal(existing)
+	require.NoError(t, err)
+	require.Equal(t, string(existing), string(byts))
+
+	err = ioutil.WriteFile(filepath.Join(dir, "cam3.yml"), []byte("{}"), 0o644)
+	require.NoError(t, err)
+
+	_, _, err = Load(tmpf)
+	require.EqualError(t, err, "path 'cam3' is defined both in the configuration file and in '"+
+		filepath.Join(dir, "cam3.yml")+"'")
+}
+
+func TestConfSavePathsDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "rtsp-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = os.Mkdir(filepath.Join(dir, "paths"), 0o755)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "paths", "cam1.yml"),
+		[]byte("# my camera\n"+
+			"source: rtsp://localhost:8554/mystream\n"), 0o644)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "paths", "cam2.json"),
+		[]byte(`{"readUser": "myuser", "readPass": "mypass"}`), 0o644)
+	require.NoError(t, err)
+
+	// pathsDir is relative to the directory of the configuration file
+	confPath := filepath.Join(dir, "rtsp-simple-server.yml")
+	err = ioutil.WriteFile(confPath, []byte("pathsDir: paths\n"), 0o644)
+	require.NoError(t, err)
+
+	oldConf, _, err := Load(confPath)
+	require.NoError(t, err)
+	require.Equal(t, "rtsp://localhost:8554/mystream", oldConf.Paths["cam1"].Source)
+
+	newConf, _, err := Load(confPath)
+	require.NoError(t, err)
+	newConf.Paths["cam1"].SourceOnDemand = true
+	delete(newConf.Paths, "cam2")
+
+	fileConf, err := LoadFile(confPath)
+	require.NoError(t, err)
+
+	err = fileConf.ApplyChanges(oldConf, newConf)
+	require.NoError(t, err)
+
+	err = fileConf.SavePathsDir(confPath, oldConf, newConf, nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(fileConf.Paths))
+
+	byts, err := ioutil.ReadFile(filepath.Join(dir, "paths", "cam1.yml"))
+	require.NoError(t, err)
+	require.Equal(t, "# my camera\n"+
+		"source: rtsp://localhost:8554/mystream\n"+
+		"sourceOnDemand: true\n", string(byts))
+
+	_, err = os.Stat(filepath.Join(dir, "paths", "cam2.json"))
+	require.Equal(t, true, os.IsNotExist(err))
+
+	conf, _, err := Load(confPath)
+	require.NoError(t, err)
+	require.Equal(t, true, conf.Paths["cam1"].SourceOnDemand)
+	_, ok := conf.Paths["cam2"]
+	require.Equal(t, false, ok)
+}
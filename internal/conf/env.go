@@ -12,17 +12,20 @@ type envUnmarshaler interface {
 	unmarshalEnv(string) error
 }
 
-func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) error {
+// loadEnvInternal loads environment variables into rv.
+// Errors are added to errs, in order to report all of them at once.
+func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value, errs *ValidationErrors) {
 	rt := rv.Type()
 
 	if i, ok := rv.Addr().Interface().(envUnmarshaler); ok {
 		if ev, ok := env[prefix]; ok {
 			err := i.unmarshalEnv(ev)
 			if err != nil {
-				return fmt.Errorf("%s: %s", prefix, err)
+				errs.add(prefix, err)
+				return
 			}
 		}
-		return nil
+		return
 	}
 
 	switch rt {
@@ -30,27 +33,29 @@ func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) err
 		if ev, ok := env[prefix]; ok {
 			rv.SetString(ev)
 		}
-		return nil
+		return
 
 	case reflect.TypeOf(int(0)):
 		if ev, ok := env[prefix]; ok {
 			iv, err := strconv.ParseInt(ev, 10, 64)
 			if err != nil {
-				return fmt.Errorf("%s: %s", prefix, err)
+				errs.add(prefix, err)
+				return
 			}
 			rv.SetInt(iv)
 		}
-		return nil
+		return
 
 	case reflect.TypeOf(uint64(0)):
 		if ev, ok := env[prefix]; ok {
 			iv, err := strconv.ParseUint(ev, 10, 64)
 			if err != nil {
-				return fmt.Errorf("%s: %s", prefix, err)
+				errs.add(prefix, err)
+				return
 			}
 			rv.SetUint(iv)
 		}
-		return nil
+		return
 
 	case reflect.TypeOf(bool(false)):
 		if ev, ok := env[prefix]; ok {
@@ -62,10 +67,10 @@ func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) err
 				rv.SetBool(false)
 
 			default:
-				return fmt.Errorf("%s: invalid value '%s'", prefix, ev)
+				errs.add(prefix, fmt.Errorf("invalid value '%s'", ev))
 			}
 		}
-		return nil
+		return
 	}
 
 	switch rt.Kind() {
@@ -98,12 +103,9 @@ func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) err
 				rv.SetMapIndex(reflect.ValueOf(mapKeyLower), nv)
 			}
 
-			err := loadEnvInternal(env, prefix+"_"+mapKey, nv.Elem())
-			if err != nil {
-				return err
-			}
+			loadEnvInternal(env, prefix+"_"+mapKey, nv.Elem(), errs)
 		}
-		return nil
+		return
 
 	case reflect.Struct:
 		flen := rt.NumField()
@@ -115,23 +117,31 @@ func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) err
 				continue
 			}
 
-			err := loadEnvInternal(env, prefix+"_"+strings.ToUpper(f.Name), rv.Field(i))
-			if err != nil {
-				return err
-			}
+			loadEnvInternal(env, prefix+"_"+strings.ToUpper(f.Name), rv.Field(i), errs)
 		}
-		return nil
+		return
 	}
 
-	return fmt.Errorf("unsupported type: %v", rt)
+	errs.add(prefix, fmt.Errorf("unsupported type: %v", rt))
 }
 
 func loadFromEnvironment(prefix string, v interface{}) error {
+	errs := loadFromEnvironmentAll(prefix, v)
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// loadFromEnvironmentAll loads environment variables into v and returns all the errors found.
+func loadFromEnvironmentAll(prefix string, v interface{}) ValidationErrors {
 	env := make(map[string]string)
 	for _, kv := range os.Environ() {
 		tmp := strings.SplitN(kv, "=", 2)
 		env[tmp[0]] = tmp[1]
 	}
 
-	return loadEnvInternal(env, prefix, reflect.ValueOf(v).Elem())
+	var errs ValidationErrors
+	loadEnvInternal(env, prefix, reflect.ValueOf(v).Elem(), &errs)
+	return errs
 }
@@ -0,0 +1,161 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Format is the format of a configuration file.
+type Format int
+
+// supported formats.
+const (
+	FormatYAML Format = iota
+	FormatJSON
+	FormatTOML
+)
+
+// FormatFromPath returns the format of a configuration file,
+// deduced from its extension. YAML is used by default.
+func FormatFromPath(fpath string) Format {
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".json":
+		return FormatJSON
+
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatYAML
+}
+
+// unmarshal decodes a configuration file into a generic map.
+func (f Format) unmarshal(byts []byte) (interface{}, error) {
+	var temp interface{}
+
+	switch f {
+	case FormatJSON:
+		err := json.Unmarshal(byts, &temp)
+		if err != nil {
+			return nil, err
+		}
+
+	case FormatTOML:
+		var m map[string]interface{}
+		err := toml.Unmarshal(byts, &m)
+		if err != nil {
+			return nil, err
+		}
+		temp = m
+
+	default:
+		err := yaml.Unmarshal(byts, &temp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return temp, nil
+}
+
+// toYAML converts a configuration file into YAML.
+func (f Format) toYAML(byts []byte) ([]byte, error) {
+	if f == FormatYAML || len(bytes.TrimSpace(byts)) == 0 {
+		return byts, nil
+	}
+
+	temp, err := f.unmarshal(byts)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(temp)
+}
+
+// fromYAML converts a YAML configuration file into the format.
+func (f Format) fromYAML(byts []byte) ([]byte, error) {
+	if f == FormatYAML {
+		return byts, nil
+	}
+
+	var temp interface{}
+	err := yaml.Unmarshal(byts, &temp)
+	if err != nil {
+		return nil, err
+	}
+	temp = stringKeys(temp)
+
+	if f == FormatJSON {
+		byts, err := json.MarshalIndent(temp, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(byts, '\n'), nil
+	}
+
+	// TOML doesn't support null values.
+	// null paths are replaced with empty tables, other null values are removed.
+	var removeNulls func(i interface{}, isPaths bool)
+	removeNulls = func(i interface{}, isPaths bool) {
+		switch x := i.(type) {
+		case map[string]interface{}:
+			for k, v := range x {
+				switch {
+				case v != nil:
+					removeNulls(v, !isPaths && k == "paths")
+
+				case isPaths:
+					x[k] = map[string]interface{}{}
+
+				default:
+					delete(x, k)
+				}
+			}
+
+		case []interface{}:
+			for _, v := range x {
+				removeNulls(v, false)
+			}
+		}
+	}
+	removeNulls(temp, false)
+
+	var buf bytes.Buffer
+	err = toml.NewEncoder(&buf).Encode(temp)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// stringKeys converts interface{} keys into string keys to avoid JSON errors.
+func stringKeys(i interface{}) interface{} {
+	switch x := i.(type) {
+	case map[interface{}]interface{}:
+		m2 := map[string]interface{}{}
+		for k, v := range x {
+			m2[k.(string)] = stringKeys(v)
+		}
+		return m2
+
+	case map[string]interface{}:
+		for k, v := range x {
+			x[k] = stringKeys(v)
+		}
+		return x
+
+	case []interface{}:
+		a2 := make([]interface{}, len(x))
+		for i, v := range x {
+			a2[i] = stringKeys(v)
+		}
+		return a2
+	}
+
+	return i
+}
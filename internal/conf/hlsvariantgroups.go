@@ -0,0 +1,73 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HLSVariantGroups is the hlsVariantGroups parameter.
+// It maps the name of a group to the names of the paths that are its variants.
+type HLSVariantGroups map[string][]string
+
+// unmarshalEnv unmarshals a HLSVariantGroups from an environment variable
+// in the format "group1:path1,path2;group2:path3,path4".
+func (d *HLSVariantGroups) unmarshalEnv(s string) error {
+	*d = make(HLSVariantGroups)
+
+	for _, entry := range strings.Split(s, ";") {
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid HLS variant group: '%s'", entry)
+		}
+
+		(*d)[parts[0]] = strings.Split(parts[1], ",")
+	}
+
+	return nil
+}
+
+func (d HLSVariantGroups) check(paths map[string]*PathConf) error {
+	for name, variants := range d {
+		err := IsValidPathName(name)
+		if err != nil {
+			return fmt.Errorf("invalid HLS variant group name '%s': %s", name, err)
+		}
+
+		if _, ok := paths[name]; ok {
+			return fmt.Errorf("HLS variant group name '%s' is already used by a path", name)
+		}
+
+		if len(variants) == 0 {
+			return fmt.Errorf("HLS variant group '%s' has no variants", name)
+		}
+
+		for _, variant := range variants {
+			err := IsValidPathName(variant)
+			if err != nil {
+				return fmt.Errorf("invalid variant '%s' of HLS variant group '%s': %s", variant, name, err)
+			}
+
+			if _, ok := d[variant]; ok {
+				return fmt.Errorf("variant '%s' of HLS variant group '%s' is a HLS variant group", variant, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Contains checks whether a path is a variant of any group.
+func (d HLSVariantGroups) Contains(pathName string) bool {
+	for _, variants := range d {
+		for _, variant := range variants {
+			if variant == pathName {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+var logComponents = []string{"rtsp", "rtsps", "rtmp", "hls", "api", "metrics", "pprof"}
+
+// LogComponentLevels is the logComponentLevels parameter.
+// It maps the name of a component to its log level.
+type LogComponentLevels map[string]LogLevel
+
+// unmarshalEnv unmarshals a LogComponentLevels from an environment variable
+// in the format "component1:level1,component2:level2".
+func (d *LogComponentLevels) unmarshalEnv(s string) error {
+	*d = make(LogComponentLevels)
+
+	for _, entry := range strings.Split(s, ",") {
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid component log level: '%s'", entry)
+		}
+
+		var level LogLevel
+		err := level.unmarshalEnv(parts[1])
+		if err != nil {
+			return err
+		}
+
+		(*d)[parts[0]] = level
+	}
+
+	return nil
+}
+
+func (d LogComponentLevels) check() error {
+	for name, level := range d {
+		found := false
+		for _, c := range logComponents {
+			if c == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid log component '%s'; available components are %s",
+				name, strings.Join(logComponents, ", "))
+		}
+
+		if level == 0 {
+			return fmt.Errorf("log level of component '%s' is empty", name)
+		}
+	}
+
+	return nil
+}
@@ -24,8 +24,11 @@ func (d LogLevel) MarshalJSON() ([]byte, error) {
 	case LogLevel(logger.Info):
 		out = "info"
 
-	default:
+	case LogLevel(logger.Debug):
 		out = "debug"
+
+	default:
+		out = ""
 	}
 
 	return json.Marshal(out)
@@ -51,6 +54,10 @@ func (d *LogLevel) UnmarshalJSON(b []byte) error {
 	case "debug":
 		*d = LogLevel(logger.Debug)
 
+	// path log levels can be empty, in order to inherit the global one
+	case "":
+		*d = 0
+
 	default:
 		return fmt.Errorf("invalid log level: %s", in)
 	}
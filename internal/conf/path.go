@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +14,49 @@ import (
 
 var rePathName = regexp.MustCompile(`^[0-9a-zA-Z_\-/\.~]+$`)
 
+var reSourceVariant = regexp.MustCompile(`^(highest|lowest|[0-9]+x[0-9]+)$`)
+
+var reGroup = regexp.MustCompile(`\$G[0-9]+|\$\{G[0-9]+\}`)
+
+// ExpandGroups replaces references to the groups of the regular expression
+// of a path ($G1 or ${G1}) with the matches of the path name.
+func ExpandGroups(s string, matches []string) string {
+	return reGroup.ReplaceAllStringFunc(s, func(ref string) string {
+		n, _ := strconv.Atoi(strings.Trim(ref, "${}G"))
+		if n < len(matches) {
+			return matches[n]
+		}
+		return ref
+	})
+}
+
+// CheckURLGroups checks that the matches of the groups that are inserted into
+// source, sourceRedirect and fallback can't change the host or the structure of the URLs.
+func (pconf *PathConf) CheckURLGroups(matches []string) error {
+	urls := []string{pconf.Source, pconf.SourceRedirect}
+	if !strings.HasPrefix(pconf.Fallback, "/") {
+		urls = append(urls, pconf.Fallback)
+	}
+
+	for _, u := range urls {
+		for _, ref := range reGroup.FindAllString(u, -1) {
+			n, _ := strconv.Atoi(strings.Trim(ref, "${}G"))
+			if n < len(matches) && strings.ContainsAny(matches[n], "/:@?#") {
+				return fmt.Errorf("group %d contains characters that are not allowed inside URLs (%s)",
+					n, matches[n])
+			}
+		}
+	}
+
+	return nil
+}
+
+// withSampleGroups replaces references to groups with a sample value,
+// in order to validate parameters that contain them.
+func withSampleGroups(s string) string {
+	return reGroup.ReplaceAllString(s, "0")
+}
+
 // IsValidPathName checks if a path name is valid.
 func IsValidPathName(name string) error {
 	if name == "" {
@@ -38,25 +82,34 @@ func IsValidPathName(name string) error {
 type PathConf struct {
 	Regexp *regexp.Regexp `json:"-"`
 
+	// general
+	LogLevel LogLevel `json:"logLevel"`
+
 	// source
 	Source                     string         `json:"source"`
 	SourceProtocol             SourceProtocol `json:"sourceProtocol"`
 	SourceAnyPortEnable        bool           `json:"sourceAnyPortEnable"`
 	SourceFingerprint          string         `json:"sourceFingerprint"`
+	SourceVariant              string         `json:"sourceVariant"`
 	SourceOnDemand             bool           `json:"sourceOnDemand"`
 	SourceOnDemandStartTimeout StringDuration `json:"sourceOnDemandStartTimeout"`
 	SourceOnDemandCloseAfter   StringDuration `json:"sourceOnDemandCloseAfter"`
 	SourceRedirect             string         `json:"sourceRedirect"`
 	DisablePublisherOverride   bool           `json:"disablePublisherOverride"`
 	Fallback                   string         `json:"fallback"`
+	Alias                      string         `json:"alias"`
+	GOPCache                   bool           `json:"gopCache"`
+	KeyframeCache              bool           `json:"keyframeCache"`
+	SourceInactivityTimeout    StringDuration `json:"sourceInactivityTimeout"`
 
 	// authentication
-	PublishUser Credential `json:"publishUser"`
-	PublishPass Credential `json:"publishPass"`
-	PublishIPs  IPsOrNets  `json:"publishIPs"`
-	ReadUser    Credential `json:"readUser"`
-	ReadPass    Credential `json:"readPass"`
-	ReadIPs     IPsOrNets  `json:"readIPs"`
+	PublishUser        Credential     `json:"publishUser"`
+	PublishPass        Credential     `json:"publishPass"`
+	PublishIPs         IPsOrNets      `json:"publishIPs"`
+	ReadUser           Credential     `json:"readUser"`
+	ReadPass           Credential     `json:"readPass"`
+	ReadIPs            IPsOrNets      `json:"readIPs"`
+	MaxSessionDuration StringDuration `json:"maxSessionDuration"`
 
 	// external commands
 	RunOnInit               string         `json:"runOnInit"`
@@ -67,31 +120,56 @@ type PathConf struct {
 	RunOnDemandCloseAfter   StringDuration `json:"runOnDemandCloseAfter"`
 	RunOnReady              string         `json:"runOnReady"`
 	RunOnReadyRestart       bool           `json:"runOnReadyRestart"`
+	RunOnNotReady           string         `json:"runOnNotReady"`
 	RunOnRead               string         `json:"runOnRead"`
 	RunOnReadRestart        bool           `json:"runOnReadRestart"`
+	RunOnUnread             string         `json:"runOnUnread"`
+	RunOnSourceError        string         `json:"runOnSourceError"`
+	RunOnSourceInactive     string         `json:"runOnSourceInactive"`
 
 	// deprecated, replaced by runOnReady. TODO: remove in next version
 	RunOnPublish        string `json:"runOnPublish"`
 	RunOnPublishRestart bool   `json:"runOnPublishRestart"`
 }
 
-func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
+// checkAlias checks that the path pointed by an alias exists and is not an alias itself.
+func (pconf *PathConf) checkAlias(paths map[string]*PathConf) error {
+	target, ok := paths[pconf.Alias]
+	if !ok {
+		return fmt.Errorf("alias '%s' points to a path which doesn't exist", pconf.Alias)
+	}
+
+	if target.Alias != "" {
+		return fmt.Errorf("alias '%s' points to another alias", pconf.Alias)
+	}
+
+	return nil
+}
+
+// checkAndFillMissing fills missing parameters and returns all the errors found.
+// If the path name is invalid, the other parameters are not checked.
+func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) ValidationErrors {
+	var errs ValidationErrors
+
 	if name == "" {
-		return fmt.Errorf("path name can not be empty")
+		errs.add("", fmt.Errorf("path name can not be empty"))
+		return errs
 	}
 
 	// normal path
 	if name[0] != '~' {
 		err := IsValidPathName(name)
 		if err != nil {
-			return fmt.Errorf("invalid path name: %s (%s)", err, name)
+			errs.add("", fmt.Errorf("invalid path name: %s (%s)", err, name))
+			return errs
 		}
 
 		// regular expression path
 	} else {
 		pathRegexp, err := regexp.Compile(name[1:])
 		if err != nil {
-			return fmt.Errorf("invalid regular expression: %s", name[1:])
+			errs.add("", fmt.Errorf("invalid regular expression: %s", name[1:]))
+			return errs
 		}
 		pconf.Regexp = pathRegexp
 	}
@@ -100,82 +178,39 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		pconf.Source = "publisher"
 	}
 
-	switch {
-	case pconf.Source == "publisher":
-
-	case strings.HasPrefix(pconf.Source, "rtsp://") ||
-		strings.HasPrefix(pconf.Source, "rtsps://"):
-		if pconf.Regexp != nil {
-			return fmt.Errorf("a path with a regular expression (or path 'all') cannot have a RTSP source; use another path")
-		}
-
-		_, err := base.ParseURL(pconf.Source)
-		if err != nil {
-			return fmt.Errorf("'%s' is not a valid RTSP URL", pconf.Source)
-		}
-
-	case strings.HasPrefix(pconf.Source, "rtmp://"):
-		if pconf.Regexp != nil {
-			return fmt.Errorf("a path with a regular expression (or path 'all') cannot have a RTMP source; use another path")
-		}
-
-		u, err := url.Parse(pconf.Source)
-		if err != nil {
-			return fmt.Errorf("'%s' is not a valid RTMP URL", pconf.Source)
-		}
-		if u.Scheme != "rtmp" {
-			return fmt.Errorf("'%s' is not a valid RTMP URL", pconf.Source)
-		}
+	// parameters that can contain references to groups
+	source := pconf.Source
+	sourceRedirect := pconf.SourceRedirect
+	fallback := pconf.Fallback
+	if pconf.Regexp != nil {
+		source = withSampleGroups(source)
+		sourceRedirect = withSampleGroups(sourceRedirect)
+		fallback = withSampleGroups(fallback)
+	}
 
-		if u.User != nil {
-			pass, _ := u.User.Password()
-			user := u.User.Username()
-			if user != "" && pass == "" ||
-				user == "" && pass != "" {
-				return fmt.Errorf("username and password must be both provided")
-			}
-		}
+	err := pconf.checkSource(source, sourceRedirect)
+	if err != nil {
+		errs.add("source", err)
+	}
 
-	case strings.HasPrefix(pconf.Source, "http://") ||
-		strings.HasPrefix(pconf.Source, "https://"):
-		if pconf.Regexp != nil {
-			return fmt.Errorf("a path with a regular expression (or path 'all') cannot have a HLS source; use another path")
-		}
+	if pconf.Alias != "" {
+		err := IsValidPathName(pconf.Alias)
 
-		u, err := url.Parse(pconf.Source)
-		if err != nil {
-			return fmt.Errorf("'%s' is not a valid HLS URL", pconf.Source)
-		}
-		if u.Scheme != "http" && u.Scheme != "https" {
-			return fmt.Errorf("'%s' is not a valid HLS URL", pconf.Source)
-		}
+		switch {
+		case pconf.Source != "publisher":
+			errs.add("alias", fmt.Errorf("'alias' can't be used with a source; set the source in the aliased path"))
 
-		if u.User != nil {
-			pass, _ := u.User.Password()
-			user := u.User.Username()
-			if user != "" && pass == "" ||
-				user == "" && pass != "" {
-				return fmt.Errorf("username and password must be both provided")
-			}
-		}
+		case err != nil:
+			errs.add("alias", fmt.Errorf("'%s': %s", pconf.Alias, err))
 
-	case pconf.Source == "redirect":
-		if pconf.SourceRedirect == "" {
-			return fmt.Errorf("source redirect must be filled")
+		case pconf.Alias == name:
+			errs.add("alias", fmt.Errorf("a path can't be an alias of itself"))
 		}
-
-		_, err := base.ParseURL(pconf.SourceRedirect)
-		if err != nil {
-			return fmt.Errorf("'%s' is not a valid RTSP URL", pconf.SourceRedirect)
-		}
-
-	default:
-		return fmt.Errorf("invalid source: '%s'", pconf.Source)
 	}
 
 	if pconf.SourceOnDemand {
 		if pconf.Source == "publisher" {
-			return fmt.Errorf("'sourceOnDemand' is useless when source is 'publisher'")
+			errs.add("sourceOnDemand", fmt.Errorf("'sourceOnDemand' is useless when source is 'publisher'"))
 		}
 	}
 
@@ -188,61 +223,69 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 	}
 
 	if pconf.Fallback != "" {
-		if strings.HasPrefix(pconf.Fallback, "/") {
-			err := IsValidPathName(pconf.Fallback[1:])
+		if strings.HasPrefix(fallback, "/") {
+			err := IsValidPathName(fallback[1:])
 			if err != nil {
-				return fmt.Errorf("'%s': %s", pconf.Fallback, err)
+				errs.add("fallback", fmt.Errorf("'%s': %s", pconf.Fallback, err))
 			}
 		} else {
-			_, err := base.ParseURL(pconf.Fallback)
+			_, err := base.ParseURL(fallback)
 			if err != nil {
-				return fmt.Errorf("'%s' is not a valid RTSP URL", pconf.Fallback)
+				errs.add("fallback", fmt.Errorf("'%s' is not a valid RTSP URL", pconf.Fallback))
 			}
 		}
 	}
 
+	if pconf.SourceInactivityTimeout < 0 {
+		errs.add("sourceInactivityTimeout", fmt.Errorf("'sourceInactivityTimeout' can't be negative"))
+	}
+
 	if (pconf.PublishUser != "" && pconf.PublishPass == "") ||
 		(pconf.PublishUser == "" && pconf.PublishPass != "") {
-		return fmt.Errorf("read username and password must be both filled")
+		errs.add("publishUser", fmt.Errorf("read username and password must be both filled"))
 	}
 
 	if pconf.PublishUser != "" && pconf.Source != "publisher" {
-		return fmt.Errorf("'publishUser' is useless when source is not 'publisher', since " +
-			"the stream is not provided by a publisher, but by a fixed source")
+		errs.add("publishUser", fmt.Errorf("'publishUser' is useless when source is not 'publisher', since "+
+			"the stream is not provided by a publisher, but by a fixed source"))
 	}
 
 	if pconf.PublishUser != "" && conf.ExternalAuthenticationURL != "" {
-		return fmt.Errorf("'publishUser' can't be used with 'externalAuthenticationURL'")
+		errs.add("publishUser", fmt.Errorf("'publishUser' can't be used with 'externalAuthenticationURL'"))
 	}
 
 	if len(pconf.PublishIPs) > 0 && pconf.Source != "publisher" {
-		return fmt.Errorf("'publishIPs' is useless when source is not 'publisher', since " +
-			"the stream is not provided by a publisher, but by a fixed source")
+		errs.add("publishIPs", fmt.Errorf("'publishIPs' is useless when source is not 'publisher', since "+
+			"the stream is not provided by a publisher, but by a fixed source"))
 	}
 
 	if len(pconf.PublishIPs) > 0 && conf.ExternalAuthenticationURL != "" {
-		return fmt.Errorf("'publishIPs' can't be used with 'externalAuthenticationURL'")
+		errs.add("publishIPs", fmt.Errorf("'publishIPs' can't be used with 'externalAuthenticationURL'"))
 	}
 
 	if (pconf.ReadUser != "" && pconf.ReadPass == "") ||
 		(pconf.ReadUser == "" && pconf.ReadPass != "") {
-		return fmt.Errorf("read username and password must be both filled")
+		errs.add("readUser", fmt.Errorf("read username and password must be both filled"))
 	}
 
 	if pconf.ReadUser != "" && conf.ExternalAuthenticationURL != "" {
-		return fmt.Errorf("'readUser' can't be used with 'externalAuthenticationURL'")
+		errs.add("readUser", fmt.Errorf("'readUser' can't be used with 'externalAuthenticationURL'"))
 	}
 
 	if len(pconf.ReadIPs) > 0 && conf.ExternalAuthenticationURL != "" {
-		return fmt.Errorf("'readIPs' can't be used with 'externalAuthenticationURL'")
+		errs.add("readIPs", fmt.Errorf("'readIPs' can't be used with 'externalAuthenticationURL'"))
+	}
+
+	if pconf.MaxSessionDuration < 0 {
+		errs.add("maxSessionDuration", fmt.Errorf("'maxSessionDuration' can't be negative"))
 	}
 
 	if pconf.RunOnInit != "" && pconf.Regexp != nil {
-		return fmt.Errorf("a path with a regular expression does not support option 'runOnInit'; use another path")
+		errs.add("runOnInit", fmt.Errorf("a path with a regular expression does not support option 'runOnInit'; use another path"))
 	}
 
 	if pconf.RunOnDemand != "" && pconf.Source != "publisher" {
-		return fmt.Errorf("'runOnDemand' can be used only when source is 'publisher'")
+		errs.add("runOnDemand", fmt.Errorf("'runOnDemand' can be used only when source is 'publisher'"))
 	}
 
 	if pconf.RunOnPublish != "" {
@@ -261,6 +304,89 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		pconf.RunOnDemandCloseAfter = 10 * StringDuration(time.Second)
 	}
 
+	return errs
+}
+
+// checkSource checks the source of a path.
+// source and sourceRedirect have references to groups replaced with sample values.
+func (pconf *PathConf) checkSource(source string, sourceRedirect string) error {
+	switch {
+	case pconf.Source == "publisher":
+
+	case strings.HasPrefix(pconf.Source, "rtsp://") ||
+		strings.HasPrefix(pconf.Source, "rtsps://"):
+		if pconf.Regexp != nil && !pconf.SourceOnDemand {
+			return fmt.Errorf("a path with a regular expression (or path 'all') can have a RTSP source only if 'sourceOnDemand' is enabled")
+		}
+
+		_, err := base.ParseURL(source)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid RTSP URL", pconf.Source)
+		}
+
+	case strings.HasPrefix(pconf.Source, "rtmp://"):
+		if pconf.Regexp != nil && !pconf.SourceOnDemand {
+			return fmt.Errorf("a path with a regular expression (or path 'all') can have a RTMP source only if 'sourceOnDemand' is enabled")
+		}
+
+		u, err := url.Parse(source)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid RTMP URL", pconf.Source)
+		}
+		if u.Scheme != "rtmp" {
+			return fmt.Errorf("'%s' is not a valid RTMP URL", pconf.Source)
+		}
+
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			user := u.User.Username()
+			if user != "" && pass == "" ||
+				user == "" && pass != "" {
+				return fmt.Errorf("username and password must be both provided")
+			}
+		}
+
+	case strings.HasPrefix(pconf.Source, "http://") ||
+		strings.HasPrefix(pconf.Source, "https://"):
+		if pconf.Regexp != nil && !pconf.SourceOnDemand {
+			return fmt.Errorf("a path with a regular expression (or path 'all') can have a HLS source only if 'sourceOnDemand' is enabled")
+		}
+
+		u, err := url.Parse(source)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid HLS URL", pconf.Source)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("'%s' is not a valid HLS URL", pconf.Source)
+		}
+
+		if pconf.SourceVariant != "" && !reSourceVariant.MatchString(pconf.SourceVariant) {
+			return fmt.Errorf("invalid source variant: '%s'", pconf.SourceVariant)
+		}
+
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			user := u.User.Username()
+			if user != "" && pass == "" ||
+				user == "" && pass != "" {
+				return fmt.Errorf("username and password must be both provided")
+			}
+		}
+
+	case pconf.Source == "redirect":
+		if pconf.SourceRedirect == "" {
+			return fmt.Errorf("source redirect must be filled")
+		}
+
+		_, err := base.ParseURL(sourceRedirect)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid RTSP URL", pconf.SourceRedirect)
+		}
+
+	default:
+		return fmt.Errorf("invalid source: '%s'", pconf.Source)
+	}
+
 	return nil
 }
 
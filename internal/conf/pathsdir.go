@@ -0,0 +1,233 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pathsDirFiles returns the files of a paths directory, indexed by path name.
+// The name of a path is the relative path of its file, without extension.
+func pathsDirFiles(dir string) (map[string]string, error) {
+	ret := make(map[string]string)
+
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// skip hidden files and directories
+		if fpath != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		ext := filepath.Ext(fpath)
+		switch strings.ToLower(ext) {
+		case ".yml", ".yaml", ".json", ".toml":
+		default:
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(strings.TrimSuffix(rel, ext))
+		if _, ok := ret[name]; ok {
+			return fmt.Errorf("path '%s' is defined by multiple files", name)
+		}
+
+		ret[name] = fpath
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// PathsDirPath returns the directory set with the pathsDir parameter.
+// A relative directory is relative to the directory of the configuration file.
+func (conf *Conf) PathsDirPath(confPath string) string {
+	if conf.PathsDir == "" || filepath.IsAbs(conf.PathsDir) {
+		return conf.PathsDir
+	}
+	return filepath.Join(filepath.Dir(confPath), conf.PathsDir)
+}
+
+// loadPathsDir loads path configurations from the directory set
+// with the pathsDir parameter, that can be overridden by the environment.
+func loadPathsDir(conf *Conf, confPath string) (ValidationErrors, error) {
+	if v, ok := os.LookupEnv("RTSP_PATHSDIR"); ok {
+		conf.PathsDir = v
+	}
+
+	if conf.PathsDir == "" {
+		return nil, nil
+	}
+
+	return loadFromPathsDir(conf.PathsDirPath(confPath), conf)
+}
+
+// loadFromPathsDir loads path configurations from a directory in which
+// every file contains the configuration of a single path.
+// The returned error is filled when the directory can't be read;
+// errors related to single files are all returned in errs.
+func loadFromPathsDir(dir string, conf *Conf) (ValidationErrors, error) {
+	files, err := pathsDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs ValidationErrors
+
+	if conf.Paths == nil {
+		conf.Paths = make(map[string]*PathConf)
+	}
+
+	for name, fpath := range files {
+		_, ok1 := conf.Paths[name]
+		_, ok2 := conf.Paths[pathKey(name)]
+		if ok1 || ok2 {
+			errs.add("paths."+name, fmt.Errorf("path '%s' is defined both in the configuration file and in '%s'", name, fpath))
+			continue
+		}
+
+		pconf := &PathConf{}
+		fileErrs, err := loadFileInto(fpath, pconf)
+		if err != nil {
+			errs.add("paths."+name, fmt.Errorf("file '%s': %s", fpath, err))
+			continue
+		}
+
+		for _, e := range fileErrs {
+			field := "paths." + name
+			if e.Field != "" {
+				field += "." + e.Field
+			}
+			errs.add(field, fmt.Errorf("file '%s': %s", fpath, e.Err))
+		}
+
+		conf.Paths[name] = pconf
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+
+	return errs, nil
+}
+
+// SavePathsDir writes into their own files the paths loaded from pathsDir
+// that differ between from and to, and removes the files of the paths that
+// are not in to anymore. Paths loaded from pathsDir are then removed from conf,
+// in order not to write them into the configuration file.
+// confPath is the path of the configuration file. beforeWrite, if not nil, is called
+// before a file is written with byts or removed (byts is nil), in order to allow
+// a watcher of the directory to ignore the change.
+func (conf *Conf) SavePathsDir(confPath string, from *Conf, to *Conf,
+	beforeWrite func(fpath string, byts []byte),
+) error {
+	dir := to.PathsDirPath(confPath)
+	if dir == "" {
+		return nil
+	}
+
+	files, err := pathsDirFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for name, fpath := range files {
+		delete(conf.Paths, name)
+
+		fpconf, ok1 := from.Paths[name]
+		tpconf, ok2 := to.Paths[name]
+
+		switch {
+		case ok1 && !ok2:
+			if beforeWrite != nil {
+				beforeWrite(fpath, nil)
+			}
+
+			err := os.Remove(fpath)
+			if err != nil {
+				return err
+			}
+
+		case ok1 && !fpconf.Equal(tpconf):
+			byts, err := marshalPathsDirFile(fpath, name, tpconf)
+			if err != nil {
+				return fmt.Errorf("file '%s': %s", fpath, err)
+			}
+
+			if beforeWrite != nil {
+				beforeWrite(fpath, byts)
+			}
+
+			err = WriteFile(fpath, byts)
+			if err != nil {
+				return fmt.Errorf("file '%s': %s", fpath, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// marshalPathsDirFile encodes the configuration of a path in the format of its file,
+// preserving comments and order of parameters.
+func marshalPathsDirFile(fpath string, name string, pconf *PathConf) ([]byte, error) {
+	existing, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	format := FormatFromPath(fpath)
+
+	existing, err = format.toYAML(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := yamlNodeFromJSON(pconf)
+	if err != nil {
+		return nil, err
+	}
+
+	def := func() *yaml.Node {
+		dconf := &Conf{Paths: map[string]*PathConf{name: {}}}
+
+		err := dconf.CheckAndFillMissing()
+		if err != nil {
+			return nil
+		}
+
+		n, err := yamlNodeFromJSON(dconf.Paths[name])
+		if err != nil {
+			return nil
+		}
+		return n
+	}()
+
+	byts, err := marshalYAML(src, def, existing, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return format.fromYAML(byts)
+}
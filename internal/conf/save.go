@@ -0,0 +1,450 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	yaml2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// "all" is stored in the configuration as "~^.*$".
+func pathKey(k string) string {
+	if k == "all" {
+		return "~^.*$"
+	}
+	return k
+}
+
+// yamlNeedsQuoting checks whether a string would be decoded as something else
+// than itself if written without quotes.
+func yamlNeedsQuoting(s string) bool {
+	var v interface{}
+	err := yaml2.Unmarshal([]byte(s), &v)
+	if err != nil {
+		return true
+	}
+
+	s2, ok := v.(string)
+	return !ok || s2 != s
+}
+
+// yamlNodeFromJSON converts a value into a YAML node with the formatting
+// used in the configuration file.
+func yamlNodeFromJSON(v interface{}) (*yaml.Node, error) {
+	byts, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(byts, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var format func(n *yaml.Node)
+	format = func(n *yaml.Node) {
+		switch n.Kind {
+		case yaml.MappingNode:
+			n.Style = 0
+
+		case yaml.SequenceNode:
+			n.Style = yaml.FlowStyle
+
+		case yaml.ScalarNode:
+			n.Style = 0
+
+			switch n.Tag {
+			case "!!null":
+				n.Value = ""
+
+			case "!!str":
+				if yamlNeedsQuoting(n.Value) {
+					n.Style = yaml.DoubleQuotedStyle
+				}
+			}
+		}
+
+		for _, c := range n.Content {
+			format(c)
+		}
+	}
+	format(doc.Content[0])
+
+	return doc.Content[0], nil
+}
+
+// yamlNodeValue decodes a node as the configuration loader does.
+// Empty values are decoded as nil, and lists of strings are sorted.
+func yamlNodeValue(n *yaml.Node) interface{} {
+	byts, err := yaml.Marshal(n)
+	if err != nil {
+		return nil
+	}
+
+	var v interface{}
+	err = yaml2.Unmarshal(byts, &v)
+	if err != nil {
+		return nil
+	}
+
+	var normalize func(i interface{}) interface{}
+	normalize = func(i interface{}) interface{} {
+		switch x := i.(type) {
+		case map[interface{}]interface{}:
+			if len(x) == 0 {
+				return nil
+			}
+			m2 := make(map[string]interface{})
+			for k, v := range x {
+				m2[fmt.Sprint(k)] = normalize(v)
+			}
+			return m2
+
+		case []interface{}:
+			if len(x) == 0 {
+				return nil
+			}
+			a2 := make([]interface{}, len(x))
+			strs := make([]string, 0, len(x))
+			for i, v := range x {
+				a2[i] = normalize(v)
+				if s, ok := a2[i].(string); ok {
+					strs = append(strs, s)
+				}
+			}
+			if len(strs) == len(a2) {
+				sort.Strings(strs)
+				for i, s := range strs {
+					a2[i] = s
+				}
+			}
+			return a2
+
+		case string:
+			if x == "" {
+				return nil
+			}
+		}
+
+		return i
+	}
+
+	return normalize(v)
+}
+
+func yamlNodesEqual(a *yaml.Node, b *yaml.Node) bool {
+	return reflect.DeepEqual(yamlNodeValue(a), yamlNodeValue(b))
+}
+
+func yamlMappingValue(n *yaml.Node, key string, isPaths bool) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k := n.Content[i].Value
+		if isPaths {
+			k = pathKey(k)
+		}
+		if k == key {
+			return n.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// yamlReplace replaces the content of a node, preserving its comments.
+func yamlReplace(dst *yaml.Node, src *yaml.Node) {
+	headComment := dst.HeadComment
+	lineComment := dst.LineComment
+	footComment := dst.FootComment
+	style := dst.Style
+	wasSequence := (dst.Kind == yaml.SequenceNode)
+
+	*dst = *src
+
+	dst.HeadComment = headComment
+	dst.LineComment = lineComment
+	dst.FootComment = footComment
+
+	if wasSequence && src.Kind == yaml.SequenceNode {
+		dst.Style = style
+	}
+}
+
+// yamlMerge writes src into dst. Keys that are missing in dst are added
+// only if their value differs from the default value.
+func yamlMerge(dst *yaml.Node, src *yaml.Node, def *yaml.Node, isRoot bool, isPaths bool) {
+	if src.Kind != yaml.MappingNode {
+		if !yamlNodesEqual(dst, src) {
+			yamlReplace(dst, src)
+		}
+		return
+	}
+
+	if dst.Kind != yaml.MappingNode {
+		yamlReplace(dst, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+	}
+
+	// remove keys that are not present anymore
+	var content []*yaml.Node
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		k := dst.Content[i].Value
+		if isPaths {
+			k = pathKey(k)
+		}
+		if yamlMappingValue(src, k, false) != nil {
+			content = append(content, dst.Content[i], dst.Content[i+1])
+		}
+	}
+	dst.Content = content
+
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		k := src.Content[i].Value
+		v := src.Content[i+1]
+		childIsPaths := isRoot && k == "paths"
+		childDef := yamlMappingValue(def, k, false)
+
+		dv := yamlMappingValue(dst, k, isPaths)
+		if dv != nil {
+			yamlMerge(dv, v, childDef, false, childIsPaths)
+			continue
+		}
+
+		// path entries and the path map must always be written
+		if !isPaths && !childIsPaths && childDef != nil && yamlNodesEqual(childDef, v) {
+			continue
+		}
+
+		if v.Kind == yaml.MappingNode {
+			dv = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			yamlMerge(dv, v, childDef, false, childIsPaths)
+		} else {
+			dv = v
+		}
+
+		dst.Content = append(dst.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k},
+			dv)
+	}
+}
+
+// marshalYAML encodes src in YAML. existing is the current content of the
+// file, and is used to preserve comments and order of parameters.
+// Parameters that are not in existing are written only if they differ
+// from their value in def.
+func marshalYAML(src *yaml.Node, def *yaml.Node, existing []byte, isRoot bool) ([]byte, error) {
+	var doc yaml.Node
+	if len(bytes.TrimSpace(existing)) != 0 {
+		err := yaml.Unmarshal(existing, &doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		doc = yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}},
+		}
+	}
+
+	yamlMerge(doc.Content[0], src, def, isRoot, false)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err := enc.Encode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	enc.Close()
+
+	return buf.Bytes(), nil
+}
+
+// Marshal encodes the configuration in YAML.
+// existing is the current content of the configuration file, and is used to
+// preserve comments and order of parameters. Parameters that are not
+// in existing are written only if they differ from their default value.
+func (conf *Conf) Marshal(existing []byte) ([]byte, error) {
+	src, err := yamlNodeFromJSON(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	def := func() *yaml.Node {
+		dconf := &Conf{Paths: make(map[string]*PathConf)}
+		for name := range conf.Paths {
+			dconf.Paths[name] = &PathConf{}
+		}
+
+		err := dconf.CheckAndFillMissing()
+		if err != nil {
+			return nil
+		}
+
+		n, err := yamlNodeFromJSON(dconf)
+		if err != nil {
+			return nil
+		}
+		return n
+	}()
+
+	return marshalYAML(src, def, existing, true)
+}
+
+func jsonMap(v interface{}) (map[string]interface{}, error) {
+	byts, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	err = json.Unmarshal(byts, &m)
+	return m, err
+}
+
+// ApplyChanges writes into the configuration the parameters and paths
+// that differ between from and to. It allows to write changes into a
+// configuration without copying parameters that were set in other ways.
+func (conf *Conf) ApplyChanges(from *Conf, to *Conf) error {
+	dst, err := jsonMap(conf)
+	if err != nil {
+		return err
+	}
+
+	fm, err := jsonMap(from)
+	if err != nil {
+		return err
+	}
+
+	tm, err := jsonMap(to)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range tm {
+		if k != "paths" && !reflect.DeepEqual(fm[k], v) {
+			dst[k] = v
+		}
+	}
+
+	fpaths, _ := fm["paths"].(map[string]interface{})
+	tpaths, _ := tm["paths"].(map[string]interface{})
+	dpaths, _ := dst["paths"].(map[string]interface{})
+	if dpaths == nil {
+		dpaths = make(map[string]interface{})
+	}
+
+	for name := range fpaths {
+		if _, ok := tpaths[name]; !ok {
+			delete(dpaths, name)
+		}
+	}
+
+	for name, tv := range tpaths {
+		fpconf, ok1 := fpaths[name].(map[string]interface{})
+		dpconf, ok2 := dpaths[name].(map[string]interface{})
+		if !ok1 || !ok2 {
+			if !reflect.DeepEqual(fpaths[name], tv) {
+				dpaths[name] = tv
+			}
+			continue
+		}
+
+		for k, v := range tv.(map[string]interface{}) {
+			if !reflect.DeepEqual(fpconf[k], v) {
+				dpconf[k] = v
+			}
+		}
+	}
+
+	dst["paths"] = dpaths
+
+	byts, err := json.Marshal(dst)
+	if err != nil {
+		return err
+	}
+
+	var newConf Conf
+	err = json.Unmarshal(byts, &newConf)
+	if err != nil {
+		return err
+	}
+
+	err = newConf.CheckAndFillMissing()
+	if err != nil {
+		return err
+	}
+
+	*conf = newConf
+	return nil
+}
+
+// MarshalFormat encodes the configuration in the given format.
+// existing is the current content of the configuration file.
+func (conf *Conf) MarshalFormat(existing []byte, format Format) ([]byte, error) {
+	existing, err := format.toYAML(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	byts, err := conf.Marshal(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	return format.fromYAML(byts)
+}
+
+// WriteFile writes a configuration file atomically, by writing a temporary
+// file and replacing the existing one.
+func WriteFile(fpath string, byts []byte) error {
+	// if the file is a symlink, replace its target
+	if real, err := filepath.EvalSymlinks(fpath); err == nil {
+		fpath = real
+	}
+
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(fpath); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fpath), "."+filepath.Base(fpath)+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	_, err = f.Write(byts)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	f.Close()
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, fpath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
@@ -21,6 +21,12 @@ func (s *StringSize) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	// bytefmt doesn't support zero sizes
+	if in == "0" || in == "0B" {
+		*s = 0
+		return nil
+	}
+
 	v, err := bytefmt.ToBytes(in)
 	if err != nil {
 		return err
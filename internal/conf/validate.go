@@ -0,0 +1,168 @@
+package conf
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/aler9/gortsplib"
+)
+
+// ValidationError is an error related to a configuration field.
+type ValidationError struct {
+	Field string
+	Err   error
+}
+
+// Error implements the error interface.
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Err.Error()
+	}
+	return e.Field + ": " + e.Err.Error()
+}
+
+// MarshalJSON marshals a ValidationError into JSON.
+func (e ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}{e.Field, e.Err.Error()})
+}
+
+// ValidationErrors is a list of ValidationError.
+type ValidationErrors []ValidationError
+
+func (errs *ValidationErrors) add(field string, err error) {
+	*errs = append(*errs, ValidationError{Field: field, Err: err})
+}
+
+// Error implements the error interface.
+func (errs ValidationErrors) Error() string {
+	var tmp []string
+	for _, e := range errs {
+		tmp = append(tmp, e.Error())
+	}
+	return strings.Join(tmp, "; ")
+}
+
+// Validate checks the configuration and returns all the errors found.
+// In addition to the checks performed by CheckAndFillMissing, it loads
+// the TLS certificate and checks that listeners do not use the same port.
+// The configuration is not modified.
+func (conf *Conf) Validate() ValidationErrors {
+	tmp := *conf
+
+	tmp.Paths = make(map[string]*PathConf)
+	for name, pconf := range conf.Paths {
+		if pconf != nil {
+			pconfCopy := *pconf
+			pconf = &pconfCopy
+		}
+		tmp.Paths[name] = pconf
+	}
+
+	errs := tmp.checkAndFillMissing()
+
+	if tmp.Encryption != EncryptionNo {
+		_, err := tls.LoadX509KeyPair(tmp.ServerCert, tmp.ServerKey)
+		if err != nil {
+			errs.add("serverCert", err)
+		}
+	}
+
+	errs = append(errs, tmp.checkAddresses()...)
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+
+	return errs
+}
+
+type confListener struct {
+	field   string
+	network string
+	address string
+}
+
+func (conf *Conf) listeners() []confListener {
+	var ret []confListener
+
+	if !conf.RTSPDisable {
+		if conf.Encryption != EncryptionStrict {
+			ret = append(ret, confListener{"rtspAddress", "tcp", conf.RTSPAddress})
+
+			if _, ok := conf.Protocols[Protocol(gortsplib.TransportUDP)]; ok {
+				ret = append(ret, confListener{"rtpAddress", "udp", conf.RTPAddress})
+				ret = append(ret, confListener{"rtcpAddress", "udp", conf.RTCPAddress})
+			}
+		}
+
+		if conf.Encryption != EncryptionNo {
+			ret = append(ret, confListener{"rtspsAddress", "tcp", conf.RTSPSAddress})
+		}
+	}
+
+	if !conf.RTMPDisable {
+		ret = append(ret, confListener{"rtmpAddress", "tcp", conf.RTMPAddress})
+	}
+
+	if !conf.HLSDisable {
+		ret = append(ret, confListener{"hlsAddress", "tcp", conf.HLSAddress})
+	}
+
+	if conf.API {
+		ret = append(ret, confListener{"apiAddress", "tcp", conf.APIAddress})
+	}
+
+	if conf.Metrics {
+		ret = append(ret, confListener{"metricsAddress", "tcp", conf.MetricsAddress})
+	}
+
+	if conf.PPROF {
+		ret = append(ret, confListener{"pprofAddress", "tcp", conf.PPROFAddress})
+	}
+
+	return ret
+}
+
+// checkAddresses checks that addresses are valid and that they don't conflict.
+func (conf *Conf) checkAddresses() ValidationErrors {
+	var errs ValidationErrors
+
+	type parsed struct {
+		confListener
+		host string
+		port string
+	}
+	var valid []parsed
+
+	for _, l := range conf.listeners() {
+		host, port, err := net.SplitHostPort(l.address)
+		if err != nil {
+			errs.add(l.field, err)
+			continue
+		}
+
+		for _, other := range valid {
+			if other.network == l.network && other.port == port &&
+				(other.host == host || isAnyHost(other.host) || isAnyHost(host)) {
+				errs.add(l.field, fmt.Errorf("address '%s' conflicts with '%s' (%s)",
+					l.address, other.field, other.address))
+				break
+			}
+		}
+
+		valid = append(valid, parsed{l, host, port})
+	}
+
+	return errs
+}
+
+func isAnyHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
@@ -1,8 +1,12 @@
 package confwatcher
 
 import (
+	"crypto/sha256"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -18,6 +22,14 @@ type ConfWatcher struct {
 	inner       *fsnotify.Watcher
 	watchedPath string
 
+	ignoredMutex    sync.Mutex
+	ignoredHash     *[sha256.Size]byte
+	ignoredDirFiles map[string]*[sha256.Size]byte
+
+	dirMutex    sync.Mutex
+	watchedDir  string
+	watchedDirs []string
+
 	// out
 	signal chan struct{}
 	done   chan struct{}
@@ -45,10 +57,11 @@ func New(confPath string) (*ConfWatcher, error) {
 	}
 
 	w := &ConfWatcher{
-		inner:       inner,
-		watchedPath: absolutePath,
-		signal:      make(chan struct{}),
-		done:        make(chan struct{}),
+		inner:           inner,
+		watchedPath:     absolutePath,
+		ignoredDirFiles: make(map[string]*[sha256.Size]byte),
+		signal:          make(chan struct{}),
+		done:            make(chan struct{}),
 	}
 
 	go w.run()
@@ -66,16 +79,195 @@ func (w *ConfWatcher) Close() {
 	<-w.done
 }
 
+// Ignore prevents the next change of the configuration file from being signaled,
+// if the file content is equal to byts. The hash is discarded after the next change.
+// This allows the program to write the configuration file without triggering a reload.
+// Only writes of the configuration file are covered; use IgnoreDirFile for files
+// of the watched directory.
+func (w *ConfWatcher) Ignore(byts []byte) {
+	h := sha256.Sum256(byts)
+
+	w.ignoredMutex.Lock()
+	defer w.ignoredMutex.Unlock()
+	w.ignoredHash = &h
+}
+
+// IgnoreDirFile prevents the next change of a file of the watched directory
+// from being signaled, if the file content is equal to byts or, when byts is nil,
+// if the file has been removed. It must be called before the file is written.
+func (w *ConfWatcher) IgnoreDirFile(fpath string, byts []byte) {
+	absolutePath, _ := filepath.Abs(fpath)
+
+	var h *[sha256.Size]byte
+	if byts != nil {
+		v := sha256.Sum256(byts)
+		h = &v
+	}
+
+	w.ignoredMutex.Lock()
+	defer w.ignoredMutex.Unlock()
+	w.ignoredDirFiles[absolutePath] = h
+}
+
+// WatchDir watches a directory and all its subdirectories, in addition to the
+// configuration file. Any change to the files of the directory is signaled.
+// The previously watched directory, if any, is not watched anymore.
+// An empty dir disables the watching of directories.
+func (w *ConfWatcher) WatchDir(dir string) error {
+	w.dirMutex.Lock()
+	defer w.dirMutex.Unlock()
+
+	for _, d := range w.watchedDirs {
+		w.inner.Remove(d)
+	}
+	w.watchedDir = ""
+	w.watchedDirs = nil
+
+	if dir == "" {
+		return nil
+	}
+
+	absolutePath, _ := filepath.Abs(dir)
+	w.watchedDir = absolutePath
+
+	return w.addDir(absolutePath)
+}
+
+func (w *ConfWatcher) addDir(dir string) error {
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		err = w.inner.Add(fpath)
+		if err != nil {
+			return err
+		}
+
+		w.watchedDirs = append(w.watchedDirs, fpath)
+		return nil
+	})
+}
+
+// isDirEvent checks whether an event regards the watched directory.
+// If a subdirectory has been created, it is watched too.
+func (w *ConfWatcher) isDirEvent(event fsnotify.Event) bool {
+	w.dirMutex.Lock()
+	defer w.dirMutex.Unlock()
+
+	if w.watchedDir == "" {
+		return false
+	}
+
+	eventPath, _ := filepath.Abs(event.Name)
+	if !strings.HasPrefix(eventPath, w.watchedDir+string(filepath.Separator)) {
+		return false
+	}
+
+	if (event.Op & fsnotify.Create) == fsnotify.Create {
+		if info, err := os.Stat(eventPath); err == nil && info.IsDir() {
+			w.addDir(eventPath) //nolint:errcheck
+		}
+	}
+
+	return true
+}
+
+// isDirFile checks whether a path of the watched directory is a configuration file
+// or a directory. Hidden files and files with other extensions are not.
+func isDirFile(fpath string) bool {
+	if strings.HasPrefix(filepath.Base(fpath), ".") {
+		return false
+	}
+
+	if info, err := os.Stat(fpath); err == nil && info.IsDir() {
+		return true
+	}
+
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".yml", ".yaml", ".json", ".toml":
+		return true
+	}
+	return false
+}
+
+func (w *ConfWatcher) isDirFileIgnored(fpath string) bool {
+	w.ignoredMutex.Lock()
+	defer w.ignoredMutex.Unlock()
+
+	h, ok := w.ignoredDirFiles[fpath]
+	if !ok {
+		return false
+	}
+	delete(w.ignoredDirFiles, fpath)
+
+	byts, err := ioutil.ReadFile(fpath)
+	if h == nil {
+		return os.IsNotExist(err)
+	}
+	if err != nil {
+		return false
+	}
+
+	return sha256.Sum256(byts) == *h
+}
+
+func (w *ConfWatcher) isIgnored() bool {
+	w.ignoredMutex.Lock()
+	defer w.ignoredMutex.Unlock()
+
+	if w.ignoredHash == nil {
+		return false
+	}
+
+	byts, err := ioutil.ReadFile(w.watchedPath)
+	if err != nil {
+		return false
+	}
+
+	h := *w.ignoredHash
+	w.ignoredHash = nil
+
+	return sha256.Sum256(byts) == h
+}
+
 func (w *ConfWatcher) run() {
 	defer close(w.done)
 
 	var lastCalled time.Time
 	previousWatchedPath, _ := filepath.EvalSymlinks(w.watchedPath)
 
+	// changes to the directory are not discarded when they happen too
+	// frequently, since they may regard different files; they are delayed.
+	dirTimer := time.NewTimer(0)
+	<-dirTimer.C
+	dirPending := false
+
 outer:
 	for {
 		select {
 		case event := <-w.inner.Events:
+			if w.isDirEvent(event) {
+				eventPath, _ := filepath.Abs(event.Name)
+				if !isDirFile(eventPath) || w.isDirFileIgnored(eventPath) {
+					continue
+				}
+
+				if !dirPending {
+					dirPending = true
+					wait := minInterval - time.Since(lastCalled)
+					if wait < additionalWait {
+						wait = additionalWait
+					}
+					dirTimer.Reset(wait)
+				}
+				continue
+			}
+
 			if time.Since(lastCalled) < minInterval {
 				continue
 			}
@@ -94,15 +286,25 @@ outer:
 				time.Sleep(additionalWait)
 				previousWatchedPath = currentWatchedPath
 
+				if w.isIgnored() {
+					continue
+				}
+
 				lastCalled = time.Now()
 				w.signal <- struct{}{}
 			}
 
+		case <-dirTimer.C:
+			dirPending = false
+			lastCalled = time.Now()
+			w.signal <- struct{}{}
+
 		case <-w.inner.Errors:
 			break outer
 		}
 	}
 
+	dirTimer.Stop()
 	close(w.signal)
 }
 
@@ -3,6 +3,7 @@ package confwatcher
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -154,3 +155,138 @@ func TestSymlinkDeleteCreate(t *testing.T) {
 		return
 	}
 }
+
+func TestIgnore(t *testing.T) {
+	fpath, err := writeTempFile([]byte("{}"))
+	require.NoError(t, err)
+	defer os.Remove(fpath)
+
+	w, err := New(fpath)
+	require.NoError(t, err)
+	defer w.Close()
+
+	w.Ignore([]byte("paths: {}\n"))
+
+	err = ioutil.WriteFile(fpath+".tmp", []byte("paths: {}\n"), 0o644)
+	require.NoError(t, err)
+	err = os.Rename(fpath+".tmp", fpath)
+	require.NoError(t, err)
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case <-w.Watch():
+		t.Errorf("should not happen")
+		return
+	}
+
+	func() {
+		f, err := os.Create(fpath)
+		require.NoError(t, err)
+		defer f.Close()
+
+		// the hash is discarded after being used once
+		_, err = f.Write([]byte("paths: {}\n"))
+		require.NoError(t, err)
+	}()
+
+	select {
+	case <-w.Watch():
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("timed out")
+		return
+	}
+}
+
+func TestDir(t *testing.T) {
+	fpath, err := writeTempFile([]byte("{}"))
+	require.NoError(t, err)
+	defer os.Remove(fpath)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "confwatcher-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := New(fpath)
+	require.NoError(t, err)
+	defer w.Close()
+
+	err = w.WatchDir(dir)
+	require.NoError(t, err)
+
+	// files of subdirectories created later are watched too
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	require.NoError(t, err)
+
+	select {
+	case <-w.Watch():
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("timed out")
+		return
+	}
+
+	// changes that happen right after a signal are not discarded
+	err = ioutil.WriteFile(filepath.Join(dir, "sub", "path.yml"), []byte("{}"), 0o644)
+	require.NoError(t, err)
+
+	select {
+	case <-w.Watch():
+	case <-time.After(1500 * time.Millisecond):
+		t.Errorf("timed out")
+		return
+	}
+}
+
+func TestDirIgnore(t *testing.T) {
+	fpath, err := writeTempFile([]byte("{}"))
+	require.NoError(t, err)
+	defer os.Remove(fpath)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "confwatcher-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pathFile := filepath.Join(dir, "path.yml")
+	err = ioutil.WriteFile(pathFile, []byte("{}"), 0o644)
+	require.NoError(t, err)
+
+	w, err := New(fpath)
+	require.NoError(t, err)
+	defer w.Close()
+
+	err = w.WatchDir(dir)
+	require.NoError(t, err)
+
+	// hidden files and files with other extensions are not signaled
+	err = ioutil.WriteFile(filepath.Join(dir, "readme.txt"), []byte("aa"), 0o644)
+	require.NoError(t, err)
+
+	w.IgnoreDirFile(pathFile, []byte("source: publisher\n"))
+
+	err = ioutil.WriteFile(filepath.Join(dir, ".path.yml.tmp"), []byte("source: publisher\n"), 0o644)
+	require.NoError(t, err)
+	err = os.Rename(filepath.Join(dir, ".path.yml.tmp"), pathFile)
+	require.NoError(t, err)
+
+	w.IgnoreDirFile(pathFile, nil)
+
+	err = os.Remove(pathFile)
+	require.NoError(t, err)
+
+	select {
+	case <-time.After(1500 * time.Millisecond):
+	case <-w.Watch():
+		t.Errorf("should not happen")
+		return
+	}
+
+	// the hash is discarded after being used once
+	err = ioutil.WriteFile(pathFile, []byte("{}"), 0o644)
+	require.NoError(t, err)
+
+	select {
+	case <-w.Watch():
+	case <-time.After(1500 * time.Millisecond):
+		t.Errorf("timed out")
+		return
+	}
+}
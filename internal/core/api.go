@@ -3,16 +3,22 @@ package core
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/mp4"
 )
 
 func interfaceIsEmpty(i interface{}) bool {
@@ -44,21 +50,39 @@ func cloneStruct(dest interface{}, source interface{}) {
 func loadConfData(ctx *gin.Context) (interface{}, error) {
 	var in struct {
 		// general
-		LogLevel                  *conf.LogLevel        `json:"logLevel"`
-		LogDestinations           *conf.LogDestinations `json:"logDestinations"`
-		LogFile                   *string               `json:"logFile"`
-		ReadTimeout               *conf.StringDuration  `json:"readTimeout"`
-		WriteTimeout              *conf.StringDuration  `json:"writeTimeout"`
-		ReadBufferCount           *int                  `json:"readBufferCount"`
-		ExternalAuthenticationURL *string               `json:"externalAuthenticationURL"`
-		API                       *bool                 `json:"api"`
-		APIAddress                *string               `json:"apiAddress"`
-		Metrics                   *bool                 `json:"metrics"`
-		MetricsAddress            *string               `json:"metricsAddress"`
-		PPROF                     *bool                 `json:"pprof"`
-		PPROFAddress              *string               `json:"pprofAddress"`
-		RunOnConnect              *string               `json:"runOnConnect"`
-		RunOnConnectRestart       *bool                 `json:"runOnConnectRestart"`
+		LogLevel                       *conf.LogLevel           `json:"logLevel"`
+		LogComponentLevels             *conf.LogComponentLevels `json:"logComponentLevels"`
+		LogFormat                      *conf.LogFormat          `json:"logFormat"`
+		LogDestinations                *conf.LogDestinations    `json:"logDestinations"`
+		LogFile                        *string                  `json:"logFile"`
+		LogFileMaxSize                 *conf.StringSize         `json:"logFileMaxSize"`
+		LogFileMaxAge                  *conf.StringDuration     `json:"logFileMaxAge"`
+		LogFileMaxBackups              *int                     `json:"logFileMaxBackups"`
+		LogFileCompress                *bool                    `json:"logFileCompress"`
+		ReadTimeout                    *conf.StringDuration     `json:"readTimeout"`
+		WriteTimeout                   *conf.StringDuration     `json:"writeTimeout"`
+		ReadBufferCount                *int                     `json:"readBufferCount"`
+		DrainTimeout                   *conf.StringDuration     `json:"drainTimeout"`
+		BanDuration                    *conf.StringDuration     `json:"banDuration"`
+		AuthFailureLimit               *int                     `json:"authFailureLimit"`
+		AuthFailurePeriod              *conf.StringDuration     `json:"authFailurePeriod"`
+		AuthFailureBanDuration         *conf.StringDuration     `json:"authFailureBanDuration"`
+		ExternalAuthenticationURL      *string                  `json:"externalAuthenticationURL"`
+		ExternalAuthenticationCacheTTL *conf.StringDuration     `json:"externalAuthenticationCacheTTL"`
+		API                            *bool                    `json:"api"`
+		APIAddress                     *string                  `json:"apiAddress"`
+		APIPersist                     *bool                    `json:"apiPersist"`
+		APILogStream                   *bool                    `json:"apiLogStream"`
+		Metrics                        *bool                    `json:"metrics"`
+		MetricsAddress                 *string                  `json:"metricsAddress"`
+		PPROF                          *bool                    `json:"pprof"`
+		PPROFAddress                   *string                  `json:"pprofAddress"`
+		RunOnConnect                   *string                  `json:"runOnConnect"`
+		RunOnConnectRestart            *bool                    `json:"runOnConnectRestart"`
+		RunOnDisconnect                *string                  `json:"runOnDisconnect"`
+		RunOnRestartPause              *conf.StringDuration     `json:"runOnRestartPause"`
+		RunOnRestartMaxPause           *conf.StringDuration     `json:"runOnRestartMaxPause"`
+		RunOnMaxRestarts               *int                     `json:"runOnMaxRestarts"`
 
 		// RTSP
 		RTSPDisable       *bool             `json:"rtspDisable"`
@@ -81,13 +105,15 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 		RTMPAddress *string `json:"rtmpAddress"`
 
 		// HLS
-		HLSDisable         *bool                `json:"hlsDisable"`
-		HLSAddress         *string              `json:"hlsAddress"`
-		HLSAlwaysRemux     *bool                `json:"hlsAlwaysRemux"`
-		HLSSegmentCount    *int                 `json:"hlsSegmentCount"`
-		HLSSegmentDuration *conf.StringDuration `json:"hlsSegmentDuration"`
-		HLSSegmentMaxSize  *conf.StringSize     `json:"hlsSegmentMaxSize"`
-		HLSAllowOrigin     *string              `json:"hlsAllowOrigin"`
+		HLSDisable          *bool                  `json:"hlsDisable"`
+		HLSAddress          *string                `json:"hlsAddress"`
+		HLSAlwaysRemux      *bool                  `json:"hlsAlwaysRemux"`
+		HLSSegmentCount     *int                   `json:"hlsSegmentCount"`
+		HLSSegmentDuration  *conf.StringDuration   `json:"hlsSegmentDuration"`
+		HLSSegmentMaxSize   *conf.StringSize       `json:"hlsSegmentMaxSize"`
+		HLSSegmentDirectory *string                `json:"hlsSegmentDirectory"`
+		HLSAllowOrigin      *string                `json:"hlsAllowOrigin"`
+		HLSVariantGroups    *conf.HLSVariantGroups `json:"hlsVariantGroups"`
 	}
 	err := json.NewDecoder(ctx.Request.Body).Decode(&in)
 	if err != nil {
@@ -97,27 +123,62 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 	return in, err
 }
 
+type apiKickData struct {
+	Reason      string              `json:"reason"`
+	Ban         string              `json:"ban"`
+	BanDuration conf.StringDuration `json:"banDuration"`
+}
+
+// loadKickData loads the optional parameters of a kick request.
+func loadKickData(ctx *gin.Context) (*apiKickData, error) {
+	var in apiKickData
+
+	if ctx.Request.ContentLength != 0 {
+		err := json.NewDecoder(ctx.Request.Body).Decode(&in)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	switch in.Ban {
+	case "", banTypeIP, banTypeUser:
+	default:
+		return nil, fmt.Errorf("invalid ban type: '%s'", in.Ban)
+	}
+
+	return &in, nil
+}
+
 func loadConfPathData(ctx *gin.Context) (interface{}, error) {
 	var in struct {
+		// general
+		LogLevel *conf.LogLevel `json:"logLevel"`
+
 		// source
 		Source                     *string              `json:"source"`
 		SourceProtocol             *conf.SourceProtocol `json:"sourceProtocol"`
 		SourceAnyPortEnable        *bool                `json:"sourceAnyPortEnable"`
 		SourceFingerprint          *string              `json:"sourceFingerprint"`
+		SourceVariant              *string              `json:"sourceVariant"`
 		SourceOnDemand             *bool                `json:"sourceOnDemand"`
 		SourceOnDemandStartTimeout *conf.StringDuration `json:"sourceOnDemandStartTimeout"`
 		SourceOnDemandCloseAfter   *conf.StringDuration `json:"sourceOnDemandCloseAfter"`
 		SourceRedirect             *string              `json:"sourceRedirect"`
 		DisablePublisherOverride   *bool                `json:"disablePublisherOverride"`
 		Fallback                   *string              `json:"fallback"`
+		Alias                      *string              `json:"alias"`
+		GOPCache                   *bool                `json:"gopCache"`
+		KeyframeCache              *bool                `json:"keyframeCache"`
+		SourceInactivityTimeout    *conf.StringDuration `json:"sourceInactivityTimeout"`
 
 		// authentication
-		PublishUser *conf.Credential `json:"publishUser"`
-		PublishPass *conf.Credential `json:"publishPass"`
-		PublishIPs  *conf.IPsOrNets  `json:"publishIPs"`
-		ReadUser    *conf.Credential `json:"readUser"`
-		ReadPass    *conf.Credential `json:"readPass"`
-		ReadIPs     *conf.IPsOrNets  `json:"readIPs"`
+		PublishUser        *conf.Credential     `json:"publishUser"`
+		PublishPass        *conf.Credential     `json:"publishPass"`
+		PublishIPs         *conf.IPsOrNets      `json:"publishIPs"`
+		ReadUser           *conf.Credential     `json:"readUser"`
+		ReadPass           *conf.Credential     `json:"readPass"`
+		ReadIPs            *conf.IPsOrNets      `json:"readIPs"`
+		MaxSessionDuration *conf.StringDuration `json:"maxSessionDuration"`
 
 		// external commands
 		RunOnInit               *string              `json:"runOnInit"`
@@ -128,8 +189,12 @@ func loadConfPathData(ctx *gin.Context) (interface{}, error) {
 		RunOnDemandCloseAfter   *conf.StringDuration `json:"runOnDemandCloseAfter"`
 		RunOnReady              *string              `json:"runOnReady"`
 		RunOnReadyRestart       *bool                `json:"runOnReadyRestart"`
+		RunOnNotReady           *string              `json:"runOnNotReady"`
 		RunOnRead               *string              `json:"runOnRead"`
 		RunOnReadRestart        *bool                `json:"runOnReadRestart"`
+		RunOnUnread             *string              `json:"runOnUnread"`
+		RunOnSourceError        *string              `json:"runOnSourceError"`
+		RunOnSourceInactive     *string              `json:"runOnSourceInactive"`
 
 		// deprecated, replaced by runOnReady. TODO: remove in next version
 		RunOnPublish        *string `json:"runOnPublish"`
@@ -145,6 +210,8 @@ func loadConfPathData(ctx *gin.Context) (interface{}, error) {
 
 type apiPathManager interface {
 	onAPIPathsList(req pathAPIPathsListReq) pathAPIPathsListRes
+	onAPIPathsStream(req pathAPIPathsStreamReq) pathAPIPathsStreamRes
+	onAPIPathsSnapshot(req pathAPIPathsSnapshotReq) pathAPIPathsSnapshotRes
 }
 
 type apiRTSPServer interface {
@@ -164,29 +231,39 @@ type apiHLSServer interface {
 type apiParent interface {
 	Log(logger.Level, string, ...interface{})
 	onAPIConfigSet(conf *conf.Conf)
+	onAPILoggerSet(level *conf.LogLevel, destinations *conf.LogDestinations) error
+	onAPIConfigLastReload() *coreReloadReport
+	onAPIDrainStart()
+	onAPIDrainGet() time.Time
 }
 
 type api struct {
 	conf        *conf.Conf
+	logHandler  *logger.Logger
 	pathManager apiPathManager
 	rtspServer  apiRTSPServer
 	rtspsServer apiRTSPServer
 	rtmpServer  apiRTMPServer
 	hlsServer   apiHLSServer
+	banList     *banList
 	parent      apiParent
 
-	mutex sync.Mutex
-	s     *http.Server
+	ctx       context.Context
+	ctxCancel func()
+	mutex     sync.Mutex
+	s         *http.Server
 }
 
 func newAPI(
 	address string,
 	conf *conf.Conf,
+	logHandler *logger.Logger,
 	pathManager apiPathManager,
 	rtspServer apiRTSPServer,
 	rtspsServer apiRTSPServer,
 	rtmpServer apiRTMPServer,
 	hlsServer apiHLSServer,
+	banList *banList,
 	parent apiParent,
 ) (*api, error) {
 	ln, err := net.Listen("tcp", address)
@@ -194,14 +271,20 @@ func newAPI(
 		return nil, err
 	}
 
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
 	a := &api{
 		conf:        conf,
+		logHandler:  logHandler,
 		pathManager: pathManager,
 		rtspServer:  rtspServer,
 		rtspsServer: rtspsServer,
 		rtmpServer:  rtmpServer,
 		hlsServer:   hlsServer,
+		banList:     banList,
 		parent:      parent,
+		ctx:         ctx,
+		ctxCancel:   ctxCancel,
 	}
 
 	router := gin.New()
@@ -213,27 +296,35 @@ func newAPI(
 	group.POST("/v1/config/paths/add/*name", a.onConfigPathsAdd)
 	group.POST("/v1/config/paths/edit/*name", a.onConfigPathsEdit)
 	group.POST("/v1/config/paths/remove/*name", a.onConfigPathsDelete)
+	group.GET("/v1/config/lastreload", a.onConfigLastReload)
+	group.POST("/v1/config/validate", a.onConfigValidate)
 
-	group.GET("/v1/paths/list", a.onPathsList)
-
-	if !interfaceIsEmpty(a.rtspServer) {
-		group.GET("/v1/rtspsessions/list", a.onRTSPSessionsList)
-		group.POST("/v1/rtspsessions/kick/:id", a.onRTSPSessionsKick)
+	group.GET("/v1/logger/get", a.onLoggerGet)
+	group.POST("/v1/logger/set", a.onLoggerSet)
+	if conf.APILogStream {
+		group.GET("/v1/logger/stream", a.onLoggerStream)
 	}
 
-	if !interfaceIsEmpty(a.rtspsServer) {
-		group.GET("/v1/rtspssessions/list", a.onRTSPSSessionsList)
-		group.POST("/v1/rtspssessions/kick/:id", a.onRTSPSSessionsKick)
-	}
-
-	if !interfaceIsEmpty(a.rtmpServer) {
-		group.GET("/v1/rtmpconns/list", a.onRTMPConnsList)
-		group.POST("/v1/rtmpconns/kick/:id", a.onRTMPConnsKick)
-	}
+	group.GET("/v1/drain/get", a.onDrainGet)
+	group.POST("/v1/drain/start", a.onDrainStart)
 
-	if !interfaceIsEmpty(a.hlsServer) {
-		group.GET("/v1/hlsmuxers/list", a.onHLSMuxersList)
-	}
+	group.GET("/v1/paths/list", a.onPathsList)
+	group.GET("/v1/paths/stream/*name", a.onPathsStream)
+	group.GET("/v1/paths/snapshot/*name", a.onPathsSnapshot)
+
+	group.GET("/v1/bans/list", a.onBansList)
+	group.POST("/v1/bans/add", a.onBansAdd)
+	group.POST("/v1/bans/remove/:id", a.onBansRemove)
+
+	// servers can be created and closed while the API is running;
+	// requests regarding servers that are not running return 404.
+	group.GET("/v1/rtspsessions/list", a.onRTSPSessionsList)
+	group.POST("/v1/rtspsessions/kick/:id", a.onRTSPSessionsKick)
+	group.GET("/v1/rtspssessions/list", a.onRTSPSSessionsList)
+	group.POST("/v1/rtspssessions/kick/:id", a.onRTSPSSessionsKick)
+	group.GET("/v1/rtmpconns/list", a.onRTMPConnsList)
+	group.POST("/v1/rtmpconns/kick/:id", a.onRTMPConnsKick)
+	group.GET("/v1/hlsmuxers/list", a.onHLSMuxersList)
 
 	a.s = &http.Server{Handler: router}
 
@@ -246,18 +337,19 @@ func newAPI(
 
 func (a *api) close() {
 	a.log(logger.Info, "listener is closing")
+	a.ctxCancel()
 	a.s.Shutdown(context.Background())
 }
 
 func (a *api) log(level logger.Level, format string, args ...interface{}) {
-	a.parent.Log(level, "[API] "+format, args...)
+	a.parent.Log(level, format, append([]interface{}{logger.Component("API")}, args...)...)
 }
 
 func (a *api) mwLog(ctx *gin.Context) {
-	a.log(logger.Info, "[conn %v] %s %s", ctx.Request.RemoteAddr, ctx.Request.Method, ctx.Request.URL.Path)
+	a.log(logger.Info, "%s %s", logger.RemoteAddr(ctx.Request.RemoteAddr), ctx.Request.Method, ctx.Request.URL.Path)
 
 	byts, _ := httputil.DumpRequest(ctx.Request, true)
-	a.log(logger.Debug, "[conn %v] [c->s] %s", ctx.Request.RemoteAddr, string(byts))
+	a.log(logger.Debug, "[c->s] %s", logger.RemoteAddr(ctx.Request.RemoteAddr), string(byts))
 
 	logw := &httpLogWriter{ResponseWriter: ctx.Writer}
 	ctx.Writer = logw
@@ -266,7 +358,7 @@ func (a *api) mwLog(ctx *gin.Context) {
 
 	ctx.Next()
 
-	a.log(logger.Debug, "[conn %v] [s->c] %s", ctx.Request.RemoteAddr, logw.dump())
+	a.log(logger.Debug, "[s->c] %s", logger.RemoteAddr(ctx.Request.RemoteAddr), logw.dump())
 }
 
 func (a *api) onConfigGet(ctx *gin.Context) {
@@ -430,8 +522,118 @@ func (a *api) onConfigPathsDelete(ctx *gin.Context) {
 	ctx.Status(http.StatusOK)
 }
 
+func (a *api) onLoggerGet(ctx *gin.Context) {
+	a.mutex.Lock()
+	logHandler := a.logHandler
+	a.mutex.Unlock()
+
+	if logHandler == nil {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, struct {
+		Level        conf.LogLevel        `json:"level"`
+		Destinations conf.LogDestinations `json:"destinations"`
+	}{
+		Level:        conf.LogLevel(logHandler.Level()),
+		Destinations: conf.LogDestinations(logHandler.Destinations()),
+	})
+}
+
+func (a *api) onLoggerSet(ctx *gin.Context) {
+	var in struct {
+		Level        *conf.LogLevel        `json:"level"`
+		Destinations *conf.LogDestinations `json:"destinations"`
+	}
+	err := json.NewDecoder(ctx.Request.Body).Decode(&in)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if (in.Level != nil && *in.Level == 0) ||
+		(in.Destinations != nil && len(*in.Destinations) == 0) {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	logHandler := a.logHandler
+	a.mutex.Unlock()
+
+	if logHandler == nil {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	// the logger is changed without reloading the configuration
+	err = a.parent.onAPILoggerSet(in.Level, in.Destinations)
+	if err != nil {
+		a.log(logger.Warn, "unable to set the logger: %s", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+func (a *api) onLoggerStream(ctx *gin.Context) {
+	a.mutex.Lock()
+	logHandler := a.logHandler
+	a.mutex.Unlock()
+
+	if logHandler == nil {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	recent, ch := logHandler.Subscribe()
+	defer logHandler.Unsubscribe(ch)
+
+	ctx.Writer.Header().Set("Content-Type", "text/event-stream")
+	ctx.Writer.Header().Set("Cache-Control", "no-cache")
+	ctx.Writer.WriteHeader(http.StatusOK)
+
+	write := func(entry string) {
+		// entries can span multiple lines
+		ctx.Writer.WriteString("data: " + strings.ReplaceAll(entry, "\n", "\ndata: ") + "\n\n")
+	}
+
+	for _, entry := range recent {
+		write(entry)
+	}
+	ctx.Writer.Flush()
+
+	for {
+		select {
+		case entry, ok := <-ch:
+			if !ok {
+				return
+			}
+			write(entry)
+			ctx.Writer.Flush()
+
+		case <-ctx.Request.Context().Done():
+			return
+
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
 func (a *api) onPathsList(ctx *gin.Context) {
-	res := a.pathManager.onAPIPathsList(pathAPIPathsListReq{})
+	a.mutex.Lock()
+	pathManager := a.pathManager
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(pathManager) {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	res := pathManager.onAPIPathsList(pathAPIPathsListReq{})
 	if res.err != nil {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -440,8 +642,94 @@ func (a *api) onPathsList(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, res.data)
 }
 
+func (a *api) onPathsStream(ctx *gin.Context) {
+	name := ctx.Param("name")
+	if len(name) < 2 || name[0] != '/' {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	name = name[1:]
+
+	a.mutex.Lock()
+	pathManager := a.pathManager
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(pathManager) {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	res := pathManager.onAPIPathsStream(pathAPIPathsStreamReq{name: name})
+	if res.err != nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
+func (a *api) onPathsSnapshot(ctx *gin.Context) {
+	name := ctx.Param("name")
+	if len(name) < 2 || name[0] != '/' {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	name = name[1:]
+
+	format := ctx.Query("format")
+	switch format {
+	case "", "mp4", "annexb":
+	default:
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	pathManager := a.pathManager
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(pathManager) {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	res := pathManager.onAPIPathsSnapshot(pathAPIPathsSnapshotReq{name: name})
+	if res.err != nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var byts []byte
+	var contentType string
+	var err error
+
+	if format == "annexb" {
+		byts, err = res.keyframe.annexB()
+		contentType = "video/h264"
+	} else {
+		byts, err = mp4.WriteH264(res.keyframe.sps, res.keyframe.pps, res.keyframe.nalus)
+		contentType = "video/mp4"
+	}
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Header("Last-Modified", res.keyframe.time.UTC().Format(http.TimeFormat))
+	ctx.Data(http.StatusOK, contentType, byts)
+}
+
 func (a *api) onRTSPSessionsList(ctx *gin.Context) {
-	res := a.rtspServer.onAPISessionsList(rtspServerAPISessionsListReq{})
+	a.mutex.Lock()
+	rtspServer := a.rtspServer
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(rtspServer) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	res := rtspServer.onAPISessionsList(rtspServerAPISessionsListReq{})
 	if res.err != nil {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -451,19 +739,41 @@ func (a *api) onRTSPSessionsList(ctx *gin.Context) {
 }
 
 func (a *api) onRTSPSessionsKick(ctx *gin.Context) {
-	id := ctx.Param("id")
+	in, err := loadKickData(ctx)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
 
-	res := a.rtspServer.onAPISessionsKick(rtspServerAPISessionsKickReq{id: id})
-	if res.err != nil {
+	a.mutex.Lock()
+	rtspServer := a.rtspServer
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(rtspServer) {
 		ctx.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
-	ctx.Status(http.StatusOK)
+	a.kickWithBan(ctx, in, func(beforeKick func(net.IP, string) error) error {
+		return rtspServer.onAPISessionsKick(rtspServerAPISessionsKickReq{
+			id:         ctx.Param("id"),
+			reason:     in.Reason,
+			beforeKick: beforeKick,
+		}).err
+	})
 }
 
 func (a *api) onRTSPSSessionsList(ctx *gin.Context) {
-	res := a.rtspsServer.onAPISessionsList(rtspServerAPISessionsListReq{})
+	a.mutex.Lock()
+	rtspsServer := a.rtspsServer
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(rtspsServer) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	res := rtspsServer.onAPISessionsList(rtspServerAPISessionsListReq{})
 	if res.err != nil {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -473,19 +783,122 @@ func (a *api) onRTSPSSessionsList(ctx *gin.Context) {
 }
 
 func (a *api) onRTSPSSessionsKick(ctx *gin.Context) {
-	id := ctx.Param("id")
+	in, err := loadKickData(ctx)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
 
-	res := a.rtspsServer.onAPISessionsKick(rtspServerAPISessionsKickReq{id: id})
-	if res.err != nil {
+	a.mutex.Lock()
+	rtspsServer := a.rtspsServer
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(rtspsServer) {
 		ctx.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
+	a.kickWithBan(ctx, in, func(beforeKick func(net.IP, string) error) error {
+		return rtspsServer.onAPISessionsKick(rtspServerAPISessionsKickReq{
+			id:         ctx.Param("id"),
+			reason:     in.Reason,
+			beforeKick: beforeKick,
+		}).err
+	})
+}
+
+func (a *api) onConfigValidate(ctx *gin.Context) {
+	body, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	var newConf conf.Conf
+	cloneStruct(&newConf, a.conf)
+	a.mutex.Unlock()
+
+	// in addition to global parameters, paths can be validated too.
+	// parameters are decoded in the same way as the configuration file,
+	// in order to report non-existent parameters and wrong types.
+	errs, err := newConf.DecodeJSON(body)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	errs = append(errs, newConf.Validate()...)
+	if errs == nil {
+		errs = conf.ValidationErrors{}
+	}
+
+	ctx.JSON(http.StatusOK, struct {
+		Valid  bool                  `json:"valid"`
+		Errors conf.ValidationErrors `json:"errors"`
+	}{
+		Valid:  len(errs) == 0,
+		Errors: errs,
+	})
+}
+
+func (a *api) onConfigLastReload(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, a.parent.onAPIConfigLastReload())
+}
+
+func (a *api) onDrainGet(ctx *gin.Context) {
+	a.mutex.Lock()
+	c := a.conf
+	a.mutex.Unlock()
+
+	out := struct {
+		Draining          bool                `json:"draining"`
+		StartTime         *time.Time          `json:"startTime"`
+		Timeout           conf.StringDuration `json:"timeout"`
+		RemainingSessions int                 `json:"remainingSessions"`
+	}{
+		Timeout: c.DrainTimeout,
+	}
+
+	if startTime := a.parent.onAPIDrainGet(); !startTime.IsZero() {
+		out.Draining = true
+		out.StartTime = &startTime
+		a.mutex.Lock()
+		rtspServer, rtspsServer, rtmpServer, hlsServer := a.rtspServer, a.rtspsServer, a.rtmpServer, a.hlsServer
+		a.mutex.Unlock()
+
+		out.RemainingSessions = activeSessionsCount(rtspServer, rtspsServer, rtmpServer, hlsServer)
+	}
+
+	ctx.JSON(http.StatusOK, out)
+}
+
+func (a *api) onDrainStart(ctx *gin.Context) {
+	a.mutex.Lock()
+	c := a.conf
+	a.mutex.Unlock()
+
+	if c.DrainTimeout == 0 {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	a.parent.onAPIDrainStart()
+
 	ctx.Status(http.StatusOK)
 }
 
 func (a *api) onRTMPConnsList(ctx *gin.Context) {
-	res := a.rtmpServer.onAPIConnsList(rtmpServerAPIConnsListReq{})
+	a.mutex.Lock()
+	rtmpServer := a.rtmpServer
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(rtmpServer) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	res := rtmpServer.onAPIConnsList(rtmpServerAPIConnsListReq{})
 	if res.err != nil {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -495,10 +908,127 @@ func (a *api) onRTMPConnsList(ctx *gin.Context) {
 }
 
 func (a *api) onRTMPConnsKick(ctx *gin.Context) {
-	id := ctx.Param("id")
+	in, err := loadKickData(ctx)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
 
-	res := a.rtmpServer.onAPIConnsKick(rtmpServerAPIConnsKickReq{id: id})
-	if res.err != nil {
+	a.mutex.Lock()
+	rtmpServer := a.rtmpServer
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(rtmpServer) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	a.kickWithBan(ctx, in, func(beforeKick func(net.IP, string) error) error {
+		return rtmpServer.onAPIConnsKick(rtmpServerAPIConnsKickReq{
+			id:         ctx.Param("id"),
+			reason:     in.Reason,
+			beforeKick: beforeKick,
+		}).err
+	})
+}
+
+// kickWithBan kicks a session with kick and bans its IP or user, if requested.
+// The ban is created before the session is kicked, in order not to kick
+// the session when the ban can't be created.
+func (a *api) kickWithBan(ctx *gin.Context, in *apiKickData,
+	kick func(beforeKick func(net.IP, string) error) error,
+) {
+	duration := in.BanDuration
+	if duration == 0 {
+		a.mutex.Lock()
+		duration = a.conf.BanDuration
+		a.mutex.Unlock()
+	}
+
+	var banID string
+	var banErr error
+
+	err := kick(func(remoteIP net.IP, user string) error {
+		banID, banErr = a.banKicked(in, time.Duration(duration), remoteIP, user)
+		return banErr
+	})
+
+	switch {
+	case banErr != nil:
+		ctx.AbortWithStatus(http.StatusBadRequest)
+
+	case err != nil:
+		ctx.AbortWithStatus(http.StatusNotFound)
+
+	case banID == "":
+		ctx.Status(http.StatusOK)
+
+	default:
+		ctx.JSON(http.StatusOK, struct {
+			BanID string `json:"banID"`
+		}{banID})
+	}
+}
+
+// banKicked bans the IP or the user of a session that is going to be kicked,
+// if requested. It returns the ID of the ban, or an empty ID if no ban was requested.
+func (a *api) banKicked(in *apiKickData, duration time.Duration, remoteIP net.IP, user string) (string, error) {
+	var value string
+	switch in.Ban {
+	case "":
+		return "", nil
+
+	case banTypeIP:
+		value = remoteIP.String()
+
+	case banTypeUser:
+		// the session was not authenticated with an user
+		if user == "" {
+			return "", fmt.Errorf("session has no user")
+		}
+		value = user
+	}
+
+	return a.banList.add(in.Ban, value, in.Reason, duration)
+}
+
+func (a *api) onBansList(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, a.banList.list())
+}
+
+func (a *api) onBansAdd(ctx *gin.Context) {
+	var in struct {
+		Type     string              `json:"type"`
+		Value    string              `json:"value"`
+		Reason   string              `json:"reason"`
+		Duration conf.StringDuration `json:"duration"`
+	}
+	err := json.NewDecoder(ctx.Request.Body).Decode(&in)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if in.Duration == 0 {
+		a.mutex.Lock()
+		in.Duration = a.conf.BanDuration
+		a.mutex.Unlock()
+	}
+
+	id, err := a.banList.add(in.Type, in.Value, in.Reason, time.Duration(in.Duration))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, struct {
+		ID string `json:"id"`
+	}{id})
+}
+
+func (a *api) onBansRemove(ctx *gin.Context) {
+	err := a.banList.remove(ctx.Param("id"))
+	if err != nil {
 		ctx.AbortWithStatus(http.StatusNotFound)
 		return
 	}
@@ -507,7 +1037,16 @@ func (a *api) onRTMPConnsKick(ctx *gin.Context) {
 }
 
 func (a *api) onHLSMuxersList(ctx *gin.Context) {
-	res := a.hlsServer.onAPIHLSMuxersList(hlsServerAPIMuxersListReq{})
+	a.mutex.Lock()
+	hlsServer := a.hlsServer
+	a.mutex.Unlock()
+
+	if interfaceIsEmpty(hlsServer) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	res := hlsServer.onAPIHLSMuxersList(hlsServerAPIMuxersListReq{})
 	if res.err != nil {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -522,3 +1061,45 @@ func (a *api) onConfReload(conf *conf.Conf) {
 	defer a.mutex.Unlock()
 	a.conf = conf
 }
+
+// onLogHandlerSet is called by core.
+func (a *api) onLogHandlerSet(l *logger.Logger) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.logHandler = l
+}
+
+// onPathManagerSet is called by core.
+func (a *api) onPathManagerSet(s apiPathManager) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.pathManager = s
+}
+
+// onRTSPServerSet is called by core.
+func (a *api) onRTSPServerSet(s apiRTSPServer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rtspServer = s
+}
+
+// onRTSPSServerSet is called by core.
+func (a *api) onRTSPSServerSet(s apiRTSPServer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rtspsServer = s
+}
+
+// onRTMPServerSet is called by core.
+func (a *api) onRTMPServerSet(s apiRTMPServer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rtmpServer = s
+}
+
+// onHLSServerSet is called by core.
+func (a *api) onHLSServerSet(s apiHLSServer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.hlsServer = s
+}
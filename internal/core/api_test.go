@@ -1,18 +1,27 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/aler9/gortsplib/pkg/headers"
 	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 func httpRequest(method string, ur string, in interface{}, out interface{}) error {
@@ -87,6 +96,97 @@ func TestAPIConfigSet(t *testing.T) {
 	require.Equal(t, []interface{}{"tcp"}, out["protocols"])
 }
 
+func TestAPIConfigPersist(t *testing.T) {
+	os.Setenv("RTSP_PATHS_CAM1_READUSER", "myuser")
+	defer os.Unsetenv("RTSP_PATHS_CAM1_READUSER")
+	os.Setenv("RTSP_PATHS_CAM1_READPASS", "mypass")
+	defer os.Unsetenv("RTSP_PATHS_CAM1_READPASS")
+
+	tmpf, err := writeTempFile([]byte("api: yes\n" +
+		"apiPersist: yes\n" +
+		"paths:\n" +
+		"  cam1:\n" +
+		"    source: publisher\n"))
+	require.NoError(t, err)
+	defer os.Remove(tmpf)
+
+	p, ok := New([]string{tmpf})
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/set", map[string]interface{}{
+		"readBufferCount": 1024,
+	}, nil)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	byts, err := ioutil.ReadFile(tmpf)
+	require.NoError(t, err)
+	require.Equal(t, "api: yes\n"+
+		"apiPersist: yes\n"+
+		"paths:\n"+
+		"  cam1:\n"+
+		"    source: publisher\n"+
+		"readBufferCount: 1024\n", string(byts))
+}
+
+func TestAPIConfigPersistPathsDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "rtsp-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = os.Mkdir(filepath.Join(dir, "paths"), 0o755)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "paths", "cam1.yml"),
+		[]byte("source: publisher\n"), 0o644)
+	require.NoError(t, err)
+
+	confPath := filepath.Join(dir, "rtsp-simple-server.yml")
+	err = ioutil.WriteFile(confPath, []byte("api: yes\n"+
+		"apiPersist: yes\n"+
+		"pathsDir: paths\n"), 0o644)
+	require.NoError(t, err)
+
+	p, ok := New([]string{confPath})
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	// connections to the API of the previous server can't be reused
+	http.DefaultClient.CloseIdleConnections()
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/paths/edit/cam1", map[string]interface{}{
+		"readUser": "myuser",
+		"readPass": "mypass",
+	}, nil)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	var before struct {
+		Time time.Time `json:"time"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/config/lastreload", nil, &before)
+	require.NoError(t, err)
+
+	byts, err := ioutil.ReadFile(filepath.Join(dir, "paths", "cam1.yml"))
+	require.NoError(t, err)
+	require.Equal(t, "source: publisher\n"+
+		"readUser: myuser\n"+
+		"readPass: mypass\n", string(byts))
+
+	// writing the path file doesn't cause another reload
+	time.Sleep(2 * time.Second)
+
+	var after struct {
+		Time time.Time `json:"time"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/config/lastreload", nil, &after)
+	require.NoError(t, err)
+	require.Equal(t, true, before.Time.Equal(after.Time))
+}
+
 func TestAPIConfigPathsAdd(t *testing.T) {
 	p, ok := newInstance("api: yes\n")
 	require.Equal(t, true, ok)
@@ -155,6 +255,375 @@ func TestAPIConfigPathsRemove(t *testing.T) {
 	require.Equal(t, false, ok)
 }
 
+func TestAPIConfigValidate(t *testing.T) {
+	p, ok := newInstance("api: yes\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	var out struct {
+		Valid  bool `json:"valid"`
+		Errors []struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err := httpRequest(http.MethodPost, "http://localhost:9997/v1/config/validate", map[string]interface{}{
+		"readBufferCount": 4096,
+	}, &out)
+	require.NoError(t, err)
+	require.Equal(t, true, out.Valid)
+	require.Equal(t, 0, len(out.Errors))
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/validate", map[string]interface{}{
+		"rtmpAddress": ":8888",
+		"paths": map[string]interface{}{
+			"~^(invalid": map[string]interface{}{},
+		},
+	}, &out)
+	require.NoError(t, err)
+	require.Equal(t, false, out.Valid)
+	require.Equal(t, 2, len(out.Errors))
+	require.Equal(t, "hlsAddress", out.Errors[0].Field)
+	require.Equal(t, "paths.~^(invalid", out.Errors[1].Field)
+
+	// non-existent parameters and wrong types are reported
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/validate", map[string]interface{}{
+		"readBufferCont": 4096,
+		"rtmpAddress":    1935,
+		"paths": map[string]interface{}{
+			"mypath": map[string]interface{}{
+				"sourceOnDemand": "yes",
+			},
+		},
+	}, &out)
+	require.NoError(t, err)
+	require.Equal(t, false, out.Valid)
+	require.Equal(t, 3, len(out.Errors))
+	require.Equal(t, "paths.mypath.sourceOnDemand", out.Errors[0].Field)
+	require.Equal(t, "readBufferCont", out.Errors[1].Field)
+	require.Equal(t, "non-existent parameter: 'readBufferCont'", out.Errors[1].Message)
+	require.Equal(t, "rtmpAddress", out.Errors[2].Field)
+
+	// the configuration is not applied
+	var conf map[string]interface{}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/config/get", nil, &conf)
+	require.NoError(t, err)
+	require.Equal(t, ":1935", conf["rtmpAddress"])
+}
+
+func TestAPIConfigLastReload(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{0x01, 0x02, 0x03, 0x04}, []byte{0x01, 0x02, 0x03, 0x04}, nil)
+	require.NoError(t, err)
+
+	source := gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer source.Close()
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/paths/add/other", map[string]interface{}{
+		"source": "publisher",
+	}, nil)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	var out struct {
+		RestartedResources []string `json:"restartedResources"`
+		RestartedPaths     []string `json:"restartedPaths"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/config/lastreload", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, []string{}, out.RestartedResources)
+	require.Equal(t, []string{}, out.RestartedPaths)
+
+	// the publisher of an unaffected path is still online
+	var paths struct {
+		Items map[string]struct {
+			SourceReady bool `json:"sourceReady"`
+		} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &paths)
+	require.NoError(t, err)
+	require.Equal(t, true, paths.Items["mypath"].SourceReady)
+
+	// timeouts and commands are applied to running servers
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/set", map[string]interface{}{
+		"readTimeout":  "20s",
+		"runOnConnect": "echo aa",
+	}, nil)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/config/lastreload", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, []string{}, out.RestartedResources)
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &paths)
+	require.NoError(t, err)
+	require.Equal(t, true, paths.Items["mypath"].SourceReady)
+
+	// the API is not restarted with servers
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/set", map[string]interface{}{
+		"authMethods": []string{"basic"},
+	}, nil)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/config/lastreload", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, []string{"rtspServer"}, out.RestartedResources)
+
+	res, err := http.Get("http://localhost:9997/v1/rtspsessions/list")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestAPILogger(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"apiLogStream: yes\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	var out struct {
+		Level        string   `json:"level"`
+		Destinations []string `json:"destinations"`
+	}
+	err := httpRequest(http.MethodGet, "http://localhost:9997/v1/logger/get", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, "info", out.Level)
+	require.Equal(t, []string{"stdout"}, out.Destinations)
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/logger/set", map[string]interface{}{
+		"level": "warn",
+	}, nil)
+	require.NoError(t, err)
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/logger/get", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, "warn", out.Level)
+
+	// the logger is changed synchronously, without reloading the configuration
+	require.Equal(t, logger.Warn, logger.Level(p.conf.LogLevel))
+	require.Nil(t, p.onAPIConfigLastReload())
+
+	var confOut map[string]interface{}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/config/get", nil, &confOut)
+	require.NoError(t, err)
+	require.Equal(t, "warn", confOut["logLevel"])
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/logger/set", map[string]interface{}{
+		"level": "invalid",
+	}, nil)
+	require.Error(t, err)
+
+	res, err := http.Get("http://localhost:9997/v1/logger/stream")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	p.Log(logger.Error, "test entry")
+
+	r := bufio.NewReader(res.Body)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if strings.HasPrefix(line, "data: ") && strings.HasSuffix(line, "test entry\n") {
+			break
+		}
+	}
+}
+
+func TestAPIDrain(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"drainTimeout: 10s\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{0x01, 0x02, 0x03, 0x04}, []byte{0x01, 0x02, 0x03, 0x04}, nil)
+	require.NoError(t, err)
+
+	source := gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer source.Close()
+
+	var out struct {
+		Draining          bool `json:"draining"`
+		RemainingSessions int  `json:"remainingSessions"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/drain/get", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, false, out.Draining)
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/drain/start", nil, nil)
+	require.NoError(t, err)
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/drain/get", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, true, out.Draining)
+	require.Equal(t, 1, out.RemainingSessions)
+
+	// new readers are refused
+	reader := gortsplib.Client{}
+	err = reader.StartReading("rtsp://localhost:8554/mypath")
+	require.EqualError(t, err, "bad status code: 503 (Service Unavailable)")
+
+	source.Close()
+
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("server did not shut down")
+	}
+
+	// connections to the API of the drained server can't be reused
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func TestAPIDrainDisabled(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	err := httpRequest(http.MethodPost, "http://localhost:9997/v1/drain/start", nil, nil)
+	require.EqualError(t, err, "bad status code: 400")
+}
+
+func TestAPIDrainTimeout(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"drainTimeout: 1s\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{0x01, 0x02, 0x03, 0x04}, []byte{0x01, 0x02, 0x03, 0x04}, nil)
+	require.NoError(t, err)
+
+	source := gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer source.Close()
+
+	conn, err := net.Dial("tcp", "localhost:8554")
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	writeReq := func(req base.Request) *base.Response {
+		var bb bytes.Buffer
+		req.Write(&bb)
+		_, err := conn.Write(bb.Bytes())
+		require.NoError(t, err)
+
+		var res base.Response
+		err = res.Read(br)
+		require.NoError(t, err)
+		require.Equal(t, base.StatusOK, res.StatusCode)
+		return &res
+	}
+
+	u, err := base.ParseURL("rtsp://localhost:8554/mypath/trackID=0")
+	require.NoError(t, err)
+
+	res := writeReq(base.Request{
+		Method: base.Setup,
+		URL:    u,
+		Header: base.Header{
+			"CSeq": base.HeaderValue{"1"},
+			"Transport": headers.Transport{
+				Mode: func() *headers.TransportMode {
+					v := headers.TransportModePlay
+					return &v
+				}(),
+				Protocol:       headers.TransportProtocolTCP,
+				InterleavedIDs: &[2]int{0, 1},
+			}.Write(),
+		},
+	})
+
+	var sx headers.Session
+	err = sx.Read(res.Header["Session"])
+	require.NoError(t, err)
+
+	u, err = base.ParseURL("rtsp://localhost:8554/mypath")
+	require.NoError(t, err)
+
+	writeReq(base.Request{
+		Method: base.Play,
+		URL:    u,
+		Header: base.Header{
+			"CSeq":    base.HeaderValue{"2"},
+			"Session": base.HeaderValue{sx.Session},
+		},
+	})
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/drain/start", nil, nil)
+	require.NoError(t, err)
+
+	// sessions still open when the timeout is reached are notified
+	frame := base.InterleavedFrame{Payload: make([]byte, 2048)}
+	var req base.Request
+	for {
+		what, err := base.ReadInterleavedFrameOrRequest(&frame, &req, br)
+		require.NoError(t, err)
+		if _, ok := what.(*base.Request); ok {
+			break
+		}
+		frame.Payload = frame.Payload[:cap(frame.Payload)]
+	}
+
+	require.Equal(t, base.Teardown, req.Method)
+	require.Equal(t, "rtsp://localhost:8554/mypath", req.URL.String())
+	require.Equal(t, base.HeaderValue{sx.Session}, req.Header["Session"])
+
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("server did not shut down")
+	}
+
+	// connections to the API of the drained server can't be reused
+	http.DefaultClient.CloseIdleConnections()
+}
+
 func TestAPIPathsList(t *testing.T) {
 	serverCertFpath, err := writeTempFile(serverCert)
 	require.NoError(t, err)
@@ -218,6 +687,172 @@ func TestAPIPathsList(t *testing.T) {
 	}()
 }
 
+func TestAPIPathsStream(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{
+			0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78,
+			0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03,
+			0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+			0x60, 0xc6, 0x58,
+		},
+		[]byte{0x08}, nil)
+	require.NoError(t, err)
+
+	audioTrack, err := gortsplib.NewTrackAAC(97, 2, 44100, 2, nil)
+	require.NoError(t, err)
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/stream/mypath", nil, nil)
+	require.EqualError(t, err, "bad status code: 404")
+
+	source := gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{videoTrack, audioTrack})
+	require.NoError(t, err)
+	defer source.Close()
+
+	err = source.WritePacketRTP(0, []byte{
+		0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x01, 0x05,
+	})
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	var out struct {
+		Tracks []struct {
+			Codec     string `json:"codec"`
+			ClockRate int    `json:"clockRate"`
+			H264      *struct {
+				Profile string `json:"profile"`
+				Level   string `json:"level"`
+				Width   int    `json:"width"`
+				Height  int    `json:"height"`
+			} `json:"h264"`
+			AAC *struct {
+				Type         int    `json:"type"`
+				SampleRate   int    `json:"sampleRate"`
+				ChannelCount int    `json:"channelCount"`
+				Config       string `json:"config"`
+			} `json:"aac"`
+			BytesReceived uint64     `json:"bytesReceived"`
+			LastFrameTime *time.Time `json:"lastFrameTime"`
+		} `json:"tracks"`
+		SDP           string     `json:"sdp"`
+		LastFrameTime *time.Time `json:"lastFrameTime"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/stream/mypath", nil, &out)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(out.Tracks))
+
+	require.Equal(t, "h264", out.Tracks[0].Codec)
+	require.Equal(t, 90000, out.Tracks[0].ClockRate)
+	require.NotNil(t, out.Tracks[0].H264)
+	require.Equal(t, "High", out.Tracks[0].H264.Profile)
+	require.Equal(t, "4.0", out.Tracks[0].H264.Level)
+	require.Equal(t, 1920, out.Tracks[0].H264.Width)
+	require.Equal(t, 1080, out.Tracks[0].H264.Height)
+	require.Equal(t, uint64(13), out.Tracks[0].BytesReceived)
+	require.NotNil(t, out.Tracks[0].LastFrameTime)
+
+	require.Equal(t, "aac", out.Tracks[1].Codec)
+	require.Equal(t, 44100, out.Tracks[1].ClockRate)
+	require.NotNil(t, out.Tracks[1].AAC)
+	require.Equal(t, 2, out.Tracks[1].AAC.Type)
+	require.Equal(t, 44100, out.Tracks[1].AAC.SampleRate)
+	require.Equal(t, 2, out.Tracks[1].AAC.ChannelCount)
+	require.Equal(t, "1210", out.Tracks[1].AAC.Config)
+	require.Nil(t, out.Tracks[1].LastFrameTime)
+
+	require.Contains(t, out.SDP, "m=video")
+	require.Contains(t, out.SDP, "m=audio")
+	require.NotNil(t, out.LastFrameTime)
+}
+
+func TestAPIPathsSnapshot(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	sps := []byte{
+		0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78,
+		0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03,
+		0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+		0x60, 0xc6, 0x58,
+	}
+	pps := []byte{0x08}
+
+	track, err := gortsplib.NewTrackH264(96, sps, pps, nil)
+	require.NoError(t, err)
+
+	source := gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer source.Close()
+
+	get := func(format string) ([]byte, string, int) {
+		res, err := http.Get("http://localhost:9997/v1/paths/snapshot/mypath?format=" + format)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		byts, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		return byts, res.Header.Get("Content-Type"), res.StatusCode
+	}
+
+	_, _, code := get("annexb")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// non-IDR frame
+	err = source.WritePacketRTP(0, []byte{
+		0x80, 0xe0, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x01, 0x01, 0x02,
+	})
+	require.NoError(t, err)
+
+	// IDR frame
+	err = source.WritePacketRTP(0, []byte{
+		0x80, 0xe0, 0x00, 0x02, 0x00, 0x00, 0x0b, 0xb8,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x03,
+	})
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	byts, contentType, code := get("annexb")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "video/h264", contentType)
+	require.Equal(t, bytes.Join([][]byte{
+		{0x00, 0x00, 0x00, 0x01},
+		sps,
+		{0x00, 0x00, 0x00, 0x01, 0x08},
+		{0x00, 0x00, 0x00, 0x01, 0x65, 0x03},
+	}, nil), byts)
+
+	byts, contentType, code = get("")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "video/mp4", contentType)
+	require.Equal(t, "ftyp", string(byts[4:8]))
+	require.Equal(t, []byte("mdat\x00\x00\x00\x02\x65\x03"), byts[len(byts)-10:])
+
+	_, _, code = get("invalid")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
 func TestAPIList(t *testing.T) {
 	serverCertFpath, err := writeTempFile(serverCert)
 	require.NoError(t, err)
@@ -452,3 +1087,164 @@ func TestAPIKick(t *testing.T) {
 		})
 	}
 }
+
+func TestAPIKickBan(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{0x01, 0x02, 0x03, 0x04}, []byte{0x01, 0x02, 0x03, 0x04}, nil)
+	require.NoError(t, err)
+
+	source := gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer source.Close()
+
+	var sessions struct {
+		Items map[string]struct{} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/rtspsessions/list", nil, &sessions)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sessions.Items))
+
+	var id string
+	for k := range sessions.Items {
+		id = k
+	}
+
+	// the session has no user, therefore the ban is not valid and the session is not kicked
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/rtspsessions/kick/"+id, map[string]interface{}{
+		"ban": "user",
+	}, nil)
+	require.EqualError(t, err, "bad status code: 400")
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/rtspsessions/list", nil, &sessions)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sessions.Items))
+
+	var kickRes struct {
+		BanID string `json:"banID"`
+	}
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/rtspsessions/kick/"+id, map[string]interface{}{
+		"reason":      "test",
+		"ban":         "ip",
+		"banDuration": "1m",
+	}, &kickRes)
+	require.NoError(t, err)
+	require.NotEqual(t, "", kickRes.BanID)
+
+	var bans struct {
+		Items map[string]struct {
+			Type   string `json:"type"`
+			Value  string `json:"value"`
+			Reason string `json:"reason"`
+		} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/bans/list", nil, &bans)
+	require.NoError(t, err)
+	require.Equal(t, "ip", bans.Items[kickRes.BanID].Type)
+	require.Equal(t, "127.0.0.1", bans.Items[kickRes.BanID].Value)
+	require.Equal(t, "test", bans.Items[kickRes.BanID].Reason)
+
+	source2 := gortsplib.Client{}
+	err = source2.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.EqualError(t, err, "bad status code: 403 (Forbidden)")
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/bans/remove/"+kickRes.BanID, nil, nil)
+	require.NoError(t, err)
+
+	source3 := gortsplib.Client{}
+	err = source3.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer source3.Close()
+}
+
+func TestAPIAuthFailureBan(t *testing.T) {
+	p, ok := newInstance("api: yes\n" +
+		"rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"authFailureLimit: 2\n" +
+		"paths:\n" +
+		"  all:\n" +
+		"    publishIPs: [128.0.0.1/32]\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{0x01, 0x02, 0x03, 0x04}, []byte{0x01, 0x02, 0x03, 0x04}, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		source := gortsplib.Client{}
+		err = source.StartPublishing("rtsp://localhost:8554/mypath",
+			gortsplib.Tracks{track})
+		require.EqualError(t, err, "bad status code: 401 (Unauthorized)")
+	}
+
+	var bans struct {
+		Items map[string]struct {
+			Type      string `json:"type"`
+			Value     string `json:"value"`
+			Automatic bool   `json:"automatic"`
+		} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/bans/list", nil, &bans)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(bans.Items))
+
+	var id string
+	for k, v := range bans.Items {
+		id = k
+		require.Equal(t, "ip", v.Type)
+		require.Equal(t, "127.0.0.1", v.Value)
+		require.Equal(t, true, v.Automatic)
+	}
+
+	// the connection is closed by the listener
+	source := gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.Error(t, err)
+	require.NotEqual(t, "bad status code: 401 (Unauthorized)", err.Error())
+
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/bans/remove/"+id, nil, nil)
+	require.NoError(t, err)
+
+	source = gortsplib.Client{}
+	err = source.StartPublishing("rtsp://localhost:8554/mypath",
+		gortsplib.Tracks{track})
+	require.EqualError(t, err, "bad status code: 401 (Unauthorized)")
+
+	// rejections caused by a manual ban are not counted as failures
+	var addRes struct {
+		ID string `json:"id"`
+	}
+	err = httpRequest(http.MethodPost, "http://localhost:9997/v1/bans/add", map[string]interface{}{
+		"type":     "ip",
+		"value":    "127.0.0.1",
+		"duration": "1m",
+	}, &addRes)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		source := gortsplib.Client{}
+		err = source.StartPublishing("rtsp://localhost:8554/mypath",
+			gortsplib.Tracks{track})
+		require.EqualError(t, err, "bad status code: 403 (Forbidden)")
+	}
+
+	bans.Items = nil
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/bans/list", nil, &bans)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(bans.Items))
+	require.Equal(t, false, bans.Items[addRes.ID].Automatic)
+}
@@ -0,0 +1,326 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// supported ban types.
+const (
+	banTypeIP   = "ip"
+	banTypeUser = "user"
+)
+
+// kickError returns the error that is used to close a kicked session.
+func kickError(reason string) error {
+	if reason != "" {
+		return fmt.Errorf("kicked (%s)", reason)
+	}
+	return fmt.Errorf("kicked")
+}
+
+// reason of the bans created after too many authentication failures.
+const banReasonAuthFailures = "too many authentication failures"
+
+type banListItem struct {
+	Type       string    `json:"type"`
+	Value      string    `json:"value"`
+	Reason     string    `json:"reason"`
+	Automatic  bool      `json:"automatic"`
+	Created    time.Time `json:"created"`
+	Expiration time.Time `json:"expiration"`
+}
+
+type banListData struct {
+	Items map[string]banListItem `json:"items"`
+}
+
+// banList is a list of temporarily banned IPs and users.
+// It also keeps track of authentication failures and bans IPs
+// that fail authentication too many times.
+type banList struct {
+	mutex                  sync.Mutex
+	nextID                 uint64
+	items                  map[string]banListItem
+	autoIPBans             map[string]time.Time
+	authFailureLimit       int
+	authFailurePeriod      time.Duration
+	authFailureBanDuration time.Duration
+	authFailures           map[string][]time.Time
+	authFailuresPruned     time.Time
+	authFailuresTotal      uint64
+}
+
+func newBanList() *banList {
+	return &banList{
+		items:        make(map[string]banListItem),
+		autoIPBans:   make(map[string]time.Time),
+		authFailures: make(map[string][]time.Time),
+	}
+}
+
+// setAuthFailureParams is called by core.
+func (l *banList) setAuthFailureParams(limit int, period time.Duration, banDuration time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.authFailureLimit = limit
+	l.authFailurePeriod = period
+	l.authFailureBanDuration = banDuration
+}
+
+// removeExpired must be called with the mutex locked.
+func (l *banList) removeExpired() {
+	now := time.Now()
+	for id, item := range l.items {
+		if !now.Before(item.Expiration) {
+			l.deleteUnlocked(id)
+		}
+	}
+}
+
+// add is called by api.
+func (l *banList) add(typ string, value string, reason string, duration time.Duration) (string, error) {
+	switch typ {
+	case banTypeIP:
+		if net.ParseIP(value) == nil {
+			return "", fmt.Errorf("invalid IP: '%s'", value)
+		}
+
+	case banTypeUser:
+		if value == "" {
+			return "", fmt.Errorf("user is empty")
+		}
+
+	default:
+		return "", fmt.Errorf("invalid ban type: '%s'", typ)
+	}
+
+	if duration <= 0 {
+		return "", fmt.Errorf("invalid ban duration")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.addUnlocked(banListItem{
+		Type:   typ,
+		Value:  value,
+		Reason: reason,
+	}, duration), nil
+}
+
+// addUnlocked must be called with the mutex locked.
+func (l *banList) addUnlocked(item banListItem, duration time.Duration) string {
+	l.nextID++
+	id := strconv.FormatUint(l.nextID, 10)
+
+	now := time.Now()
+	item.Created = now
+	item.Expiration = now.Add(duration)
+	l.items[id] = item
+
+	return id
+}
+
+// deleteUnlocked must be called with the mutex locked.
+func (l *banList) deleteUnlocked(id string) {
+	item := l.items[id]
+
+	// the entry may belong to a newer ban of the same IP
+	if item.Automatic && item.Type == banTypeIP && l.autoIPBans[item.Value].Equal(item.Expiration) {
+		delete(l.autoIPBans, item.Value)
+	}
+
+	delete(l.items, id)
+}
+
+// remove is called by api.
+func (l *banList) remove(id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.removeExpired()
+
+	if _, ok := l.items[id]; !ok {
+		return fmt.Errorf("not found")
+	}
+
+	l.deleteUnlocked(id)
+	return nil
+}
+
+// list is called by api.
+func (l *banList) list() *banListData {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.removeExpired()
+
+	data := &banListData{
+		Items: make(map[string]banListItem),
+	}
+	for id, item := range l.items {
+		data.Items[id] = item
+	}
+	return data
+}
+
+// check is called by rtspConn, rtmpConn and hlsMuxer.
+// It returns an error if the IP or the user are banned.
+func (l *banList) check(ip net.IP, user string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.removeExpired()
+
+	for _, item := range l.items {
+		if (item.Type == banTypeIP && ip != nil && ip.Equal(net.ParseIP(item.Value))) ||
+			(item.Type == banTypeUser && user != "" && user == item.Value) {
+			if item.Reason != "" {
+				return fmt.Errorf("%s '%s' is banned (%s)", item.Type, item.Value, item.Reason)
+			}
+			return fmt.Errorf("%s '%s' is banned", item.Type, item.Value)
+		}
+	}
+
+	return nil
+}
+
+// isIPBlocked is called by banListener.
+// It returns true if the IP has been banned because of too many authentication failures.
+func (l *banList) isIPBlocked(ip net.IP) bool {
+	key := ip.String()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.isIPBlockedUnlocked(key)
+}
+
+// isIPBlockedUnlocked must be called with the mutex locked.
+// Expired bans are removed lazily.
+func (l *banList) isIPBlockedUnlocked(key string) bool {
+	expiration, ok := l.autoIPBans[key]
+	if !ok {
+		return false
+	}
+
+	if !time.Now().Before(expiration) {
+		delete(l.autoIPBans, key)
+		return false
+	}
+
+	return true
+}
+
+// onAuthFailure is called by rtspConn, rtspSession, rtmpConn and hlsMuxer.
+// It returns true if the IP has been banned because of too many failures.
+func (l *banList) onAuthFailure(ip net.IP) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.authFailuresTotal++
+
+	if l.authFailureLimit <= 0 || ip == nil {
+		return false
+	}
+
+	now := time.Now()
+
+	// remove IPs whose failures are all older than the period,
+	// at most once per period.
+	if now.Sub(l.authFailuresPruned) >= l.authFailurePeriod {
+		l.authFailuresPruned = now
+		for key, times := range l.authFailures {
+			if now.Sub(times[len(times)-1]) > l.authFailurePeriod {
+				delete(l.authFailures, key)
+			}
+		}
+	}
+
+	key := ip.String()
+
+	// remove failures of this IP that are older than the period
+	times := l.authFailures[key]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > l.authFailurePeriod {
+		i++
+	}
+	times = append(times[i:], now)
+
+	if len(times) < l.authFailureLimit {
+		l.authFailures[key] = times
+		return false
+	}
+
+	delete(l.authFailures, key)
+
+	if l.isIPBlockedUnlocked(key) {
+		return false
+	}
+
+	id := l.addUnlocked(banListItem{
+		Type:      banTypeIP,
+		Value:     key,
+		Reason:    banReasonAuthFailures,
+		Automatic: true,
+	}, l.authFailureBanDuration)
+	l.autoIPBans[key] = l.items[id].Expiration
+
+	return true
+}
+
+// stats is called by metrics.
+func (l *banList) stats() (authFailures uint64, ipBans int64, userBans int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.removeExpired()
+
+	for _, item := range l.items {
+		switch item.Type {
+		case banTypeIP:
+			ipBans++
+
+		case banTypeUser:
+			userBans++
+		}
+	}
+
+	return l.authFailuresTotal, ipBans, userBans
+}
+
+// banListener is a net.Listener that closes connections coming from IPs
+// banned because of authentication failures as soon as they are accepted.
+type banListener struct {
+	net.Listener
+	banList *banList
+}
+
+func newBanListener(ln net.Listener, banList *banList) net.Listener {
+	return &banListener{
+		Listener: ln,
+		banList:  banList,
+	}
+}
+
+// Accept implements net.Listener.
+func (l *banListener) Accept() (net.Conn, error) {
+	for {
+		nconn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if addr, ok := nconn.RemoteAddr().(*net.TCPAddr); ok && l.banList.isIPBlocked(addr.IP) {
+			nconn.Close()
+			continue
+		}
+
+		return nconn, nil
+	}
+}
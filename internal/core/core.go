@@ -3,9 +3,15 @@ package core
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/gin-gonic/gin"
@@ -20,27 +26,47 @@ import (
 
 var version = "v0.0.0"
 
+type coreReloadReport struct {
+	Time               time.Time `json:"time"`
+	RestartedResources []string  `json:"restartedResources"`
+	RestartedPaths     []string  `json:"restartedPaths"`
+}
+
+type coreAPILoggerSetReq struct {
+	level        *conf.LogLevel
+	destinations *conf.LogDestinations
+	res          chan error
+}
+
 // Core is an instance of rtsp-simple-server.
 type Core struct {
-	ctx             context.Context
-	ctxCancel       func()
-	confPath        string
-	conf            *conf.Conf
-	confFound       bool
-	logger          *logger.Logger
-	externalCmdPool *externalcmd.Pool
-	metrics         *metrics
-	pprof           *pprof
-	pathManager     *pathManager
-	rtspServer      *rtspServer
-	rtspsServer     *rtspServer
-	rtmpServer      *rtmpServer
-	hlsServer       *hlsServer
-	api             *api
-	confWatcher     *confwatcher.ConfWatcher
+	ctx               context.Context
+	ctxCancel         func()
+	confPath          string
+	conf              *conf.Conf
+	confFound         bool
+	logger            *logger.Logger
+	externalCmdPool   *externalcmd.Pool
+	banList           *banList
+	externalAuthCache *externalAuthCache
+	metrics           *metrics
+	pprof             *pprof
+	pathManager       *pathManager
+	rtspServer        *rtspServer
+	rtspsServer       *rtspServer
+	rtmpServer        *rtmpServer
+	hlsServer         *hlsServer
+	api               *api
+	confWatcher       *confwatcher.ConfWatcher
+	mutex             sync.Mutex
+	drainStart        time.Time
+	lastReload        *coreReloadReport
 
 	// in
-	apiConfigSet chan *conf.Conf
+	apiConfigSet  chan *conf.Conf
+	apiLoggerSet  chan coreAPILoggerSetReq
+	apiDrainStart chan struct{}
+	sessionEnd    chan struct{}
 
 	// out
 	done chan struct{}
@@ -52,6 +78,7 @@ func New(args []string) (*Core, bool) {
 		"rtsp-simple-server "+version+"\n\nRTSP server.")
 
 	argVersion := k.Flag("version", "print version").Bool()
+	argCheck := k.Flag("check", "check the configuration file and exit").Bool()
 	argConfPath := k.Arg("confpath", "path to a config file. The default is rtsp-simple-server.yml.").
 		Default("rtsp-simple-server.yml").String()
 
@@ -62,6 +89,24 @@ func New(args []string) (*Core, bool) {
 		os.Exit(0)
 	}
 
+	if *argCheck {
+		errs, err := conf.LoadAndValidate(*argConfPath)
+		if err != nil {
+			fmt.Printf("ERR: %s\n", err)
+			os.Exit(1)
+		}
+
+		if len(errs) != 0 {
+			for _, e := range errs {
+				fmt.Printf("ERR: %s\n", e)
+			}
+			os.Exit(1)
+		}
+
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
 	// on Linux, try to raise the number of file descriptors that can be opened
 	// to allow the maximum possible number of clients
 	// do not check for errors
@@ -72,11 +117,16 @@ func New(args []string) (*Core, bool) {
 	ctx, ctxCancel := context.WithCancel(context.Background())
 
 	p := &Core{
-		ctx:          ctx,
-		ctxCancel:    ctxCancel,
-		confPath:     *argConfPath,
-		apiConfigSet: make(chan *conf.Conf),
-		done:         make(chan struct{}),
+		ctx:               ctx,
+		ctxCancel:         ctxCancel,
+		confPath:          *argConfPath,
+		apiConfigSet:      make(chan *conf.Conf),
+		apiLoggerSet:      make(chan coreAPILoggerSetReq),
+		banList:           newBanList(),
+		externalAuthCache: newExternalAuthCache(),
+		apiDrainStart:     make(chan struct{}),
+		sessionEnd:        make(chan struct{}, 1),
+		done:              make(chan struct{}),
 	}
 
 	var err error
@@ -130,6 +180,23 @@ func (p *Core) run() {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+	defer signal.Stop(terminate)
+
+	var drainTimer *time.Timer
+	var drainTimeout <-chan time.Time
+	startDrain := func() bool {
+		p.startDrain()
+		drainTimer = time.NewTimer(time.Duration(p.conf.DrainTimeout))
+		drainTimeout = drainTimer.C
+		return p.drainDone()
+	}
+
 outer:
 	for {
 		select {
@@ -151,12 +218,66 @@ outer:
 		case newConf := <-p.apiConfigSet:
 			p.Log(logger.Info, "reloading configuration (API request)")
 
+			oldConf := p.conf
+
 			err := p.reloadConf(newConf, true)
 			if err != nil {
 				p.Log(logger.Error, "%s", err)
 				break outer
 			}
 
+			if newConf.APIPersist {
+				err := p.persistConf(oldConf, newConf)
+				if err != nil {
+					p.Log(logger.Warn, "unable to write the configuration file: %s", err)
+				}
+			}
+
+		case <-hangup:
+			err := p.logger.Reopen()
+			if err != nil {
+				p.Log(logger.Error, "unable to reopen the log file: %s", err)
+			} else {
+				p.Log(logger.Info, "log file reopened")
+			}
+
+		case <-terminate:
+			if p.conf.DrainTimeout == 0 {
+				p.Log(logger.Info, "shutting down gracefully")
+				break outer
+			}
+
+			if !p.drainStartTime().IsZero() {
+				p.Log(logger.Info, "shutting down")
+				break outer
+			}
+
+			p.Log(logger.Info, "draining (SIGTERM received)")
+			if startDrain() {
+				break outer
+			}
+
+		case req := <-p.apiLoggerSet:
+			req.res <- p.setLogger(req.level, req.destinations)
+
+		case <-p.apiDrainStart:
+			if p.drainStartTime().IsZero() {
+				p.Log(logger.Info, "draining (API request)")
+				if startDrain() {
+					break outer
+				}
+			}
+
+		case <-p.sessionEnd:
+			if !p.drainStartTime().IsZero() && p.drainDone() {
+				break outer
+			}
+
+		case <-drainTimeout:
+			p.Log(logger.Info, "drain timeout reached with %d open sessions, shutting down",
+				activeSessionsCount(p.rtspServer, p.rtspsServer, p.rtmpServer, p.hlsServer))
+			break outer
+
 		case <-interrupt:
 			p.Log(logger.Info, "shutting down gracefully")
 			break outer
@@ -166,6 +287,17 @@ outer:
 		}
 	}
 
+	if drainTimer != nil {
+		drainTimer.Stop()
+
+		if p.rtspServer != nil {
+			p.rtspServer.notifyTeardown()
+		}
+		if p.rtspsServer != nil {
+			p.rtspsServer.notifyTeardown()
+		}
+	}
+
 	p.ctxCancel()
 
 	p.closeResources(nil, false)
@@ -177,13 +309,33 @@ func (p *Core) createResources(initial bool) error {
 	if p.logger == nil {
 		p.logger, err = logger.New(
 			logger.Level(p.conf.LogLevel),
+			func() map[string]logger.Level {
+				ret := make(map[string]logger.Level)
+				for k, v := range p.conf.LogComponentLevels {
+					ret[k] = logger.Level(v)
+				}
+				return ret
+			}(),
+			logger.Format(p.conf.LogFormat),
 			p.conf.LogDestinations,
-			p.conf.LogFile)
+			p.conf.LogFile,
+			uint64(p.conf.LogFileMaxSize),
+			time.Duration(p.conf.LogFileMaxAge),
+			p.conf.LogFileMaxBackups,
+			p.conf.LogFileCompress,
+			p.conf.API && p.conf.APILogStream)
 		if err != nil {
 			return err
 		}
 	}
 
+	p.banList.setAuthFailureParams(
+		p.conf.AuthFailureLimit,
+		time.Duration(p.conf.AuthFailurePeriod),
+		time.Duration(p.conf.AuthFailureBanDuration))
+
+	p.externalAuthCache.setTTL(time.Duration(p.conf.ExternalAuthenticationCacheTTL))
+
 	if initial {
 		p.Log(logger.Info, "rtsp-simple-server %s", version)
 		if !p.confFound {
@@ -191,14 +343,19 @@ func (p *Core) createResources(initial bool) error {
 		}
 	}
 
-	if initial {
-		p.externalCmdPool = externalcmd.NewPool()
+	if p.externalCmdPool == nil {
+		p.externalCmdPool = externalcmd.NewPool(
+			time.Duration(p.conf.RunOnRestartPause),
+			time.Duration(p.conf.RunOnRestartMaxPause),
+			p.conf.RunOnMaxRestarts,
+		)
 	}
 
 	if p.conf.Metrics {
 		if p.metrics == nil {
 			p.metrics, err = newMetrics(
 				p.conf.MetricsAddress,
+				p.banList,
 				p)
 			if err != nil {
 				return err
@@ -227,8 +384,11 @@ func (p *Core) createResources(initial bool) error {
 			p.conf.ReadBufferSize,
 			p.conf.Paths,
 			p.externalCmdPool,
-			p.metrics,
 			p)
+
+		if !p.drainStartTime().IsZero() {
+			p.pathManager.onDrain()
+		}
 	}
 
 	if !p.conf.RTSPDisable &&
@@ -260,8 +420,10 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.Protocols,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
 				p.externalCmdPool,
-				p.metrics,
+				p.banList,
+				p.externalAuthCache,
 				p.pathManager,
 				p)
 			if err != nil {
@@ -297,8 +459,10 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.Protocols,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
 				p.externalCmdPool,
-				p.metrics,
+				p.banList,
+				p.externalAuthCache,
 				p.pathManager,
 				p)
 			if err != nil {
@@ -319,8 +483,10 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.RTSPAddress,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
 				p.externalCmdPool,
-				p.metrics,
+				p.banList,
+				p.externalAuthCache,
 				p.pathManager,
 				p)
 			if err != nil {
@@ -339,14 +505,21 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.HLSSegmentCount,
 				p.conf.HLSSegmentDuration,
 				p.conf.HLSSegmentMaxSize,
+				p.conf.HLSSegmentDirectory,
 				p.conf.HLSAllowOrigin,
+				p.conf.HLSVariantGroups,
 				p.conf.ReadBufferCount,
+				p.banList,
+				p.externalAuthCache,
 				p.pathManager,
-				p.metrics,
 				p)
 			if err != nil {
 				return err
 			}
+
+			if !p.drainStartTime().IsZero() {
+				p.hlsServer.onDrain()
+			}
 		}
 	}
 
@@ -355,11 +528,13 @@ func (p *Core) createResources(initial bool) error {
 			p.api, err = newAPI(
 				p.conf.APIAddress,
 				p.conf,
+				p.logger,
 				p.pathManager,
 				p.rtspServer,
 				p.rtspsServer,
 				p.rtmpServer,
 				p.hlsServer,
+				p.banList,
 				p)
 			if err != nil {
 				return err
@@ -367,22 +542,69 @@ func (p *Core) createResources(initial bool) error {
 		}
 	}
 
+	if p.api != nil {
+		p.api.onLogHandlerSet(p.logger)
+		p.api.onPathManagerSet(p.pathManager)
+		p.api.onRTSPServerSet(p.rtspServer)
+		p.api.onRTSPSServerSet(p.rtspsServer)
+		p.api.onRTMPServerSet(p.rtmpServer)
+		p.api.onHLSServerSet(p.hlsServer)
+	}
+
+	if p.metrics != nil {
+		p.metrics.onPathManagerSet(p.pathManager)
+		p.metrics.onRTSPServerSet(p.rtspServer)
+		p.metrics.onRTSPSServerSet(p.rtspsServer)
+		p.metrics.onRTMPServerSet(p.rtmpServer)
+		p.metrics.onHLSServerSet(p.hlsServer)
+	}
+
 	if initial && p.confFound {
 		p.confWatcher, err = confwatcher.New(p.confPath)
 		if err != nil {
 			return err
 		}
+
+		err = p.confWatcher.WatchDir(p.conf.PathsDirPath(p.confPath))
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
+// closeResources closes resources affected by a configuration change,
+// or all resources if newConf is nil. It returns the paths that were closed
+// by the path manager.
+func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) []string {
 	closeLogger := false
 	if newConf == nil ||
-		!reflect.DeepEqual(newConf.LogDestinations, p.conf.LogDestinations) ||
-		newConf.LogFile != p.conf.LogFile {
+		!reflect.DeepEqual(newConf.LogComponentLevels, p.conf.LogComponentLevels) ||
+		newConf.LogFormat != p.conf.LogFormat ||
+		newConf.LogFile != p.conf.LogFile ||
+		newConf.LogFileMaxSize != p.conf.LogFileMaxSize ||
+		newConf.LogFileMaxAge != p.conf.LogFileMaxAge ||
+		newConf.LogFileMaxBackups != p.conf.LogFileMaxBackups ||
+		newConf.LogFileCompress != p.conf.LogFileCompress {
 		closeLogger = true
+	} else {
+		// level and destinations can be changed without recreating the logger
+		if !reflect.DeepEqual(newConf.LogDestinations, p.conf.LogDestinations) {
+			err := p.logger.SetDestinations(newConf.LogDestinations)
+			if err != nil {
+				closeLogger = true
+			}
+		}
+
+		if newConf.LogLevel != p.conf.LogLevel {
+			p.logger.SetLevel(logger.Level(newConf.LogLevel))
+		}
+
+		if newConf.API != p.conf.API ||
+			newConf.APILogStream != p.conf.APILogStream {
+			p.logger.SetStream(newConf.API && newConf.APILogStream)
+		}
 	}
 
 	closeMetrics := false
@@ -399,17 +621,35 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		closePPROF = true
 	}
 
+	closeExternalCmdPool := false
+	if newConf == nil ||
+		newConf.RunOnRestartPause != p.conf.RunOnRestartPause ||
+		newConf.RunOnRestartMaxPause != p.conf.RunOnRestartMaxPause ||
+		newConf.RunOnMaxRestarts != p.conf.RunOnMaxRestarts {
+		closeExternalCmdPool = true
+	}
+
+	var closedPaths []string
+
 	closePathManager := false
 	if newConf == nil ||
+		closeExternalCmdPool {
+		closePathManager = true
+	} else if !reflect.DeepEqual(newConf.Paths, p.conf.Paths) ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		newConf.ReadTimeout != p.conf.ReadTimeout ||
 		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
-		newConf.ReadBufferSize != p.conf.ReadBufferSize ||
-		closeMetrics {
-		closePathManager = true
-	} else if !reflect.DeepEqual(newConf.Paths, p.conf.Paths) {
-		p.pathManager.onConfReload(newConf.Paths)
+		newConf.ReadBufferSize != p.conf.ReadBufferSize {
+		res := p.pathManager.onConfReload(pathManagerConfReloadReq{
+			pathConfs:       newConf.Paths,
+			rtspAddress:     newConf.RTSPAddress,
+			readTimeout:     newConf.ReadTimeout,
+			writeTimeout:    newConf.WriteTimeout,
+			readBufferCount: newConf.ReadBufferCount,
+			readBufferSize:  newConf.ReadBufferSize,
+		})
+		closedPaths = res.closedPaths
 	}
 
 	closeRTSPServer := false
@@ -419,8 +659,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		!reflect.DeepEqual(newConf.AuthMethods, p.conf.AuthMethods) ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
+		// gortsplib allocates buffers with this value and doesn't allow to change it
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
 		newConf.RTPAddress != p.conf.RTPAddress ||
@@ -428,11 +667,6 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.MulticastIPRange != p.conf.MulticastIPRange ||
 		newConf.MulticastRTPPort != p.conf.MulticastRTPPort ||
 		newConf.MulticastRTCPPort != p.conf.MulticastRTCPPort ||
-		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
-		closeMetrics ||
 		closePathManager {
 		closeRTSPServer = true
 	}
@@ -444,16 +678,12 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
 		newConf.RTSPSAddress != p.conf.RTSPSAddress ||
 		!reflect.DeepEqual(newConf.AuthMethods, p.conf.AuthMethods) ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
+		// gortsplib allocates buffers with this value and doesn't allow to change it
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.ServerCert != p.conf.ServerCert ||
 		newConf.ServerKey != p.conf.ServerKey ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
-		closeMetrics ||
 		closePathManager {
 		closeRTSPSServer = true
 	}
@@ -463,13 +693,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.RTMPDisable != p.conf.RTMPDisable ||
 		newConf.RTMPAddress != p.conf.RTMPAddress ||
 		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
-		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
-		closeMetrics ||
 		closePathManager {
 		closeRTMPServer = true
 	}
@@ -483,10 +707,10 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.HLSSegmentCount != p.conf.HLSSegmentCount ||
 		newConf.HLSSegmentDuration != p.conf.HLSSegmentDuration ||
 		newConf.HLSSegmentMaxSize != p.conf.HLSSegmentMaxSize ||
+		newConf.HLSSegmentDirectory != p.conf.HLSSegmentDirectory ||
 		newConf.HLSAllowOrigin != p.conf.HLSAllowOrigin ||
-		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
-		closePathManager ||
-		closeMetrics {
+		!reflect.DeepEqual(newConf.HLSVariantGroups, p.conf.HLSVariantGroups) ||
+		closePathManager {
 		closeHLSServer = true
 	}
 
@@ -494,11 +718,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 	if newConf == nil ||
 		newConf.API != p.conf.API ||
 		newConf.APIAddress != p.conf.APIAddress ||
-		closePathManager ||
-		closeRTSPServer ||
-		closeRTSPSServer ||
-		closeRTMPServer ||
-		closeHLSServer {
+		newConf.APILogStream != p.conf.APILogStream {
 		closeAPI = true
 	}
 
@@ -516,27 +736,96 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		}
 	}
 
+	if newConf != nil {
+		if !closeRTSPServer && p.rtspServer != nil {
+			p.rtspServer.onConfReload(rtspServerConfReloadReq{
+				readTimeout:         newConf.ReadTimeout,
+				writeTimeout:        newConf.WriteTimeout,
+				runOnConnect:        newConf.RunOnConnect,
+				runOnConnectRestart: newConf.RunOnConnectRestart,
+				runOnDisconnect:     newConf.RunOnDisconnect,
+			})
+		}
+
+		if !closeRTSPSServer && p.rtspsServer != nil {
+			p.rtspsServer.onConfReload(rtspServerConfReloadReq{
+				readTimeout:         newConf.ReadTimeout,
+				writeTimeout:        newConf.WriteTimeout,
+				runOnConnect:        newConf.RunOnConnect,
+				runOnConnectRestart: newConf.RunOnConnectRestart,
+				runOnDisconnect:     newConf.RunOnDisconnect,
+			})
+		}
+
+		if !closeRTMPServer && p.rtmpServer != nil {
+			p.rtmpServer.onConfReload(rtmpServerConfReloadReq{
+				readTimeout:         newConf.ReadTimeout,
+				writeTimeout:        newConf.WriteTimeout,
+				readBufferCount:     newConf.ReadBufferCount,
+				runOnConnect:        newConf.RunOnConnect,
+				runOnConnectRestart: newConf.RunOnConnectRestart,
+				runOnDisconnect:     newConf.RunOnDisconnect,
+			})
+		}
+
+		if !closeHLSServer && p.hlsServer != nil {
+			p.hlsServer.onConfReload(hlsServerConfReloadReq{
+				readBufferCount: newConf.ReadBufferCount,
+			})
+		}
+	}
+
 	if closeRTSPSServer && p.rtspsServer != nil {
+		if p.metrics != nil {
+			p.metrics.onRTSPSServerSet(nil)
+		}
+		if p.api != nil {
+			p.api.onRTSPSServerSet(nil)
+		}
 		p.rtspsServer.close()
 		p.rtspsServer = nil
 	}
 
 	if closeRTSPServer && p.rtspServer != nil {
+		if p.metrics != nil {
+			p.metrics.onRTSPServerSet(nil)
+		}
+		if p.api != nil {
+			p.api.onRTSPServerSet(nil)
+		}
 		p.rtspServer.close()
 		p.rtspServer = nil
 	}
 
 	if closePathManager && p.pathManager != nil {
+		if p.metrics != nil {
+			p.metrics.onPathManagerSet(nil)
+		}
+		if p.api != nil {
+			p.api.onPathManagerSet(nil)
+		}
 		p.pathManager.close()
 		p.pathManager = nil
 	}
 
 	if closeHLSServer && p.hlsServer != nil {
+		if p.metrics != nil {
+			p.metrics.onHLSServerSet(nil)
+		}
+		if p.api != nil {
+			p.api.onHLSServerSet(nil)
+		}
 		p.hlsServer.close()
 		p.hlsServer = nil
 	}
 
 	if closeRTMPServer && p.rtmpServer != nil {
+		if p.metrics != nil {
+			p.metrics.onRTMPServerSet(nil)
+		}
+		if p.api != nil {
+			p.api.onRTMPServerSet(nil)
+		}
 		p.rtmpServer.close()
 		p.rtmpServer = nil
 	}
@@ -551,22 +840,247 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		p.metrics = nil
 	}
 
-	if newConf == nil {
+	if closeExternalCmdPool && p.externalCmdPool != nil {
 		p.Log(logger.Info, "waiting for external commands")
 		p.externalCmdPool.Close()
+		p.externalCmdPool = nil
 	}
 
 	if closeLogger {
+		if p.api != nil {
+			p.api.onLogHandlerSet(nil)
+		}
 		p.logger.Close()
 		p.logger = nil
 	}
+
+	return closedPaths
+}
+
+// activeResources returns the names of existing resources.
+func (p *Core) activeResources() map[string]bool {
+	return map[string]bool{
+		"logger":          p.logger != nil,
+		"externalCmdPool": p.externalCmdPool != nil,
+		"metrics":         p.metrics != nil,
+		"pprof":           p.pprof != nil,
+		"pathManager":     p.pathManager != nil,
+		"rtspServer":      p.rtspServer != nil,
+		"rtspsServer":     p.rtspsServer != nil,
+		"rtmpServer":      p.rtmpServer != nil,
+		"hlsServer":       p.hlsServer != nil,
+		"api":             p.api != nil,
+	}
 }
 
 func (p *Core) reloadConf(newConf *conf.Conf, calledByAPI bool) error {
-	p.closeResources(newConf, calledByAPI)
+	before := p.activeResources()
+
+	closedPaths := p.closeResources(newConf, calledByAPI)
+
+	afterClose := p.activeResources()
+
+	if p.confWatcher != nil && newConf.PathsDir != p.conf.PathsDir {
+		err := p.confWatcher.WatchDir(newConf.PathsDirPath(p.confPath))
+		if err != nil {
+			return err
+		}
+	}
 
 	p.conf = newConf
-	return p.createResources(false)
+	err := p.createResources(false)
+	if err != nil {
+		return err
+	}
+
+	afterCreate := p.activeResources()
+
+	report := &coreReloadReport{
+		Time:               time.Now(),
+		RestartedResources: []string{},
+		RestartedPaths:     closedPaths,
+	}
+	for name, active := range before {
+		if active && !afterClose[name] && afterCreate[name] {
+			report.RestartedResources = append(report.RestartedResources, name)
+		}
+	}
+	sort.Strings(report.RestartedResources)
+
+	if report.RestartedPaths == nil {
+		report.RestartedPaths = []string{}
+	}
+	sort.Strings(report.RestartedPaths)
+
+	p.mutex.Lock()
+	p.lastReload = report
+	p.mutex.Unlock()
+
+	if len(report.RestartedResources) == 0 && len(report.RestartedPaths) == 0 {
+		p.Log(logger.Info, "configuration reloaded, no resources were restarted")
+	} else {
+		p.Log(logger.Info, "configuration reloaded, restarted resources: [%s], restarted paths: [%s]",
+			strings.Join(report.RestartedResources, ", "),
+			strings.Join(report.RestartedPaths, ", "))
+	}
+
+	return nil
+}
+
+// persistConf writes the changes between two configurations into the
+// configuration file, without triggering a reload. Paths loaded from pathsDir
+// are written into their own files. Parameters set through
+// environment variables are not written.
+func (p *Core) persistConf(oldConf *conf.Conf, newConf *conf.Conf) error {
+	if _, ok := os.LookupEnv("RTSP_CONFKEY"); ok {
+		return fmt.Errorf("the configuration file is encrypted")
+	}
+
+	existing, err := ioutil.ReadFile(p.confPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fileConf := &conf.Conf{}
+	if existing != nil {
+		fileConf, err = conf.LoadFile(p.confPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = fileConf.CheckAndFillMissing()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fileConf.ApplyChanges(oldConf, newConf)
+	if err != nil {
+		return err
+	}
+
+	err = fileConf.SavePathsDir(p.confPath, oldConf, newConf, func(fpath string, byts []byte) {
+		if p.confWatcher != nil {
+			p.confWatcher.IgnoreDirFile(fpath, byts)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	byts, err := fileConf.MarshalFormat(existing, conf.FormatFromPath(p.confPath))
+	if err != nil {
+		return err
+	}
+
+	if p.confWatcher != nil {
+		p.confWatcher.Ignore(byts)
+	}
+
+	return conf.WriteFile(p.confPath, byts)
+}
+
+// startDrain stops accepting new readers and publishers.
+func (p *Core) startDrain() {
+	p.mutex.Lock()
+	p.drainStart = time.Now()
+	p.mutex.Unlock()
+
+	if p.pathManager != nil {
+		p.pathManager.onDrain()
+	}
+
+	if p.hlsServer != nil {
+		p.hlsServer.onDrain()
+	}
+}
+
+// drainDone returns true when there are no sessions left.
+func (p *Core) drainDone() bool {
+	if activeSessionsCount(p.rtspServer, p.rtspsServer, p.rtmpServer, p.hlsServer) != 0 {
+		return false
+	}
+
+	p.Log(logger.Info, "all sessions have been closed, shutting down")
+	return true
+}
+
+func (p *Core) drainStartTime() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.drainStart
+}
+
+// onAPIDrainStart is called by api.
+func (p *Core) onAPIDrainStart() {
+	select {
+	case p.apiDrainStart <- struct{}{}:
+	case <-p.ctx.Done():
+	}
+}
+
+// onAPIConfigLastReload is called by api.
+func (p *Core) onAPIConfigLastReload() *coreReloadReport {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.lastReload
+}
+
+// onSessionEnd is called by rtspServer, rtmpServer and hlsServer
+// when a session stops reading or publishing.
+func (p *Core) onSessionEnd() {
+	select {
+	case p.sessionEnd <- struct{}{}:
+	default:
+	}
+}
+
+// onAPIDrainGet is called by api.
+func (p *Core) onAPIDrainGet() time.Time {
+	return p.drainStartTime()
+}
+
+// setLogger changes the level and the destinations of the logger without
+// reloading the configuration. The in-memory configuration is updated too,
+// while the configuration file is not.
+func (p *Core) setLogger(level *conf.LogLevel, destinations *conf.LogDestinations) error {
+	newConf := *p.conf
+
+	if destinations != nil {
+		err := p.logger.SetDestinations(*destinations)
+		if err != nil {
+			return err
+		}
+		newConf.LogDestinations = *destinations
+	}
+
+	if level != nil {
+		p.logger.SetLevel(logger.Level(*level))
+		newConf.LogLevel = *level
+	}
+
+	p.conf = &newConf
+
+	if p.api != nil {
+		p.api.onConfReload(p.conf)
+	}
+
+	return nil
+}
+
+// onAPILoggerSet is called by api.
+func (p *Core) onAPILoggerSet(level *conf.LogLevel, destinations *conf.LogDestinations) error {
+	req := coreAPILoggerSetReq{
+		level:        level,
+		destinations: destinations,
+		res:          make(chan error),
+	}
+	select {
+	case p.apiLoggerSet <- req:
+		return <-req.res
+	case <-p.ctx.Done():
+		return fmt.Errorf("terminated")
+	}
 }
 
 // onAPIConfigSet is called by api.
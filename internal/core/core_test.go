@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -398,6 +399,118 @@ func TestCorePathRunOnReady(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCorePathRunOnNotReady(t *testing.T) {
+	doneFile := filepath.Join(os.TempDir(), "onnotready_done")
+	defer os.Remove(doneFile)
+
+	p, ok := newInstance(fmt.Sprintf("rtmpDisable: yes\n"+
+		"hlsDisable: yes\n"+
+		"paths:\n"+
+		"  test:\n"+
+		"    runOnNotReady: sh -c \"echo $RTSP_PATH $RTSP_PROTOCOL $RTSP_QUERY > %s\"\n",
+		doneFile))
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{0x01, 0x02, 0x03, 0x04}, []byte{0x01, 0x02, 0x03, 0x04}, nil)
+	require.NoError(t, err)
+
+	c := gortsplib.Client{}
+
+	err = c.StartPublishing(
+		"rtsp://localhost:8554/test?param=value",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	_, err = os.Stat(doneFile)
+	require.Error(t, err)
+
+	c.Close()
+
+	time.Sleep(1 * time.Second)
+
+	byts, err := ioutil.ReadFile(doneFile)
+	require.NoError(t, err)
+	require.Equal(t, "test rtsp param=value\n", string(byts))
+}
+
+func TestCorePathSourceInactivityTimeout(t *testing.T) {
+	doneFile := filepath.Join(os.TempDir(), "onsourceinactive_done")
+	defer os.Remove(doneFile)
+
+	p, ok := newInstance(fmt.Sprintf("api: yes\n"+
+		"rtmpDisable: yes\n"+
+		"hlsDisable: yes\n"+
+		"paths:\n"+
+		"  test:\n"+
+		"    sourceInactivityTimeout: 1s\n"+
+		"    runOnSourceInactive: touch %s\n",
+		doneFile))
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{0x01, 0x02, 0x03, 0x04}, []byte{0x01, 0x02, 0x03, 0x04}, nil)
+	require.NoError(t, err)
+
+	c := gortsplib.Client{}
+
+	err = c.StartPublishing(
+		"rtsp://localhost:8554/test",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 8; i++ {
+		err = c.WritePacketRTP(0, []byte{
+			0x80, 0x60, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x01, 0x05,
+		})
+		require.NoError(t, err)
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	_, err = os.Stat(doneFile)
+	require.Error(t, err)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	_, err = os.Stat(doneFile)
+	require.NoError(t, err)
+
+	var out struct {
+		Items map[string]struct {
+			SourceReady              bool   `json:"sourceReady"`
+			SourceInactivityTimeouts uint64 `json:"sourceInactivityTimeouts"`
+		} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, false, out.Items["test"].SourceReady)
+	require.Equal(t, uint64(1), out.Items["test"].SourceInactivityTimeouts)
+
+	// paused publishers are not closed
+	c2 := gortsplib.Client{}
+
+	err = c2.StartPublishing(
+		"rtsp://localhost:8554/test",
+		gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer c2.Close()
+
+	_, err = c2.Pause()
+	require.NoError(t, err)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), out.Items["test"].SourceInactivityTimeouts)
+}
+
 func TestCoreHotReloading(t *testing.T) {
 	confPath := filepath.Join(os.TempDir(), "rtsp-conf")
 
@@ -0,0 +1,46 @@
+package core
+
+// activeSessionsCount returns the number of RTSP sessions and RTMP connections
+// that are reading or publishing, plus the number of HLS muxers,
+// that are closed once their clients stop downloading segments.
+func activeSessionsCount(
+	rtspServer apiRTSPServer,
+	rtspsServer apiRTSPServer,
+	rtmpServer apiRTMPServer,
+	hlsServer apiHLSServer,
+) int {
+	count := 0
+
+	for _, s := range []apiRTSPServer{rtspServer, rtspsServer} {
+		if !interfaceIsEmpty(s) {
+			res := s.onAPISessionsList(rtspServerAPISessionsListReq{})
+			if res.err == nil {
+				for _, i := range res.data.Items {
+					if i.State != "idle" {
+						count++
+					}
+				}
+			}
+		}
+	}
+
+	if !interfaceIsEmpty(rtmpServer) {
+		res := rtmpServer.onAPIConnsList(rtmpServerAPIConnsListReq{})
+		if res.err == nil {
+			for _, i := range res.data.Items {
+				if i.State != "idle" {
+					count++
+				}
+			}
+		}
+	}
+
+	if !interfaceIsEmpty(hlsServer) {
+		res := hlsServer.onAPIHLSMuxersList(hlsServerAPIMuxersListReq{})
+		if res.err == nil {
+			count += len(res.data.Items)
+		}
+	}
+
+	return count
+}
@@ -2,44 +2,221 @@ package core
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+const (
+	externalAuthTimeout = 10 * time.Second
 )
 
+var externalAuthClient = &http.Client{
+	Timeout: externalAuthTimeout,
+}
+
+// headers that change between requests of the same client,
+// that are not included into cache keys.
+var externalAuthCacheVolatileHeaders = map[string]struct{}{
+	"Accept":         {},
+	"Content-Length": {},
+	"Content-Type":   {},
+	"Cseq":           {},
+	"Date":           {},
+	"Range":          {},
+	"Session":        {},
+	"Timestamp":      {},
+	"Transport":      {},
+}
+
+type externalAuthReq struct {
+	IP        string            `json:"ip"`
+	User      string            `json:"user"`
+	Password  string            `json:"password"`
+	Path      string            `json:"path"`
+	Protocol  string            `json:"protocol"`
+	ID        string            `json:"id"`
+	Action    string            `json:"action"`
+	Query     string            `json:"query"`
+	UserAgent string            `json:"userAgent"`
+	Headers   map[string]string `json:"headers"`
+	Cookies   map[string]string `json:"cookies"`
+}
+
+// externalAuthRes is the optional body of a positive response of the external authentication server.
+type externalAuthRes struct {
+	// overrides the path requested by the client.
+	Path string `json:"path"`
+
+	// time after which the session is closed.
+	ExpiresAt *time.Time `json:"expiresAt"`
+
+	// maximum duration of the session.
+	MaxSessionDuration *conf.StringDuration `json:"maxSessionDuration"`
+}
+
+func (r *externalAuthRes) expired() bool {
+	return r.ExpiresAt != nil && !time.Now().Before(*r.ExpiresAt)
+}
+
+type externalAuthCacheEntry struct {
+	res        *externalAuthRes
+	expiration time.Time
+}
+
+// externalAuthCache keeps the positive results of the external authentication server,
+// in order to avoid calling it for every request.
+type externalAuthCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]externalAuthCacheEntry
+}
+
+func newExternalAuthCache() *externalAuthCache {
+	return &externalAuthCache{
+		entries: make(map[string]externalAuthCacheEntry),
+	}
+}
+
+// setTTL is called by core.
+func (c *externalAuthCache) setTTL(ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if ttl != c.ttl {
+		c.ttl = ttl
+		c.entries = make(map[string]externalAuthCacheEntry)
+	}
+}
+
+// cacheKey returns the hashed key of a request, that includes all the fields
+// that can be used by the server, except the ones that change between requests
+// of the same client (ID and volatile headers).
+func (c *externalAuthCache) cacheKey(ur string, req externalAuthReq) string {
+	headers := make(map[string]string)
+	for key, val := range req.Headers {
+		if _, ok := externalAuthCacheVolatileHeaders[http.CanonicalHeaderKey(key)]; !ok {
+			headers[http.CanonicalHeaderKey(key)] = val
+		}
+	}
+
+	req.ID = ""
+	req.Headers = headers
+	enc, _ := json.Marshal(struct {
+		URL string
+		Req externalAuthReq
+	}{ur, req})
+
+	h := sha256.Sum256(enc)
+	return hex.EncodeToString(h[:])
+}
+
+func (c *externalAuthCache) get(key string) (*externalAuthRes, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !time.Now().Before(entry.expiration) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return entry.res, true
+}
+
+func (c *externalAuthCache) set(key string, res *externalAuthRes) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expiration) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = externalAuthCacheEntry{
+		res:        res,
+		expiration: now.Add(c.ttl),
+	}
+}
+
 func externalAuth(
 	ur string,
-	ip string,
-	user string,
-	password string,
-	path string,
-	action string,
-	query string,
-) error {
-	enc, _ := json.Marshal(struct {
-		IP       string `json:"ip"`
-		User     string `json:"user"`
-		Password string `json:"password"`
-		Path     string `json:"path"`
-		Action   string `json:"action"`
-		Query    string `json:"query"`
-	}{
-		IP:       ip,
-		User:     user,
-		Password: password,
-		Path:     path,
-		Action:   action,
-		Query:    query,
-	})
-	res, err := http.Post(ur, "application/json", bytes.NewReader(enc))
+	cache *externalAuthCache,
+	req externalAuthReq,
+) (*externalAuthRes, error) {
+	key := cache.cacheKey(ur, req)
+
+	ret, ok := cache.get(key)
+	if !ok {
+		var err error
+		ret, err = externalAuthRequest(ur, req)
+		if err != nil {
+			return nil, err
+		}
+
+		cache.set(key, ret)
+	}
+
+	if ret.expired() {
+		return nil, fmt.Errorf("session expired")
+	}
+
+	return ret, nil
+}
+
+func externalAuthRequest(ur string, req externalAuthReq) (*externalAuthRes, error) {
+	enc, _ := json.Marshal(req)
+	res, err := externalAuthClient.Post(ur, "application/json", bytes.NewReader(enc))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return fmt.Errorf("bad status code: %d", res.StatusCode)
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	var ret externalAuthRes
+
+	// the body is optional
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(res.Body).Decode(&ret)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid response body: %s", err)
+		}
 	}
 
-	return nil
+	return &ret, nil
+}
+
+// externalAuthHeaders converts request headers into the format sent to the external authentication server.
+// Credentials are excluded, since they are sent separately.
+func externalAuthHeaders(header map[string][]string) map[string]string {
+	ret := make(map[string]string)
+	for key, vals := range header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Authorization", "Cookie":
+			continue
+		}
+		ret[key] = strings.Join(vals, ", ")
+	}
+	return ret
 }
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalAuthCacheKey(t *testing.T) {
+	c := newExternalAuthCache()
+
+	req := externalAuthReq{
+		IP:       "127.0.0.1",
+		User:     "myuser",
+		Password: "mypass",
+		Path:     "mypath",
+		Action:   "read",
+		Headers:  map[string]string{"CSeq": "1", "X-Token": "abc"},
+		Cookies:  map[string]string{"session": "def"},
+	}
+	key := c.cacheKey("http://auth", req)
+	require.Equal(t, false, strings.Contains(key, "mypass"))
+
+	// volatile headers and IDs are not part of the key
+	req2 := req
+	req2.ID = "123"
+	req2.Headers = map[string]string{"CSeq": "2", "X-Token": "abc"}
+	require.Equal(t, key, c.cacheKey("http://auth", req2))
+
+	req2 = req
+	req2.Headers = map[string]string{"CSeq": "1"}
+	require.NotEqual(t, key, c.cacheKey("http://auth", req2))
+
+	req2 = req
+	req2.Cookies = nil
+	require.NotEqual(t, key, c.cacheKey("http://auth", req2))
+}
@@ -27,6 +27,10 @@ import (
 const (
 	closeCheckPeriod     = 1 * time.Second
 	closeAfterInactivity = 60 * time.Second
+
+	// once the playlist is ended, players stop reloading it and only download
+	// the remaining segments.
+	drainCloseAfterInactivity = 5 * time.Second
 )
 
 const index = `<!DOCTYPE html>
@@ -98,18 +102,21 @@ type hlsMuxerResponse struct {
 	status int
 	header map[string]string
 	body   io.Reader
+	muxer  *hls.Muxer
 }
 
 type hlsMuxerRequest struct {
-	dir  string
-	file string
-	req  *http.Request
-	res  chan hlsMuxerResponse
+	dir     string
+	file    string
+	variant bool
+	req     *http.Request
+	res     chan hlsMuxerResponse
 }
 
 type hlsMuxerTrackIDPayloadPair struct {
 	trackID int
 	buf     []byte
+	ntp     time.Time
 }
 
 type hlsMuxerPathManager interface {
@@ -128,9 +135,14 @@ type hlsMuxer struct {
 	hlsSegmentCount           int
 	hlsSegmentDuration        conf.StringDuration
 	hlsSegmentMaxSize         conf.StringSize
+	hlsSegmentDirectory       string
+	hlsAlignSegments          bool
 	readBufferCount           int
 	wg                        *sync.WaitGroup
 	pathName                  string
+	banList                   *banList
+	externalAuthCache         *externalAuthCache
+	sessions                  *hlsSessions
 	pathManager               hlsMuxerPathManager
 	parent                    hlsMuxerParent
 
@@ -139,6 +151,7 @@ type hlsMuxer struct {
 	path            *path
 	ringBuffer      *ringbuffer.RingBuffer
 	lastRequestTime *int64
+	draining        *int32
 	muxer           *hls.Muxer
 	requests        []hlsMuxerRequest
 
@@ -155,9 +168,14 @@ func newHLSMuxer(
 	hlsSegmentCount int,
 	hlsSegmentDuration conf.StringDuration,
 	hlsSegmentMaxSize conf.StringSize,
+	hlsSegmentDirectory string,
+	hlsAlignSegments bool,
 	readBufferCount int,
 	wg *sync.WaitGroup,
 	pathName string,
+	banList *banList,
+	externalAuthCache *externalAuthCache,
+	sessions *hlsSessions,
 	pathManager hlsMuxerPathManager,
 	parent hlsMuxerParent) *hlsMuxer {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
@@ -169,9 +187,14 @@ func newHLSMuxer(
 		hlsSegmentCount:           hlsSegmentCount,
 		hlsSegmentDuration:        hlsSegmentDuration,
 		hlsSegmentMaxSize:         hlsSegmentMaxSize,
+		hlsSegmentDirectory:       hlsSegmentDirectory,
+		hlsAlignSegments:          hlsAlignSegments,
 		readBufferCount:           readBufferCount,
 		wg:                        wg,
 		pathName:                  pathName,
+		banList:                   banList,
+		externalAuthCache:         externalAuthCache,
+		sessions:                  sessions,
 		pathManager:               pathManager,
 		parent:                    parent,
 		ctx:                       ctx,
@@ -180,6 +203,7 @@ func newHLSMuxer(
 			v := time.Now().Unix()
 			return &v
 		}(),
+		draining:               new(int32),
 		request:                make(chan hlsMuxerRequest),
 		hlsServerAPIMuxersList: make(chan hlsServerAPIMuxersListSubReq),
 	}
@@ -197,7 +221,9 @@ func (m *hlsMuxer) close() {
 }
 
 func (m *hlsMuxer) log(level logger.Level, format string, args ...interface{}) {
-	m.parent.log(level, "[muxer %s] "+format, append([]interface{}{m.pathName}, args...)...)
+	m.parent.log(level, format, append([]interface{}{
+		logger.Field{Key: "path", Value: m.pathName, Prefix: "[muxer " + m.pathName + "]"},
+	}, args...)...)
 }
 
 // PathName returns the path name.
@@ -317,6 +343,8 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 		m.hlsSegmentCount,
 		time.Duration(m.hlsSegmentDuration),
 		uint64(m.hlsSegmentMaxSize),
+		m.hlsAlignSegments,
+		m.hlsSegmentDirectory,
 		videoTrack,
 		audioTrack,
 	)
@@ -358,7 +386,7 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 						continue
 					}
 
-					err = m.muxer.WriteH264(pts, nalus)
+					err = m.muxer.WriteH264(pair.ntp, pts, nalus)
 					if err != nil {
 						m.log(logger.Warn, "unable to write segment: %v", err)
 						continue
@@ -379,7 +407,7 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 						continue
 					}
 
-					err = m.muxer.WriteAAC(pts, aus)
+					err = m.muxer.WriteAAC(pair.ntp, pts, aus)
 					if err != nil {
 						m.log(logger.Warn, "unable to write segment: %v", err)
 						continue
@@ -392,10 +420,27 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 	closeCheckTicker := time.NewTicker(closeCheckPeriod)
 	defer closeCheckTicker.Stop()
 
+	ended := false
+
 	for {
 		select {
 		case <-closeCheckTicker.C:
 			t := time.Unix(atomic.LoadInt64(m.lastRequestTime), 0)
+
+			if atomic.LoadInt32(m.draining) == 1 {
+				if !ended {
+					m.muxer.End()
+					ended = true
+				}
+
+				if time.Since(t) >= drainCloseAfterInactivity {
+					m.ringBuffer.Close()
+					<-writerDone
+					return fmt.Errorf("drained")
+				}
+				continue
+			}
+
 			if !m.hlsAlwaysRemux && time.Since(t) >= closeAfterInactivity {
 				m.ringBuffer.Close()
 				<-writerDone
@@ -416,10 +461,17 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 func (m *hlsMuxer) handleRequest(req hlsMuxerRequest) hlsMuxerResponse {
 	atomic.StoreInt64(m.lastRequestTime, time.Now().Unix())
 
-	err := m.authenticate(req.req)
+	authRes, err := m.authenticate(req.req)
 	if err != nil {
 		if terr, ok := err.(pathErrAuthCritical); ok {
 			m.log(logger.Info, "authentication error: %s", terr.message)
+
+			tmp, _, _ := net.SplitHostPort(req.req.RemoteAddr)
+			ip := net.ParseIP(tmp)
+			if !terr.banned && m.banList.onAuthFailure(ip) {
+				m.log(logger.Warn, "IP %s banned because of too many authentication failures", ip)
+			}
+
 			return hlsMuxerResponse{
 				status: http.StatusUnauthorized,
 			}
@@ -433,6 +485,19 @@ func (m *hlsMuxer) handleRequest(req hlsMuxerRequest) hlsMuxerResponse {
 		}
 	}
 
+	if m.sessions.expired(m.pathName, req.req, authRes, m.path.Conf()) {
+		m.log(logger.Info, "session of %s expired", req.req.RemoteAddr)
+		return hlsMuxerResponse{status: http.StatusForbidden}
+	}
+
+	// the muxer is listed into the primary playlist of a variant group
+	if req.variant {
+		return hlsMuxerResponse{
+			status: http.StatusOK,
+			muxer:  m.muxer,
+		}
+	}
+
 	switch {
 	case req.file == "index.m3u8":
 		return hlsMuxerResponse{
@@ -480,38 +545,67 @@ func (m *hlsMuxer) handleRequest(req hlsMuxerRequest) hlsMuxerResponse {
 	}
 }
 
-func (m *hlsMuxer) authenticate(req *http.Request) error {
+func (m *hlsMuxer) authenticate(req *http.Request) (*externalAuthRes, error) {
 	pathConf := m.path.Conf()
 	pathIPs := pathConf.ReadIPs
 	pathUser := pathConf.ReadUser
 	pathPass := pathConf.ReadPass
 
+	tmp, _, _ := net.SplitHostPort(req.RemoteAddr)
+	ip := net.ParseIP(tmp)
+
+	reqUser, _, _ := req.BasicAuth()
+	err := m.banList.check(ip, reqUser)
+	if err != nil {
+		return nil, pathErrAuthCritical{
+			message: err.Error(),
+			banned:  true,
+		}
+	}
+
+	var authRes *externalAuthRes
+
 	if m.externalAuthenticationURL != "" {
-		tmp, _, _ := net.SplitHostPort(req.RemoteAddr)
-		ip := net.ParseIP(tmp)
 		user, pass, _ := req.BasicAuth()
 
-		err := externalAuth(
+		cookies := make(map[string]string)
+		for _, cookie := range req.Cookies() {
+			cookies[cookie.Name] = cookie.Value
+		}
+
+		var err error
+		authRes, err = externalAuth(
 			m.externalAuthenticationURL,
-			ip.String(),
-			user,
-			pass,
-			m.pathName,
-			"read",
-			req.URL.RawQuery)
+			m.externalAuthCache,
+			externalAuthReq{
+				IP:        ip.String(),
+				User:      user,
+				Password:  pass,
+				Path:      m.pathName,
+				Protocol:  "hls",
+				Action:    "read",
+				Query:     req.URL.RawQuery,
+				UserAgent: req.UserAgent(),
+				Headers:   externalAuthHeaders(req.Header),
+				Cookies:   cookies,
+			})
 		if err != nil {
-			return pathErrAuthCritical{
+			return nil, pathErrAuthCritical{
 				message: fmt.Sprintf("external authentication failed: %s", err),
 			}
 		}
+
+		// muxers are shared between readers, therefore paths can't be overridden
+		if authRes.Path != "" && authRes.Path != m.pathName {
+			return nil, pathErrAuthCritical{
+				message: "external authentication returned a different path, that is not supported by HLS",
+			}
+		}
 	}
 
 	if pathIPs != nil {
-		tmp, _, _ := net.SplitHostPort(req.RemoteAddr)
-		ip := net.ParseIP(tmp)
-
 		if !ipEqualOrInRange(ip, pathIPs) {
-			return pathErrAuthCritical{
+			return nil, pathErrAuthCritical{
 				message: fmt.Sprintf("IP '%s' not allowed", ip),
 			}
 		}
@@ -520,17 +614,17 @@ func (m *hlsMuxer) authenticate(req *http.Request) error {
 	if pathUser != "" {
 		user, pass, ok := req.BasicAuth()
 		if !ok {
-			return pathErrAuthNotCritical{}
+			return nil, pathErrAuthNotCritical{}
 		}
 
 		if user != string(pathUser) || pass != string(pathPass) {
-			return pathErrAuthCritical{
+			return nil, pathErrAuthCritical{
 				message: "invalid credentials",
 			}
 		}
 	}
 
-	return nil
+	return authRes, nil
 }
 
 // onRequest is called by hlsserver.Server (forwarded from ServeHTTP).
@@ -542,14 +636,19 @@ func (m *hlsMuxer) onRequest(req hlsMuxerRequest) {
 	}
 }
 
+// onDrain is called by hlsServer.
+func (m *hlsMuxer) onDrain() {
+	atomic.StoreInt32(m.draining, 1)
+}
+
 // onReaderAccepted implements reader.
 func (m *hlsMuxer) onReaderAccepted() {
 	m.log(logger.Info, "is converting into HLS")
 }
 
 // onReaderPacketRTP implements reader.
-func (m *hlsMuxer) onReaderPacketRTP(trackID int, payload []byte) {
-	m.ringBuffer.Push(hlsMuxerTrackIDPayloadPair{trackID, payload})
+func (m *hlsMuxer) onReaderPacketRTP(trackID int, payload []byte, ntp time.Time) {
+	m.ringBuffer.Push(hlsMuxerTrackIDPayloadPair{trackID, payload, ntp})
 }
 
 // onReaderPacketRTCP implements reader.
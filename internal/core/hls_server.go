@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/hls"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
@@ -40,8 +42,13 @@ type hlsServerAPIMuxersListSubReq struct {
 	res  chan struct{}
 }
 
+type hlsServerConfReloadReq struct {
+	readBufferCount int
+}
+
 type hlsServerParent interface {
 	Log(logger.Level, string, ...interface{})
+	onSessionEnd()
 }
 
 type hlsServer struct {
@@ -50,10 +57,13 @@ type hlsServer struct {
 	hlsSegmentCount           int
 	hlsSegmentDuration        conf.StringDuration
 	hlsSegmentMaxSize         conf.StringSize
+	hlsSegmentDirectory       string
 	hlsAllowOrigin            string
+	hlsVariantGroups          conf.HLSVariantGroups
 	readBufferCount           int
+	banList                   *banList
+	externalAuthCache         *externalAuthCache
 	pathManager               *pathManager
-	metrics                   *metrics
 	parent                    hlsServerParent
 
 	ctx       context.Context
@@ -61,11 +71,15 @@ type hlsServer struct {
 	wg        sync.WaitGroup
 	ln        net.Listener
 	muxers    map[string]*hlsMuxer
+	sessions  *hlsSessions
+	draining  bool
 
 	// in
+	confReload      chan hlsServerConfReloadReq
 	pathSourceReady chan *path
 	request         chan hlsMuxerRequest
 	muxerClose      chan *hlsMuxer
+	drain           chan struct{}
 	apiMuxersList   chan hlsServerAPIMuxersListReq
 }
 
@@ -77,10 +91,13 @@ func newHLSServer(
 	hlsSegmentCount int,
 	hlsSegmentDuration conf.StringDuration,
 	hlsSegmentMaxSize conf.StringSize,
+	hlsSegmentDirectory string,
 	hlsAllowOrigin string,
+	hlsVariantGroups conf.HLSVariantGroups,
 	readBufferCount int,
+	banList *banList,
+	externalAuthCache *externalAuthCache,
 	pathManager *pathManager,
-	metrics *metrics,
 	parent hlsServerParent,
 ) (*hlsServer, error) {
 	ln, err := net.Listen("tcp", address)
@@ -96,18 +113,24 @@ func newHLSServer(
 		hlsSegmentCount:           hlsSegmentCount,
 		hlsSegmentDuration:        hlsSegmentDuration,
 		hlsSegmentMaxSize:         hlsSegmentMaxSize,
+		hlsSegmentDirectory:       hlsSegmentDirectory,
 		hlsAllowOrigin:            hlsAllowOrigin,
+		hlsVariantGroups:          hlsVariantGroups,
 		readBufferCount:           readBufferCount,
+		banList:                   banList,
+		externalAuthCache:         externalAuthCache,
 		pathManager:               pathManager,
 		parent:                    parent,
-		metrics:                   metrics,
 		ctx:                       ctx,
 		ctxCancel:                 ctxCancel,
-		ln:                        ln,
+		ln:                        newBanListener(ln, banList),
 		muxers:                    make(map[string]*hlsMuxer),
+		sessions:                  newHLSSessions(),
+		confReload:                make(chan hlsServerConfReloadReq),
 		pathSourceReady:           make(chan *path),
 		request:                   make(chan hlsMuxerRequest),
 		muxerClose:                make(chan *hlsMuxer),
+		drain:                     make(chan struct{}),
 		apiMuxersList:             make(chan hlsServerAPIMuxersListReq),
 	}
 
@@ -115,10 +138,6 @@ func newHLSServer(
 
 	s.pathManager.onHLSServerSet(s)
 
-	if s.metrics != nil {
-		s.metrics.onHLSServerSet(s)
-	}
-
 	s.wg.Add(1)
 	go s.run()
 
@@ -127,7 +146,7 @@ func newHLSServer(
 
 // Log is the main logging function.
 func (s *hlsServer) log(level logger.Level, format string, args ...interface{}) {
-	s.parent.Log(level, "[HLS] "+format, append([]interface{}{}, args...)...)
+	s.parent.Log(level, format, append([]interface{}{logger.Component("HLS")}, args...)...)
 }
 
 func (s *hlsServer) close() {
@@ -148,12 +167,21 @@ func (s *hlsServer) run() {
 outer:
 	for {
 		select {
+		case req := <-s.confReload:
+			// new values are used by new muxers only
+			s.readBufferCount = req.readBufferCount
+
 		case pa := <-s.pathSourceReady:
-			if s.hlsAlwaysRemux {
+			if s.hlsAlwaysRemux && !s.draining {
 				s.findOrCreateMuxer(pa.Name())
 			}
 
 		case req := <-s.request:
+			if _, ok := s.muxers[req.dir]; !ok && s.draining {
+				req.res <- hlsMuxerResponse{status: http.StatusServiceUnavailable}
+				continue
+			}
+
 			r := s.findOrCreateMuxer(req.dir)
 			r.onRequest(req)
 
@@ -163,6 +191,14 @@ outer:
 			}
 			delete(s.muxers, c.PathName())
 
+			s.parent.onSessionEnd()
+
+		case <-s.drain:
+			s.draining = true
+			for _, m := range s.muxers {
+				m.onDrain()
+			}
+
 		case req := <-s.apiMuxersList:
 			muxers := make(map[string]*hlsMuxer)
 
@@ -184,17 +220,13 @@ outer:
 	hs.Shutdown(context.Background())
 
 	s.pathManager.onHLSServerSet(nil)
-
-	if s.metrics != nil {
-		s.metrics.onHLSServerSet(nil)
-	}
 }
 
 func (s *hlsServer) onRequest(ctx *gin.Context) {
-	s.log(logger.Info, "[conn %v] %s %s", ctx.Request.RemoteAddr, ctx.Request.Method, ctx.Request.URL.Path)
+	s.log(logger.Info, "%s %s", logger.RemoteAddr(ctx.Request.RemoteAddr), ctx.Request.Method, ctx.Request.URL.Path)
 
 	byts, _ := httputil.DumpRequest(ctx.Request, true)
-	s.log(logger.Debug, "[conn %v] [c->s] %s", ctx.Request.RemoteAddr, string(byts))
+	s.log(logger.Debug, "[c->s] %s", logger.RemoteAddr(ctx.Request.RemoteAddr), string(byts))
 
 	logw := &httpLogWriter{ResponseWriter: ctx.Writer}
 	ctx.Writer = logw
@@ -241,18 +273,18 @@ func (s *hlsServer) onRequest(ctx *gin.Context) {
 
 	dir = strings.TrimSuffix(dir, "/")
 
-	cres := make(chan hlsMuxerResponse)
-	hreq := hlsMuxerRequest{
-		dir:  dir,
-		file: fname,
-		req:  ctx.Request,
-		res:  cres,
-	}
-
-	select {
-	case s.request <- hreq:
-		res := <-cres
+	res, ok := func() (hlsMuxerResponse, bool) {
+		if variants, ok := s.hlsVariantGroups[dir]; ok {
+			return s.requestVariantGroup(dir, fname, variants, ctx.Request)
+		}
 
+		return s.requestMuxer(hlsMuxerRequest{
+			dir:  dir,
+			file: fname,
+			req:  ctx.Request,
+		})
+	}()
+	if ok {
 		for k, v := range res.header {
 			ctx.Writer.Header().Set(k, v)
 		}
@@ -260,12 +292,91 @@ func (s *hlsServer) onRequest(ctx *gin.Context) {
 
 		if res.body != nil {
 			io.Copy(ctx.Writer, res.body)
+
+			// segments stored on disk are served through files
+			if c, ok := res.body.(io.Closer); ok {
+				c.Close()
+			}
 		}
+	}
+
+	s.log(logger.Debug, "[s->c] %s", logger.RemoteAddr(ctx.Request.RemoteAddr), logw.dump())
+}
+
+func (s *hlsServer) requestMuxer(req hlsMuxerRequest) (hlsMuxerResponse, bool) {
+	req.res = make(chan hlsMuxerResponse)
+
+	select {
+	case s.request <- req:
+		return <-req.res, true
 
 	case <-s.ctx.Done():
+		return hlsMuxerResponse{}, false
 	}
+}
+
+func (s *hlsServer) requestVariantGroup(
+	group string,
+	fname string,
+	variants []string,
+	req *http.Request,
+) (hlsMuxerResponse, bool) {
+	switch fname {
+	case "":
+		return hlsMuxerResponse{
+			status: http.StatusOK,
+			header: map[string]string{
+				"Content-Type": `text/html`,
+			},
+			body: bytes.NewReader([]byte(index)),
+		}, true
+
+	case "index.m3u8":
+		// variant URIs are relative to the group directory
+		prefix := strings.Repeat("../", strings.Count(group, "/")+1)
+
+		var mvariants []hls.MuxerVariant
+
+		for _, variant := range variants {
+			res, ok := s.requestMuxer(hlsMuxerRequest{
+				dir:     variant,
+				variant: true,
+				req:     req,
+			})
+			if !ok {
+				return res, false
+			}
+
+			switch res.status {
+			case http.StatusOK:
+				mvariants = append(mvariants, hls.MuxerVariant{
+					Muxer: res.muxer,
+					URI:   prefix + variant + "/stream.m3u8",
+				})
+
+			case http.StatusNotFound:
+				// skip variants that are not available
+
+			default:
+				return res, true
+			}
+		}
+
+		if len(mvariants) == 0 {
+			return hlsMuxerResponse{status: http.StatusNotFound}, true
+		}
+
+		return hlsMuxerResponse{
+			status: http.StatusOK,
+			header: map[string]string{
+				"Content-Type": `application/x-mpegURL`,
+			},
+			body: hls.GroupPrimaryPlaylist(mvariants),
+		}, true
 
-	s.log(logger.Debug, "[conn %v] [s->c] %s", ctx.Request.RemoteAddr, logw.dump())
+	default:
+		return hlsMuxerResponse{status: http.StatusNotFound}, true
+	}
 }
 
 func (s *hlsServer) findOrCreateMuxer(pathName string) *hlsMuxer {
@@ -279,9 +390,14 @@ func (s *hlsServer) findOrCreateMuxer(pathName string) *hlsMuxer {
 			s.hlsSegmentCount,
 			s.hlsSegmentDuration,
 			s.hlsSegmentMaxSize,
+			s.hlsSegmentDirectory,
+			s.hlsVariantGroups.Contains(pathName),
 			s.readBufferCount,
 			&s.wg,
 			pathName,
+			s.banList,
+			s.externalAuthCache,
+			s.sessions,
 			s.pathManager,
 			s)
 		s.muxers[pathName] = r
@@ -297,6 +413,22 @@ func (s *hlsServer) onMuxerClose(c *hlsMuxer) {
 	}
 }
 
+// onDrain is called by core.
+func (s *hlsServer) onDrain() {
+	select {
+	case s.drain <- struct{}{}:
+	case <-s.ctx.Done():
+	}
+}
+
+// onConfReload is called by core.
+func (s *hlsServer) onConfReload(req hlsServerConfReloadReq) {
+	select {
+	case s.confReload <- req:
+	case <-s.ctx.Done():
+	}
+}
+
 // onPathSourceReady is called by core.
 func (s *hlsServer) onPathSourceReady(pa *path) {
 	select {
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+type hlsSessionKey struct {
+	pathName string
+	ip       string
+	user     string
+	pass     string
+	query    string
+}
+
+type hlsSession struct {
+	expiresAt   time.Time
+	lastRequest time.Time
+}
+
+// hlsSessions stores the sessions of HLS clients. Since HLS is stateless,
+// sessions are identified by IP, credentials and query of requests.
+// Sessions are shared between muxers, in order to survive the closing of
+// muxers that are not used anymore.
+type hlsSessions struct {
+	mutex     sync.Mutex
+	sessions  map[hlsSessionKey]*hlsSession
+	lastPrune time.Time
+}
+
+func newHLSSessions() *hlsSessions {
+	return &hlsSessions{
+		sessions:  make(map[hlsSessionKey]*hlsSession),
+		lastPrune: time.Now(),
+	}
+}
+
+// expired checks whether the session of the client that performed a request has expired.
+// A session is kept until it expires, even if the client stops performing requests,
+// in order to prevent clients from obtaining a new session by pausing.
+// Expired sessions are discarded when the client stops performing requests.
+func (s *hlsSessions) expired(
+	pathName string,
+	req *http.Request,
+	authRes *externalAuthRes,
+	pathConf *conf.PathConf,
+) bool {
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now.Sub(s.lastPrune) >= closeAfterInactivity {
+		s.lastPrune = now
+
+		for key, sess := range s.sessions {
+			if !now.Before(sess.expiresAt) && now.Sub(sess.lastRequest) >= closeAfterInactivity {
+				delete(s.sessions, key)
+			}
+		}
+	}
+
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	user, pass, _ := req.BasicAuth()
+	key := hlsSessionKey{
+		pathName: pathName,
+		ip:       ip,
+		user:     user,
+		pass:     pass,
+		query:    req.URL.RawQuery,
+	}
+
+	sess, ok := s.sessions[key]
+	if !ok || (!now.Before(sess.expiresAt) && now.Sub(sess.lastRequest) >= closeAfterInactivity) {
+		expiresAt := sessionExpiration(authRes, pathConf)
+		if expiresAt == nil {
+			delete(s.sessions, key)
+			return false
+		}
+
+		sess = &hlsSession{expiresAt: *expiresAt}
+		s.sessions[key] = sess
+	}
+
+	sess.lastRequest = now
+
+	return !now.Before(sess.expiresAt)
+}
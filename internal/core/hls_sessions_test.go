@@ -0,0 +1,42 @@
+package core
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+func TestHLSSessions(t *testing.T) {
+	s := newHLSSessions()
+
+	expired := func(query string, expiresAt time.Time) bool {
+		req := httptest.NewRequest("GET", "/mypath/stream.m3u8?"+query, nil)
+		req.RemoteAddr = "127.0.0.1:5000"
+		return s.expired("mypath", req, &externalAuthRes{ExpiresAt: &expiresAt}, &conf.PathConf{})
+	}
+
+	key := hlsSessionKey{pathName: "mypath", ip: "127.0.0.1", query: "token=a"}
+	initialExpiration := time.Now().Add(time.Hour)
+
+	require.Equal(t, false, expired("token=a", initialExpiration))
+
+	// the expiration is not renewed when the client pauses
+	s.sessions[key].lastRequest = time.Now().Add(-2 * closeAfterInactivity)
+	require.Equal(t, false, expired("token=a", time.Now().Add(2*time.Hour)))
+	require.Equal(t, initialExpiration, s.sessions[key].expiresAt)
+
+	// an expired session stays expired while the client performs requests
+	s.sessions[key].expiresAt = time.Now().Add(-1 * time.Second)
+	require.Equal(t, true, expired("token=a", time.Now().Add(time.Hour)))
+
+	// a new token obtains a new session
+	require.Equal(t, false, expired("token=b", time.Now().Add(time.Hour)))
+
+	// an expired session is discarded when the client stops performing requests
+	s.sessions[key].lastRequest = time.Now().Add(-2 * closeAfterInactivity)
+	require.Equal(t, false, expired("token=a", time.Now().Add(time.Hour)))
+}
@@ -20,11 +20,13 @@ type hlsSourceParent interface {
 	log(logger.Level, string, ...interface{})
 	onSourceStaticSetReady(req pathSourceStaticSetReadyReq) pathSourceStaticSetReadyRes
 	onSourceStaticSetNotReady(req pathSourceStaticSetNotReadyReq)
+	onSourceStaticError(err error)
 }
 
 type hlsSource struct {
 	ur          string
 	fingerprint string
+	variant     string
 	wg          *sync.WaitGroup
 	parent      hlsSourceParent
 
@@ -36,6 +38,7 @@ func newHLSSource(
 	parentCtx context.Context,
 	ur string,
 	fingerprint string,
+	variant string,
 	wg *sync.WaitGroup,
 	parent hlsSourceParent) *hlsSource {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
@@ -43,6 +46,7 @@ func newHLSSource(
 	s := &hlsSource{
 		ur:          ur,
 		fingerprint: fingerprint,
+		variant:     variant,
 		wg:          wg,
 		parent:      parent,
 		ctx:         ctx,
@@ -63,7 +67,9 @@ func (s *hlsSource) close() {
 }
 
 func (s *hlsSource) Log(level logger.Level, format string, args ...interface{}) {
-	s.parent.log(level, "[hls source] "+format, args...)
+	s.parent.log(level, format, append([]interface{}{
+		logger.Field{Key: "source", Value: "hls", Prefix: "[hls source]"},
+	}, args...)...)
 }
 
 func (s *hlsSource) run() {
@@ -145,18 +151,21 @@ func (s *hlsSource) runInner() bool {
 	c, err := hls.NewClient(
 		s.ur,
 		s.fingerprint,
+		s.variant,
 		onTracks,
 		onPacket,
 		s,
 	)
 	if err != nil {
 		s.Log(logger.Info, "ERR: %v", err)
+		s.parent.onSourceStaticError(err)
 		return true
 	}
 
 	select {
 	case err := <-c.Wait():
 		s.Log(logger.Info, "ERR: %v", err)
+		s.parent.onSourceStaticError(err)
 		return true
 
 	case <-s.ctx.Done():
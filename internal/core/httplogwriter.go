@@ -8,18 +8,20 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// httpLogWriter counts the bytes of the body instead of storing them,
+// in order to support long-lived responses.
 type httpLogWriter struct {
 	gin.ResponseWriter
-	buf bytes.Buffer
+	bodySize int
 }
 
 func (w *httpLogWriter) Write(b []byte) (int, error) {
-	w.buf.Write(b)
+	w.bodySize += len(b)
 	return w.ResponseWriter.Write(b)
 }
 
 func (w *httpLogWriter) WriteString(s string) (int, error) {
-	w.buf.WriteString(s)
+	w.bodySize += len(s)
 	return w.ResponseWriter.WriteString(s)
 }
 
@@ -28,8 +30,8 @@ func (w *httpLogWriter) dump() string {
 	fmt.Fprintf(&buf, "%s %d %s\n", "HTTP/1.1", w.ResponseWriter.Status(), http.StatusText(w.ResponseWriter.Status()))
 	w.ResponseWriter.Header().Write(&buf)
 	buf.Write([]byte("\n"))
-	if w.buf.Len() > 0 {
-		fmt.Fprintf(&buf, "(body of %d bytes)", w.buf.Len())
+	if w.bodySize > 0 {
+		fmt.Fprintf(&buf, "(body of %d bytes)", w.bodySize)
 	}
 	return buf.String()
 }
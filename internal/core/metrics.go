@@ -38,7 +38,8 @@ type metricsParent interface {
 }
 
 type metrics struct {
-	parent metricsParent
+	banList *banList
+	parent  metricsParent
 
 	ln          net.Listener
 	server      *http.Server
@@ -52,6 +53,7 @@ type metrics struct {
 
 func newMetrics(
 	address string,
+	banList *banList,
 	parent metricsParent,
 ) (*metrics, error) {
 	ln, err := net.Listen("tcp", address)
@@ -60,8 +62,9 @@ func newMetrics(
 	}
 
 	m := &metrics{
-		parent: parent,
-		ln:     ln,
+		banList: banList,
+		parent:  parent,
+		ln:      ln,
 	}
 
 	router := gin.New()
@@ -82,7 +85,7 @@ func (m *metrics) close() {
 }
 
 func (m *metrics) log(level logger.Level, format string, args ...interface{}) {
-	m.parent.Log(level, "[metrics] "+format, args...)
+	m.parent.Log(level, format, append([]interface{}{logger.Component("metrics")}, args...)...)
 }
 
 func (m *metrics) run() {
@@ -93,21 +96,36 @@ func (m *metrics) run() {
 }
 
 func (m *metrics) onMetrics(ctx *gin.Context) {
+	// do not hold the mutex while querying servers, since it would block
+	// core when it sets or unsets them.
+	m.mutex.Lock()
+	pathManager := m.pathManager
+	rtspServer := m.rtspServer
+	rtspsServer := m.rtspsServer
+	rtmpServer := m.rtmpServer
+	hlsServer := m.hlsServer
+	m.mutex.Unlock()
+
 	out := ""
 
-	res := m.pathManager.onAPIPathsList(pathAPIPathsListReq{})
-	if res.err == nil {
-		for name, p := range res.data.Items {
-			if p.SourceReady {
-				out += metric("paths{name=\""+name+"\",state=\"ready\"}", 1)
-			} else {
-				out += metric("paths{name=\""+name+"\",state=\"notReady\"}", 1)
+	if !interfaceIsEmpty(pathManager) {
+		res := pathManager.onAPIPathsList(pathAPIPathsListReq{})
+		if res.err == nil {
+			for name, p := range res.data.Items {
+				if p.SourceReady {
+					out += metric("paths{name=\""+name+"\",state=\"ready\"}", 1)
+				} else {
+					out += metric("paths{name=\""+name+"\",state=\"notReady\"}", 1)
+				}
+
+				out += metric("paths_source_inactivity_timeouts{name=\""+name+"\"}",
+					int64(p.SourceInactivityTimeouts))
 			}
 		}
 	}
 
-	if !interfaceIsEmpty(m.rtspServer) {
-		res := m.rtspServer.onAPISessionsList(rtspServerAPISessionsListReq{})
+	if !interfaceIsEmpty(rtspServer) {
+		res := rtspServer.onAPISessionsList(rtspServerAPISessionsListReq{})
 		if res.err == nil {
 			idleCount := int64(0)
 			readCount := int64(0)
@@ -133,8 +151,8 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 		}
 	}
 
-	if !interfaceIsEmpty(m.rtspsServer) {
-		res := m.rtspsServer.onAPISessionsList(rtspServerAPISessionsListReq{})
+	if !interfaceIsEmpty(rtspsServer) {
+		res := rtspsServer.onAPISessionsList(rtspServerAPISessionsListReq{})
 		if res.err == nil {
 			idleCount := int64(0)
 			readCount := int64(0)
@@ -160,8 +178,8 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 		}
 	}
 
-	if !interfaceIsEmpty(m.rtmpServer) {
-		res := m.rtmpServer.onAPIConnsList(rtmpServerAPIConnsListReq{})
+	if !interfaceIsEmpty(rtmpServer) {
+		res := rtmpServer.onAPIConnsList(rtmpServerAPIConnsListReq{})
 		if res.err == nil {
 			idleCount := int64(0)
 			readCount := int64(0)
@@ -187,8 +205,8 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 		}
 	}
 
-	if !interfaceIsEmpty(m.hlsServer) {
-		res := m.hlsServer.onAPIHLSMuxersList(hlsServerAPIMuxersListReq{})
+	if !interfaceIsEmpty(hlsServer) {
+		res := hlsServer.onAPIHLSMuxersList(hlsServerAPIMuxersListReq{})
 		if res.err == nil {
 			for name := range res.data.Items {
 				out += metric("hls_muxers{name=\""+name+"\"}", 1)
@@ -196,39 +214,44 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 		}
 	}
 
+	authFailures, ipBans, userBans := m.banList.stats()
+	out += metric("auth_failures", int64(authFailures))
+	out += metric("bans{type=\"ip\"}", ipBans)
+	out += metric("bans{type=\"user\"}", userBans)
+
 	ctx.Writer.WriteHeader(http.StatusOK)
 	io.WriteString(ctx.Writer, out)
 }
 
-// onPathManagerSet is called by pathManager.
+// onPathManagerSet is called by core.
 func (m *metrics) onPathManagerSet(s metricsPathManager) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.pathManager = s
 }
 
-// onRTSPServer is called by rtspServer (plain).
+// onRTSPServerSet is called by core.
 func (m *metrics) onRTSPServerSet(s metricsRTSPServer) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.rtspServer = s
 }
 
-// onRTSPServer is called by rtspServer (plain).
+// onRTSPSServerSet is called by core.
 func (m *metrics) onRTSPSServerSet(s metricsRTSPServer) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.rtspsServer = s
 }
 
-// onRTMPServerSet is called by rtmpServer.
+// onRTMPServerSet is called by core.
 func (m *metrics) onRTMPServerSet(s metricsRTMPServer) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.rtmpServer = s
 }
 
-// onHLSServerSet is called by hlsServer.
+// onHLSServerSet is called by core.
 func (m *metrics) onHLSServerSet(s metricsHLSServer) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -77,17 +77,22 @@ func TestMetrics(t *testing.T) {
 	}
 
 	require.Equal(t, map[string]string{
-		"hls_muxers{name=\"rtsp_path\"}":            "1",
-		"paths{name=\"rtsp_path\",state=\"ready\"}": "1",
-		"paths{name=\"rtmp_path\",state=\"ready\"}": "1",
-		"rtmp_conns{state=\"idle\"}":                "0",
-		"rtmp_conns{state=\"publish\"}":             "1",
-		"rtmp_conns{state=\"read\"}":                "0",
-		"rtsp_sessions{state=\"idle\"}":             "0",
-		"rtsp_sessions{state=\"publish\"}":          "1",
-		"rtsp_sessions{state=\"read\"}":             "0",
-		"rtsps_sessions{state=\"idle\"}":            "0",
-		"rtsps_sessions{state=\"publish\"}":         "0",
-		"rtsps_sessions{state=\"read\"}":            "0",
+		"auth_failures":                                        "0",
+		"bans{type=\"ip\"}":                                    "0",
+		"bans{type=\"user\"}":                                  "0",
+		"hls_muxers{name=\"rtsp_path\"}":                       "1",
+		"paths{name=\"rtsp_path\",state=\"ready\"}":            "1",
+		"paths{name=\"rtmp_path\",state=\"ready\"}":            "1",
+		"paths_source_inactivity_timeouts{name=\"rtsp_path\"}": "0",
+		"paths_source_inactivity_timeouts{name=\"rtmp_path\"}": "0",
+		"rtmp_conns{state=\"idle\"}":                           "0",
+		"rtmp_conns{state=\"publish\"}":                        "1",
+		"rtmp_conns{state=\"read\"}":                           "0",
+		"rtsp_sessions{state=\"idle\"}":                        "0",
+		"rtsp_sessions{state=\"publish\"}":                     "1",
+		"rtsp_sessions{state=\"read\"}":                        "0",
+		"rtsps_sessions{state=\"idle\"}":                       "0",
+		"rtsps_sessions{state=\"publish\"}":                    "0",
+		"rtsps_sessions{state=\"read\"}":                       "0",
 	}, vals)
 }
@@ -38,6 +38,13 @@ func (e pathErrNoOnePublishing) Error() string {
 	return fmt.Sprintf("no one is publishing to path '%s'", e.pathName)
 }
 
+type pathErrDraining struct{}
+
+// Error implements the error interface.
+func (pathErrDraining) Error() string {
+	return "server is draining"
+}
+
 type pathErrAuthNotCritical struct {
 	message  string
 	response *base.Response
@@ -51,6 +58,9 @@ func (pathErrAuthNotCritical) Error() string {
 type pathErrAuthCritical struct {
 	message  string
 	response *base.Response
+
+	// the client is banned; this is not counted as an authentication failure.
+	banned bool
 }
 
 // Error implements the error interface.
@@ -58,6 +68,17 @@ func (pathErrAuthCritical) Error() string {
 	return "critical authentication error"
 }
 
+// pathErrAuthOverride is returned when the external authentication server
+// assigns another path to the client.
+type pathErrAuthOverride struct {
+	pathName string
+}
+
+// Error implements the error interface.
+func (e pathErrAuthOverride) Error() string {
+	return fmt.Sprintf("path overridden by external authentication with '%s'", e.pathName)
+}
+
 type pathParent interface {
 	log(logger.Level, string, ...interface{})
 	onPathSourceReady(*path)
@@ -185,11 +206,12 @@ type pathPublisherPauseReq struct {
 }
 
 type pathAPIPathsListItem struct {
-	ConfName    string         `json:"confName"`
-	Conf        *conf.PathConf `json:"conf"`
-	Source      interface{}    `json:"source"`
-	SourceReady bool           `json:"sourceReady"`
-	Readers     []interface{}  `json:"readers"`
+	ConfName                 string         `json:"confName"`
+	Conf                     *conf.PathConf `json:"conf"`
+	Source                   interface{}    `json:"source"`
+	SourceReady              bool           `json:"sourceReady"`
+	Readers                  []interface{}  `json:"readers"`
+	SourceInactivityTimeouts uint64         `json:"sourceInactivityTimeouts"`
 }
 
 type pathAPIPathsListData struct {
@@ -211,6 +233,64 @@ type pathAPIPathsListSubReq struct {
 	res  chan struct{}
 }
 
+type pathAPIPathsStreamTrackH264 struct {
+	Profile string  `json:"profile"`
+	Level   string  `json:"level"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	FPS     float64 `json:"fps"`
+}
+
+type pathAPIPathsStreamTrackAAC struct {
+	Type         int    `json:"type"`
+	SampleRate   int    `json:"sampleRate"`
+	ChannelCount int    `json:"channelCount"`
+	Config       string `json:"config"`
+}
+
+type pathAPIPathsStreamTrack struct {
+	Codec         string                       `json:"codec"`
+	ClockRate     int                          `json:"clockRate"`
+	H264          *pathAPIPathsStreamTrackH264 `json:"h264"`
+	AAC           *pathAPIPathsStreamTrackAAC  `json:"aac"`
+	BytesReceived uint64                       `json:"bytesReceived"`
+	Bitrate       uint64                       `json:"bitrate"`
+	LastFrameTime *time.Time                   `json:"lastFrameTime"`
+}
+
+type pathAPIPathsStreamData struct {
+	Tracks        []pathAPIPathsStreamTrack `json:"tracks"`
+	SDP           string                    `json:"sdp"`
+	Bitrate       uint64                    `json:"bitrate"`
+	LastFrameTime *time.Time                `json:"lastFrameTime"`
+}
+
+type pathAPIPathsStreamRes struct {
+	data *pathAPIPathsStreamData
+	path *path
+	err  error
+}
+
+type pathAPIPathsStreamReq struct {
+	name string
+	res  chan pathAPIPathsStreamRes
+}
+
+type pathAPIPathsSnapshotRes struct {
+	keyframe *streamKeyframe
+	path     *path
+	err      error
+}
+
+type pathAPIPathsSnapshotReq struct {
+	name string
+	res  chan pathAPIPathsSnapshotRes
+}
+
+// minimum interval between runOnSourceError commands,
+// since static sources retry continuously.
+const pathOnSourceErrorCmdInterval = 10 * time.Second
+
 type path struct {
 	rtspAddress     string
 	readTimeout     conf.StringDuration
@@ -225,20 +305,26 @@ type path struct {
 	externalCmdPool *externalcmd.Pool
 	parent          pathParent
 
-	ctx                context.Context
-	ctxCancel          func()
-	source             source
-	sourceReady        bool
-	sourceStaticWg     sync.WaitGroup
-	readers            map[reader]pathReaderState
-	describeRequests   []pathDescribeReq
-	setupPlayRequests  []pathReaderSetupPlayReq
-	stream             *stream
-	onDemandCmd        *externalcmd.Cmd
-	onReadyCmd         *externalcmd.Cmd
-	onDemandReadyTimer *time.Timer
-	onDemandCloseTimer *time.Timer
-	onDemandState      pathOnDemandState
+	ctx                 context.Context
+	ctxCancel           func()
+	source              source
+	sourceReady         bool
+	sourceStaticWg      sync.WaitGroup
+	readers             map[reader]pathReaderState
+	describeRequests    []pathDescribeReq
+	setupPlayRequests   []pathReaderSetupPlayReq
+	stream              *stream
+	onDemandCmd         *externalcmd.Cmd
+	onReadyCmd          *externalcmd.Cmd
+	onDemandReadyTimer  *time.Timer
+	onDemandCloseTimer  *time.Timer
+	onDemandState       pathOnDemandState
+	inactivityTimer     *time.Timer
+	inactivityCount     uint64
+	onSourceInactiveCmd *externalcmd.Cmd
+	onSourceErrorMutex  sync.Mutex
+	onSourceErrorCmd    *externalcmd.Cmd
+	onSourceErrorTime   time.Time
 
 	// in
 	sourceStaticSetReady    chan pathSourceStaticSetReadyReq
@@ -253,6 +339,8 @@ type path struct {
 	readerPlay              chan pathReaderPlayReq
 	readerPause             chan pathReaderPauseReq
 	apiPathsList            chan pathAPIPathsListSubReq
+	apiPathsStream          chan pathAPIPathsStreamReq
+	apiPathsSnapshot        chan pathAPIPathsSnapshotReq
 }
 
 func newPath(
@@ -289,6 +377,7 @@ func newPath(
 		readers:                 make(map[reader]pathReaderState),
 		onDemandReadyTimer:      newEmptyTimer(),
 		onDemandCloseTimer:      newEmptyTimer(),
+		inactivityTimer:         newEmptyTimer(),
 		sourceStaticSetReady:    make(chan pathSourceStaticSetReadyReq),
 		sourceStaticSetNotReady: make(chan pathSourceStaticSetNotReadyReq),
 		describe:                make(chan pathDescribeReq),
@@ -301,6 +390,8 @@ func newPath(
 		readerPlay:              make(chan pathReaderPlayReq),
 		readerPause:             make(chan pathReaderPauseReq),
 		apiPathsList:            make(chan pathAPIPathsListSubReq),
+		apiPathsStream:          make(chan pathAPIPathsStreamReq),
+		apiPathsSnapshot:        make(chan pathAPIPathsSnapshotReq),
 	}
 
 	pa.log(logger.Debug, "opened")
@@ -317,7 +408,19 @@ func (pa *path) close() {
 
 // Log is the main logging function.
 func (pa *path) log(level logger.Level, format string, args ...interface{}) {
-	pa.parent.log(level, "[path "+pa.name+"] "+format, args...)
+	f := logger.Path(pa.name)
+	f.Level = logger.Level(pa.conf.LogLevel)
+
+	pa.parent.log(level, format, append([]interface{}{
+		logger.Field{Key: "component", Value: "path"},
+		f,
+	}, args...)...)
+}
+
+// logField returns a field that attaches the path name and the path log level
+// to log entries of other components, without changing their text.
+func (pa *path) logField() logger.Field {
+	return logger.Field{Key: "path", Value: pa.name, Level: logger.Level(pa.conf.LogLevel)}
 }
 
 // ConfName returns the configuration name of this path.
@@ -384,6 +487,13 @@ func (pa *path) run() {
 					return fmt.Errorf("not in use")
 				}
 
+			case <-pa.inactivityTimer.C:
+				pa.onInactivityTimer()
+
+				if pa.shouldClose() {
+					return fmt.Errorf("not in use")
+				}
+
 			case req := <-pa.sourceStaticSetReady:
 				if req.source == pa.source {
 					pa.sourceSetReady(req.tracks)
@@ -452,6 +562,12 @@ func (pa *path) run() {
 			case req := <-pa.apiPathsList:
 				pa.handleAPIPathsList(req)
 
+			case req := <-pa.apiPathsStream:
+				pa.handleAPIPathsStream(req)
+
+			case req := <-pa.apiPathsSnapshot:
+				pa.handleAPIPathsSnapshot(req)
+
 			case <-pa.ctx.Done():
 				return fmt.Errorf("terminated")
 			}
@@ -462,6 +578,7 @@ func (pa *path) run() {
 
 	pa.onDemandReadyTimer.Stop()
 	pa.onDemandCloseTimer.Stop()
+	pa.inactivityTimer.Stop()
 
 	if onInitCmd != nil {
 		onInitCmd.Close()
@@ -492,6 +609,19 @@ func (pa *path) run() {
 		pa.log(logger.Info, "runOnDemand command stopped")
 	}
 
+	if pa.onSourceInactiveCmd != nil {
+		pa.onSourceInactiveCmd.Close()
+		pa.log(logger.Info, "runOnSourceInactive command stopped")
+	}
+
+	pa.onSourceErrorMutex.Lock()
+	if pa.onSourceErrorCmd != nil {
+		pa.onSourceErrorCmd.Close()
+		pa.onSourceErrorCmd = nil
+		pa.log(logger.Info, "runOnSourceError command stopped")
+	}
+	pa.onSourceErrorMutex.Unlock()
+
 	pa.log(logger.Debug, "closed (%v)", err)
 
 	pa.parent.onPathClose(pa)
@@ -513,6 +643,17 @@ func (pa *path) hasStaticSource() bool {
 		strings.HasPrefix(pa.conf.Source, "https://")
 }
 
+func (pa *path) hasExternalCmds() bool {
+	return pa.conf.RunOnInit != "" ||
+		pa.conf.RunOnDemand != "" ||
+		pa.conf.RunOnReady != "" ||
+		pa.conf.RunOnNotReady != "" ||
+		pa.conf.RunOnRead != "" ||
+		pa.conf.RunOnUnread != "" ||
+		pa.conf.RunOnSourceError != "" ||
+		pa.conf.RunOnSourceInactive != ""
+}
+
 func (pa *path) isOnDemand() bool {
 	return (pa.hasStaticSource() && pa.conf.SourceOnDemand) || pa.conf.RunOnDemand != ""
 }
@@ -533,6 +674,23 @@ func (pa *path) externalCmdEnv() externalcmd.Environment {
 	return env
 }
 
+// externalCmdEnvWith returns the environment of the path, extended with additional variables.
+func (pa *path) externalCmdEnvWith(vars externalcmd.Environment) externalcmd.Environment {
+	env := pa.externalCmdEnv()
+	for key, val := range vars {
+		env[key] = val
+	}
+	return env
+}
+
+// sourceExternalCmdEnv returns the environment of commands related to the source.
+func (pa *path) sourceExternalCmdEnv() externalcmd.Environment {
+	if pub, ok := pa.source.(publisher); ok {
+		return pa.externalCmdEnvWith(pub.externalCmdEnv())
+	}
+	return pa.externalCmdEnv()
+}
+
 func (pa *path) onDemandStartSource() {
 	pa.onDemandReadyTimer.Stop()
 	if pa.hasStaticSource() {
@@ -594,9 +752,65 @@ func (pa *path) onDemandCloseSource() {
 	}
 }
 
+func (pa *path) onInactivityTimer() {
+	// the timeout is applied only while the source is ready, i.e. while a publisher
+	// is recording; publishers that are paused are not ready.
+	if !pa.sourceReady {
+		return
+	}
+
+	timeout := time.Duration(pa.conf.SourceInactivityTimeout)
+
+	elapsed := time.Since(pa.stream.lastPacketTime())
+	if elapsed < timeout {
+		pa.inactivityTimer = time.NewTimer(timeout - elapsed)
+		return
+	}
+
+	pa.log(logger.Warn, "source has not sent any packet in %v", timeout)
+	pa.inactivityCount++
+
+	// compute the environment before the source is removed
+	env := pa.sourceExternalCmdEnv()
+
+	if pa.hasStaticSource() {
+		if pa.isOnDemand() && pa.onDemandState != pathOnDemandStateInitial {
+			pa.onDemandCloseSource()
+		} else {
+			pa.log(logger.Info, "restarting source")
+			pa.sourceSetNotReady()
+			pa.source.(sourceStatic).close()
+			pa.staticSourceCreate()
+		}
+	} else {
+		pa.source.(publisher).close()
+		pa.doPublisherRemove()
+	}
+
+	if pa.conf.RunOnSourceInactive != "" {
+		if pa.onSourceInactiveCmd != nil {
+			pa.onSourceInactiveCmd.Close()
+		}
+
+		pa.log(logger.Info, "runOnSourceInactive command started")
+		pa.onSourceInactiveCmd = externalcmd.NewCmd(
+			pa.externalCmdPool,
+			pa.conf.RunOnSourceInactive,
+			false,
+			env,
+			func(co int) {
+				pa.log(logger.Info, "runOnSourceInactive command exited with code %d", co)
+			})
+	}
+}
+
 func (pa *path) sourceSetReady(tracks gortsplib.Tracks) {
 	pa.sourceReady = true
-	pa.stream = newStream(tracks)
+	pa.stream = newStream(tracks, pa.conf.GOPCache, pa.conf.KeyframeCache, pa.readBufferCount)
+
+	if pa.conf.SourceInactivityTimeout != 0 {
+		pa.inactivityTimer = time.NewTimer(time.Duration(pa.conf.SourceInactivityTimeout))
+	}
 
 	if pa.isOnDemand() {
 		pa.onDemandReadyTimer.Stop()
@@ -629,7 +843,7 @@ func (pa *path) sourceSetReady(tracks gortsplib.Tracks) {
 			pa.externalCmdPool,
 			pa.conf.RunOnReady,
 			pa.conf.RunOnReadyRestart,
-			pa.externalCmdEnv(),
+			pa.sourceExternalCmdEnv(),
 			func(co int) {
 				pa.log(logger.Info, "runOnReady command exited with code %d", co)
 			})
@@ -648,8 +862,23 @@ func (pa *path) sourceSetNotReady() {
 		pa.log(logger.Info, "runOnReady command stopped")
 	}
 
+	if pa.conf.RunOnNotReady != "" {
+		pa.log(logger.Info, "runOnNotReady command started")
+		externalcmd.NewCmd(
+			pa.externalCmdPool,
+			pa.conf.RunOnNotReady,
+			false,
+			pa.sourceExternalCmdEnv(),
+			func(co int) {
+				pa.log(logger.Info, "runOnNotReady command exited with code %d", co)
+			})
+	}
+
 	pa.sourceReady = false
 
+	pa.inactivityTimer.Stop()
+	pa.inactivityTimer = newEmptyTimer()
+
 	if pa.stream != nil {
 		pa.stream.close()
 		pa.stream = nil
@@ -657,12 +886,14 @@ func (pa *path) sourceSetNotReady() {
 }
 
 func (pa *path) staticSourceCreate() {
+	source := conf.ExpandGroups(pa.conf.Source, pa.matches)
+
 	switch {
 	case strings.HasPrefix(pa.conf.Source, "rtsp://") ||
 		strings.HasPrefix(pa.conf.Source, "rtsps://"):
 		pa.source = newRTSPSource(
 			pa.ctx,
-			pa.conf.Source,
+			source,
 			pa.conf.SourceProtocol,
 			pa.conf.SourceAnyPortEnable,
 			pa.conf.SourceFingerprint,
@@ -675,7 +906,7 @@ func (pa *path) staticSourceCreate() {
 	case strings.HasPrefix(pa.conf.Source, "rtmp://"):
 		pa.source = newRTMPSource(
 			pa.ctx,
-			pa.conf.Source,
+			source,
 			pa.readTimeout,
 			pa.writeTimeout,
 			&pa.sourceStaticWg,
@@ -684,8 +915,9 @@ func (pa *path) staticSourceCreate() {
 		strings.HasPrefix(pa.conf.Source, "https://"):
 		pa.source = newHLSSource(
 			pa.ctx,
-			pa.conf.Source,
+			source,
 			pa.conf.SourceFingerprint,
+			pa.conf.SourceVariant,
 			&pa.sourceStaticWg,
 			pa)
 	}
@@ -716,7 +948,7 @@ func (pa *path) doPublisherRemove() {
 func (pa *path) handleDescribe(req pathDescribeReq) {
 	if _, ok := pa.source.(*sourceRedirect); ok {
 		req.res <- pathDescribeRes{
-			redirect: pa.conf.SourceRedirect,
+			redirect: conf.ExpandGroups(pa.conf.SourceRedirect, pa.matches),
 		}
 		return
 	}
@@ -737,17 +969,18 @@ func (pa *path) handleDescribe(req pathDescribeReq) {
 	}
 
 	if pa.conf.Fallback != "" {
+		fallback := conf.ExpandGroups(pa.conf.Fallback, pa.matches)
 		fallbackURL := func() string {
-			if strings.HasPrefix(pa.conf.Fallback, "/") {
+			if strings.HasPrefix(fallback, "/") {
 				ur := base.URL{
 					Scheme: req.url.Scheme,
 					User:   req.url.User,
 					Host:   req.url.Host,
-					Path:   pa.conf.Fallback,
+					Path:   fallback,
 				}
 				return ur.String()
 			}
-			return pa.conf.Fallback
+			return fallback
 		}()
 		req.res <- pathDescribeRes{redirect: fallbackURL}
 		return
@@ -890,10 +1123,30 @@ func (pa *path) handleAPIPathsList(req pathAPIPathsListSubReq) {
 			}
 			return ret
 		}(),
+		SourceInactivityTimeouts: pa.inactivityCount,
 	}
 	close(req.res)
 }
 
+func (pa *path) handleAPIPathsStream(req pathAPIPathsStreamReq) {
+	if !pa.sourceReady {
+		req.res <- pathAPIPathsStreamRes{err: pathErrNoOnePublishing{pathName: pa.name}}
+		return
+	}
+
+	req.res <- pathAPIPathsStreamRes{data: pa.stream.apiDescribe()}
+}
+
+func (pa *path) handleAPIPathsSnapshot(req pathAPIPathsSnapshotReq) {
+	if !pa.sourceReady {
+		req.res <- pathAPIPathsSnapshotRes{err: pathErrNoOnePublishing{pathName: pa.name}}
+		return
+	}
+
+	keyframe, err := pa.stream.keyframe()
+	req.res <- pathAPIPathsSnapshotRes{keyframe: keyframe, err: err}
+}
+
 // onSourceStaticSetReady is called by a sourceStatic.
 func (pa *path) onSourceStaticSetReady(req pathSourceStaticSetReadyReq) pathSourceStaticSetReadyRes {
 	req.res = make(chan pathSourceStaticSetReadyRes)
@@ -915,6 +1168,43 @@ func (pa *path) onSourceStaticSetNotReady(req pathSourceStaticSetNotReadyReq) {
 	}
 }
 
+// onSourceStaticError is called by a sourceStatic.
+func (pa *path) onSourceStaticError(err error) {
+	if pa.conf.RunOnSourceError == "" {
+		return
+	}
+
+	pa.onSourceErrorMutex.Lock()
+	defer pa.onSourceErrorMutex.Unlock()
+
+	// run a single command at once, and not more often than pathOnSourceErrorCmdInterval
+	if pa.onSourceErrorCmd != nil || time.Since(pa.onSourceErrorTime) < pathOnSourceErrorCmdInterval {
+		return
+	}
+
+	pa.log(logger.Info, "runOnSourceError command started")
+	pa.onSourceErrorTime = time.Now()
+
+	var cmd *externalcmd.Cmd
+	cmd = externalcmd.NewCmd(
+		pa.externalCmdPool,
+		pa.conf.RunOnSourceError,
+		false,
+		pa.externalCmdEnvWith(externalcmd.Environment{
+			"RTSP_SOURCE_ERROR": err.Error(),
+		}),
+		func(co int) {
+			pa.log(logger.Info, "runOnSourceError command exited with code %d", co)
+
+			pa.onSourceErrorMutex.Lock()
+			if pa.onSourceErrorCmd == cmd {
+				pa.onSourceErrorCmd = nil
+			}
+			pa.onSourceErrorMutex.Unlock()
+		})
+	pa.onSourceErrorCmd = cmd
+}
+
 // onDescribe is called by a reader or publisher through pathManager.
 func (pa *path) onDescribe(req pathDescribeReq) pathDescribeRes {
 	select {
@@ -1016,3 +1306,27 @@ func (pa *path) onAPIPathsList(req pathAPIPathsListSubReq) {
 	case <-pa.ctx.Done():
 	}
 }
+
+// onAPIPathsSnapshot is called by api.
+func (pa *path) onAPIPathsSnapshot(req pathAPIPathsSnapshotReq) pathAPIPathsSnapshotRes {
+	req.res = make(chan pathAPIPathsSnapshotRes)
+	select {
+	case pa.apiPathsSnapshot <- req:
+		return <-req.res
+
+	case <-pa.ctx.Done():
+		return pathAPIPathsSnapshotRes{err: fmt.Errorf("terminated")}
+	}
+}
+
+// onAPIPathsStream is called by api.
+func (pa *path) onAPIPathsStream(req pathAPIPathsStreamReq) pathAPIPathsStreamRes {
+	req.res = make(chan pathAPIPathsStreamRes)
+	select {
+	case pa.apiPathsStream <- req:
+		return <-req.res
+
+	case <-pa.ctx.Done():
+		return pathAPIPathsStreamRes{err: fmt.Errorf("terminated")}
+	}
+}
@@ -10,6 +10,25 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+type pathManagerConfReloadRes struct {
+	closedPaths []string
+}
+
+type pathManagerConfReloadReq struct {
+	pathConfs       map[string]*conf.PathConf
+	rtspAddress     string
+	readTimeout     conf.StringDuration
+	writeTimeout    conf.StringDuration
+	readBufferCount int
+	readBufferSize  int
+	res             chan pathManagerConfReloadRes
+}
+
+// pathCredential fills a credential with the groups of the regular expression of a path.
+func pathCredential(c conf.Credential, matches []string) conf.Credential {
+	return conf.Credential(conf.ExpandGroups(string(c), matches))
+}
+
 type pathManagerHLSServer interface {
 	onPathSourceReady(pa *path)
 }
@@ -26,7 +45,6 @@ type pathManager struct {
 	readBufferSize  int
 	pathConfs       map[string]*conf.PathConf
 	externalCmdPool *externalcmd.Pool
-	metrics         *metrics
 	parent          pathManagerParent
 
 	ctx       context.Context
@@ -34,9 +52,10 @@ type pathManager struct {
 	wg        sync.WaitGroup
 	hlsServer pathManagerHLSServer
 	paths     map[string]*path
+	draining  bool
 
 	// in
-	confReload        chan map[string]*conf.PathConf
+	confReload        chan pathManagerConfReloadReq
 	pathClose         chan *path
 	pathSourceReady   chan *path
 	describe          chan pathDescribeReq
@@ -44,6 +63,9 @@ type pathManager struct {
 	publisherAnnounce chan pathPublisherAnnounceReq
 	hlsServerSet      chan pathManagerHLSServer
 	apiPathsList      chan pathAPIPathsListReq
+	apiPathsStream    chan pathAPIPathsStreamReq
+	apiPathsSnapshot  chan pathAPIPathsSnapshotReq
+	drain             chan struct{}
 }
 
 func newPathManager(
@@ -55,24 +77,28 @@ func newPathManager(
 	readBufferSize int,
 	pathConfs map[string]*conf.PathConf,
 	externalCmdPool *externalcmd.Pool,
-	metrics *metrics,
 	parent pathManagerParent) *pathManager {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
+	// copy the map, since it's edited when the configuration is reloaded
+	pathConfsCopy := make(map[string]*conf.PathConf, len(pathConfs))
+	for name, pathConf := range pathConfs {
+		pathConfsCopy[name] = pathConf
+	}
+
 	pm := &pathManager{
 		rtspAddress:       rtspAddress,
 		readTimeout:       readTimeout,
 		writeTimeout:      writeTimeout,
 		readBufferCount:   readBufferCount,
 		readBufferSize:    readBufferSize,
-		pathConfs:         pathConfs,
+		pathConfs:         pathConfsCopy,
 		externalCmdPool:   externalCmdPool,
-		metrics:           metrics,
 		parent:            parent,
 		ctx:               ctx,
 		ctxCancel:         ctxCancel,
 		paths:             make(map[string]*path),
-		confReload:        make(chan map[string]*conf.PathConf),
+		confReload:        make(chan pathManagerConfReloadReq),
 		pathClose:         make(chan *path),
 		pathSourceReady:   make(chan *path),
 		describe:          make(chan pathDescribeReq),
@@ -80,18 +106,17 @@ func newPathManager(
 		publisherAnnounce: make(chan pathPublisherAnnounceReq),
 		hlsServerSet:      make(chan pathManagerHLSServer),
 		apiPathsList:      make(chan pathAPIPathsListReq),
+		apiPathsStream:    make(chan pathAPIPathsStreamReq),
+		apiPathsSnapshot:  make(chan pathAPIPathsSnapshotReq),
+		drain:             make(chan struct{}),
 	}
 
 	for pathConfName, pathConf := range pm.pathConfs {
-		if pathConf.Regexp == nil {
+		if pathConf.Regexp == nil && pathConf.Alias == "" {
 			pm.createPath(pathConfName, pathConf, pathConfName, nil)
 		}
 	}
 
-	if pm.metrics != nil {
-		pm.metrics.onPathManagerSet(pm)
-	}
-
 	pm.log(logger.Debug, "path manager opened")
 
 	pm.wg.Add(1)
@@ -117,7 +142,24 @@ func (pm *pathManager) run() {
 outer:
 	for {
 		select {
-		case pathConfs := <-pm.confReload:
+		case req := <-pm.confReload:
+			pathConfs := req.pathConfs
+
+			// parameters of static sources
+			sourceParamsChanged := req.readTimeout != pm.readTimeout ||
+				req.writeTimeout != pm.writeTimeout ||
+				req.readBufferCount != pm.readBufferCount ||
+				req.readBufferSize != pm.readBufferSize
+
+			// parameters of external commands
+			cmdParamsChanged := req.rtspAddress != pm.rtspAddress
+
+			pm.rtspAddress = req.rtspAddress
+			pm.readTimeout = req.readTimeout
+			pm.writeTimeout = req.writeTimeout
+			pm.readBufferCount = req.readBufferCount
+			pm.readBufferSize = req.readBufferSize
+
 			// remove confs
 			for pathConfName := range pm.pathConfs {
 				if _, ok := pathConfs[pathConfName]; !ok {
@@ -140,21 +182,27 @@ outer:
 			}
 
 			// remove paths associated with a conf which doesn't exist anymore
-			// or has changed
+			// or has changed, or affected by changed parameters
+			var closedPaths []string
 			for _, pa := range pm.paths {
-				if pathConf, ok := pm.pathConfs[pa.ConfName()]; !ok || pathConf != pa.Conf() {
+				if pathConf, ok := pm.pathConfs[pa.ConfName()]; !ok || pathConf != pa.Conf() ||
+					(sourceParamsChanged && pa.hasStaticSource()) ||
+					(cmdParamsChanged && pa.hasExternalCmds()) {
 					delete(pm.paths, pa.Name())
 					pa.close()
+					closedPaths = append(closedPaths, pa.Name())
 				}
 			}
 
 			// add new paths
 			for pathConfName, pathConf := range pm.pathConfs {
-				if _, ok := pm.paths[pathConfName]; !ok && pathConf.Regexp == nil {
+				if _, ok := pm.paths[pathConfName]; !ok && pathConf.Regexp == nil && pathConf.Alias == "" {
 					pm.createPath(pathConfName, pathConf, pathConfName, nil)
 				}
 			}
 
+			req.res <- pathManagerConfReloadRes{closedPaths: closedPaths}
+
 		case pa := <-pm.pathClose:
 			if pmpa, ok := pm.paths[pa.Name()]; !ok || pmpa != pa {
 				continue
@@ -168,30 +216,42 @@ outer:
 			}
 
 		case req := <-pm.describe:
-			pathConfName, pathConf, pathMatches, err := pm.findPathConf(req.pathName)
-			if err != nil {
-				req.res <- pathDescribeRes{err: err}
+			if pm.draining {
+				req.res <- pathDescribeRes{err: pathErrDraining{}}
 				continue
 			}
 
-			err = req.authenticate(
-				pathConf.ReadIPs,
-				pathConf.ReadUser,
-				pathConf.ReadPass)
+			pathName, pathConfName, pathConf, pathMatches, err := pm.findPathConf(req.pathName)
 			if err != nil {
 				req.res <- pathDescribeRes{err: err}
 				continue
 			}
 
+			if req.authenticate != nil {
+				err = req.authenticate(
+					pathConf.ReadIPs,
+					pathCredential(pathConf.ReadUser, pathMatches),
+					pathCredential(pathConf.ReadPass, pathMatches))
+				if err != nil {
+					req.res <- pathDescribeRes{err: err}
+					continue
+				}
+			}
+
 			// create path if it doesn't exist
-			if _, ok := pm.paths[req.pathName]; !ok {
-				pm.createPath(pathConfName, pathConf, req.pathName, pathMatches)
+			if _, ok := pm.paths[pathName]; !ok {
+				pm.createPath(pathConfName, pathConf, pathName, pathMatches)
 			}
 
-			req.res <- pathDescribeRes{path: pm.paths[req.pathName]}
+			req.res <- pathDescribeRes{path: pm.paths[pathName]}
 
 		case req := <-pm.readerSetupPlay:
-			pathConfName, pathConf, pathMatches, err := pm.findPathConf(req.pathName)
+			if pm.draining {
+				req.res <- pathReaderSetupPlayRes{err: pathErrDraining{}}
+				continue
+			}
+
+			pathName, pathConfName, pathConf, pathMatches, err := pm.findPathConf(req.pathName)
 			if err != nil {
 				req.res <- pathReaderSetupPlayRes{err: err}
 				continue
@@ -200,8 +260,8 @@ outer:
 			if req.authenticate != nil {
 				err = req.authenticate(
 					pathConf.ReadIPs,
-					pathConf.ReadUser,
-					pathConf.ReadPass)
+					pathCredential(pathConf.ReadUser, pathMatches),
+					pathCredential(pathConf.ReadPass, pathMatches))
 				if err != nil {
 					req.res <- pathReaderSetupPlayRes{err: err}
 					continue
@@ -209,34 +269,44 @@ outer:
 			}
 
 			// create path if it doesn't exist
-			if _, ok := pm.paths[req.pathName]; !ok {
-				pm.createPath(pathConfName, pathConf, req.pathName, pathMatches)
+			if _, ok := pm.paths[pathName]; !ok {
+				pm.createPath(pathConfName, pathConf, pathName, pathMatches)
 			}
 
-			req.res <- pathReaderSetupPlayRes{path: pm.paths[req.pathName]}
+			req.res <- pathReaderSetupPlayRes{path: pm.paths[pathName]}
 
 		case req := <-pm.publisherAnnounce:
-			pathConfName, pathConf, pathMatches, err := pm.findPathConf(req.pathName)
-			if err != nil {
-				req.res <- pathPublisherAnnounceRes{err: err}
+			if pm.draining {
+				req.res <- pathPublisherAnnounceRes{err: pathErrDraining{}}
 				continue
 			}
 
-			err = req.authenticate(
-				pathConf.PublishIPs,
-				pathConf.PublishUser,
-				pathConf.PublishPass)
+			pathName, pathConfName, pathConf, pathMatches, err := pm.findPathConf(req.pathName)
 			if err != nil {
 				req.res <- pathPublisherAnnounceRes{err: err}
 				continue
 			}
 
+			if req.authenticate != nil {
+				err = req.authenticate(
+					pathConf.PublishIPs,
+					pathCredential(pathConf.PublishUser, pathMatches),
+					pathCredential(pathConf.PublishPass, pathMatches))
+				if err != nil {
+					req.res <- pathPublisherAnnounceRes{err: err}
+					continue
+				}
+			}
+
 			// create path if it doesn't exist
-			if _, ok := pm.paths[req.pathName]; !ok {
-				pm.createPath(pathConfName, pathConf, req.pathName, pathMatches)
+			if _, ok := pm.paths[pathName]; !ok {
+				pm.createPath(pathConfName, pathConf, pathName, pathMatches)
 			}
 
-			req.res <- pathPublisherAnnounceRes{path: pm.paths[req.pathName]}
+			req.res <- pathPublisherAnnounceRes{path: pm.paths[pathName]}
+
+		case <-pm.drain:
+			pm.draining = true
 
 		case s := <-pm.hlsServerSet:
 			pm.hlsServer = s
@@ -252,16 +322,30 @@ outer:
 				paths: paths,
 			}
 
+		case req := <-pm.apiPathsStream:
+			pa, ok := pm.paths[req.name]
+			if !ok {
+				req.res <- pathAPIPathsStreamRes{err: fmt.Errorf("path not found")}
+				continue
+			}
+
+			req.res <- pathAPIPathsStreamRes{path: pa}
+
+		case req := <-pm.apiPathsSnapshot:
+			pa, ok := pm.paths[req.name]
+			if !ok {
+				req.res <- pathAPIPathsSnapshotRes{err: fmt.Errorf("path not found")}
+				continue
+			}
+
+			req.res <- pathAPIPathsSnapshotRes{path: pa}
+
 		case <-pm.ctx.Done():
 			break outer
 		}
 	}
 
 	pm.ctxCancel()
-
-	if pm.metrics != nil {
-		pm.metrics.onPathManagerSet(nil)
-	}
 }
 
 func (pm *pathManager) createPath(
@@ -285,15 +369,20 @@ func (pm *pathManager) createPath(
 		pm)
 }
 
-func (pm *pathManager) findPathConf(name string) (string, *conf.PathConf, []string, error) {
+// findPathConf returns the name of the path that serves the given name,
+// that is different from the given name when it is an alias, and its configuration.
+func (pm *pathManager) findPathConf(name string) (string, string, *conf.PathConf, []string, error) {
 	err := conf.IsValidPathName(name)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("invalid path name: %s (%s)", err, name)
+		return "", "", nil, nil, fmt.Errorf("invalid path name: %s (%s)", err, name)
 	}
 
 	// normal path
 	if pathConf, ok := pm.pathConfs[name]; ok {
-		return name, pathConf, nil, nil
+		if pathConf.Alias != "" {
+			return pm.findAliasedPathConf(pathConf.Alias)
+		}
+		return name, name, pathConf, nil, nil
 	}
 
 	// regular expression path
@@ -301,19 +390,39 @@ func (pm *pathManager) findPathConf(name string) (string, *conf.PathConf, []stri
 		if pathConf.Regexp != nil {
 			m := pathConf.Regexp.FindStringSubmatch(name)
 			if m != nil {
-				return pathConfName, pathConf, m, nil
+				if pathConf.Alias != "" {
+					return pm.findAliasedPathConf(pathConf.Alias)
+				}
+
+				err := pathConf.CheckURLGroups(m)
+				if err != nil {
+					return "", "", nil, nil, fmt.Errorf("invalid path name: %s (%s)", err, name)
+				}
+
+				return name, pathConfName, pathConf, m, nil
 			}
 		}
 	}
 
-	return "", nil, nil, fmt.Errorf("path '%s' is not configured", name)
+	return "", "", nil, nil, fmt.Errorf("path '%s' is not configured", name)
+}
+
+func (pm *pathManager) findAliasedPathConf(name string) (string, string, *conf.PathConf, []string, error) {
+	pathConf, ok := pm.pathConfs[name]
+	if !ok || pathConf.Alias != "" {
+		return "", "", nil, nil, fmt.Errorf("alias '%s' points to a path which is not configured", name)
+	}
+	return name, name, pathConf, nil, nil
 }
 
 // onConfReload is called by core.
-func (pm *pathManager) onConfReload(pathConfs map[string]*conf.PathConf) {
+func (pm *pathManager) onConfReload(req pathManagerConfReloadReq) pathManagerConfReloadRes {
+	req.res = make(chan pathManagerConfReloadRes)
 	select {
-	case pm.confReload <- pathConfs:
+	case pm.confReload <- req:
+		return <-req.res
 	case <-pm.ctx.Done():
+		return pathManagerConfReloadRes{}
 	}
 }
 
@@ -384,6 +493,15 @@ func (pm *pathManager) onReaderSetupPlay(req pathReaderSetupPlayReq) pathReaderS
 	}
 }
 
+// onDrain is called by core.
+// After this call, new readers and publishers are refused.
+func (pm *pathManager) onDrain() {
+	select {
+	case pm.drain <- struct{}{}:
+	case <-pm.ctx.Done():
+	}
+}
+
 // onHLSServerSet is called by hlsServer.
 func (pm *pathManager) onHLSServerSet(s pathManagerHLSServer) {
 	select {
@@ -413,3 +531,37 @@ func (pm *pathManager) onAPIPathsList(req pathAPIPathsListReq) pathAPIPathsListR
 		return pathAPIPathsListRes{err: fmt.Errorf("terminated")}
 	}
 }
+
+// onAPIPathsStream is called by api.
+func (pm *pathManager) onAPIPathsStream(req pathAPIPathsStreamReq) pathAPIPathsStreamRes {
+	req.res = make(chan pathAPIPathsStreamRes)
+	select {
+	case pm.apiPathsStream <- req:
+		res := <-req.res
+		if res.err != nil {
+			return res
+		}
+
+		return res.path.onAPIPathsStream(pathAPIPathsStreamReq{})
+
+	case <-pm.ctx.Done():
+		return pathAPIPathsStreamRes{err: fmt.Errorf("terminated")}
+	}
+}
+
+// onAPIPathsSnapshot is called by api.
+func (pm *pathManager) onAPIPathsSnapshot(req pathAPIPathsSnapshotReq) pathAPIPathsSnapshotRes {
+	req.res = make(chan pathAPIPathsSnapshotRes)
+	select {
+	case pm.apiPathsSnapshot <- req:
+		res := <-req.res
+		if res.err != nil {
+			return res
+		}
+
+		return res.path.onAPIPathsSnapshot(pathAPIPathsSnapshotReq{})
+
+	case <-pm.ctx.Done():
+		return pathAPIPathsSnapshotRes{err: fmt.Errorf("terminated")}
+	}
+}
@@ -53,7 +53,7 @@ func (pp *pprof) close() {
 }
 
 func (pp *pprof) log(level logger.Level, format string, args ...interface{}) {
-	pp.parent.Log(level, "[pprof] "+format, args...)
+	pp.parent.Log(level, format, append([]interface{}{logger.Component("pprof")}, args...)...)
 }
 
 func (pp *pprof) run() {
@@ -1,8 +1,13 @@
 package core
 
+import (
+	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
+)
+
 // publisher is an entity that can publish a stream dynamically.
 type publisher interface {
 	source
 	close()
 	onPublisherAccepted(tracksLen int)
+	externalCmdEnv() externalcmd.Environment
 }
@@ -1,10 +1,14 @@
 package core
 
+import (
+	"time"
+)
+
 // reader is an entity that can read a stream.
 type reader interface {
 	close()
 	onReaderAccepted()
-	onReaderPacketRTP(int, []byte)
+	onReaderPacketRTP(int, []byte, time.Time)
 	onReaderPacketRTCP(int, []byte)
 	onReaderAPIDescribe() interface{}
 }
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
@@ -40,6 +41,7 @@ func pathNameAndQuery(inURL *url.URL) (string, url.Values, string) {
 type rtmpConnTrackIDPayloadPair struct {
 	trackID int
 	buf     []byte
+	ntp     time.Time
 }
 
 type rtmpConnPathManager interface {
@@ -61,17 +63,25 @@ type rtmpConn struct {
 	readBufferCount           int
 	runOnConnect              string
 	runOnConnectRestart       bool
+	runOnDisconnect           string
 	wg                        *sync.WaitGroup
 	conn                      *rtmp.Conn
 	externalCmdPool           *externalcmd.Pool
+	banList                   *banList
+	externalAuthCache         *externalAuthCache
 	pathManager               rtmpConnPathManager
 	parent                    rtmpConnParent
 
 	ctx        context.Context
 	ctxCancel  func()
 	path       *path
+	logPath    atomic.Value // logger.Field
+	query      string
+	kickReason atomic.Value           // string
 	ringBuffer *ringbuffer.RingBuffer // read
 	state      gortsplib.ServerSessionState
+	user       string
+	expiresAt  *time.Time
 	stateMutex sync.Mutex
 }
 
@@ -85,9 +95,12 @@ func newRTMPConn(
 	readBufferCount int,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	wg *sync.WaitGroup,
 	nconn net.Conn,
 	externalCmdPool *externalcmd.Pool,
+	banList *banList,
+	externalAuthCache *externalAuthCache,
 	pathManager rtmpConnPathManager,
 	parent rtmpConnParent) *rtmpConn {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
@@ -101,9 +114,12 @@ func newRTMPConn(
 		readBufferCount:           readBufferCount,
 		runOnConnect:              runOnConnect,
 		runOnConnectRestart:       runOnConnectRestart,
+		runOnDisconnect:           runOnDisconnect,
 		wg:                        wg,
 		conn:                      rtmp.NewServerConn(nconn),
 		externalCmdPool:           externalCmdPool,
+		banList:                   banList,
+		externalAuthCache:         externalAuthCache,
 		pathManager:               pathManager,
 		parent:                    parent,
 		ctx:                       ctx,
@@ -123,6 +139,12 @@ func (c *rtmpConn) close() {
 	c.ctxCancel()
 }
 
+// kick closes a Conn and reports a reason.
+func (c *rtmpConn) kick(reason string) {
+	c.kickReason.Store(reason)
+	c.ctxCancel()
+}
+
 // ID returns the ID of the Conn.
 func (c *rtmpConn) ID() string {
 	return c.id
@@ -134,34 +156,50 @@ func (c *rtmpConn) RemoteAddr() net.Addr {
 }
 
 func (c *rtmpConn) log(level logger.Level, format string, args ...interface{}) {
-	c.parent.log(level, "[conn %v] "+format, append([]interface{}{c.conn.RemoteAddr()}, args...)...)
+	fields := []interface{}{logger.RemoteAddr(c.conn.RemoteAddr())}
+	if f, ok := c.logPath.Load().(logger.Field); ok {
+		fields = append(fields, f)
+	}
+	c.parent.log(level, format, append(fields, args...)...)
 }
 
 func (c *rtmpConn) ip() net.IP {
 	return c.conn.RemoteAddr().(*net.TCPAddr).IP
 }
 
+func (c *rtmpConn) connExternalCmdEnv() externalcmd.Environment {
+	_, port, _ := net.SplitHostPort(c.rtspAddress)
+	return externalcmd.Environment{
+		"RTSP_PATH":      "",
+		"RTSP_PORT":      port,
+		"RTSP_REMOTE_IP": c.ip().String(),
+		"RTSP_PROTOCOL":  "rtmp",
+	}
+}
+
 func (c *rtmpConn) safeState() gortsplib.ServerSessionState {
 	c.stateMutex.Lock()
 	defer c.stateMutex.Unlock()
 	return c.state
 }
 
+func (c *rtmpConn) safeUser() string {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.user
+}
+
 func (c *rtmpConn) run() {
 	defer c.wg.Done()
 
 	err := func() error {
 		if c.runOnConnect != "" {
 			c.log(logger.Info, "runOnConnect command started")
-			_, port, _ := net.SplitHostPort(c.rtspAddress)
 			onConnectCmd := externalcmd.NewCmd(
 				c.externalCmdPool,
 				c.runOnConnect,
 				c.runOnConnectRestart,
-				externalcmd.Environment{
-					"RTSP_PATH": "",
-					"RTSP_PORT": port,
-				},
+				c.connExternalCmdEnv(),
 				func(co int) {
 					c.log(logger.Info, "runOnConnect command exited with code %d", co)
 				})
@@ -186,6 +224,9 @@ func (c *rtmpConn) run() {
 		case <-c.ctx.Done():
 			cancel()
 			<-runErr
+			if reason, ok := c.kickReason.Load().(string); ok {
+				return kickError(reason)
+			}
 			return errors.New("terminated")
 		}
 	}()
@@ -195,6 +236,18 @@ func (c *rtmpConn) run() {
 	c.parent.onConnClose(c)
 
 	c.log(logger.Info, "closed (%v)", err)
+
+	if c.runOnDisconnect != "" {
+		c.log(logger.Info, "runOnDisconnect command started")
+		externalcmd.NewCmd(
+			c.externalCmdPool,
+			c.runOnDisconnect,
+			false,
+			c.connExternalCmdEnv(),
+			func(co int) {
+				c.log(logger.Info, "runOnDisconnect command exited with code %d", co)
+			})
+	}
 }
 
 func (c *rtmpConn) runInner(ctx context.Context) error {
@@ -218,20 +271,41 @@ func (c *rtmpConn) runInner(ctx context.Context) error {
 
 func (c *rtmpConn) runRead(ctx context.Context) error {
 	pathName, query, rawQuery := pathNameAndQuery(c.conn.URL())
+	c.query = rawQuery
 
-	res := c.pathManager.onReaderSetupPlay(pathReaderSetupPlayReq{
+	c.stateMutex.Lock()
+	c.user = query.Get("user")
+	c.stateMutex.Unlock()
+
+	var authRes *externalAuthRes
+
+	req := pathReaderSetupPlayReq{
 		author:   c,
 		pathName: pathName,
 		authenticate: func(
 			pathIPs []interface{},
 			pathUser conf.Credential,
 			pathPass conf.Credential) error {
-			return c.authenticate(pathName, pathIPs, pathUser, pathPass, "read", query, rawQuery)
+			var err error
+			authRes, err = c.authenticate(pathName, pathIPs, pathUser, pathPass, "read", query, rawQuery)
+			return err
 		},
-	})
+	}
+	res := c.pathManager.onReaderSetupPlay(req)
+
+	if terr, ok := res.err.(pathErrAuthOverride); ok {
+		c.log(logger.Debug, "%s", terr.Error())
+		req.pathName = terr.pathName
+		req.authenticate = nil
+		res = c.pathManager.onReaderSetupPlay(req)
+	}
 
 	if res.err != nil {
 		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			if !terr.banned && c.banList.onAuthFailure(c.ip()) {
+				c.log(logger.Warn, "IP %s banned because of too many authentication failures", c.ip())
+			}
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtmpConnPauseAfterAuthError)
 			return errors.New(terr.message)
@@ -240,6 +314,10 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 	}
 
 	c.path = res.path
+	c.logPath.Store(res.path.logField())
+
+	stopExpiration := c.setExpiration(authRes)
+	defer stopExpiration()
 
 	defer func() {
 		c.path.onReaderRemove(pathReaderRemoveReq{author: c})
@@ -282,6 +360,8 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 		return fmt.Errorf("the stream doesn't contain an H264 track or an AAC track")
 	}
 
+	gopCache := res.stream.gopCache != nil
+
 	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
 	err := c.conn.WriteMetadata(videoTrack, audioTrack)
 	if err != nil {
@@ -299,13 +379,27 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 		author: c,
 	})
 
+	if c.path.Conf().RunOnUnread != "" {
+		defer func() {
+			c.log(logger.Info, "runOnUnread command started")
+			externalcmd.NewCmd(
+				c.externalCmdPool,
+				c.path.Conf().RunOnUnread,
+				false,
+				c.path.externalCmdEnvWith(c.externalCmdEnv()),
+				func(co int) {
+					c.log(logger.Info, "runOnUnread command exited with code %d", co)
+				})
+		}()
+	}
+
 	if c.path.Conf().RunOnRead != "" {
 		c.log(logger.Info, "runOnRead command started")
 		onReadCmd := externalcmd.NewCmd(
 			c.externalCmdPool,
 			c.path.Conf().RunOnRead,
 			c.path.Conf().RunOnReadRestart,
-			c.path.externalCmdEnv(),
+			c.path.externalCmdEnvWith(c.externalCmdEnv()),
 			func(co int) {
 				c.log(logger.Info, "runOnRead command exited with code %d", co)
 			})
@@ -319,6 +413,9 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 	c.conn.SetReadDeadline(time.Time{})
 
 	var videoStartPTS time.Duration
+	var videoStartNTP time.Time
+	var audioPTSOffset time.Duration
+	audioFirstAUFound := false
 	var videoDTSEst *h264.DTSEstimator
 	videoFirstIDRFound := false
 
@@ -376,6 +473,7 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 
 				videoFirstIDRFound = true
 				videoStartPTS = pts
+				videoStartNTP = pair.ntp
 				videoDTSEst = h264.NewDTSEstimator()
 			}
 
@@ -417,7 +515,20 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 				continue
 			}
 
-			pts -= videoStartPTS
+			if gopCache {
+				// the audio and video decoders start from the first packet they receive.
+				// align audio timestamps to video ones by using wall-clock time, since
+				// packets of a group can be received at once from the GOP cache.
+				if !audioFirstAUFound {
+					audioFirstAUFound = true
+					audioPTSOffset = pair.ntp.Sub(videoStartNTP) - pts
+				}
+
+				pts += audioPTSOffset
+			} else {
+				pts -= videoStartPTS
+			}
+
 			if pts < 0 {
 				continue
 			}
@@ -465,20 +576,41 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 	}
 
 	pathName, query, rawQuery := pathNameAndQuery(c.conn.URL())
+	c.query = rawQuery
+
+	c.stateMutex.Lock()
+	c.user = query.Get("user")
+	c.stateMutex.Unlock()
 
-	res := c.pathManager.onPublisherAnnounce(pathPublisherAnnounceReq{
+	var authRes *externalAuthRes
+
+	req := pathPublisherAnnounceReq{
 		author:   c,
 		pathName: pathName,
 		authenticate: func(
 			pathIPs []interface{},
 			pathUser conf.Credential,
 			pathPass conf.Credential) error {
-			return c.authenticate(pathName, pathIPs, pathUser, pathPass, "publish", query, rawQuery)
+			var err error
+			authRes, err = c.authenticate(pathName, pathIPs, pathUser, pathPass, "publish", query, rawQuery)
+			return err
 		},
-	})
+	}
+	res := c.pathManager.onPublisherAnnounce(req)
+
+	if terr, ok := res.err.(pathErrAuthOverride); ok {
+		c.log(logger.Debug, "%s", terr.Error())
+		req.pathName = terr.pathName
+		req.authenticate = nil
+		res = c.pathManager.onPublisherAnnounce(req)
+	}
 
 	if res.err != nil {
 		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			if !terr.banned && c.banList.onAuthFailure(c.ip()) {
+				c.log(logger.Warn, "IP %s banned because of too many authentication failures", c.ip())
+			}
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtmpConnPauseAfterAuthError)
 			return errors.New(terr.message)
@@ -487,6 +619,10 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 	}
 
 	c.path = res.path
+	c.logPath.Store(res.path.logField())
+
+	stopExpiration := c.setExpiration(authRes)
+	defer stopExpiration()
 
 	defer func() {
 		c.path.onPublisherRemove(pathPublisherRemoveReq{author: c})
@@ -594,6 +730,65 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 	}
 }
 
+// externalAuthenticate calls the external authentication server.
+func (c *rtmpConn) externalAuthenticate(
+	pathName string,
+	action string,
+	query url.Values,
+	rawQuery string,
+) (*externalAuthRes, error) {
+	res, err := externalAuth(
+		c.externalAuthenticationURL,
+		c.externalAuthCache,
+		externalAuthReq{
+			IP:       c.ip().String(),
+			User:     query.Get("user"),
+			Password: query.Get("pass"),
+			Path:     pathName,
+			Protocol: "rtmp",
+			ID:       c.id,
+			Action:   action,
+			Query:    rawQuery,
+		})
+	if err != nil {
+		return nil, pathErrAuthCritical{
+			message: fmt.Sprintf("external authentication failed: %s", err),
+		}
+	}
+
+	if res.Path != "" && res.Path != pathName {
+		return res, pathErrAuthOverride{pathName: res.Path}
+	}
+
+	return res, nil
+}
+
+// setExpiration closes the connection when the limits of authentication are reached.
+func (c *rtmpConn) setExpiration(authRes *externalAuthRes) func() {
+	expiresAt := sessionExpiration(authRes, c.path.Conf())
+	if expiresAt == nil {
+		return func() {}
+	}
+
+	c.stateMutex.Lock()
+	c.expiresAt = expiresAt
+	c.stateMutex.Unlock()
+
+	t := time.AfterFunc(time.Until(*expiresAt), func() {
+		c.kick("session expired")
+	})
+	return func() {
+		t.Stop()
+	}
+}
+
+// remainingTime returns the time left before the connection expires, or nil if it doesn't expire.
+func (c *rtmpConn) remainingTime() *conf.StringDuration {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return remainingTime(c.expiresAt)
+}
+
 func (c *rtmpConn) authenticate(
 	pathName string,
 	pathIPs []interface{},
@@ -602,27 +797,23 @@ func (c *rtmpConn) authenticate(
 	action string,
 	query url.Values,
 	rawQuery string,
-) error {
-	if c.externalAuthenticationURL != "" {
-		err := externalAuth(
-			c.externalAuthenticationURL,
-			c.ip().String(),
-			query.Get("user"),
-			query.Get("pass"),
-			pathName,
-			action,
-			rawQuery)
-		if err != nil {
-			return pathErrAuthCritical{
-				message: fmt.Sprintf("external authentication failed: %s", err),
-			}
+) (*externalAuthRes, error) {
+	err := c.banList.check(c.ip(), query.Get("user"))
+	if err != nil {
+		return nil, pathErrAuthCritical{
+			message: err.Error(),
+			banned:  true,
 		}
 	}
 
+	if c.externalAuthenticationURL != "" {
+		return c.externalAuthenticate(pathName, action, query, rawQuery)
+	}
+
 	if pathIPs != nil {
 		ip := c.ip()
 		if !ipEqualOrInRange(ip, pathIPs) {
-			return pathErrAuthCritical{
+			return nil, pathErrAuthCritical{
 				message: fmt.Sprintf("IP '%s' not allowed", ip),
 			}
 		}
@@ -631,13 +822,13 @@ func (c *rtmpConn) authenticate(
 	if pathUser != "" {
 		if query.Get("user") != string(pathUser) ||
 			query.Get("pass") != string(pathPass) {
-			return pathErrAuthCritical{
+			return nil, pathErrAuthCritical{
 				message: "invalid credentials",
 			}
 		}
 	}
 
-	return nil
+	return nil, nil
 }
 
 // onReaderAccepted implements reader.
@@ -646,8 +837,8 @@ func (c *rtmpConn) onReaderAccepted() {
 }
 
 // onReaderPacketRTP implements reader.
-func (c *rtmpConn) onReaderPacketRTP(trackID int, payload []byte) {
-	c.ringBuffer.Push(rtmpConnTrackIDPayloadPair{trackID, payload})
+func (c *rtmpConn) onReaderPacketRTP(trackID int, payload []byte, ntp time.Time) {
+	c.ringBuffer.Push(rtmpConnTrackIDPayloadPair{trackID, payload, ntp})
 }
 
 // onReaderPacketRTCP implements reader.
@@ -682,3 +873,13 @@ func (c *rtmpConn) onPublisherAccepted(tracksLen int) {
 			return "tracks"
 		}())
 }
+
+// externalCmdEnv implements publisher.
+func (c *rtmpConn) externalCmdEnv() externalcmd.Environment {
+	return externalcmd.Environment{
+		"RTSP_REMOTE_IP":  c.ip().String(),
+		"RTSP_SESSION_ID": c.id,
+		"RTSP_PROTOCOL":   "rtmp",
+		"RTSP_QUERY":      c.query,
+	}
+}
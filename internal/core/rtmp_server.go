@@ -17,8 +17,9 @@ import (
 )
 
 type rtmpServerAPIConnsListItem struct {
-	RemoteAddr string `json:"remoteAddr"`
-	State      string `json:"state"`
+	RemoteAddr    string               `json:"remoteAddr"`
+	State         string               `json:"state"`
+	RemainingTime *conf.StringDuration `json:"remainingTime"`
 }
 
 type rtmpServerAPIConnsListData struct {
@@ -39,12 +40,28 @@ type rtmpServerAPIConnsKickRes struct {
 }
 
 type rtmpServerAPIConnsKickReq struct {
-	id  string
+	id     string
+	reason string
+
+	// called before the connection is kicked; the connection is not kicked
+	// if it returns an error.
+	beforeKick func(remoteIP net.IP, user string) error
+
 	res chan rtmpServerAPIConnsKickRes
 }
 
+type rtmpServerConfReloadReq struct {
+	readTimeout         conf.StringDuration
+	writeTimeout        conf.StringDuration
+	readBufferCount     int
+	runOnConnect        string
+	runOnConnectRestart bool
+	runOnDisconnect     string
+}
+
 type rtmpServerParent interface {
 	Log(logger.Level, string, ...interface{})
+	onSessionEnd()
 }
 
 type rtmpServer struct {
@@ -55,8 +72,10 @@ type rtmpServer struct {
 	rtspAddress               string
 	runOnConnect              string
 	runOnConnectRestart       bool
+	runOnDisconnect           string
 	externalCmdPool           *externalcmd.Pool
-	metrics                   *metrics
+	banList                   *banList
+	externalAuthCache         *externalAuthCache
 	pathManager               *pathManager
 	parent                    rtmpServerParent
 
@@ -67,6 +86,7 @@ type rtmpServer struct {
 	conns     map[*rtmpConn]struct{}
 
 	// in
+	confReload   chan rtmpServerConfReloadReq
 	connClose    chan *rtmpConn
 	apiConnsList chan rtmpServerAPIConnsListReq
 	apiConnsKick chan rtmpServerAPIConnsKickReq
@@ -82,8 +102,10 @@ func newRTMPServer(
 	rtspAddress string,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	externalCmdPool *externalcmd.Pool,
-	metrics *metrics,
+	banList *banList,
+	externalAuthCache *externalAuthCache,
 	pathManager *pathManager,
 	parent rtmpServerParent) (*rtmpServer, error) {
 	l, err := net.Listen("tcp", address)
@@ -101,14 +123,17 @@ func newRTMPServer(
 		rtspAddress:               rtspAddress,
 		runOnConnect:              runOnConnect,
 		runOnConnectRestart:       runOnConnectRestart,
+		runOnDisconnect:           runOnDisconnect,
 		externalCmdPool:           externalCmdPool,
-		metrics:                   metrics,
+		banList:                   banList,
+		externalAuthCache:         externalAuthCache,
 		pathManager:               pathManager,
 		parent:                    parent,
 		ctx:                       ctx,
 		ctxCancel:                 ctxCancel,
-		l:                         l,
+		l:                         newBanListener(l, banList),
 		conns:                     make(map[*rtmpConn]struct{}),
+		confReload:                make(chan rtmpServerConfReloadReq),
 		connClose:                 make(chan *rtmpConn),
 		apiConnsList:              make(chan rtmpServerAPIConnsListReq),
 		apiConnsKick:              make(chan rtmpServerAPIConnsKickReq),
@@ -116,10 +141,6 @@ func newRTMPServer(
 
 	s.log(logger.Info, "listener opened on %s", address)
 
-	if s.metrics != nil {
-		s.metrics.onRTMPServerSet(s)
-	}
-
 	s.wg.Add(1)
 	go s.run()
 
@@ -127,7 +148,7 @@ func newRTMPServer(
 }
 
 func (s *rtmpServer) log(level logger.Level, format string, args ...interface{}) {
-	s.parent.Log(level, "[RTMP] "+format, append([]interface{}{}, args...)...)
+	s.parent.Log(level, format, append([]interface{}{logger.Component("RTMP")}, args...)...)
 }
 
 func (s *rtmpServer) close() {
@@ -185,18 +206,31 @@ outer:
 				s.readBufferCount,
 				s.runOnConnect,
 				s.runOnConnectRestart,
+				s.runOnDisconnect,
 				&s.wg,
 				nconn,
 				s.externalCmdPool,
+				s.banList,
+				s.externalAuthCache,
 				s.pathManager,
 				s)
 			s.conns[c] = struct{}{}
 
+		case req := <-s.confReload:
+			// new values are used by new connections only
+			s.readTimeout = req.readTimeout
+			s.writeTimeout = req.writeTimeout
+			s.readBufferCount = req.readBufferCount
+			s.runOnConnect = req.runOnConnect
+			s.runOnConnectRestart = req.runOnConnectRestart
+			s.runOnDisconnect = req.runOnDisconnect
+
 		case c := <-s.connClose:
 			if _, ok := s.conns[c]; !ok {
 				continue
 			}
 			delete(s.conns, c)
+			s.parent.onSessionEnd()
 
 		case req := <-s.apiConnsList:
 			data := &rtmpServerAPIConnsListData{
@@ -216,27 +250,32 @@ outer:
 						}
 						return "idle"
 					}(),
+					RemainingTime: c.remainingTime(),
 				}
 			}
 
 			req.res <- rtmpServerAPIConnsListRes{data: data}
 
 		case req := <-s.apiConnsKick:
-			res := func() bool {
+			res := func() rtmpServerAPIConnsKickRes {
 				for c := range s.conns {
 					if c.ID() == req.id {
+						if req.beforeKick != nil {
+							err := req.beforeKick(c.ip(), c.safeUser())
+							if err != nil {
+								return rtmpServerAPIConnsKickRes{err: err}
+							}
+						}
+
 						delete(s.conns, c)
-						c.close()
-						return true
+						c.kick(req.reason)
+						s.parent.onSessionEnd()
+						return rtmpServerAPIConnsKickRes{}
 					}
 				}
-				return false
+				return rtmpServerAPIConnsKickRes{err: fmt.Errorf("not found")}
 			}()
-			if res {
-				req.res <- rtmpServerAPIConnsKickRes{}
-			} else {
-				req.res <- rtmpServerAPIConnsKickRes{fmt.Errorf("not found")}
-			}
+			req.res <- res
 
 		case <-s.ctx.Done():
 			break outer
@@ -246,10 +285,6 @@ outer:
 	s.ctxCancel()
 
 	s.l.Close()
-
-	if s.metrics != nil {
-		s.metrics.onRTMPServerSet(s)
-	}
 }
 
 func (s *rtmpServer) newConnID() (string, error) {
@@ -280,6 +315,14 @@ func (s *rtmpServer) newConnID() (string, error) {
 	}
 }
 
+// onConfReload is called by core.
+func (s *rtmpServer) onConfReload(req rtmpServerConfReloadReq) {
+	select {
+	case s.confReload <- req:
+	case <-s.ctx.Done():
+	}
+}
+
 // onConnClose is called by rtmpConn.
 func (s *rtmpServer) onConnClose(c *rtmpConn) {
 	select {
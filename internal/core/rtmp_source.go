@@ -26,6 +26,7 @@ type rtmpSourceParent interface {
 	log(logger.Level, string, ...interface{})
 	onSourceStaticSetReady(req pathSourceStaticSetReadyReq) pathSourceStaticSetReadyRes
 	onSourceStaticSetNotReady(req pathSourceStaticSetNotReadyReq)
+	onSourceStaticError(err error)
 }
 
 type rtmpSource struct {
@@ -73,7 +74,9 @@ func (s *rtmpSource) close() {
 }
 
 func (s *rtmpSource) log(level logger.Level, format string, args ...interface{}) {
-	s.parent.log(level, "[rtmp source] "+format, args...)
+	s.parent.log(level, format, append([]interface{}{
+		logger.Field{Key: "source", Value: "rtmp", Prefix: "[rtmp source]"},
+	}, args...)...)
 }
 
 func (s *rtmpSource) run() {
@@ -261,6 +264,7 @@ func (s *rtmpSource) runInner() bool {
 	case err := <-runErr:
 		innerCtxCancel()
 		s.log(logger.Info, "ERR: %s", err)
+		s.parent.onSourceStaticError(err)
 		return true
 
 	case <-s.ctx.Done():
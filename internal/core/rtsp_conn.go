@@ -25,13 +25,17 @@ type rtspConnParent interface {
 }
 
 type rtspConn struct {
+	isTLS                     bool
 	externalAuthenticationURL string
 	rtspAddress               string
 	authMethods               []headers.AuthMethod
 	readTimeout               conf.StringDuration
 	runOnConnect              string
 	runOnConnectRestart       bool
+	runOnDisconnect           string
 	externalCmdPool           *externalcmd.Pool
+	banList                   *banList
+	externalAuthCache         *externalAuthCache
 	pathManager               *pathManager
 	conn                      *gortsplib.ServerConn
 	parent                    rtspConnParent
@@ -44,24 +48,32 @@ type rtspConn struct {
 }
 
 func newRTSPConn(
+	isTLS bool,
 	externalAuthenticationURL string,
 	rtspAddress string,
 	authMethods []headers.AuthMethod,
 	readTimeout conf.StringDuration,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	externalCmdPool *externalcmd.Pool,
+	banList *banList,
+	externalAuthCache *externalAuthCache,
 	pathManager *pathManager,
 	conn *gortsplib.ServerConn,
 	parent rtspConnParent) *rtspConn {
 	c := &rtspConn{
+		isTLS:                     isTLS,
 		externalAuthenticationURL: externalAuthenticationURL,
 		rtspAddress:               rtspAddress,
 		authMethods:               authMethods,
 		readTimeout:               readTimeout,
 		runOnConnect:              runOnConnect,
 		runOnConnectRestart:       runOnConnectRestart,
+		runOnDisconnect:           runOnDisconnect,
 		externalCmdPool:           externalCmdPool,
+		banList:                   banList,
+		externalAuthCache:         externalAuthCache,
 		pathManager:               pathManager,
 		conn:                      conn,
 		parent:                    parent,
@@ -71,17 +83,13 @@ func newRTSPConn(
 
 	if c.runOnConnect != "" {
 		c.log(logger.Info, "runOnConnect command started")
-		_, port, _ := net.SplitHostPort(c.rtspAddress)
 		c.onConnectCmd = externalcmd.NewCmd(
 			c.externalCmdPool,
 			c.runOnConnect,
 			c.runOnConnectRestart,
-			externalcmd.Environment{
-				"RTSP_PATH": "",
-				"RTSP_PORT": port,
-			},
+			c.externalCmdEnv(),
 			func(co int) {
-				c.log(logger.Info, "runOnInit command exited with code %d", co)
+				c.log(logger.Info, "runOnConnect command exited with code %d", co)
 			})
 	}
 
@@ -89,7 +97,7 @@ func newRTSPConn(
 }
 
 func (c *rtspConn) log(level logger.Level, format string, args ...interface{}) {
-	c.parent.log(level, "[conn %v] "+format, append([]interface{}{c.conn.NetConn().RemoteAddr()}, args...)...)
+	c.parent.log(level, format, append([]interface{}{logger.RemoteAddr(c.conn.NetConn().RemoteAddr())}, args...)...)
 }
 
 // Conn returns the RTSP connection.
@@ -101,72 +109,153 @@ func (c *rtspConn) ip() net.IP {
 	return c.conn.NetConn().RemoteAddr().(*net.TCPAddr).IP
 }
 
-func (c *rtspConn) authenticate(
+func (c *rtspConn) protocol() string {
+	if c.isTLS {
+		return "rtsps"
+	}
+	return "rtsp"
+}
+
+func (c *rtspConn) externalCmdEnv() externalcmd.Environment {
+	_, port, _ := net.SplitHostPort(c.rtspAddress)
+	return externalcmd.Environment{
+		"RTSP_PATH":      "",
+		"RTSP_PORT":      port,
+		"RTSP_REMOTE_IP": c.ip().String(),
+		"RTSP_PROTOCOL":  c.protocol(),
+	}
+}
+
+// requestUser returns the user provided by the Authorization header of a request.
+func requestUser(req *base.Request) string {
+	var auth headers.Authorization
+	err := auth.Read(req.Header["Authorization"])
+	if err != nil {
+		return ""
+	}
+
+	if auth.Method == headers.AuthBasic {
+		return auth.BasicUser
+	}
+
+	if auth.DigestValues.Username != nil {
+		return *auth.DigestValues.Username
+	}
+	return ""
+}
+
+// externalAuthenticate calls the external authentication server.
+func (c *rtspConn) externalAuthenticate(
 	pathName string,
-	pathIPs []interface{},
-	pathUser conf.Credential,
-	pathPass conf.Credential,
 	action string,
 	req *base.Request,
 	query string,
-) error {
-	if c.externalAuthenticationURL != "" {
-		username := ""
-		password := ""
-
-		var auth headers.Authorization
-		err := auth.Read(req.Header["Authorization"])
-		if err == nil && auth.Method == headers.AuthBasic {
-			username = auth.BasicUser
-			password = auth.BasicPass
-		}
+	sessionID string,
+) (*externalAuthRes, error) {
+	username := ""
+	password := ""
+
+	var auth headers.Authorization
+	err := auth.Read(req.Header["Authorization"])
+	if err == nil && auth.Method == headers.AuthBasic {
+		username = auth.BasicUser
+		password = auth.BasicPass
+	}
 
-		err = externalAuth(
-			c.externalAuthenticationURL,
-			c.ip().String(),
-			username,
-			password,
-			pathName,
-			action,
-			query)
-		if err != nil {
-			c.authFailures++
+	header := make(map[string][]string)
+	for key, vals := range req.Header {
+		header[key] = vals
+	}
 
-			// VLC with login prompt sends 4 requests:
-			// 1) without credentials
-			// 2) with password but without username
-			// 3) without credentials
-			// 4) with password and username
-			// therefore we must allow up to 3 failures
-			if c.authFailures > 3 {
-				return pathErrAuthCritical{
-					message: "unauthorized: " + err.Error(),
-					response: &base.Response{
-						StatusCode: base.StatusUnauthorized,
-					},
-				}
-			}
+	userAgent := ""
+	if vals, ok := req.Header["User-Agent"]; ok && len(vals) > 0 {
+		userAgent = vals[0]
+	}
 
-			v := "IPCAM"
-			return pathErrAuthNotCritical{
+	res, err := externalAuth(
+		c.externalAuthenticationURL,
+		c.externalAuthCache,
+		externalAuthReq{
+			IP:        c.ip().String(),
+			User:      username,
+			Password:  password,
+			Path:      pathName,
+			Protocol:  c.protocol(),
+			ID:        sessionID,
+			Action:    action,
+			Query:     query,
+			UserAgent: userAgent,
+			Headers:   externalAuthHeaders(header),
+		})
+	if err != nil {
+		c.authFailures++
+
+		// VLC with login prompt sends 4 requests:
+		// 1) without credentials
+		// 2) with password but without username
+		// 3) without credentials
+		// 4) with password and username
+		// therefore we must allow up to 3 failures
+		if c.authFailures > 3 {
+			return nil, pathErrAuthCritical{
 				message: "unauthorized: " + err.Error(),
 				response: &base.Response{
 					StatusCode: base.StatusUnauthorized,
-					Header: base.Header{
-						"WWW-Authenticate": headers.Authenticate{
-							Method: headers.AuthBasic,
-							Realm:  &v,
-						}.Write(),
-					},
 				},
 			}
 		}
+
+		v := "IPCAM"
+		return nil, pathErrAuthNotCritical{
+			message: "unauthorized: " + err.Error(),
+			response: &base.Response{
+				StatusCode: base.StatusUnauthorized,
+				Header: base.Header{
+					"WWW-Authenticate": headers.Authenticate{
+						Method: headers.AuthBasic,
+						Realm:  &v,
+					}.Write(),
+				},
+			},
+		}
+	}
+
+	if res.Path != "" && res.Path != pathName {
+		return res, pathErrAuthOverride{pathName: res.Path}
+	}
+
+	return res, nil
+}
+
+func (c *rtspConn) authenticate(
+	pathName string,
+	pathIPs []interface{},
+	pathUser conf.Credential,
+	pathPass conf.Credential,
+	action string,
+	req *base.Request,
+	query string,
+	sessionID string,
+) (*externalAuthRes, error) {
+	err := c.banList.check(c.ip(), requestUser(req))
+	if err != nil {
+		return nil, pathErrAuthCritical{
+			message: err.Error(),
+			response: &base.Response{
+				StatusCode: base.StatusForbidden,
+			},
+			banned: true,
+		}
+	}
+
+	if c.externalAuthenticationURL != "" {
+		return c.externalAuthenticate(pathName, action, req, query, sessionID)
 	}
 
 	if pathIPs != nil {
 		ip := c.ip()
 		if !ipEqualOrInRange(ip, pathIPs) {
-			return pathErrAuthCritical{
+			return nil, pathErrAuthCritical{
 				message: fmt.Sprintf("IP '%s' not allowed", ip),
 				response: &base.Response{
 					StatusCode: base.StatusUnauthorized,
@@ -194,7 +283,7 @@ func (c *rtspConn) authenticate(
 			// 4) with password and username
 			// therefore we must allow up to 3 failures
 			if c.authFailures > 3 {
-				return pathErrAuthCritical{
+				return nil, pathErrAuthCritical{
 					message: "unauthorized: " + err.Error(),
 					response: &base.Response{
 						StatusCode: base.StatusUnauthorized,
@@ -202,7 +291,7 @@ func (c *rtspConn) authenticate(
 				}
 			}
 
-			return pathErrAuthNotCritical{
+			return nil, pathErrAuthNotCritical{
 				response: &base.Response{
 					StatusCode: base.StatusUnauthorized,
 					Header: base.Header{
@@ -216,7 +305,18 @@ func (c *rtspConn) authenticate(
 		c.authFailures = 0
 	}
 
-	return nil
+	return nil, nil
+}
+
+// onAuthFailure is called by rtspConn and rtspSession.
+func (c *rtspConn) onAuthFailure(err pathErrAuthCritical) {
+	if err.banned {
+		return
+	}
+
+	if c.banList.onAuthFailure(c.ip()) {
+		c.log(logger.Warn, "IP %s banned because of too many authentication failures", c.ip())
+	}
 }
 
 // onClose is called by rtspServer.
@@ -227,6 +327,18 @@ func (c *rtspConn) onClose(err error) {
 		c.onConnectCmd.Close()
 		c.log(logger.Info, "runOnConnect command stopped")
 	}
+
+	if c.runOnDisconnect != "" {
+		c.log(logger.Info, "runOnDisconnect command started")
+		externalcmd.NewCmd(
+			c.externalCmdPool,
+			c.runOnDisconnect,
+			false,
+			c.externalCmdEnv(),
+			func(co int) {
+				c.log(logger.Info, "runOnDisconnect command exited with code %d", co)
+			})
+	}
 }
 
 // onRequest is called by rtspServer.
@@ -242,16 +354,25 @@ func (c *rtspConn) OnResponse(res *base.Response) {
 // onDescribe is called by rtspServer.
 func (c *rtspConn) onDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx,
 ) (*base.Response, *gortsplib.ServerStream, error) {
-	res := c.pathManager.onDescribe(pathDescribeReq{
+	req := pathDescribeReq{
 		pathName: ctx.Path,
 		url:      ctx.Req.URL,
 		authenticate: func(
 			pathIPs []interface{},
 			pathUser conf.Credential,
 			pathPass conf.Credential) error {
-			return c.authenticate(ctx.Path, pathIPs, pathUser, pathPass, "read", ctx.Req, ctx.Query)
+			_, err := c.authenticate(ctx.Path, pathIPs, pathUser, pathPass, "read", ctx.Req, ctx.Query, "")
+			return err
 		},
-	})
+	}
+	res := c.pathManager.onDescribe(req)
+
+	if terr, ok := res.err.(pathErrAuthOverride); ok {
+		c.log(logger.Debug, "%s", terr.Error())
+		req.pathName = terr.pathName
+		req.authenticate = nil
+		res = c.pathManager.onDescribe(req)
+	}
 
 	if res.err != nil {
 		switch terr := res.err.(type) {
@@ -260,6 +381,8 @@ func (c *rtspConn) onDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx,
 			return terr.response, nil, nil
 
 		case pathErrAuthCritical:
+			c.onAuthFailure(terr)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtspConnPauseAfterAuthError)
 
@@ -270,6 +393,11 @@ func (c *rtspConn) onDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx,
 				StatusCode: base.StatusNotFound,
 			}, nil, res.err
 
+		case pathErrDraining:
+			return &base.Response{
+				StatusCode: base.StatusServiceUnavailable,
+			}, nil, res.err
+
 		default:
 			return &base.Response{
 				StatusCode: base.StatusBadRequest,
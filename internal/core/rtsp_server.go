@@ -6,15 +6,16 @@ import (
 	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/base"
 	"github.com/aler9/gortsplib/pkg/headers"
-	"github.com/aler9/gortsplib/pkg/liberrors"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
@@ -22,8 +23,9 @@ import (
 )
 
 type rtspServerAPISessionsListItem struct {
-	RemoteAddr string `json:"remoteAddr"`
-	State      string `json:"state"`
+	RemoteAddr    string               `json:"remoteAddr"`
+	State         string               `json:"state"`
+	RemainingTime *conf.StringDuration `json:"remainingTime"`
 }
 
 type rtspServerAPISessionsListData struct {
@@ -42,24 +44,41 @@ type rtspServerAPISessionsKickRes struct {
 }
 
 type rtspServerAPISessionsKickReq struct {
-	id string
+	id     string
+	reason string
+
+	// called before the session is kicked; the session is not kicked
+	// if it returns an error.
+	beforeKick func(remoteIP net.IP, user string) error
+}
+
+type rtspServerConfReloadReq struct {
+	readTimeout         conf.StringDuration
+	writeTimeout        conf.StringDuration
+	runOnConnect        string
+	runOnConnectRestart bool
+	runOnDisconnect     string
 }
 
 type rtspServerParent interface {
 	Log(logger.Level, string, ...interface{})
+	onSessionEnd()
 }
 
 type rtspServer struct {
 	externalAuthenticationURL string
 	authMethods               []headers.AuthMethod
-	readTimeout               conf.StringDuration
+	readTimeout               *int64 // time.Duration, accessed atomically
+	writeTimeout              *int64 // time.Duration, accessed atomically
 	isTLS                     bool
 	rtspAddress               string
 	protocols                 map[conf.Protocol]struct{}
 	runOnConnect              string
 	runOnConnectRestart       bool
+	runOnDisconnect           string
 	externalCmdPool           *externalcmd.Pool
-	metrics                   *metrics
+	banList                   *banList
+	externalAuthCache         *externalAuthCache
 	pathManager               *pathManager
 	parent                    rtspServerParent
 
@@ -95,8 +114,10 @@ func newRTSPServer(
 	protocols map[conf.Protocol]struct{},
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	externalCmdPool *externalcmd.Pool,
-	metrics *metrics,
+	banList *banList,
+	externalAuthCache *externalAuthCache,
 	pathManager *pathManager,
 	parent rtspServerParent) (*rtspServer, error) {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
@@ -104,12 +125,17 @@ func newRTSPServer(
 	s := &rtspServer{
 		externalAuthenticationURL: externalAuthenticationURL,
 		authMethods:               authMethods,
-		readTimeout:               readTimeout,
+		readTimeout:               new(int64),
+		writeTimeout:              new(int64),
 		isTLS:                     isTLS,
 		rtspAddress:               rtspAddress,
 		protocols:                 protocols,
+		runOnConnect:              runOnConnect,
+		runOnConnectRestart:       runOnConnectRestart,
+		runOnDisconnect:           runOnDisconnect,
 		externalCmdPool:           externalCmdPool,
-		metrics:                   metrics,
+		banList:                   banList,
+		externalAuthCache:         externalAuthCache,
 		pathManager:               pathManager,
 		parent:                    parent,
 		ctx:                       ctx,
@@ -118,6 +144,9 @@ func newRTSPServer(
 		sessions:                  make(map[*gortsplib.ServerSession]*rtspSession),
 	}
 
+	atomic.StoreInt64(s.readTimeout, int64(readTimeout))
+	atomic.StoreInt64(s.writeTimeout, int64(writeTimeout))
+
 	s.srv = &gortsplib.Server{
 		Handler:         s,
 		ReadTimeout:     time.Duration(readTimeout),
@@ -125,6 +154,16 @@ func newRTSPServer(
 		ReadBufferCount: readBufferCount,
 		ReadBufferSize:  readBufferSize,
 		RTSPAddress:     address,
+		Listen: func(network string, address string) (net.Listener, error) {
+			ln, err := net.Listen(network, address)
+			if err != nil {
+				return nil, err
+			}
+			return &rtspServerListener{
+				Listener: newBanListener(ln, banList),
+				s:        s,
+			}, nil
+		},
 	}
 
 	if useUDP {
@@ -166,20 +205,52 @@ func newRTSPServer(
 
 	s.log(logger.Info, "listener opened on "+strings.Join(temp, ", "))
 
-	if s.metrics != nil {
-		if !isTLS {
-			s.metrics.onRTSPServerSet(s)
-		} else {
-			s.metrics.onRTSPSServerSet(s)
-		}
-	}
-
 	s.wg.Add(1)
 	go s.run()
 
 	return s, nil
 }
 
+// rtspServerListener wraps the connections accepted by gortsplib,
+// in order to apply the current timeouts of the server.
+type rtspServerListener struct {
+	net.Listener
+	s *rtspServer
+}
+
+// Accept implements net.Listener.
+func (l *rtspServerListener) Accept() (net.Conn, error) {
+	nconn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rtspServerNetConn{Conn: nconn, s: l.s}, nil
+}
+
+// rtspServerNetConn replaces the deadlines set by gortsplib, that are computed
+// with the timeouts the server was started with, with deadlines computed with
+// the current timeouts.
+type rtspServerNetConn struct {
+	net.Conn
+	s *rtspServer
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *rtspServerNetConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		t = time.Now().Add(time.Duration(atomic.LoadInt64(c.s.readTimeout)))
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *rtspServerNetConn) SetWriteDeadline(t time.Time) error {
+	if !t.IsZero() {
+		t = time.Now().Add(time.Duration(atomic.LoadInt64(c.s.writeTimeout)))
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
 func (s *rtspServer) log(level logger.Level, format string, args ...interface{}) {
 	label := func() string {
 		if s.isTLS {
@@ -187,7 +258,7 @@ func (s *rtspServer) log(level logger.Level, format string, args ...interface{})
 		}
 		return "RTSP"
 	}()
-	s.parent.Log(level, "[%s] "+format, append([]interface{}{label}, args...)...)
+	s.parent.Log(level, format, append([]interface{}{logger.Component(label)}, args...)...)
 }
 
 func (s *rtspServer) close() {
@@ -217,14 +288,6 @@ outer:
 	}
 
 	s.ctxCancel()
-
-	if s.metrics != nil {
-		if !s.isTLS {
-			s.metrics.onRTSPServerSet(nil)
-		} else {
-			s.metrics.onRTSPSServerSet(nil)
-		}
-	}
 }
 
 func (s *rtspServer) newSessionID() (string, error) {
@@ -242,8 +305,8 @@ func (s *rtspServer) newSessionID() (string, error) {
 		id := strconv.FormatUint(uint64(u), 10)
 
 		alreadyPresent := func() bool {
-			for _, s := range s.sessions {
-				if s.ID() == id {
+			for _, se := range s.sessions {
+				if se.ID() == id {
 					return true
 				}
 			}
@@ -257,14 +320,24 @@ func (s *rtspServer) newSessionID() (string, error) {
 
 // OnConnOpen implements gortsplib.ServerHandlerOnConnOpen.
 func (s *rtspServer) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
+	s.mutex.RLock()
+	runOnConnect := s.runOnConnect
+	runOnConnectRestart := s.runOnConnectRestart
+	runOnDisconnect := s.runOnDisconnect
+	s.mutex.RUnlock()
+
 	c := newRTSPConn(
+		s.isTLS,
 		s.externalAuthenticationURL,
 		s.rtspAddress,
 		s.authMethods,
-		s.readTimeout,
-		s.runOnConnect,
-		s.runOnConnectRestart,
+		conf.StringDuration(atomic.LoadInt64(s.readTimeout)),
+		runOnConnect,
+		runOnConnectRestart,
+		runOnDisconnect,
 		s.externalCmdPool,
+		s.banList,
+		s.externalAuthCache,
 		s.pathManager,
 		ctx.Conn,
 		s)
@@ -331,6 +404,7 @@ func (s *rtspServer) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCt
 
 	if se != nil {
 		se.onClose(ctx.Error)
+		s.parent.onSessionEnd()
 	}
 }
 
@@ -382,7 +456,10 @@ func (s *rtspServer) OnPause(ctx *gortsplib.ServerHandlerOnPauseCtx) (*base.Resp
 	s.mutex.RLock()
 	se := s.sessions[ctx.Session]
 	s.mutex.RUnlock()
-	return se.onPause(ctx)
+
+	res, err := se.onPause(ctx)
+	s.parent.onSessionEnd()
+	return res, err
 }
 
 // OnPacketRTP implements gortsplib.ServerHandlerOnPacket.
@@ -401,6 +478,42 @@ func (s *rtspServer) OnPacketRTCP(ctx *gortsplib.ServerHandlerOnPacketRTCPCtx) {
 	se.onPacketRTCP(ctx)
 }
 
+// onConfReload is called by core.
+// The timeout of sessions that use UDP and the buffers of gortsplib keep
+// using the values the server was started with.
+func (s *rtspServer) onConfReload(req rtspServerConfReloadReq) {
+	atomic.StoreInt64(s.readTimeout, int64(req.readTimeout))
+	atomic.StoreInt64(s.writeTimeout, int64(req.writeTimeout))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.runOnConnect = req.runOnConnect
+	s.runOnConnectRestart = req.runOnConnectRestart
+	s.runOnDisconnect = req.runOnDisconnect
+}
+
+// notifyTeardown is called by core.
+func (s *rtspServer) notifyTeardown() {
+	writeTimeout := time.Duration(atomic.LoadInt64(s.writeTimeout))
+
+	s.mutex.RLock()
+	sessions := make([]*rtspSession, 0, len(s.sessions))
+	for _, se := range s.sessions {
+		sessions = append(sessions, se)
+	}
+	s.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, se := range sessions {
+		wg.Add(1)
+		go func(se *rtspSession) {
+			defer wg.Done()
+			se.notifyTeardown(writeTimeout)
+		}(se)
+	}
+	wg.Wait()
+}
+
 // onAPISessionsList is called by api and metrics.
 func (s *rtspServer) onAPISessionsList(req rtspServerAPISessionsListReq) rtspServerAPISessionsListRes {
 	select {
@@ -416,11 +529,11 @@ func (s *rtspServer) onAPISessionsList(req rtspServerAPISessionsListReq) rtspSer
 		Items: make(map[string]rtspServerAPISessionsListItem),
 	}
 
-	for _, s := range s.sessions {
-		data.Items[s.ID()] = rtspServerAPISessionsListItem{
-			RemoteAddr: s.RemoteAddr().String(),
+	for _, se := range s.sessions {
+		data.Items[se.ID()] = rtspServerAPISessionsListItem{
+			RemoteAddr: se.RemoteAddr().String(),
 			State: func() string {
-				switch s.safeState() {
+				switch se.safeState() {
 				case gortsplib.ServerSessionStatePreRead,
 					gortsplib.ServerSessionStateRead:
 					return "read"
@@ -431,6 +544,7 @@ func (s *rtspServer) onAPISessionsList(req rtspServerAPISessionsListReq) rtspSer
 				}
 				return "idle"
 			}(),
+			RemainingTime: se.remainingTime(),
 		}
 	}
 
@@ -445,17 +559,33 @@ func (s *rtspServer) onAPISessionsKick(req rtspServerAPISessionsKickReq) rtspSer
 	default:
 	}
 
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	se, err := func() (*rtspSession, error) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		for key, se := range s.sessions {
+			if se.ID() == req.id {
+				if req.beforeKick != nil {
+					err := req.beforeKick(se.RemoteAddr().(*net.TCPAddr).IP, se.safeUser())
+					if err != nil {
+						return nil, err
+					}
+				}
 
-	for key, se := range s.sessions {
-		if se.ID() == req.id {
-			se.close()
-			delete(s.sessions, key)
-			se.onClose(liberrors.ErrServerTerminated{})
-			return rtspServerAPISessionsKickRes{}
+				delete(s.sessions, key)
+				return se, nil
+			}
 		}
+
+		return nil, fmt.Errorf("not found")
+	}()
+	if err != nil {
+		return rtspServerAPISessionsKickRes{err: err}
 	}
 
-	return rtspServerAPISessionsKickRes{err: fmt.Errorf("not found")}
+	se.close()
+	se.onClose(kickError(req.reason))
+	s.parent.onSessionEnd()
+
+	return rtspServerAPISessionsKickRes{}
 }
@@ -1,14 +1,17 @@
 package core
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/aler9/gortsplib/pkg/headers"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
@@ -19,6 +22,49 @@ const (
 	pauseAfterAuthError = 2 * time.Second
 )
 
+// sessionExpiration returns the time after which a session that starts now must be closed,
+// that is the earliest between the limits of the external authentication and of the path.
+func sessionExpiration(authRes *externalAuthRes, pathConf *conf.PathConf) *time.Time {
+	var ret *time.Time
+
+	setIfEarlier := func(t time.Time) {
+		if ret == nil || t.Before(*ret) {
+			ret = &t
+		}
+	}
+
+	if pathConf.MaxSessionDuration != 0 {
+		setIfEarlier(time.Now().Add(time.Duration(pathConf.MaxSessionDuration)))
+	}
+
+	if authRes != nil {
+		if authRes.ExpiresAt != nil {
+			setIfEarlier(*authRes.ExpiresAt)
+		}
+
+		if authRes.MaxSessionDuration != nil && *authRes.MaxSessionDuration > 0 {
+			setIfEarlier(time.Now().Add(time.Duration(*authRes.MaxSessionDuration)))
+		}
+	}
+
+	return ret
+}
+
+// remainingTime returns the time left before an expiration, rounded to seconds.
+func remainingTime(expiresAt *time.Time) *conf.StringDuration {
+	if expiresAt == nil {
+		return nil
+	}
+
+	d := time.Until(*expiresAt).Truncate(time.Second)
+	if d < 0 {
+		d = 0
+	}
+
+	ret := conf.StringDuration(d)
+	return &ret
+}
+
 type rtspSessionPathManager interface {
 	onPublisherAnnounce(req pathPublisherAnnounceReq) pathPublisherAnnounceRes
 	onReaderSetupPlay(req pathReaderSetupPlayReq) pathReaderSetupPlayRes
@@ -39,12 +85,19 @@ type rtspSession struct {
 	parent          rtspSessionParent
 
 	path            *path
+	logPath         atomic.Value // logger.Field
+	query           string
+	user            string
 	state           gortsplib.ServerSessionState
 	stateMutex      sync.Mutex
 	setuppedTracks  map[int]gortsplib.Track // read
 	onReadCmd       *externalcmd.Cmd        // read
 	announcedTracks gortsplib.Tracks        // publish
 	stream          *stream                 // publish
+	expiresAt       *time.Time
+	expirationTimer *time.Timer
+	teardownConn    *gortsplib.ServerConn
+	teardownReq     *base.Request
 }
 
 func newRTSPSession(
@@ -77,6 +130,40 @@ func (s *rtspSession) close() {
 	s.ss.Close()
 }
 
+// setExpiration closes the session when the limits of authentication are reached.
+// When called multiple times, the earliest deadline is kept.
+func (s *rtspSession) setExpiration(authRes *externalAuthRes, pathConf *conf.PathConf) {
+	expiresAt := sessionExpiration(authRes, pathConf)
+	if expiresAt == nil {
+		return
+	}
+
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	if s.expiresAt != nil && !expiresAt.Before(*s.expiresAt) {
+		return
+	}
+
+	s.expiresAt = expiresAt
+
+	if s.expirationTimer != nil {
+		s.expirationTimer.Stop()
+	}
+
+	s.expirationTimer = time.AfterFunc(time.Until(*expiresAt), func() {
+		s.log(logger.Info, "session expired")
+		s.close()
+	})
+}
+
+// remainingTime returns the time left before the session expires, or nil if it doesn't expire.
+func (s *rtspSession) remainingTime() *conf.StringDuration {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return remainingTime(s.expiresAt)
+}
+
 // IsRTSPSession implements pathRTSPSession.
 func (s *rtspSession) IsRTSPSession() {}
 
@@ -91,23 +178,79 @@ func (s *rtspSession) safeState() gortsplib.ServerSessionState {
 	return s.state
 }
 
+func (s *rtspSession) safeUser() string {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.user
+}
+
 // RemoteAddr returns the remote address of the author of the session.
 func (s *rtspSession) RemoteAddr() net.Addr {
 	return s.author.NetConn().RemoteAddr()
 }
 
 func (s *rtspSession) log(level logger.Level, format string, args ...interface{}) {
-	s.parent.log(level, "[session %s] "+format, append([]interface{}{s.id}, args...)...)
+	fields := []interface{}{logger.Session(s.id)}
+	if f, ok := s.logPath.Load().(logger.Field); ok {
+		fields = append(fields, f)
+	}
+	s.parent.log(level, format, append(fields, args...)...)
+}
+
+// teardownRequest returns a TEARDOWN request that notifies the client that sent req
+// that the server is closing the session.
+func teardownRequest(req *base.Request) *base.Request {
+	var sx headers.Session
+	sx.Read(req.Header["Session"])
+
+	return &base.Request{
+		Method: base.Teardown,
+		URL:    req.URL.CloneWithoutCredentials(),
+		Header: base.Header{
+			"CSeq":    base.HeaderValue{"1"},
+			"Session": headers.Session{Session: sx.Session}.Write(),
+		},
+	}
+}
+
+// notifyTeardown sends a TEARDOWN request to a client that is reading or publishing.
+// Each message is written with a single Write(), therefore it can't be interleaved
+// with the messages and frames written by gortsplib.
+func (s *rtspSession) notifyTeardown(writeTimeout time.Duration) {
+	s.stateMutex.Lock()
+	sc := s.teardownConn
+	req := s.teardownReq
+	state := s.state
+	s.stateMutex.Unlock()
+
+	if state != gortsplib.ServerSessionStateRead && state != gortsplib.ServerSessionStatePublish {
+		return
+	}
+
+	var buf bytes.Buffer
+	req.Write(&buf)
+
+	nconn := sc.NetConn()
+	nconn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	nconn.Write(buf.Bytes())
 }
 
 // onClose is called by rtspServer.
 func (s *rtspSession) onClose(err error) {
+	s.stateMutex.Lock()
+	if s.expirationTimer != nil {
+		s.expirationTimer.Stop()
+	}
+	s.stateMutex.Unlock()
+
 	if s.ss.State() == gortsplib.ServerSessionStateRead {
 		if s.onReadCmd != nil {
 			s.onReadCmd.Close()
 			s.onReadCmd = nil
 			s.log(logger.Info, "runOnRead command stopped")
 		}
+
+		s.startOnUnreadCmd()
 	}
 
 	switch s.ss.State() {
@@ -125,16 +268,28 @@ func (s *rtspSession) onClose(err error) {
 
 // onAnnounce is called by rtspServer.
 func (s *rtspSession) onAnnounce(c *rtspConn, ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
-	res := s.pathManager.onPublisherAnnounce(pathPublisherAnnounceReq{
+	var authRes *externalAuthRes
+
+	req := pathPublisherAnnounceReq{
 		author:   s,
 		pathName: ctx.Path,
 		authenticate: func(
 			pathIPs []interface{},
 			pathUser conf.Credential,
 			pathPass conf.Credential) error {
-			return c.authenticate(ctx.Path, pathIPs, pathUser, pathPass, "publish", ctx.Req, ctx.Query)
+			var err error
+			authRes, err = c.authenticate(ctx.Path, pathIPs, pathUser, pathPass, "publish", ctx.Req, ctx.Query, s.id)
+			return err
 		},
-	})
+	}
+	res := s.pathManager.onPublisherAnnounce(req)
+
+	if terr, ok := res.err.(pathErrAuthOverride); ok {
+		s.log(logger.Debug, "%s", terr.Error())
+		req.pathName = terr.pathName
+		req.authenticate = nil
+		res = s.pathManager.onPublisherAnnounce(req)
+	}
 
 	if res.err != nil {
 		switch terr := res.err.(type) {
@@ -143,11 +298,18 @@ func (s *rtspSession) onAnnounce(c *rtspConn, ctx *gortsplib.ServerHandlerOnAnno
 			return terr.response, nil
 
 		case pathErrAuthCritical:
+			c.onAuthFailure(terr)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(pauseAfterAuthError)
 
 			return terr.response, errors.New(terr.message)
 
+		case pathErrDraining:
+			return &base.Response{
+				StatusCode: base.StatusServiceUnavailable,
+			}, res.err
+
 		default:
 			return &base.Response{
 				StatusCode: base.StatusBadRequest,
@@ -156,9 +318,13 @@ func (s *rtspSession) onAnnounce(c *rtspConn, ctx *gortsplib.ServerHandlerOnAnno
 	}
 
 	s.path = res.path
+	s.logPath.Store(res.path.logField())
+	s.query = ctx.Query
 	s.announcedTracks = ctx.Tracks
+	s.setExpiration(authRes, res.path.Conf())
 
 	s.stateMutex.Lock()
+	s.user = requestUser(ctx.Req)
 	s.state = gortsplib.ServerSessionStatePrePublish
 	s.stateMutex.Unlock()
 
@@ -184,16 +350,28 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 
 	switch s.ss.State() {
 	case gortsplib.ServerSessionStateInitial, gortsplib.ServerSessionStatePreRead: // play
-		res := s.pathManager.onReaderSetupPlay(pathReaderSetupPlayReq{
+		var authRes *externalAuthRes
+
+		req := pathReaderSetupPlayReq{
 			author:   s,
 			pathName: ctx.Path,
 			authenticate: func(
 				pathIPs []interface{},
 				pathUser conf.Credential,
 				pathPass conf.Credential) error {
-				return c.authenticate(ctx.Path, pathIPs, pathUser, pathPass, "read", ctx.Req, ctx.Query)
+				var err error
+				authRes, err = c.authenticate(ctx.Path, pathIPs, pathUser, pathPass, "read", ctx.Req, ctx.Query, s.id)
+				return err
 			},
-		})
+		}
+		res := s.pathManager.onReaderSetupPlay(req)
+
+		if terr, ok := res.err.(pathErrAuthOverride); ok {
+			s.log(logger.Debug, "%s", terr.Error())
+			req.pathName = terr.pathName
+			req.authenticate = nil
+			res = s.pathManager.onReaderSetupPlay(req)
+		}
 
 		if res.err != nil {
 			switch terr := res.err.(type) {
@@ -202,6 +380,8 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 				return terr.response, nil, nil
 
 			case pathErrAuthCritical:
+				c.onAuthFailure(terr)
+
 				// wait some seconds to stop brute force attacks
 				<-time.After(pauseAfterAuthError)
 
@@ -212,6 +392,11 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 					StatusCode: base.StatusNotFound,
 				}, nil, res.err
 
+			case pathErrDraining:
+				return &base.Response{
+					StatusCode: base.StatusServiceUnavailable,
+				}, nil, res.err
+
 			default:
 				return &base.Response{
 					StatusCode: base.StatusBadRequest,
@@ -220,6 +405,13 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 		}
 
 		s.path = res.path
+		s.logPath.Store(res.path.logField())
+		s.query = ctx.Query
+		s.setExpiration(authRes, res.path.Conf())
+
+		s.stateMutex.Lock()
+		s.user = requestUser(ctx.Req)
+		s.stateMutex.Unlock()
 
 		if ctx.TrackID >= len(res.stream.tracks()) {
 			return &base.Response{
@@ -260,7 +452,7 @@ func (s *rtspSession) onPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Respo
 				s.externalCmdPool,
 				s.path.Conf().RunOnRead,
 				s.path.Conf().RunOnReadRestart,
-				s.path.externalCmdEnv(),
+				s.path.externalCmdEnvWith(s.externalCmdEnv()),
 				func(co int) {
 					s.log(logger.Info, "runOnRead command exited with code %d", co)
 				})
@@ -268,6 +460,8 @@ func (s *rtspSession) onPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Respo
 
 		s.stateMutex.Lock()
 		s.state = gortsplib.ServerSessionStateRead
+		s.teardownConn = ctx.Conn
+		s.teardownReq = teardownRequest(ctx.Req)
 		s.stateMutex.Unlock()
 	}
 
@@ -293,6 +487,8 @@ func (s *rtspSession) onRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*base.R
 
 	s.stateMutex.Lock()
 	s.state = gortsplib.ServerSessionStatePublish
+	s.teardownConn = ctx.Conn
+	s.teardownReq = teardownRequest(ctx.Req)
 	s.stateMutex.Unlock()
 
 	return &base.Response{
@@ -309,6 +505,8 @@ func (s *rtspSession) onPause(ctx *gortsplib.ServerHandlerOnPauseCtx) (*base.Res
 			s.onReadCmd.Close()
 		}
 
+		s.startOnUnreadCmd()
+
 		s.path.onReaderPause(pathReaderPauseReq{author: s})
 
 		s.stateMutex.Lock()
@@ -328,6 +526,20 @@ func (s *rtspSession) onPause(ctx *gortsplib.ServerHandlerOnPauseCtx) (*base.Res
 	}, nil
 }
 
+func (s *rtspSession) startOnUnreadCmd() {
+	if s.path.Conf().RunOnUnread != "" {
+		s.log(logger.Info, "runOnUnread command started")
+		externalcmd.NewCmd(
+			s.externalCmdPool,
+			s.path.Conf().RunOnUnread,
+			false,
+			s.path.externalCmdEnvWith(s.externalCmdEnv()),
+			func(co int) {
+				s.log(logger.Info, "runOnUnread command exited with code %d", co)
+			})
+	}
+}
+
 // onReaderAccepted implements reader.
 func (s *rtspSession) onReaderAccepted() {
 	tracksLen := len(s.ss.SetuppedTracks())
@@ -345,7 +557,7 @@ func (s *rtspSession) onReaderAccepted() {
 }
 
 // onReaderPacketRTP implements reader.
-func (s *rtspSession) onReaderPacketRTP(trackID int, payload []byte) {
+func (s *rtspSession) onReaderPacketRTP(trackID int, payload []byte, ntp time.Time) {
 	// packets are routed to the session by gortsplib.ServerStream.
 }
 
@@ -398,6 +610,21 @@ func (s *rtspSession) onPublisherAccepted(tracksLen int) {
 		s.ss.SetuppedTransport())
 }
 
+// externalCmdEnv implements publisher.
+func (s *rtspSession) externalCmdEnv() externalcmd.Environment {
+	protocol := "rtsp"
+	if s.isTLS {
+		protocol = "rtsps"
+	}
+
+	return externalcmd.Environment{
+		"RTSP_REMOTE_IP":  s.author.NetConn().RemoteAddr().(*net.TCPAddr).IP.String(),
+		"RTSP_SESSION_ID": s.id,
+		"RTSP_PROTOCOL":   protocol,
+		"RTSP_QUERY":      s.query,
+	}
+}
+
 // onPacketRTP is called by rtspServer.
 func (s *rtspSession) onPacketRTP(ctx *gortsplib.ServerHandlerOnPacketRTPCtx) {
 	if s.ss.State() != gortsplib.ServerSessionStatePublish {
@@ -28,6 +28,7 @@ type rtspSourceParent interface {
 	log(logger.Level, string, ...interface{})
 	onSourceStaticSetReady(req pathSourceStaticSetReadyReq) pathSourceStaticSetReadyRes
 	onSourceStaticSetNotReady(req pathSourceStaticSetNotReadyReq)
+	onSourceStaticError(err error)
 }
 
 type rtspSource struct {
@@ -89,7 +90,9 @@ func (s *rtspSource) close() {
 }
 
 func (s *rtspSource) log(level logger.Level, format string, args ...interface{}) {
-	s.parent.log(level, "[rtsp source] "+format, args...)
+	s.parent.log(level, format, append([]interface{}{
+		logger.Field{Key: "source", Value: "rtsp", Prefix: "[rtsp source]"},
+	}, args...)...)
 }
 
 func (s *rtspSource) run() {
@@ -160,12 +163,14 @@ func (s *rtspSource) runInner() bool {
 	u, err := base.ParseURL(s.ur)
 	if err != nil {
 		s.log(logger.Info, "ERR: %s", err)
+		s.parent.onSourceStaticError(err)
 		return true
 	}
 
 	err = c.Start(u.Scheme, u.Host)
 	if err != nil {
 		s.log(logger.Info, "ERR: %s", err)
+		s.parent.onSourceStaticError(err)
 		return true
 	}
 	defer c.Close()
@@ -229,6 +234,7 @@ func (s *rtspSource) runInner() bool {
 	select {
 	case err := <-readErr:
 		s.log(logger.Info, "ERR: %s", err)
+		s.parent.onSourceStaticError(err)
 		return true
 
 	case <-s.ctx.Done():
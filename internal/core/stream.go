@@ -1,11 +1,122 @@
 package core
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/aac"
+	"github.com/pion/rtcp"
+
+	"github.com/aler9/rtsp-simple-server/internal/h264sps"
 )
 
+// seconds between 1900-01-01 (NTP epoch) and 1970-01-01 (Unix epoch).
+const ntpEpochOffset = 2208988800
+
+// period in which bitrates are measured.
+const streamStatsWindow = time.Second
+
+func ntpTimeToTime(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nanos := int64((v & 0xFFFFFFFF) * 1000000000 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+// streamTrackClock maps RTP timestamps of a track to wall-clock time.
+// The mapping is provided by RTCP sender reports, if available, otherwise
+// by the time of reception of the first packet.
+type streamTrackClock struct {
+	clockRate int
+
+	mutex       sync.Mutex
+	initialized bool
+	refRTP      uint32
+	refNTP      time.Time
+}
+
+func (c *streamTrackClock) onSenderReport(sr *rtcp.SenderReport) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.initialized = true
+	c.refRTP = sr.RTPTime
+	c.refNTP = ntpTimeToTime(sr.NTPTime)
+}
+
+func (c *streamTrackClock) ntpTime(payload []byte) time.Time {
+	if len(payload) < 8 {
+		return time.Now()
+	}
+	ts := binary.BigEndian.Uint32(payload[4:8])
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.initialized {
+		c.initialized = true
+		c.refRTP = ts
+		c.refNTP = time.Now()
+		return c.refNTP
+	}
+
+	// re-anchor the reference at every packet, in order to keep the difference
+	// between timestamps small and avoid wrapping when sender reports are missing
+	diff := time.Duration(int32(ts-c.refRTP)) * time.Second / time.Duration(c.clockRate)
+	c.refRTP = ts
+	c.refNTP = c.refNTP.Add(diff)
+	return c.refNTP
+}
+
+// streamTrackStats measures the bitrate and the reception time of the last packet of a track.
+type streamTrackStats struct {
+	mutex          sync.Mutex
+	bytesReceived  uint64
+	lastPacketTime time.Time
+	windowStart    time.Time
+	windowBytes    uint64
+	bitrate        uint64
+}
+
+func (s *streamTrackStats) onPacket(size int) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.bytesReceived += uint64(size)
+	s.lastPacketTime = now
+
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	}
+
+	elapsed := now.Sub(s.windowStart)
+	if elapsed >= streamStatsWindow {
+		s.bitrate = s.windowBytes * 8 * uint64(time.Second) / uint64(elapsed)
+		s.windowStart = now
+		s.windowBytes = 0
+	}
+
+	s.windowBytes += uint64(size)
+}
+
+func (s *streamTrackStats) get() (uint64, uint64, time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the track is not receiving packets anymore
+	if time.Since(s.lastPacketTime) >= 2*streamStatsWindow {
+		return s.bytesReceived, 0, s.lastPacketTime
+	}
+
+	return s.bytesReceived, s.bitrate, s.lastPacketTime
+}
+
 type streamNonRTSPReadersMap struct {
 	mutex sync.RWMutex
 	ma    map[reader]struct{}
@@ -35,12 +146,17 @@ func (m *streamNonRTSPReadersMap) remove(r reader) {
 	delete(m.ma, r)
 }
 
-func (m *streamNonRTSPReadersMap) forwardPacketRTP(trackID int, payload []byte) {
+func (m *streamNonRTSPReadersMap) forwardPacketRTP(trackID int, payload []byte, ntp time.Time) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
+	m.forwardPacketRTPUnlocked(trackID, payload, ntp)
+}
+
+// forwardPacketRTPUnlocked must be called with the mutex locked.
+func (m *streamNonRTSPReadersMap) forwardPacketRTPUnlocked(trackID int, payload []byte, ntp time.Time) {
 	for c := range m.ma {
-		c.onReaderPacketRTP(trackID, payload)
+		c.onReaderPacketRTP(trackID, payload, ntp)
 	}
 }
 
@@ -56,13 +172,36 @@ func (m *streamNonRTSPReadersMap) forwardPacketRTCP(trackID int, payload []byte)
 type stream struct {
 	nonRTSPReaders *streamNonRTSPReadersMap
 	rtspStream     *gortsplib.ServerStream
+	clocks         []*streamTrackClock
+	stats          []*streamTrackStats
+	keyframeCache  *streamKeyframeCache
+	gopCache       *streamGOPCache
+	created        time.Time
 }
 
-func newStream(tracks gortsplib.Tracks) *stream {
+func newStream(tracks gortsplib.Tracks, gopCache bool, keyframeCache bool, readBufferCount int) *stream {
 	s := &stream{
 		nonRTSPReaders: newStreamNonRTSPReadersMap(),
 		rtspStream:     gortsplib.NewServerStream(tracks),
+		created:        time.Now(),
 	}
+
+	if gopCache {
+		// leave room in the buffers of readers for the packets received during the replay
+		s.gopCache = newStreamGOPCache(tracks, readBufferCount/2)
+	}
+
+	s.clocks = make([]*streamTrackClock, len(tracks))
+	s.stats = make([]*streamTrackStats, len(tracks))
+	for i, track := range tracks {
+		s.clocks[i] = &streamTrackClock{clockRate: track.ClockRate()}
+		s.stats[i] = &streamTrackStats{}
+	}
+
+	if keyframeCache {
+		s.keyframeCacheStart()
+	}
+
 	return s
 }
 
@@ -75,10 +214,179 @@ func (s *stream) tracks() gortsplib.Tracks {
 	return s.rtspStream.Tracks()
 }
 
+// lastPacketTime returns the time of reception of the last packet of any track,
+// or the creation time of the stream if no packet has been received yet.
+func (s *stream) lastPacketTime() time.Time {
+	ret := s.created
+	for _, st := range s.stats {
+		st.mutex.Lock()
+		if st.lastPacketTime.After(ret) {
+			ret = st.lastPacketTime
+		}
+		st.mutex.Unlock()
+	}
+	return ret
+}
+
+// apiDescribe is called by path.
+func (s *stream) apiDescribe() *pathAPIPathsStreamData {
+	tracks := s.tracks()
+
+	data := &pathAPIPathsStreamData{
+		Tracks: make([]pathAPIPathsStreamTrack, len(tracks)),
+		SDP:    string(tracks.Write(false)),
+	}
+
+	for i, track := range tracks {
+		item := describeTrack(track)
+
+		bytesReceived, bitrate, lastPacketTime := s.stats[i].get()
+		item.BytesReceived = bytesReceived
+		item.Bitrate = bitrate
+		data.Bitrate += bitrate
+
+		if !lastPacketTime.IsZero() {
+			item.LastFrameTime = &lastPacketTime
+
+			if data.LastFrameTime == nil || lastPacketTime.After(*data.LastFrameTime) {
+				data.LastFrameTime = &lastPacketTime
+			}
+		}
+
+		data.Tracks[i] = item
+	}
+
+	return data
+}
+
+func h264ProfileName(profileIdc uint8, constraintFlags uint8) string {
+	switch profileIdc {
+	case 66:
+		if (constraintFlags & 0x40) != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+
+	case 77:
+		return "Main"
+
+	case 88:
+		return "Extended"
+
+	case 100:
+		return "High"
+
+	case 110:
+		return "High 10"
+
+	case 122:
+		return "High 4:2:2"
+
+	case 244:
+		return "High 4:4:4 Predictive"
+	}
+
+	return strconv.FormatInt(int64(profileIdc), 10)
+}
+
+func describeTrack(track gortsplib.Track) pathAPIPathsStreamTrack {
+	item := pathAPIPathsStreamTrack{
+		ClockRate: track.ClockRate(),
+	}
+
+	switch tt := track.(type) {
+	case *gortsplib.TrackH264:
+		item.Codec = "h264"
+
+		var sps h264sps.SPS
+		err := sps.Unmarshal(tt.SPS())
+		if err == nil {
+			item.H264 = &pathAPIPathsStreamTrackH264{
+				Profile: h264ProfileName(sps.ProfileIdc, sps.ConstraintFlags),
+				Level:   strconv.FormatInt(int64(sps.LevelIdc/10), 10) + "." + strconv.FormatInt(int64(sps.LevelIdc%10), 10),
+				Width:   sps.Width,
+				Height:  sps.Height,
+				FPS:     sps.FPS,
+			}
+		}
+
+	case *gortsplib.TrackAAC:
+		item.Codec = "aac"
+
+		item.AAC = &pathAPIPathsStreamTrackAAC{
+			Type:         tt.Type(),
+			SampleRate:   tt.ClockRate(),
+			ChannelCount: tt.ChannelCount(),
+		}
+
+		config, err := aac.MPEG4AudioConfig{
+			Type:              aac.MPEG4AudioType(tt.Type()),
+			SampleRate:        tt.ClockRate(),
+			ChannelCount:      tt.ChannelCount(),
+			AOTSpecificConfig: tt.AOTSpecificConfig(),
+		}.Encode()
+		if err == nil {
+			item.AAC.Config = hex.EncodeToString(config)
+		}
+
+	case *gortsplib.TrackOpus:
+		item.Codec = "opus"
+
+	default:
+		item.Codec = "generic"
+	}
+
+	return item
+}
+
+// keyframeCacheStart attaches the keyframe cache to the stream, if the stream has a H264 track.
+func (s *stream) keyframeCacheStart() {
+	s.keyframeCache = newStreamKeyframeCache(s.tracks())
+	if s.keyframeCache != nil {
+		s.readerAdd(s.keyframeCache)
+	}
+}
+
+// keyframe is called by path.
+// The keyframe cache is started on the first call, if it wasn't started with the stream.
+func (s *stream) keyframe() (*streamKeyframe, error) {
+	if s.keyframeCache == nil {
+		s.keyframeCacheStart()
+		if s.keyframeCache == nil {
+			return nil, fmt.Errorf("stream has no H264 track")
+		}
+	}
+	return s.keyframeCache.get()
+}
+
+// readerAdd adds a non-RTSP reader, that receives the packets of the GOP cache,
+// if enabled, before live packets. RTSP sessions read from the server stream
+// and don't receive cached packets, since the RTP-Info header sent to them
+// announces the next live packet.
 func (s *stream) readerAdd(r reader) {
-	if _, ok := r.(pathRTSPSession); !ok {
+	if _, ok := r.(pathRTSPSession); ok {
+		return
+	}
+
+	if s.gopCache == nil {
 		s.nonRTSPReaders.add(r)
+		return
 	}
+
+	s.gopCache.mutex.Lock()
+	entries := s.gopCache.cachedEntries()
+
+	// lock the readers before releasing the cache, in order to
+	// send the cached packets before the ones that are being received.
+	s.nonRTSPReaders.mutex.Lock()
+	defer s.nonRTSPReaders.mutex.Unlock()
+	s.gopCache.mutex.Unlock()
+
+	for _, e := range entries {
+		r.onReaderPacketRTP(e.trackID, e.payload, e.ntp)
+	}
+
+	s.nonRTSPReaders.ma[r] = struct{}{}
 }
 
 func (s *stream) readerRemove(r reader) {
@@ -88,14 +396,42 @@ func (s *stream) readerRemove(r reader) {
 }
 
 func (s *stream) onPacketRTP(trackID int, payload []byte) {
+	s.stats[trackID].onPacket(len(payload))
+
 	// forward to RTSP readers
 	s.rtspStream.WritePacketRTP(trackID, payload)
 
+	ntp := s.clocks[trackID].ntpTime(payload)
+
+	if s.gopCache == nil {
+		// forward to non-RTSP readers
+		s.nonRTSPReaders.forwardPacketRTP(trackID, payload, ntp)
+		return
+	}
+
+	s.gopCache.mutex.Lock()
+	s.gopCache.onPacketRTP(trackID, payload, ntp)
+
+	// lock the readers before releasing the cache, in order to
+	// prevent readers that are being added from receiving the packet twice.
+	s.nonRTSPReaders.mutex.RLock()
+	defer s.nonRTSPReaders.mutex.RUnlock()
+	s.gopCache.mutex.Unlock()
+
 	// forward to non-RTSP readers
-	s.nonRTSPReaders.forwardPacketRTP(trackID, payload)
+	s.nonRTSPReaders.forwardPacketRTPUnlocked(trackID, payload, ntp)
 }
 
 func (s *stream) onPacketRTCP(trackID int, payload []byte) {
+	// use sender reports to map RTP timestamps to wall-clock time
+	if pkts, err := rtcp.Unmarshal(payload); err == nil {
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok {
+				s.clocks[trackID].onSenderReport(sr)
+			}
+		}
+	}
+
 	// forward to RTSP readers
 	s.rtspStream.WritePacketRTCP(trackID, payload)
 
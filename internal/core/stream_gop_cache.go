@@ -0,0 +1,138 @@
+package core
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/pion/rtp"
+)
+
+// h264PacketStartsIDR returns true if a RTP/H264 packet contains the beginning of an IDR NALU.
+func h264PacketStartsIDR(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch payload[0] & 0x1F {
+	case 24: // STAP-A
+		buf := payload[1:]
+		for len(buf) >= 2 {
+			size := int(binary.BigEndian.Uint16(buf))
+			buf = buf[2:]
+
+			if size == 0 || size > len(buf) {
+				return false
+			}
+
+			if h264.NALUType(buf[0]&0x1F) == h264.NALUTypeIDR {
+				return true
+			}
+
+			buf = buf[size:]
+		}
+		return false
+
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return false
+		}
+
+		// start bit is set and the fragmented NALU is an IDR
+		return (payload[1]&0x80) != 0 && h264.NALUType(payload[1]&0x1F) == h264.NALUTypeIDR
+	}
+
+	return h264.NALUType(payload[0]&0x1F) == h264.NALUTypeIDR
+}
+
+type streamGOPCacheEntry struct {
+	trackID int
+	payload []byte
+	ntp     time.Time
+}
+
+// streamGOPCache keeps the packets received since the last H264 IDR,
+// in order to send them to new non-RTSP readers, that can start decoding immediately.
+type streamGOPCache struct {
+	videoTrackID int
+	maxPackets   int
+
+	// mutex is locked by stream until the readers map is locked,
+	// in order to prevent new readers from receiving the same packet twice.
+	mutex       sync.Mutex
+	entries     []streamGOPCacheEntry
+	valid       bool
+	auStart     int
+	auTimestamp uint32
+}
+
+func newStreamGOPCache(tracks gortsplib.Tracks, maxPackets int) *streamGOPCache {
+	for i, track := range tracks {
+		if _, ok := track.(*gortsplib.TrackH264); ok {
+			return &streamGOPCache{
+				videoTrackID: i,
+				maxPackets:   maxPackets,
+			}
+		}
+	}
+	return nil
+}
+
+// onPacketRTP must be called with the mutex locked.
+func (c *streamGOPCache) onPacketRTP(trackID int, payload []byte, ntp time.Time) {
+	if trackID == c.videoTrackID {
+		var pkt rtp.Packet
+		err := pkt.Unmarshal(payload)
+		if err != nil {
+			return
+		}
+
+		// a new access unit begins
+		if len(c.entries) == 0 || pkt.Timestamp != c.auTimestamp {
+			// until an IDR is found, keep only the current access unit
+			if !c.valid {
+				c.entries = c.entries[:0]
+			}
+
+			c.auStart = len(c.entries)
+			c.auTimestamp = pkt.Timestamp
+		}
+
+		// a new group begins with the access unit that contains the IDR,
+		// that may start with SPS and PPS
+		if h264PacketStartsIDR(pkt.Payload) {
+			if c.auStart > 0 {
+				c.entries = append([]streamGOPCacheEntry(nil), c.entries[c.auStart:]...)
+				c.auStart = 0
+			}
+			c.valid = true
+		}
+	} else if !c.valid {
+		return
+	}
+
+	// payloads point to buffers that are reused, copy them
+	c.entries = append(c.entries, streamGOPCacheEntry{
+		trackID: trackID,
+		payload: append([]byte(nil), payload...),
+		ntp:     ntp,
+	})
+
+	// the group is too long to be sent to readers without overflowing their buffers
+	if len(c.entries) > c.maxPackets {
+		c.entries = nil
+		c.valid = false
+		c.auStart = 0
+	}
+}
+
+// cachedEntries returns a copy of the current group.
+// It must be called with the mutex locked.
+func (c *streamGOPCache) cachedEntries() []streamGOPCacheEntry {
+	if !c.valid {
+		return nil
+	}
+	return append([]streamGOPCacheEntry(nil), c.entries...)
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/aler9/gortsplib/pkg/rtph264"
+	"github.com/pion/rtp"
+)
+
+// streamKeyframe is a H264 IDR access unit.
+type streamKeyframe struct {
+	sps   []byte
+	pps   []byte
+	nalus [][]byte
+	time  time.Time
+}
+
+// streamKeyframeCache is a stream reader that decodes the H264 track
+// and keeps the most recent IDR access unit.
+type streamKeyframeCache struct {
+	track   *gortsplib.TrackH264
+	trackID int
+
+	mutex    sync.Mutex
+	decoder  *rtph264.Decoder
+	sps      []byte
+	pps      []byte
+	keyframe *streamKeyframe
+}
+
+func newStreamKeyframeCache(tracks gortsplib.Tracks) *streamKeyframeCache {
+	for i, track := range tracks {
+		if tt, ok := track.(*gortsplib.TrackH264); ok {
+			return &streamKeyframeCache{
+				track:   tt,
+				trackID: i,
+				decoder: rtph264.NewDecoder(),
+			}
+		}
+	}
+	return nil
+}
+
+// close implements reader.
+func (c *streamKeyframeCache) close() {
+}
+
+// onReaderAccepted implements reader.
+func (c *streamKeyframeCache) onReaderAccepted() {
+}
+
+// onReaderPacketRTP implements reader.
+func (c *streamKeyframeCache) onReaderPacketRTP(trackID int, payload []byte, ntp time.Time) {
+	if trackID != c.trackID {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var pkt rtp.Packet
+	err := pkt.Unmarshal(payload)
+	if err != nil {
+		return
+	}
+
+	nalus, _, err := c.decoder.DecodeUntilMarker(&pkt)
+	if err != nil {
+		return
+	}
+
+	var sps []byte
+	var pps []byte
+	idrPresent := false
+
+	for _, nalu := range nalus {
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			sps = nalu
+
+		case h264.NALUTypePPS:
+			pps = nalu
+
+		case h264.NALUTypeIDR:
+			idrPresent = true
+		}
+	}
+
+	if sps == nil && pps == nil && !idrPresent {
+		return
+	}
+
+	// NALUs point to buffers that are reused, copy them
+	if sps != nil {
+		c.sps = append([]byte(nil), sps...)
+	}
+	if pps != nil {
+		c.pps = append([]byte(nil), pps...)
+	}
+
+	if idrPresent {
+		keyframe := &streamKeyframe{
+			nalus: make([][]byte, len(nalus)),
+			time:  time.Now(),
+		}
+		for i, nalu := range nalus {
+			keyframe.nalus[i] = append([]byte(nil), nalu...)
+		}
+		c.keyframe = keyframe
+	}
+}
+
+// onReaderPacketRTCP implements reader.
+func (c *streamKeyframeCache) onReaderPacketRTCP(trackID int, payload []byte) {
+}
+
+// onReaderAPIDescribe implements reader.
+func (c *streamKeyframeCache) onReaderAPIDescribe() interface{} {
+	return nil
+}
+
+// get returns the most recent keyframe, with the parameters that are needed to decode it.
+func (c *streamKeyframeCache) get() (*streamKeyframe, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.keyframe == nil {
+		return nil, fmt.Errorf("no keyframe received yet")
+	}
+
+	ret := *c.keyframe
+
+	// parameters sent in-band take precedence over the ones in the SDP
+	ret.sps = c.sps
+	if ret.sps == nil {
+		ret.sps = c.track.SPS()
+	}
+
+	ret.pps = c.pps
+	if ret.pps == nil {
+		ret.pps = c.track.PPS()
+	}
+
+	if len(ret.sps) == 0 || len(ret.pps) == 0 {
+		return nil, fmt.Errorf("SPS or PPS not received yet")
+	}
+
+	return &ret, nil
+}
+
+// annexB returns the keyframe in Annex-B format, with SPS and PPS at the beginning.
+func (k *streamKeyframe) annexB() ([]byte, error) {
+	nalus := [][]byte{k.sps, k.pps}
+
+	for _, nalu := range k.nalus {
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+			continue
+		}
+		nalus = append(nalus, nalu)
+	}
+
+	return h264.EncodeAnnexB(nalus)
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+type testStreamReader struct {
+	packets []testStreamReaderPacket
+}
+
+type testStreamReaderPacket struct {
+	trackID int
+	payload []byte
+}
+
+func (r *testStreamReader) close() {}
+
+func (r *testStreamReader) onReaderAccepted() {}
+
+func (r *testStreamReader) onReaderPacketRTP(trackID int, payload []byte, ntp time.Time) {
+	r.packets = append(r.packets, testStreamReaderPacket{trackID, payload})
+}
+
+func (r *testStreamReader) onReaderPacketRTCP(trackID int, payload []byte) {}
+
+func (r *testStreamReader) onReaderAPIDescribe() interface{} {
+	return nil
+}
+
+func TestStreamGOPCache(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{0x67, 0x01, 0x02, 0x03}, []byte{0x68, 0x01}, nil)
+	require.NoError(t, err)
+
+	audioTrack, err := gortsplib.NewTrackAAC(97, 2, 44100, 2, nil)
+	require.NoError(t, err)
+
+	s := newStream(gortsplib.Tracks{videoTrack, audioTrack}, true, false, 512)
+	defer s.close()
+
+	seq := uint16(0)
+	packet := func(ts uint32, marker bool, payload []byte) []byte {
+		seq++
+		byts, err := (&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    96,
+				SequenceNumber: seq,
+				Timestamp:      ts,
+				Marker:         marker,
+			},
+			Payload: payload,
+		}).Marshal()
+		require.NoError(t, err)
+		return byts
+	}
+
+	nonIDR1 := packet(0, true, []byte{0x01, 0x01})
+	sps := packet(3000, false, []byte{0x67, 0x01, 0x02, 0x03})
+	idrStart := packet(3000, false, []byte{0x7c, 0x85, 0x01})
+	idrEnd := packet(3000, true, []byte{0x7c, 0x45, 0x02})
+	audio := packet(4410, true, []byte{0x00, 0x10, 0x00, 0x08, 0x01})
+	nonIDR2 := packet(6000, true, []byte{0x01, 0x02})
+
+	s.onPacketRTP(0, nonIDR1)
+	s.onPacketRTP(0, sps)
+	s.onPacketRTP(0, idrStart)
+	s.onPacketRTP(0, idrEnd)
+	s.onPacketRTP(1, audio)
+	s.onPacketRTP(0, nonIDR2)
+
+	r := &testStreamReader{}
+	s.readerAdd(r)
+
+	// the group starts with the access unit that contains the IDR
+	require.Equal(t, []testStreamReaderPacket{
+		{0, sps},
+		{0, idrStart},
+		{0, idrEnd},
+		{1, audio},
+		{0, nonIDR2},
+	}, r.packets)
+
+	// live packets are received after the cached ones
+	nonIDR3 := packet(9000, true, []byte{0x01, 0x03})
+	s.onPacketRTP(0, nonIDR3)
+	require.Equal(t, testStreamReaderPacket{0, nonIDR3}, r.packets[len(r.packets)-1])
+	require.Equal(t, 6, len(r.packets))
+
+	// a new IDR resets the group
+	idr := packet(12000, true, []byte{0x65, 0x01})
+	s.onPacketRTP(0, idr)
+
+	r2 := &testStreamReader{}
+	s.readerAdd(r2)
+	require.Equal(t, []testStreamReaderPacket{{0, idr}}, r2.packets)
+}
+
+func TestStreamGOPCacheTooLong(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{0x67, 0x01, 0x02, 0x03}, []byte{0x68, 0x01}, nil)
+	require.NoError(t, err)
+
+	s := newStream(gortsplib.Tracks{videoTrack}, true, false, 8)
+	defer s.close()
+
+	for i := 0; i < 5; i++ {
+		nalu := []byte{0x01, 0x01}
+		if i == 0 {
+			nalu = []byte{0x65, 0x01}
+		}
+
+		byts, err := (&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    96,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 3000),
+				Marker:         true,
+			},
+			Payload: nalu,
+		}).Marshal()
+		require.NoError(t, err)
+
+		s.onPacketRTP(0, byts)
+	}
+
+	r := &testStreamReader{}
+	s.readerAdd(r)
+	require.Equal(t, 0, len(r.packets))
+}
+
+type testStreamRTSPReader struct {
+	testStreamReader
+}
+
+func (r *testStreamRTSPReader) IsRTSPSession() {}
+
+func TestStreamGOPCacheRTSPSession(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{0x67, 0x01, 0x02, 0x03}, []byte{0x68, 0x01}, nil)
+	require.NoError(t, err)
+
+	s := newStream(gortsplib.Tracks{videoTrack}, true, false, 512)
+	defer s.close()
+
+	byts, err := (&rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			PayloadType: 96,
+			Marker:      true,
+		},
+		Payload: []byte{0x65, 0x01},
+	}).Marshal()
+	require.NoError(t, err)
+	s.onPacketRTP(0, byts)
+
+	// RTSP sessions receive packets through the server stream,
+	// and cached packets are not replayed to them
+	r := &testStreamRTSPReader{}
+	s.readerAdd(r)
+	require.Equal(t, 0, len(r.packets))
+
+	s.onPacketRTP(0, byts)
+	require.Equal(t, 0, len(r.packets))
+	s.readerRemove(r)
+}
+
+func TestStreamKeyframeCache(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{0x67, 0x01, 0x02, 0x03}, []byte{0x68, 0x01}, nil)
+	require.NoError(t, err)
+
+	packet := func(seq uint16, nalu []byte) []byte {
+		byts, err := (&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    96,
+				SequenceNumber: seq,
+				Timestamp:      uint32(seq) * 3000,
+				Marker:         true,
+			},
+			Payload: nalu,
+		}).Marshal()
+		require.NoError(t, err)
+		return byts
+	}
+
+	t.Run("lazy", func(t *testing.T) {
+		s := newStream(gortsplib.Tracks{videoTrack}, false, false, 512)
+		defer s.close()
+
+		// packets are not decoded until a keyframe is requested
+		s.onPacketRTP(0, packet(0, []byte{0x65, 0x01}))
+		require.Nil(t, s.keyframeCache)
+
+		_, err := s.keyframe()
+		require.EqualError(t, err, "no keyframe received yet")
+
+		s.onPacketRTP(0, packet(1, []byte{0x65, 0x02}))
+
+		keyframe, err := s.keyframe()
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{{0x65, 0x02}}, keyframe.nalus)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		s := newStream(gortsplib.Tracks{videoTrack}, false, true, 512)
+		defer s.close()
+
+		s.onPacketRTP(0, packet(0, []byte{0x65, 0x01}))
+
+		keyframe, err := s.keyframe()
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{{0x65, 0x01}}, keyframe.nalus)
+	})
+}
+
+func TestStreamTrackClockNoSenderReports(t *testing.T) {
+	c := &streamTrackClock{clockRate: 90000}
+
+	packet := func(ts uint32) []byte {
+		byts, err := (&rtp.Packet{
+			Header: rtp.Header{
+				Version:     2,
+				PayloadType: 96,
+				Timestamp:   ts,
+			},
+		}).Marshal()
+		require.NoError(t, err)
+		return byts
+	}
+
+	start := c.ntpTime(packet(0))
+
+	// advance by more than 2^31 ticks without sender reports
+	var ts uint32
+	for i := 0; i < 3; i++ {
+		ts += 1 << 30
+		c.ntpTime(packet(ts))
+	}
+
+	ntp := c.ntpTime(packet(ts + 90000))
+	require.Equal(t, 3*(1<<30)*time.Second/90000+time.Second, ntp.Sub(start))
+}
@@ -6,7 +6,12 @@ import (
 )
 
 const (
-	restartPause = 5 * time.Second
+	// ExitCodeNotStarted is the exit code reported when a command can't be
+	// started, or when its exit code is not available.
+	// Commands that can't be started are not restarted.
+	ExitCodeNotStarted = -1
+
+	killTimeout = 10 * time.Second
 )
 
 // Environment is a Cmd environment.
@@ -53,6 +58,7 @@ func NewCmd(
 }
 
 // Close closes the command. It doesn't wait for the command to exit.
+// Commands that are not closed are terminated when the pool is closed.
 func (e *Cmd) Close() {
 	close(e.terminate)
 }
@@ -60,26 +66,50 @@ func (e *Cmd) Close() {
 func (e *Cmd) run() {
 	defer e.pool.wg.Done()
 
+	pause := e.pool.restartPause
+	restarts := 0
+
 	for {
 		ok := func() bool {
-			c, ok := e.runInner()
+			start := time.Now()
+
+			c, started, ok := e.runInner()
 			if !ok {
 				return false
 			}
 
-			e.onExit(c)
+			if e.onExit != nil {
+				e.onExit(c)
+			}
+
+			// reset the pause and the restart count
+			// if the command has been running for a while
+			if time.Since(start) >= e.pool.restartMaxPause {
+				pause = e.pool.restartPause
+				restarts = 0
+			}
 
-			if !e.restart {
-				<-e.terminate
+			if !e.restart ||
+				!started ||
+				(e.pool.maxRestarts > 0 && restarts >= e.pool.maxRestarts) {
 				return false
 			}
 
 			select {
-			case <-time.After(restartPause):
-				return true
+			case <-time.After(pause):
 			case <-e.terminate:
 				return false
+			case <-e.pool.terminate:
+				return false
 			}
+
+			restarts++
+			pause *= 2
+			if pause > e.pool.restartMaxPause {
+				pause = e.pool.restartMaxPause
+			}
+
+			return true
 		}()
 		if !ok {
 			break
@@ -7,14 +7,17 @@ import (
 	"os"
 	"os/exec"
 	"syscall"
+	"time"
 
 	"github.com/kballard/go-shellquote"
 )
 
-func (e *Cmd) runInner() (int, bool) {
+// runInner runs the command and returns its exit code, whether it has been started,
+// and whether it exited by itself (instead of being terminated).
+func (e *Cmd) runInner() (int, bool, bool) {
 	cmdparts, err := shellquote.Split(e.cmdstr)
-	if err != nil {
-		return 0, true
+	if err != nil || len(cmdparts) == 0 {
+		return ExitCodeNotStarted, false, true
 	}
 
 	cmd := exec.Command(cmdparts[0], cmdparts[1:]...)
@@ -29,7 +32,7 @@ func (e *Cmd) runInner() (int, bool) {
 
 	err = cmd.Start()
 	if err != nil {
-		return 0, true
+		return ExitCodeNotStarted, false, true
 	}
 
 	cmdDone := make(chan int)
@@ -41,7 +44,7 @@ func (e *Cmd) runInner() (int, bool) {
 			}
 			ee, ok := err.(*exec.ExitError)
 			if !ok {
-				return 0
+				return ExitCodeNotStarted
 			}
 			return ee.ExitCode()
 		}()
@@ -49,11 +52,20 @@ func (e *Cmd) runInner() (int, bool) {
 
 	select {
 	case <-e.terminate:
-		syscall.Kill(cmd.Process.Pid, syscall.SIGINT)
-		<-cmdDone
-		return 0, false
-
+	case <-e.pool.terminate:
 	case c := <-cmdDone:
-		return c, true
+		return c, true, true
+	}
+
+	syscall.Kill(cmd.Process.Pid, syscall.SIGINT)
+
+	// kill commands that ignore SIGINT
+	select {
+	case <-cmdDone:
+	case <-time.After(killTimeout):
+		cmd.Process.Kill()
+		<-cmdDone
 	}
+
+	return 0, true, false
 }
@@ -10,10 +10,12 @@ import (
 	"github.com/kballard/go-shellquote"
 )
 
-func (e *Cmd) runInner() (int, bool) {
+// runInner runs the command and returns its exit code, whether it has been started,
+// and whether it exited by itself (instead of being terminated).
+func (e *Cmd) runInner() (int, bool, bool) {
 	cmdparts, err := shellquote.Split(e.cmdstr)
-	if err != nil {
-		return 0, true
+	if err != nil || len(cmdparts) == 0 {
+		return ExitCodeNotStarted, false, true
 	}
 
 	cmd := exec.Command(cmdparts[0], cmdparts[1:]...)
@@ -28,7 +30,7 @@ func (e *Cmd) runInner() (int, bool) {
 
 	err = cmd.Start()
 	if err != nil {
-		return 0, true
+		return ExitCodeNotStarted, false, true
 	}
 
 	cmdDone := make(chan int)
@@ -40,7 +42,7 @@ func (e *Cmd) runInner() (int, bool) {
 			}
 			ee, ok := err.(*exec.ExitError)
 			if !ok {
-				return 0
+				return ExitCodeNotStarted
 			}
 			return ee.ExitCode()
 		}()
@@ -48,13 +50,14 @@ func (e *Cmd) runInner() (int, bool) {
 
 	select {
 	case <-e.terminate:
-		// on Windows, it's not possible to send os.Interrupt to a process.
-		// Kill() is the only supported way.
-		cmd.Process.Kill()
-		<-cmdDone
-		return 0, false
-
+	case <-e.pool.terminate:
 	case c := <-cmdDone:
-		return c, true
+		return c, true, true
 	}
+
+	// on Windows, it's not possible to send os.Interrupt to a process.
+	// Kill() is the only supported way.
+	cmd.Process.Kill()
+	<-cmdDone
+	return 0, true, false
 }
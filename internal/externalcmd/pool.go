@@ -2,19 +2,43 @@ package externalcmd
 
 import (
 	"sync"
+	"time"
 )
 
 // Pool is a pool of external commands.
 type Pool struct {
-	wg sync.WaitGroup
+	restartPause    time.Duration
+	restartMaxPause time.Duration
+	maxRestarts     int
+
+	wg        sync.WaitGroup
+	terminate chan struct{}
 }
 
 // NewPool allocates a Pool.
-func NewPool() *Pool {
-	return &Pool{}
+// Commands are restarted after restartPause; the pause is doubled after every
+// consecutive restart, up to restartMaxPause. If maxRestarts is greater
+// than zero, commands are not restarted anymore after maxRestarts restarts.
+func NewPool(
+	restartPause time.Duration,
+	restartMaxPause time.Duration,
+	maxRestarts int,
+) *Pool {
+	if restartMaxPause < restartPause {
+		restartMaxPause = restartPause
+	}
+
+	return &Pool{
+		restartPause:    restartPause,
+		restartMaxPause: restartMaxPause,
+		maxRestarts:     maxRestarts,
+		terminate:       make(chan struct{}),
+	}
 }
 
-// Close waits for all external commands to exit.
+// Close terminates the external commands that are still running,
+// including the ones that were not closed, and waits for them to exit.
 func (p *Pool) Close() {
+	close(p.terminate)
 	p.wg.Wait()
 }
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package externalcmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolCloseTerminatesCommands(t *testing.T) {
+	p := NewPool(time.Second, time.Second, 0)
+
+	exited := make(chan int, 1)
+	NewCmd(p, "sleep 100", false, nil, func(co int) {
+		exited <- co
+	})
+
+	// wait for the command to start
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("pool did not close")
+	}
+
+	require.Equal(t, 0, len(exited))
+}
+
+func TestCmdNotStarted(t *testing.T) {
+	p := NewPool(10*time.Millisecond, 10*time.Millisecond, 0)
+	defer p.Close()
+
+	exited := make(chan int, 10)
+	NewCmd(p, "/nonexisting/command", true, nil, func(co int) {
+		exited <- co
+	})
+
+	require.Equal(t, ExitCodeNotStarted, <-exited)
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, len(exited))
+}
@@ -0,0 +1,76 @@
+package h264sps
+
+import (
+	"fmt"
+)
+
+var errBufferTooShort = fmt.Errorf("buffer is too short")
+
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) readBits(n int) (uint32, error) {
+	if n > 32 {
+		return 0, fmt.Errorf("can't read more than 32 bits")
+	}
+
+	if (r.pos + n) > len(r.buf)*8 {
+		return 0, errBufferTooShort
+	}
+
+	var v uint32
+	for i := 0; i < n; i++ {
+		b := (r.buf[r.pos>>3] >> (7 - (r.pos & 0x07))) & 0x01
+		v = (v << 1) | uint32(b)
+		r.pos++
+	}
+
+	return v, nil
+}
+
+func (r *bitReader) readFlag() (bool, error) {
+	v, err := r.readBits(1)
+	return v == 1, err
+}
+
+// readGolombUnsigned reads an unsigned Exp-Golomb code (ue(v)).
+func (r *bitReader) readGolombUnsigned() (uint32, error) {
+	leadingZeros := 0
+	for {
+		b, err := r.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+
+		if b != 0 {
+			break
+		}
+
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, fmt.Errorf("invalid Exp-Golomb code")
+		}
+	}
+
+	v, err := r.readBits(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+
+	return (1 << leadingZeros) - 1 + v, nil
+}
+
+// readGolombSigned reads a signed Exp-Golomb code (se(v)).
+func (r *bitReader) readGolombSigned() (int32, error) {
+	v, err := r.readGolombUnsigned()
+	if err != nil {
+		return 0, err
+	}
+
+	if (v & 0x01) != 0 {
+		return int32((v + 1) / 2), nil
+	}
+	return -int32(v / 2), nil
+}
@@ -0,0 +1,385 @@
+// Package h264sps contains a H264 sequence parameter set (SPS) parser.
+package h264sps
+
+import (
+	"fmt"
+
+	"github.com/aler9/gortsplib/pkg/h264"
+)
+
+// SPS is a H264 sequence parameter set.
+type SPS struct {
+	ProfileIdc      uint8
+	ConstraintFlags uint8
+	LevelIdc        uint8
+	ChromaFormatIdc uint32
+	Width           int
+	Height          int
+
+	// FPS is filled only when timing informations are present, otherwise it's zero.
+	FPS float64
+}
+
+func profileHasChromaInfo(profileIdc uint8) bool {
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	lastScale := int32(8)
+	nextScale := int32(8)
+
+	for j := 0; j < size; j++ {
+		if nextScale != 0 {
+			delta, err := r.readGolombSigned()
+			if err != nil {
+				return err
+			}
+
+			nextScale = (lastScale + delta + 256) % 256
+		}
+
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+
+	return nil
+}
+
+// Unmarshal decodes a SPS from a NALU, including the NALU header.
+func (s *SPS) Unmarshal(buf []byte) error {
+	if len(buf) < 4 {
+		return errBufferTooShort
+	}
+
+	typ := h264.NALUType(buf[0] & 0x1F)
+	if typ != h264.NALUTypeSPS {
+		return fmt.Errorf("not a SPS")
+	}
+
+	s.ProfileIdc = buf[1]
+	s.ConstraintFlags = buf[2]
+	s.LevelIdc = buf[3]
+	s.ChromaFormatIdc = 1
+	s.FPS = 0
+
+	r := &bitReader{buf: h264.AntiCompetitionRemove(buf[4:])}
+
+	// seq_parameter_set_id
+	_, err := r.readGolombUnsigned()
+	if err != nil {
+		return err
+	}
+
+	separateColourPlane := false
+
+	if profileHasChromaInfo(s.ProfileIdc) {
+		s.ChromaFormatIdc, err = r.readGolombUnsigned()
+		if err != nil {
+			return err
+		}
+
+		if s.ChromaFormatIdc == 3 {
+			separateColourPlane, err = r.readFlag()
+			if err != nil {
+				return err
+			}
+		}
+
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		for i := 0; i < 2; i++ {
+			_, err = r.readGolombUnsigned()
+			if err != nil {
+				return err
+			}
+		}
+
+		// qpprime_y_zero_transform_bypass_flag
+		_, err = r.readFlag()
+		if err != nil {
+			return err
+		}
+
+		seqScalingMatrixPresent, err := r.readFlag()
+		if err != nil {
+			return err
+		}
+
+		if seqScalingMatrixPresent {
+			count := 8
+			if s.ChromaFormatIdc == 3 {
+				count = 12
+			}
+
+			for i := 0; i < count; i++ {
+				present, err := r.readFlag()
+				if err != nil {
+					return err
+				}
+
+				if present {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+
+					err = skipScalingList(r, size)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	_, err = r.readGolombUnsigned()
+	if err != nil {
+		return err
+	}
+
+	picOrderCntType, err := r.readGolombUnsigned()
+	if err != nil {
+		return err
+	}
+
+	switch picOrderCntType {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		_, err = r.readGolombUnsigned()
+		if err != nil {
+			return err
+		}
+
+	case 1:
+		// delta_pic_order_always_zero_flag
+		_, err = r.readFlag()
+		if err != nil {
+			return err
+		}
+
+		// offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		for i := 0; i < 2; i++ {
+			_, err = r.readGolombSigned()
+			if err != nil {
+				return err
+			}
+		}
+
+		numRefFramesInPicOrderCntCycle, err := r.readGolombUnsigned()
+		if err != nil {
+			return err
+		}
+
+		for i := uint32(0); i < numRefFramesInPicOrderCntCycle; i++ {
+			_, err = r.readGolombSigned()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// max_num_ref_frames
+	_, err = r.readGolombUnsigned()
+	if err != nil {
+		return err
+	}
+
+	// gaps_in_frame_num_value_allowed_flag
+	_, err = r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	picWidthInMbsMinus1, err := r.readGolombUnsigned()
+	if err != nil {
+		return err
+	}
+
+	picHeightInMapUnitsMinus1, err := r.readGolombUnsigned()
+	if err != nil {
+		return err
+	}
+
+	frameMbsOnly, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	if !frameMbsOnly {
+		// mb_adaptive_frame_field_flag
+		_, err = r.readFlag()
+		if err != nil {
+			return err
+		}
+	}
+
+	// direct_8x8_inference_flag
+	_, err = r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	frameCropping, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+
+	if frameCropping {
+		for _, v := range []*uint32{&cropLeft, &cropRight, &cropTop, &cropBottom} {
+			*v, err = r.readGolombUnsigned()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	frameHeightFactor := 2
+	if frameMbsOnly {
+		frameHeightFactor = 1
+	}
+
+	cropUnitX := 1
+	cropUnitY := frameHeightFactor
+
+	if !separateColourPlane && s.ChromaFormatIdc != 0 {
+		subWidthC := 2
+		subHeightC := 2
+
+		switch s.ChromaFormatIdc {
+		case 2:
+			subHeightC = 1
+
+		case 3:
+			subWidthC = 1
+			subHeightC = 1
+		}
+
+		cropUnitX = subWidthC
+		cropUnitY = subHeightC * frameHeightFactor
+	}
+
+	s.Width = int(picWidthInMbsMinus1+1)*16 -
+		cropUnitX*int(cropLeft+cropRight)
+	s.Height = frameHeightFactor*int(picHeightInMapUnitsMinus1+1)*16 -
+		cropUnitY*int(cropTop+cropBottom)
+
+	vuiParametersPresent, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	if vuiParametersPresent {
+		err = s.readVUI(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SPS) readVUI(r *bitReader) error {
+	aspectRatioInfoPresent, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	if aspectRatioInfoPresent {
+		aspectRatioIdc, err := r.readBits(8)
+		if err != nil {
+			return err
+		}
+
+		// extended SAR: sar_width, sar_height
+		if aspectRatioIdc == 255 {
+			_, err = r.readBits(32)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	overscanInfoPresent, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	if overscanInfoPresent {
+		// overscan_appropriate_flag
+		_, err = r.readFlag()
+		if err != nil {
+			return err
+		}
+	}
+
+	videoSignalTypePresent, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	if videoSignalTypePresent {
+		// video_format, video_full_range_flag
+		_, err = r.readBits(4)
+		if err != nil {
+			return err
+		}
+
+		colourDescriptionPresent, err := r.readFlag()
+		if err != nil {
+			return err
+		}
+
+		if colourDescriptionPresent {
+			// colour_primaries, transfer_characteristics, matrix_coefficients
+			_, err = r.readBits(24)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	chromaLocInfoPresent, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	if chromaLocInfoPresent {
+		// chroma_sample_loc_type_top_field, chroma_sample_loc_type_bottom_field
+		for i := 0; i < 2; i++ {
+			_, err = r.readGolombUnsigned()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	timingInfoPresent, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+
+	if timingInfoPresent {
+		numUnitsInTick, err := r.readBits(32)
+		if err != nil {
+			return err
+		}
+
+		timeScale, err := r.readBits(32)
+		if err != nil {
+			return err
+		}
+
+		if numUnitsInTick != 0 {
+			s.FPS = float64(timeScale) / float64(2*numUnitsInTick)
+		}
+	}
+
+	return nil
+}
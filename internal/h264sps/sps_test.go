@@ -0,0 +1,71 @@
+package h264sps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshal(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		byts []byte
+		sps  SPS
+	}{
+		{
+			"high 1920x1080",
+			[]byte{
+				0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78,
+				0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03,
+				0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+				0x60, 0xc6, 0x58,
+			},
+			SPS{
+				ProfileIdc:      100,
+				ConstraintFlags: 0,
+				LevelIdc:        40,
+				ChromaFormatIdc: 1,
+				Width:           1920,
+				Height:          1080,
+				FPS:             30,
+			},
+		},
+		{
+			"baseline 640x480",
+			[]byte{
+				0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x3d,
+				0xb0, 0x11, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00,
+				0x00, 0x03, 0x00, 0x32, 0x8f, 0x16, 0x2e, 0x48,
+			},
+			SPS{
+				ProfileIdc:      66,
+				ConstraintFlags: 0xc0,
+				LevelIdc:        30,
+				ChromaFormatIdc: 1,
+				Width:           640,
+				Height:          480,
+				FPS:             25,
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var sps SPS
+			err := sps.Unmarshal(ca.byts)
+			require.NoError(t, err)
+			require.Equal(t, ca.sps, sps)
+		})
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var sps SPS
+
+	err := sps.Unmarshal([]byte{0x67, 0x42})
+	require.EqualError(t, err, "buffer is too short")
+
+	err = sps.Unmarshal([]byte{0x68, 0x42, 0xc0, 0x1e, 0xd9})
+	require.EqualError(t, err, "not a SPS")
+
+	err = sps.Unmarshal([]byte{0x67, 0x42, 0xc0, 0x1e, 0xd9})
+	require.EqualError(t, err, "buffer is too short")
+}
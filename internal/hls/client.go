@@ -123,7 +123,9 @@ func (q *clientSegmentQueue) waitAndPull(ctx context.Context) ([]byte, error) {
 }
 
 type clientAllocateProcsReq struct {
-	res chan struct{}
+	video bool
+	audio bool
+	res   chan struct{}
 }
 
 type clientVideoProcessorData struct {
@@ -408,9 +410,10 @@ type ClientParent interface {
 
 // Client is a HLS client.
 type Client struct {
-	onTracks func(gortsplib.Track, gortsplib.Track) error
-	onPacket func(bool, []byte)
-	parent   ClientParent
+	variantPolicy string
+	onTracks      func(gortsplib.Track, gortsplib.Track) error
+	onPacket      func(bool, []byte)
+	parent        ClientParent
 
 	ctx                   context.Context
 	ctxCancel             func()
@@ -419,15 +422,20 @@ type Client struct {
 	httpClient            *http.Client
 	lastDownloadTime      time.Time
 	downloadedSegmentURIs []string
+	downloadedMapURI      string
+	lastKeyURI            string
+	lastKey               []byte
 	segmentQueue          *clientSegmentQueue
 	pmtDownloaded         bool
 	clockInitialized      bool
 	clockStartPTS         time.Duration
 
-	videoPID  *uint16
-	audioPID  *uint16
-	videoProc *clientVideoProcessor
-	audioProc *clientAudioProcessor
+	videoPID       *uint16
+	audioPID       *uint16
+	fmp4Init       *clientFMP4Init
+	fmp4ParamsSent bool
+	videoProc      *clientVideoProcessor
+	audioProc      *clientAudioProcessor
 
 	tracksMutex sync.RWMutex
 	videoTrack  gortsplib.Track
@@ -441,9 +449,12 @@ type Client struct {
 }
 
 // NewClient allocates a Client.
+// variantPolicy is the policy used to choose a variant when the playlist
+// contains multiple variants: "highest", "lowest" or "WIDTHxHEIGHT".
 func NewClient(
 	primaryPlaylistURLStr string,
 	fingerprint string,
+	variantPolicy string,
 	onTracks func(gortsplib.Track, gortsplib.Track) error,
 	onPacket func(bool, []byte),
 	parent ClientParent,
@@ -477,6 +488,7 @@ func NewClient(
 	}
 
 	c := &Client{
+		variantPolicy:      variantPolicy,
 		onTracks:           onTracks,
 		onPacket:           onPacket,
 		parent:             parent,
@@ -527,21 +539,25 @@ func (c *Client) runInner() error {
 	for {
 		select {
 		case req := <-c.allocateProcs:
-			if c.videoPID != nil {
+			if req.video {
 				c.videoProc = newClientVideoProcessor(
 					innerCtx,
 					c.onVideoTrack,
 					c.onVideoPacket)
-
-				go func() { errChan <- c.videoProc.run() }()
 			}
 
-			if c.audioPID != nil {
+			if req.audio {
 				c.audioProc = newClientAudioProcessor(
 					innerCtx,
 					c.onAudioTrack,
 					c.onAudioPacket)
+			}
 
+			if c.videoProc != nil {
+				go func() { errChan <- c.videoProc.run() }()
+			}
+
+			if c.audioProc != nil {
 				go func() { errChan <- c.audioProc.run() }()
 			}
 
@@ -613,14 +629,43 @@ func (c *Client) fillSegmentQueue(innerCtx context.Context) (bool, error) {
 
 	added := false
 
-	for _, seg := range pl.Segments {
+	// EXT-X-KEY and EXT-X-MAP apply to all the following segments,
+	// therefore they must be tracked even when segments are skipped.
+	var key *m3u8.Key
+	var mapp *m3u8.Map
+	var mapKey *m3u8.Key
+
+	for i, seg := range pl.Segments {
 		if seg == nil {
 			break
 		}
 
+		if seg.Key != nil {
+			key = seg.Key
+		}
+
+		// the initialization section is encrypted with the key that
+		// is in effect when it is declared.
+		if seg.Map != nil {
+			mapp = seg.Map
+			mapKey = key
+		}
+
 		if !c.segmentWasDownloaded(seg.URI) {
 			c.downloadedSegmentURIs = append(c.downloadedSegmentURIs, seg.URI)
-			byts, err := c.downloadSegment(innerCtx, seg.URI)
+			seqNo := pl.SeqNo + uint64(i)
+
+			if mapp != nil && mapp.URI != c.downloadedMapURI {
+				byts, err := c.downloadSegment(innerCtx, mapp.URI, mapKey, nil)
+				if err != nil {
+					return false, err
+				}
+
+				c.downloadedMapURI = mapp.URI
+				c.segmentQueue.push(byts)
+			}
+
+			byts, err := c.downloadSegment(innerCtx, seg.URI, key, &seqNo)
 			if err != nil {
 				return false, err
 			}
@@ -656,18 +701,13 @@ func (c *Client) downloadPrimaryPlaylist(innerCtx context.Context) (*m3u8.MediaP
 		return plt, nil
 
 	case *m3u8.MasterPlaylist:
-		// choose the variant with the highest bandwidth
-		var chosenVariant *m3u8.Variant
-		for _, v := range plt.Variants {
-			if chosenVariant == nil ||
-				v.VariantParams.Bandwidth > chosenVariant.VariantParams.Bandwidth {
-				chosenVariant = v
-			}
+		chosenVariant, err := clientChooseVariant(plt.Variants, c.variantPolicy)
+		if err != nil {
+			return nil, err
 		}
 
-		if chosenVariant == nil {
-			return nil, fmt.Errorf("no variants found")
-		}
+		c.log(logger.Debug, "chosen variant %s (bandwidth %d, resolution '%s')",
+			chosenVariant.URI, chosenVariant.VariantParams.Bandwidth, chosenVariant.VariantParams.Resolution)
 
 		u, err := clientURLAbsolute(c.primaryPlaylistURL, chosenVariant.URI)
 		if err != nil {
@@ -723,13 +763,76 @@ func (c *Client) downloadPlaylist(innerCtx context.Context, ur *url.URL) (m3u8.P
 	return pl, nil
 }
 
-func (c *Client) downloadSegment(innerCtx context.Context, segmentURI string) ([]byte, error) {
+func (c *Client) downloadSegment(
+	innerCtx context.Context,
+	segmentURI string,
+	key *m3u8.Key,
+	seqNo *uint64,
+) ([]byte, error) {
 	u, err := clientURLAbsolute(c.streamPlaylistURL, segmentURI)
 	if err != nil {
 		return nil, err
 	}
 
 	c.log(logger.Debug, "downloading segment %s", u)
+	byts, err := c.download(innerCtx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return byts, nil
+	}
+
+	switch key.Method {
+	case "", "NONE":
+		return byts, nil
+
+	case "AES-128":
+		keyByts, err := c.downloadKey(innerCtx, key.URI)
+		if err != nil {
+			return nil, err
+		}
+
+		iv, err := clientKeyIV(key, seqNo)
+		if err != nil {
+			return nil, err
+		}
+
+		return clientDecryptAES128(keyByts, iv, byts)
+
+	default:
+		return nil, fmt.Errorf("unsupported encryption method: %s", key.Method)
+	}
+}
+
+func (c *Client) downloadKey(innerCtx context.Context, keyURI string) ([]byte, error) {
+	// keys are rotated over time, therefore only the last one is kept
+	if c.lastKey != nil && keyURI == c.lastKeyURI {
+		return c.lastKey, nil
+	}
+
+	u, err := clientURLAbsolute(c.streamPlaylistURL, keyURI)
+	if err != nil {
+		return nil, err
+	}
+
+	c.log(logger.Debug, "downloading key %s", u)
+	byts, err := c.download(innerCtx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(byts) != 16 {
+		return nil, fmt.Errorf("invalid key size: %d", len(byts))
+	}
+
+	c.lastKeyURI = keyURI
+	c.lastKey = byts
+	return byts, nil
+}
+
+func (c *Client) download(innerCtx context.Context, u *url.URL) ([]byte, error) {
 	req, err := http.NewRequestWithContext(innerCtx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
@@ -768,6 +871,43 @@ func (c *Client) runProcessor(innerCtx context.Context) error {
 }
 
 func (c *Client) processSegment(innerCtx context.Context, byts []byte) error {
+	if len(byts) > 0 && byts[0] == 0x47 {
+		return c.processSegmentTS(innerCtx, byts)
+	}
+
+	return c.processSegmentFMP4(innerCtx, byts)
+}
+
+func (c *Client) allocateProcessors(innerCtx context.Context, video bool, audio bool) bool {
+	res := make(chan struct{})
+	select {
+	case c.allocateProcs <- clientAllocateProcsReq{video, audio, res}:
+		<-res
+		return true
+	case <-innerCtx.Done():
+		return false
+	}
+}
+
+func (c *Client) initializeClock(pts time.Duration) {
+	if c.clockInitialized {
+		return
+	}
+
+	c.clockInitialized = true
+	c.clockStartPTS = pts
+	now := time.Now()
+
+	if c.videoProc != nil {
+		c.videoProc.clockStartRTC = now
+	}
+
+	if c.audioProc != nil {
+		c.audioProc.clockStartRTC = now
+	}
+}
+
+func (c *Client) processSegmentTS(innerCtx context.Context, byts []byte) error {
 	dem := astits.NewDemuxer(context.Background(), bytes.NewReader(byts))
 
 	// parse PMT
@@ -811,11 +951,7 @@ func (c *Client) processSegment(innerCtx context.Context, byts []byte) error {
 			return fmt.Errorf("stream doesn't contain tracks with supported codecs (H264 or AAC)")
 		}
 
-		res := make(chan struct{})
-		select {
-		case c.allocateProcs <- clientAllocateProcsReq{res}:
-			<-res
-		case <-innerCtx.Done():
+		if !c.allocateProcessors(innerCtx, c.videoPID != nil, c.audioPID != nil) {
 			return nil
 		}
 	}
@@ -845,19 +981,7 @@ func (c *Client) processSegment(innerCtx context.Context, byts []byte) error {
 
 		pts := time.Duration(float64(data.PES.Header.OptionalHeader.PTS.Base) * float64(time.Second) / 90000)
 
-		if !c.clockInitialized {
-			c.clockInitialized = true
-			c.clockStartPTS = pts
-			now := time.Now()
-
-			if c.videoPID != nil {
-				c.videoProc.clockStartRTC = now
-			}
-
-			if c.audioPID != nil {
-				c.audioProc.clockStartRTC = now
-			}
-		}
+		c.initializeClock(pts)
 
 		if c.videoPID != nil && data.PID == *c.videoPID {
 			var dts time.Duration
@@ -879,13 +1003,108 @@ func (c *Client) processSegment(innerCtx context.Context, byts []byte) error {
 	}
 }
 
+func (c *Client) processSegmentFMP4(innerCtx context.Context, byts []byte) error {
+	if clientFMP4IsInit(byts) {
+		init, err := clientFMP4ParseInit(byts)
+		if err != nil {
+			return err
+		}
+
+		// the initialization segment is downloaded again when its URI changes.
+		// Parameters are updated, while processors are kept.
+		if c.fmp4Init != nil {
+			c.fmp4Init = init
+			c.fmp4ParamsSent = false
+			return nil
+		}
+
+		var videoCount, audioCount int
+		for _, track := range init.tracks {
+			if track.isVideo {
+				videoCount++
+			} else {
+				audioCount++
+			}
+		}
+
+		if videoCount > 1 || audioCount > 1 {
+			return fmt.Errorf("multiple video/audio tracks are not supported")
+		}
+
+		if videoCount == 0 && audioCount == 0 {
+			return fmt.Errorf("stream doesn't contain tracks with supported codecs (H264 or AAC)")
+		}
+
+		c.fmp4Init = init
+		c.allocateProcessors(innerCtx, videoCount > 0, audioCount > 0)
+		return nil
+	}
+
+	if c.fmp4Init == nil {
+		return fmt.Errorf("received a fMP4 segment before the initialization segment")
+	}
+
+	samples, err := clientFMP4ParseSegment(c.fmp4Init, byts)
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		c.initializeClock(sample.dts)
+
+		pts := sample.pts - c.clockStartPTS
+
+		if sample.track.isVideo {
+			if c.videoProc == nil {
+				continue
+			}
+
+			nalus, err := h264.DecodeAVCC(sample.data)
+			if err != nil {
+				return err
+			}
+
+			// SPS and PPS are stored into the initialization segment
+			if !c.fmp4ParamsSent {
+				c.fmp4ParamsSent = true
+				nalus = append([][]byte{sample.track.sps, sample.track.pps}, nalus...)
+			}
+
+			enc, err := h264.EncodeAnnexB(nalus)
+			if err != nil {
+				return err
+			}
+
+			c.videoProc.process(enc, pts, sample.dts-c.clockStartPTS)
+		} else {
+			if c.audioProc == nil {
+				continue
+			}
+
+			enc, err := aac.EncodeADTS([]*aac.ADTSPacket{{
+				Type:         int(sample.track.aacConf.Type),
+				SampleRate:   sample.track.aacConf.SampleRate,
+				ChannelCount: sample.track.aacConf.ChannelCount,
+				AU:           sample.data,
+			}})
+			if err != nil {
+				return err
+			}
+
+			c.audioProc.process(enc, pts)
+		}
+	}
+
+	return nil
+}
+
 func (c *Client) onVideoTrack(track gortsplib.Track) error {
 	c.tracksMutex.Lock()
 	defer c.tracksMutex.Unlock()
 
 	c.videoTrack = track
 
-	if c.audioPID == nil || c.audioTrack != nil {
+	if c.audioProc == nil || c.audioTrack != nil {
 		return c.initializeEncoders()
 	}
 
@@ -898,7 +1117,7 @@ func (c *Client) onAudioTrack(track gortsplib.Track) error {
 
 	c.audioTrack = track
 
-	if c.videoPID == nil || c.videoTrack != nil {
+	if c.videoProc == nil || c.videoTrack != nil {
 		return c.initializeEncoders()
 	}
 
@@ -0,0 +1,71 @@
+package hls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// clientKeyIV returns the initialization vector of a key.
+// When the IV is not provided, the media sequence number of the segment is used.
+// Initialization sections don't have a sequence number (seqNo is nil)
+// and require the IV.
+func clientKeyIV(key *m3u8.Key, seqNo *uint64) ([]byte, error) {
+	if key.IV == "" {
+		if seqNo == nil {
+			return nil, fmt.Errorf("the IV of the key of the initialization section is missing")
+		}
+
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], *seqNo)
+		return iv, nil
+	}
+
+	s := strings.TrimPrefix(strings.TrimPrefix(key.IV, "0x"), "0X")
+
+	// the IV may be written without leading zeros
+	if len(s) < aes.BlockSize*2 {
+		s = strings.Repeat("0", aes.BlockSize*2-len(s)) + s
+	}
+
+	iv, err := hex.DecodeString(s)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV: '%s'", key.IV)
+	}
+
+	return iv, nil
+}
+
+// clientDecryptAES128 decrypts a segment encrypted with AES-128 in CBC mode
+// with PKCS7 padding.
+func clientDecryptAES128(key []byte, iv []byte, byts []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(byts) == 0 || (len(byts)%aes.BlockSize) != 0 {
+		return nil, fmt.Errorf("invalid encrypted data size: %d", len(byts))
+	}
+
+	dec := make([]byte, len(byts))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(dec, byts)
+
+	padding := int(dec[len(dec)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(dec) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+
+	for _, b := range dec[len(dec)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("invalid padding")
+		}
+	}
+
+	return dec[:len(dec)-padding], nil
+}
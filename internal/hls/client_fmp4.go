@@ -0,0 +1,717 @@
+package hls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aler9/gortsplib/pkg/aac"
+)
+
+type clientFMP4Box struct {
+	typ     string
+	start   int // position of the box inside the parent buffer
+	payload []byte
+}
+
+// clientFMP4ReadBoxes reads the boxes contained in a buffer.
+func clientFMP4ReadBoxes(buf []byte) ([]clientFMP4Box, error) {
+	var ret []clientFMP4Box
+	pos := 0
+
+	for pos < len(buf) {
+		if (len(buf) - pos) < 8 {
+			return nil, fmt.Errorf("invalid box header")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(buf[pos:]))
+		typ := string(buf[pos+4 : pos+8])
+		headerSize := uint64(8)
+
+		switch size {
+		case 0:
+			size = uint64(len(buf) - pos)
+
+		case 1:
+			if (len(buf) - pos) < 16 {
+				return nil, fmt.Errorf("invalid box header")
+			}
+			size = binary.BigEndian.Uint64(buf[pos+8:])
+			headerSize = 16
+		}
+
+		if size < headerSize || size > uint64(len(buf)-pos) {
+			return nil, fmt.Errorf("invalid size of box '%s'", typ)
+		}
+
+		ret = append(ret, clientFMP4Box{
+			typ:     typ,
+			start:   pos,
+			payload: buf[pos+int(headerSize) : pos+int(size)],
+		})
+		pos += int(size)
+	}
+
+	return ret, nil
+}
+
+// clientFMP4FindBox finds a box by following a path of box types.
+func clientFMP4FindBox(buf []byte, path ...string) ([]byte, error) {
+	for _, typ := range path {
+		boxes, err := clientFMP4ReadBoxes(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, box := range boxes {
+			if box.typ == typ {
+				buf = box.payload
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("box '%s' not found", typ)
+		}
+	}
+
+	return buf, nil
+}
+
+// clientFMP4IsInit checks whether a fMP4 buffer is an initialization segment.
+func clientFMP4IsInit(buf []byte) bool {
+	boxes, err := clientFMP4ReadBoxes(buf)
+	if err != nil {
+		return false
+	}
+
+	for _, box := range boxes {
+		if box.typ == "moov" {
+			return true
+		}
+	}
+	return false
+}
+
+type clientFMP4Track struct {
+	id                    uint32
+	timeScale             uint32
+	isVideo               bool
+	sps                   []byte
+	pps                   []byte
+	aacConf               *aac.MPEG4AudioConfig
+	defaultSampleDuration uint32
+	defaultSampleSize     uint32
+}
+
+type clientFMP4Init struct {
+	tracks map[uint32]*clientFMP4Track
+}
+
+func clientFMP4ParseAVCC(buf []byte, track *clientFMP4Track) error {
+	if len(buf) < 6 {
+		return fmt.Errorf("invalid avcC")
+	}
+
+	spsCount := int(buf[5] & 0x1F)
+	pos := 6
+
+	readParam := func() ([]byte, error) {
+		if (len(buf) - pos) < 2 {
+			return nil, fmt.Errorf("invalid avcC")
+		}
+		le := int(binary.BigEndian.Uint16(buf[pos:]))
+		pos += 2
+
+		if (len(buf) - pos) < le {
+			return nil, fmt.Errorf("invalid avcC")
+		}
+		ret := append([]byte(nil), buf[pos:pos+le]...)
+		pos += le
+		return ret, nil
+	}
+
+	for i := 0; i < spsCount; i++ {
+		sps, err := readParam()
+		if err != nil {
+			return err
+		}
+
+		if track.sps == nil {
+			track.sps = sps
+		}
+	}
+
+	if (len(buf) - pos) < 1 {
+		return fmt.Errorf("invalid avcC")
+	}
+	ppsCount := int(buf[pos])
+	pos++
+
+	for i := 0; i < ppsCount; i++ {
+		pps, err := readParam()
+		if err != nil {
+			return err
+		}
+
+		if track.pps == nil {
+			track.pps = pps
+		}
+	}
+
+	if track.sps == nil || track.pps == nil {
+		return fmt.Errorf("SPS or PPS not found in avcC")
+	}
+
+	return nil
+}
+
+// clientFMP4ReadDescriptor reads a MPEG-4 descriptor (ISO/IEC 14496-1).
+func clientFMP4ReadDescriptor(buf []byte) (byte, []byte, []byte, error) {
+	if len(buf) < 2 {
+		return 0, nil, nil, fmt.Errorf("invalid descriptor")
+	}
+
+	tag := buf[0]
+	pos := 1
+	size := 0
+
+	for i := 0; i < 4; i++ {
+		if pos >= len(buf) {
+			return 0, nil, nil, fmt.Errorf("invalid descriptor")
+		}
+
+		b := buf[pos]
+		pos++
+		size = (size << 7) | int(b&0x7F)
+
+		if (b & 0x80) == 0 {
+			break
+		}
+	}
+
+	if (len(buf) - pos) < size {
+		return 0, nil, nil, fmt.Errorf("invalid descriptor")
+	}
+
+	return tag, buf[pos : pos+size], buf[pos+size:], nil
+}
+
+func clientFMP4ParseESDS(buf []byte, track *clientFMP4Track) error {
+	// version and flags
+	if len(buf) < 4 {
+		return fmt.Errorf("invalid esds")
+	}
+
+	tag, esd, _, err := clientFMP4ReadDescriptor(buf[4:])
+	if err != nil {
+		return err
+	}
+	if tag != 0x03 || len(esd) < 3 {
+		return fmt.Errorf("ES descriptor not found")
+	}
+
+	flags := esd[2]
+	esd = esd[3:]
+
+	if (flags & 0x80) != 0 {
+		if len(esd) < 2 {
+			return fmt.Errorf("invalid ES descriptor")
+		}
+		esd = esd[2:]
+	}
+
+	if (flags & 0x40) != 0 {
+		if len(esd) < 1 || len(esd) < 1+int(esd[0]) {
+			return fmt.Errorf("invalid ES descriptor")
+		}
+		esd = esd[1+int(esd[0]):]
+	}
+
+	if (flags & 0x20) != 0 {
+		if len(esd) < 2 {
+			return fmt.Errorf("invalid ES descriptor")
+		}
+		esd = esd[2:]
+	}
+
+	tag, dcd, _, err := clientFMP4ReadDescriptor(esd)
+	if err != nil {
+		return err
+	}
+	if tag != 0x04 || len(dcd) < 13 {
+		return fmt.Errorf("decoder config descriptor not found")
+	}
+
+	// objectTypeIndication must be MPEG-4 audio
+	if dcd[0] != 0x40 {
+		return fmt.Errorf("unsupported audio codec: 0x%x", dcd[0])
+	}
+
+	tag, dsi, _, err := clientFMP4ReadDescriptor(dcd[13:])
+	if err != nil {
+		return err
+	}
+	if tag != 0x05 {
+		return fmt.Errorf("decoder specific info not found")
+	}
+
+	var conf aac.MPEG4AudioConfig
+	err = conf.Decode(dsi)
+	if err != nil {
+		return err
+	}
+
+	track.aacConf = &conf
+	return nil
+}
+
+func clientFMP4ParseTrak(buf []byte) (*clientFMP4Track, error) {
+	track := &clientFMP4Track{}
+
+	tkhd, err := clientFMP4FindBox(buf, "tkhd")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tkhd) < 1 {
+		return nil, fmt.Errorf("invalid tkhd")
+	}
+
+	if tkhd[0] == 1 {
+		if len(tkhd) < 24 {
+			return nil, fmt.Errorf("invalid tkhd")
+		}
+		track.id = binary.BigEndian.Uint32(tkhd[20:])
+	} else {
+		if len(tkhd) < 16 {
+			return nil, fmt.Errorf("invalid tkhd")
+		}
+		track.id = binary.BigEndian.Uint32(tkhd[12:])
+	}
+
+	mdhd, err := clientFMP4FindBox(buf, "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mdhd) < 1 {
+		return nil, fmt.Errorf("invalid mdhd")
+	}
+
+	if mdhd[0] == 1 {
+		if len(mdhd) < 24 {
+			return nil, fmt.Errorf("invalid mdhd")
+		}
+		track.timeScale = binary.BigEndian.Uint32(mdhd[20:])
+	} else {
+		if len(mdhd) < 16 {
+			return nil, fmt.Errorf("invalid mdhd")
+		}
+		track.timeScale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+
+	if track.timeScale == 0 {
+		return nil, fmt.Errorf("invalid time scale")
+	}
+
+	stsd, err := clientFMP4FindBox(buf, "mdia", "minf", "stbl", "stsd")
+	if err != nil {
+		return nil, err
+	}
+
+	// version, flags and entry count
+	if len(stsd) < 8 {
+		return nil, fmt.Errorf("invalid stsd")
+	}
+
+	entries, err := clientFMP4ReadBoxes(stsd[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("invalid stsd")
+	}
+
+	entry := entries[0]
+
+	switch entry.typ {
+	case "avc1", "avc3":
+		// visual sample entry
+		if len(entry.payload) < 78 {
+			return nil, fmt.Errorf("invalid avc1")
+		}
+
+		avcc, err := clientFMP4FindBox(entry.payload[78:], "avcC")
+		if err != nil {
+			return nil, err
+		}
+
+		err = clientFMP4ParseAVCC(avcc, track)
+		if err != nil {
+			return nil, err
+		}
+
+		track.isVideo = true
+
+	case "mp4a":
+		// audio sample entry
+		if len(entry.payload) < 28 {
+			return nil, fmt.Errorf("invalid mp4a")
+		}
+
+		esds, err := clientFMP4FindBox(entry.payload[28:], "esds")
+		if err != nil {
+			return nil, err
+		}
+
+		err = clientFMP4ParseESDS(esds, track)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		// track with an unsupported codec
+		return nil, nil
+	}
+
+	return track, nil
+}
+
+// clientFMP4ParseInit parses a fMP4 initialization segment.
+func clientFMP4ParseInit(buf []byte) (*clientFMP4Init, error) {
+	moov, err := clientFMP4FindBox(buf, "moov")
+	if err != nil {
+		return nil, err
+	}
+
+	boxes, err := clientFMP4ReadBoxes(moov)
+	if err != nil {
+		return nil, err
+	}
+
+	init := &clientFMP4Init{
+		tracks: make(map[uint32]*clientFMP4Track),
+	}
+
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+
+		track, err := clientFMP4ParseTrak(box.payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if track != nil {
+			init.tracks[track.id] = track
+		}
+	}
+
+	// read default sample values
+	mvex, err := clientFMP4FindBox(moov, "mvex")
+	if err == nil {
+		boxes, err := clientFMP4ReadBoxes(mvex)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, box := range boxes {
+			if box.typ != "trex" {
+				continue
+			}
+
+			if len(box.payload) < 24 {
+				return nil, fmt.Errorf("invalid trex")
+			}
+
+			track, ok := init.tracks[binary.BigEndian.Uint32(box.payload[4:])]
+			if !ok {
+				continue
+			}
+
+			track.defaultSampleDuration = binary.BigEndian.Uint32(box.payload[12:])
+			track.defaultSampleSize = binary.BigEndian.Uint32(box.payload[16:])
+		}
+	}
+
+	return init, nil
+}
+
+type clientFMP4Sample struct {
+	track *clientFMP4Track
+	pts   time.Duration
+	dts   time.Duration
+	data  []byte
+}
+
+func clientFMP4Duration(v int64, timeScale uint32) time.Duration {
+	// split the value in order to avoid overflows
+	ts := int64(timeScale)
+	return time.Duration(v/ts)*time.Second + time.Duration(v%ts)*time.Second/time.Duration(ts)
+}
+
+// clientFMP4ParseTraf parses a track fragment.
+// moofStart is the position of the parent moof inside buf.
+func clientFMP4ParseTraf(
+	init *clientFMP4Init,
+	buf []byte,
+	moofStart int,
+	traf []byte,
+) ([]*clientFMP4Sample, error) {
+	boxes, err := clientFMP4ReadBoxes(traf)
+	if err != nil {
+		return nil, err
+	}
+
+	var track *clientFMP4Track
+	baseDataOffset := int64(moofStart)
+	var defaultSampleDuration, defaultSampleSize uint32
+	var baseMediaDecodeTime uint64
+	var ret []*clientFMP4Sample
+
+	for _, box := range boxes {
+		p := box.payload
+
+		switch box.typ {
+		case "tfhd":
+			if len(p) < 8 {
+				return nil, fmt.Errorf("invalid tfhd")
+			}
+
+			flags := binary.BigEndian.Uint32(p) & 0xFFFFFF
+
+			var ok bool
+			track, ok = init.tracks[binary.BigEndian.Uint32(p[4:])]
+			if !ok {
+				// track with an unsupported codec
+				return nil, nil
+			}
+
+			defaultSampleDuration = track.defaultSampleDuration
+			defaultSampleSize = track.defaultSampleSize
+			pos := 8
+
+			readUint32 := func() (uint32, error) {
+				if (len(p) - pos) < 4 {
+					return 0, fmt.Errorf("invalid tfhd")
+				}
+				v := binary.BigEndian.Uint32(p[pos:])
+				pos += 4
+				return v, nil
+			}
+
+			if (flags & 0x01) != 0 {
+				if (len(p) - pos) < 8 {
+					return nil, fmt.Errorf("invalid tfhd")
+				}
+				v := binary.BigEndian.Uint64(p[pos:])
+				if v > uint64(len(buf)) {
+					return nil, fmt.Errorf("base data offset is out of bounds")
+				}
+				baseDataOffset = int64(v)
+				pos += 8
+			}
+
+			if (flags & 0x02) != 0 {
+				_, err := readUint32()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if (flags & 0x08) != 0 {
+				defaultSampleDuration, err = readUint32()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if (flags & 0x10) != 0 {
+				defaultSampleSize, err = readUint32()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+		case "tfdt":
+			if len(p) < 8 {
+				return nil, fmt.Errorf("invalid tfdt")
+			}
+
+			if p[0] == 1 {
+				if len(p) < 12 {
+					return nil, fmt.Errorf("invalid tfdt")
+				}
+				baseMediaDecodeTime = binary.BigEndian.Uint64(p[4:])
+			} else {
+				baseMediaDecodeTime = uint64(binary.BigEndian.Uint32(p[4:]))
+			}
+
+		case "trun":
+			if track == nil {
+				return nil, fmt.Errorf("trun before tfhd")
+			}
+
+			if len(p) < 8 {
+				return nil, fmt.Errorf("invalid trun")
+			}
+
+			version := p[0]
+			flags := binary.BigEndian.Uint32(p) & 0xFFFFFF
+			sampleCount := binary.BigEndian.Uint32(p[4:])
+			pos := 8
+
+			readUint32 := func() (uint32, error) {
+				if (len(p) - pos) < 4 {
+					return 0, fmt.Errorf("invalid trun")
+				}
+				v := binary.BigEndian.Uint32(p[pos:])
+				pos += 4
+				return v, nil
+			}
+
+			dataOffset := baseDataOffset
+
+			if (flags & 0x01) != 0 {
+				v, err := readUint32()
+				if err != nil {
+					return nil, err
+				}
+				dataOffset += int64(int32(v))
+			}
+
+			if (flags & 0x04) != 0 {
+				_, err := readUint32()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// check the sample count before using it, in order to avoid
+			// allocating memory on the basis of a malicious value.
+			fieldsPerSample := 0
+			for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+				if (flags & f) != 0 {
+					fieldsPerSample++
+				}
+			}
+			if fieldsPerSample != 0 {
+				if uint64(sampleCount) > uint64((len(p)-pos)/(4*fieldsPerSample)) {
+					return nil, fmt.Errorf("invalid trun")
+				}
+			} else if defaultSampleSize == 0 ||
+				uint64(sampleCount) > uint64(len(buf))/uint64(defaultSampleSize) {
+				return nil, fmt.Errorf("invalid trun")
+			}
+
+			dts := baseMediaDecodeTime
+
+			for i := uint32(0); i < sampleCount; i++ {
+				duration := defaultSampleDuration
+				size := defaultSampleSize
+				var cto int64
+
+				if (flags & 0x100) != 0 {
+					duration, err = readUint32()
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				if (flags & 0x200) != 0 {
+					size, err = readUint32()
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				if (flags & 0x400) != 0 {
+					_, err = readUint32()
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				if (flags & 0x800) != 0 {
+					v, err := readUint32()
+					if err != nil {
+						return nil, err
+					}
+
+					if version == 0 {
+						cto = int64(v)
+					} else {
+						cto = int64(int32(v))
+					}
+				}
+
+				if dataOffset < 0 || dataOffset > int64(len(buf)) ||
+					int64(size) > (int64(len(buf))-dataOffset) {
+					return nil, fmt.Errorf("sample data is out of bounds")
+				}
+
+				ret = append(ret, &clientFMP4Sample{
+					track: track,
+					dts:   clientFMP4Duration(int64(dts), track.timeScale),
+					pts:   clientFMP4Duration(int64(dts)+cto, track.timeScale),
+					data:  buf[dataOffset : dataOffset+int64(size)],
+				})
+
+				dataOffset += int64(size)
+				dts += uint64(duration)
+			}
+
+			baseMediaDecodeTime = dts
+			baseDataOffset = dataOffset
+		}
+	}
+
+	return ret, nil
+}
+
+// clientFMP4ParseSegment parses a fMP4 media segment and returns
+// samples of all tracks, sorted by DTS.
+func clientFMP4ParseSegment(init *clientFMP4Init, buf []byte) ([]*clientFMP4Sample, error) {
+	boxes, err := clientFMP4ReadBoxes(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*clientFMP4Sample
+
+	for _, box := range boxes {
+		if box.typ != "moof" {
+			continue
+		}
+
+		trafs, err := clientFMP4ReadBoxes(box.payload)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, traf := range trafs {
+			if traf.typ != "traf" {
+				continue
+			}
+
+			samples, err := clientFMP4ParseTraf(init, buf, box.start, traf.payload)
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, samples...)
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].dts < ret[j].dts
+	})
+
+	return ret, nil
+}
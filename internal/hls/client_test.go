@@ -3,18 +3,24 @@ package hls
 import (
 	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/h264"
 	"github.com/asticode/go-astits"
 	"github.com/gin-gonic/gin"
+	"github.com/grafov/m3u8"
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/rtsp-simple-server/internal/logger"
@@ -97,7 +103,122 @@ type testHLSServer struct {
 	s *http.Server
 }
 
-func newTestHLSServer(encrypted bool) (*testHLSServer, error) {
+var testKey = []byte{
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+}
+
+func testTSSegment() []byte {
+	var buf bytes.Buffer
+	mux := astits.NewMuxer(context.Background(), &buf)
+
+	mux.AddElementaryStream(astits.PMTElementaryStream{
+		ElementaryPID: 256,
+		StreamType:    astits.StreamTypeH264Video,
+	})
+
+	mux.SetPCRPID(256)
+
+	mux.WriteTables()
+
+	enc, _ := h264.EncodeAnnexB([][]byte{
+		{7, 1, 2, 3}, // SPS
+		{8},          // PPS
+		{5},          // IDR
+	})
+
+	mux.WriteData(&astits.MuxerData{
+		PID: 256,
+		PES: &astits.PESData{
+			Header: &astits.PESHeader{
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:      2,
+					PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
+					PTS:             &astits.ClockReference{Base: int64(1 * 90000)},
+				},
+				StreamID: 224, // = video
+			},
+			Data: enc,
+		},
+	})
+
+	return buf.Bytes()
+}
+
+func testEncrypt(byts []byte, iv []byte) []byte {
+	padding := aes.BlockSize - len(byts)%aes.BlockSize
+	byts = append(append([]byte(nil), byts...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, _ := aes.NewCipher(testKey)
+	enc := make([]byte, len(byts))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(enc, byts)
+	return enc
+}
+
+func testMP4Box(typ string, payloads ...[]byte) []byte {
+	var payload []byte
+	for _, p := range payloads {
+		payload = append(payload, p...)
+	}
+
+	ret := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(ret, uint32(len(ret)))
+	copy(ret[4:], typ)
+	copy(ret[8:], payload)
+	return ret
+}
+
+func testUint32(v uint32) []byte {
+	ret := make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, v)
+	return ret
+}
+
+func testFMP4Init() []byte {
+	sps := []byte{7, 1, 2, 3}
+	pps := []byte{8}
+
+	avcc := testMP4Box("avcC",
+		[]byte{1, 1, 2, 3, 0xFF, 0xE1, 0, byte(len(sps))}, sps,
+		[]byte{1, 0, byte(len(pps))}, pps)
+
+	ftyp := testMP4Box("ftyp", []byte("iso5"), testUint32(512), []byte("iso6mp41"))
+
+	moov := testMP4Box("moov",
+		testMP4Box("trak",
+			testMP4Box("tkhd", testUint32(3), testUint32(0), testUint32(0), testUint32(1), make([]byte, 68)),
+			testMP4Box("mdia",
+				testMP4Box("mdhd", testUint32(0), testUint32(0), testUint32(0), testUint32(90000), make([]byte, 8)),
+				testMP4Box("minf",
+					testMP4Box("stbl",
+						testMP4Box("stsd", testUint32(0), testUint32(1),
+							testMP4Box("avc1", make([]byte, 78), avcc)))))),
+		testMP4Box("mvex",
+			testMP4Box("trex", testUint32(0), testUint32(1), testUint32(1),
+				testUint32(3000), testUint32(0), testUint32(0))))
+
+	return append(ftyp, moov...)
+}
+
+func testFMP4Segment() []byte {
+	mdat := testMP4Box("mdat", []byte{0, 0, 0, 1, 5}) // IDR in AVCC format
+
+	moof := func(dataOffset uint32) []byte {
+		return testMP4Box("moof",
+			testMP4Box("mfhd", testUint32(0), testUint32(1)),
+			testMP4Box("traf",
+				testMP4Box("tfhd", testUint32(0x020000), testUint32(1)),
+				testMP4Box("tfdt", testUint32(0x01000000), []byte{0, 0, 0, 0}, testUint32(90000)),
+				testMP4Box("trun", testUint32(0x000201), testUint32(1),
+					testUint32(dataOffset), testUint32(5))))
+	}
+
+	moofSize := uint32(len(moof(0)))
+
+	return append(moof(moofSize+8), mdat...)
+}
+
+func newTestHLSServer(tls bool) (*testHLSServer, error) {
 	ln, err := net.Listen("tcp", "localhost:5780")
 	if err != nil {
 		return nil, err
@@ -124,42 +245,95 @@ segment.ts
 
 	router.GET("/segment.ts", func(ctx *gin.Context) {
 		ctx.Writer.Header().Set("Content-Type", `video/MP2T`)
-		mux := astits.NewMuxer(context.Background(), ctx.Writer)
+		ctx.Writer.Write(testTSSegment())
+	})
 
-		mux.AddElementaryStream(astits.PMTElementaryStream{
-			ElementaryPID: 256,
-			StreamType:    astits.StreamTypeH264Video,
-		})
+	router.GET("/encrypted.m3u8", func(ctx *gin.Context) {
+		cnt := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-ALLOW-CACHE:NO
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:2,
+encrypted.ts
+`
 
-		mux.SetPCRPID(256)
+		ctx.Writer.Header().Set("Content-Type", `application/x-mpegURL`)
+		io.Copy(ctx.Writer, bytes.NewReader([]byte(cnt)))
+	})
 
-		mux.WriteTables()
+	router.GET("/key.bin", func(ctx *gin.Context) {
+		ctx.Writer.Write(testKey)
+	})
 
-		enc, _ := h264.EncodeAnnexB([][]byte{
-			{7, 1, 2, 3}, // SPS
-			{8},          // PPS
-			{5},          // IDR
-		})
+	router.GET("/encrypted.ts", func(ctx *gin.Context) {
+		// IV is the media sequence number of the segment
+		iv := make([]byte, aes.BlockSize)
+		iv[15] = 5
 
-		mux.WriteData(&astits.MuxerData{
-			PID: 256,
-			PES: &astits.PESData{
-				Header: &astits.PESHeader{
-					OptionalHeader: &astits.PESOptionalHeader{
-						MarkerBits:      2,
-						PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
-						PTS:             &astits.ClockReference{Base: int64(1 * 90000)},
-					},
-					StreamID: 224, // = video
-				},
-				Data: enc,
-			},
-		})
+		ctx.Writer.Header().Set("Content-Type", `video/MP2T`)
+		ctx.Writer.Write(testEncrypt(testTSSegment(), iv))
+	})
+
+	router.GET("/fmp4.m3u8", func(ctx *gin.Context) {
+		cnt := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:2,
+segment.mp4
+`
+
+		ctx.Writer.Header().Set("Content-Type", `application/x-mpegURL`)
+		io.Copy(ctx.Writer, bytes.NewReader([]byte(cnt)))
+	})
+
+	router.GET("/init.mp4", func(ctx *gin.Context) {
+		ctx.Writer.Header().Set("Content-Type", `video/mp4`)
+		ctx.Writer.Write(testFMP4Init())
+	})
+
+	router.GET("/fmp4_encrypted.m3u8", func(ctx *gin.Context) {
+		cnt := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x00000000000000000000000000000009
+#EXT-X-MAP:URI="encrypted_init.mp4"
+#EXTINF:2,
+encrypted_segment.mp4
+`
+
+		ctx.Writer.Header().Set("Content-Type", `application/x-mpegURL`)
+		io.Copy(ctx.Writer, bytes.NewReader([]byte(cnt)))
+	})
+
+	router.GET("/encrypted_init.mp4", func(ctx *gin.Context) {
+		iv := make([]byte, aes.BlockSize)
+		iv[15] = 9
+
+		ctx.Writer.Header().Set("Content-Type", `video/mp4`)
+		ctx.Writer.Write(testEncrypt(testFMP4Init(), iv))
+	})
+
+	router.GET("/encrypted_segment.mp4", func(ctx *gin.Context) {
+		iv := make([]byte, aes.BlockSize)
+		iv[15] = 9
+
+		ctx.Writer.Header().Set("Content-Type", `video/mp4`)
+		ctx.Writer.Write(testEncrypt(testFMP4Segment(), iv))
+	})
+
+	router.GET("/segment.mp4", func(ctx *gin.Context) {
+		ctx.Writer.Header().Set("Content-Type", `video/mp4`)
+		ctx.Writer.Write(testFMP4Segment())
 	})
 
 	ts.s = &http.Server{Handler: router}
 
-	if encrypted {
+	if tls {
 		go func() {
 			serverCertFpath, err := writeTempFile(serverCert)
 			if err != nil {
@@ -187,7 +361,7 @@ func (ts *testHLSServer) close() {
 }
 
 func TestClient(t *testing.T) {
-	for _, mode := range []string{"plain", "tls"} {
+	for _, mode := range []string{"plain", "tls", "aes-128", "fmp4", "fmp4-aes-128"} {
 		t.Run(mode, func(t *testing.T) {
 			ts, err := newTestHLSServer(mode == "tls")
 			require.NoError(t, err)
@@ -200,9 +374,22 @@ func TestClient(t *testing.T) {
 				prefix = "https"
 			}
 
+			playlist := "stream.m3u8"
+			switch mode {
+			case "aes-128":
+				playlist = "encrypted.m3u8"
+
+			case "fmp4":
+				playlist = "fmp4.m3u8"
+
+			case "fmp4-aes-128":
+				playlist = "fmp4_encrypted.m3u8"
+			}
+
 			c, err := NewClient(
-				prefix+"://localhost:5780/stream.m3u8",
+				prefix+"://localhost:5780/"+playlist,
 				"33949E05FFFB5FF3E8AA16F8213A6251B4D9363804BA53233C4DA9A46D6F2739",
+				"",
 				func(gortsplib.Track, gortsplib.Track) error {
 					return nil
 				},
@@ -222,3 +409,123 @@ func TestClient(t *testing.T) {
 		})
 	}
 }
+
+func TestClientChooseVariant(t *testing.T) {
+	variants := []*m3u8.Variant{
+		{URI: "mid.m3u8", VariantParams: m3u8.VariantParams{Bandwidth: 2000000, Resolution: "1280x720"}},
+		{URI: "low.m3u8", VariantParams: m3u8.VariantParams{Bandwidth: 500000, Resolution: "640x360"}},
+		{URI: "high.m3u8", VariantParams: m3u8.VariantParams{Bandwidth: 5000000, Resolution: "1920x1080"}},
+	}
+
+	for _, ca := range []struct {
+		policy string
+		uri    string
+	}{
+		{"", "high.m3u8"},
+		{"highest", "high.m3u8"},
+		{"lowest", "low.m3u8"},
+		{"1280x720", "mid.m3u8"},
+		{"1600x900", "mid.m3u8"},
+		{"320x240", "low.m3u8"},
+	} {
+		v, err := clientChooseVariant(variants, ca.policy)
+		require.NoError(t, err)
+		require.Equal(t, ca.uri, v.URI, ca.policy)
+	}
+
+	_, err := clientChooseVariant(variants, "invalid")
+	require.EqualError(t, err, "invalid variant policy: 'invalid'")
+}
+
+func TestClientFMP4ParseSegmentInvalid(t *testing.T) {
+	init, err := clientFMP4ParseInit(testFMP4Init())
+	require.NoError(t, err)
+
+	segment := func(tfhd []byte, trun []byte) []byte {
+		return append(testMP4Box("moof",
+			testMP4Box("mfhd", testUint32(0), testUint32(1)),
+			testMP4Box("traf",
+				testMP4Box("tfhd", tfhd),
+				trun)),
+			testMP4Box("mdat", []byte{0, 0, 0, 1, 5})...)
+	}
+
+	for _, ca := range []struct {
+		name string
+		byts []byte
+	}{
+		{
+			"base data offset overflow",
+			segment(
+				append(append(testUint32(0x000001), testUint32(1)...), 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF),
+				testMP4Box("trun", testUint32(0x000200), testUint32(1), testUint32(5))),
+		},
+		{
+			"negative data offset",
+			segment(
+				append(testUint32(0x020000), testUint32(1)...),
+				testMP4Box("trun", testUint32(0x000201), testUint32(1), testUint32(0xFFFFFF00), testUint32(5))),
+		},
+		{
+			"sample count with sample fields",
+			segment(
+				append(testUint32(0x020000), testUint32(1)...),
+				testMP4Box("trun", testUint32(0x000200), testUint32(0xFFFFFFFF), testUint32(5))),
+		},
+		{
+			"sample count without sample fields",
+			segment(
+				append(append(testUint32(0x020018), testUint32(1)...), append(testUint32(3000), testUint32(0)...)...),
+				testMP4Box("trun", testUint32(0x000000), testUint32(0xFFFFFFFF))),
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := clientFMP4ParseSegment(init, ca.byts)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestClientFMP4ParseSegmentLargeDecodeTime(t *testing.T) {
+	init, err := clientFMP4ParseInit(testFMP4Init())
+	require.NoError(t, err)
+
+	// 10^6 seconds at 90kHz, that overflows when multiplied by time.Second
+	dts := uint64(90000 * 1000000)
+
+	moof := func(dataOffset uint32) []byte {
+		return testMP4Box("moof",
+			testMP4Box("mfhd", testUint32(0), testUint32(1)),
+			testMP4Box("traf",
+				testMP4Box("tfhd", testUint32(0x020000), testUint32(1)),
+				testMP4Box("tfdt", testUint32(0x01000000), testUint32(uint32(dts>>32)), testUint32(uint32(dts))),
+				testMP4Box("trun", testUint32(0x000201), testUint32(1),
+					testUint32(dataOffset), testUint32(5))))
+	}
+
+	moofSize := uint32(len(moof(0)))
+	seg := append(moof(moofSize+8), testMP4Box("mdat", []byte{0, 0, 0, 1, 5})...)
+
+	samples, err := clientFMP4ParseSegment(init, seg)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(samples))
+	require.Equal(t, 1000000*time.Second, samples[0].dts)
+	require.Equal(t, 1000000*time.Second, samples[0].pts)
+}
+
+func TestClientFMP4ParseSegmentCorrupted(t *testing.T) {
+	init, err := clientFMP4ParseInit(testFMP4Init())
+	require.NoError(t, err)
+
+	seg := testFMP4Segment()
+	r := rand.New(rand.NewSource(1))
+
+	// corrupted segments must never cause panics
+	for i := 0; i < 10000; i++ {
+		byts := append([]byte(nil), seg...)
+		for j := 0; j < 1+r.Intn(4); j++ {
+			byts[r.Intn(len(byts))] = byte(r.Intn(256))
+		}
+		clientFMP4ParseSegment(init, byts)
+	}
+}
@@ -0,0 +1,96 @@
+package hls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+func clientParseResolution(s string) (int, int, bool) {
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	width, err := strconv.ParseUint(parts[0], 10, 31)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	height, err := strconv.ParseUint(parts[1], 10, 31)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return int(width), int(height), true
+}
+
+func clientVariantHighest(variants []*m3u8.Variant) *m3u8.Variant {
+	var ret *m3u8.Variant
+	for _, v := range variants {
+		if ret == nil || v.VariantParams.Bandwidth > ret.VariantParams.Bandwidth {
+			ret = v
+		}
+	}
+	return ret
+}
+
+func clientVariantLowest(variants []*m3u8.Variant) *m3u8.Variant {
+	var ret *m3u8.Variant
+	for _, v := range variants {
+		if ret == nil || v.VariantParams.Bandwidth < ret.VariantParams.Bandwidth {
+			ret = v
+		}
+	}
+	return ret
+}
+
+// clientChooseVariant chooses a variant of a primary playlist. Available policies are:
+//   - "highest" or "": the variant with the highest bandwidth
+//   - "lowest": the variant with the lowest bandwidth
+//   - "WIDTHxHEIGHT": the variant with the biggest resolution that does not exceed the given one;
+//     if there isn't any, the variant with the lowest bandwidth.
+func clientChooseVariant(variants []*m3u8.Variant, policy string) (*m3u8.Variant, error) {
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("no variants found")
+	}
+
+	switch policy {
+	case "", "highest":
+		return clientVariantHighest(variants), nil
+
+	case "lowest":
+		return clientVariantLowest(variants), nil
+	}
+
+	maxWidth, maxHeight, ok := clientParseResolution(policy)
+	if !ok {
+		return nil, fmt.Errorf("invalid variant policy: '%s'", policy)
+	}
+
+	var ret *m3u8.Variant
+	retPixels := 0
+
+	for _, v := range variants {
+		width, height, ok := clientParseResolution(v.VariantParams.Resolution)
+		if !ok || width > maxWidth || height > maxHeight {
+			continue
+		}
+
+		pixels := width * height
+		if ret == nil ||
+			pixels > retPixels ||
+			(pixels == retPixels && v.VariantParams.Bandwidth > ret.VariantParams.Bandwidth) {
+			ret = v
+			retPixels = pixels
+		}
+	}
+
+	if ret == nil {
+		return clientVariantLowest(variants), nil
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,34 @@
+package hls
+
+import (
+	"bytes"
+	"io"
+)
+
+// MuxerVariant is a variant listed in a group primary playlist.
+type MuxerVariant struct {
+	// muxer that produces the variant.
+	Muxer *Muxer
+
+	// URI of the stream playlist of the variant,
+	// relative to the group primary playlist.
+	URI string
+}
+
+// GroupPrimaryPlaylist returns a reader to read a primary playlist
+// that lists the stream playlists of multiple muxers as variants of the same content.
+func GroupPrimaryPlaylist(variants []MuxerVariant) io.Reader {
+	cnt := "#EXTM3U\n"
+
+	for _, v := range variants {
+		bandwidth := v.Muxer.streamPlaylist.peakBandwidth()
+		if bandwidth == 0 {
+			bandwidth = defaultBandwidth
+		}
+
+		cnt += v.Muxer.primaryPlaylist.streamInf(bandwidth) + "\n"
+		cnt += v.URI + "\n"
+	}
+
+	return bytes.NewReader([]byte(cnt))
+}
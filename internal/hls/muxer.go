@@ -3,6 +3,8 @@ package hls
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"time"
 
 	"github.com/aler9/gortsplib"
@@ -13,13 +15,21 @@ type Muxer struct {
 	primaryPlaylist *muxerPrimaryPlaylist
 	streamPlaylist  *muxerStreamPlaylist
 	tsGenerator     *muxerTSGenerator
+	segmentDir      string
 }
 
 // NewMuxer allocates a Muxer.
+// When alignSegments is true, segment boundaries are aligned to multiples of
+// hlsSegmentDuration in wall-clock time, in order to allow players to switch
+// between muxers that produce variants of the same content.
+// When hlsSegmentDirectory is not empty, segments are stored on disk
+// inside a temporary subdirectory of it, instead of RAM.
 func NewMuxer(
 	hlsSegmentCount int,
 	hlsSegmentDuration time.Duration,
 	hlsSegmentMaxSize uint64,
+	alignSegments bool,
+	hlsSegmentDirectory string,
 	videoTrack *gortsplib.TrackH264,
 	audioTrack *gortsplib.TrackAAC) (*Muxer, error) {
 	if videoTrack != nil {
@@ -28,6 +38,19 @@ func NewMuxer(
 		}
 	}
 
+	segmentDir := ""
+	if hlsSegmentDirectory != "" {
+		err := os.MkdirAll(hlsSegmentDirectory, 0o755)
+		if err != nil {
+			return nil, err
+		}
+
+		segmentDir, err = ioutil.TempDir(hlsSegmentDirectory, "muxer")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	primaryPlaylist := newMuxerPrimaryPlaylist(videoTrack, audioTrack)
 
 	streamPlaylist := newMuxerStreamPlaylist(hlsSegmentCount)
@@ -36,6 +59,8 @@ func NewMuxer(
 		hlsSegmentCount,
 		hlsSegmentDuration,
 		hlsSegmentMaxSize,
+		alignSegments,
+		segmentDir,
 		videoTrack,
 		audioTrack,
 		streamPlaylist)
@@ -44,6 +69,7 @@ func NewMuxer(
 		primaryPlaylist: primaryPlaylist,
 		streamPlaylist:  streamPlaylist,
 		tsGenerator:     tsGenerator,
+		segmentDir:      segmentDir,
 	}
 
 	return m, nil
@@ -51,17 +77,30 @@ func NewMuxer(
 
 // Close closes a Muxer.
 func (m *Muxer) Close() {
+	m.tsGenerator.close()
 	m.streamPlaylist.close()
+
+	if m.segmentDir != "" {
+		os.RemoveAll(m.segmentDir)
+	}
+}
+
+// End ends the stream: the stream playlist gets the EXT-X-ENDLIST tag
+// and new segments are discarded.
+func (m *Muxer) End() {
+	m.streamPlaylist.end()
 }
 
 // WriteH264 writes H264 NALUs, grouped by PTS, into the muxer.
-func (m *Muxer) WriteH264(pts time.Duration, nalus [][]byte) error {
-	return m.tsGenerator.writeH264(pts, nalus)
+// ntp is the wall-clock time of the NALUs and is used to fill EXT-X-PROGRAM-DATE-TIME.
+func (m *Muxer) WriteH264(ntp time.Time, pts time.Duration, nalus [][]byte) error {
+	return m.tsGenerator.writeH264(ntp, pts, nalus)
 }
 
 // WriteAAC writes AAC AUs, grouped by PTS, into the muxer.
-func (m *Muxer) WriteAAC(pts time.Duration, aus [][]byte) error {
-	return m.tsGenerator.writeAAC(pts, aus)
+// ntp is the wall-clock time of the AUs and is used to fill EXT-X-PROGRAM-DATE-TIME.
+func (m *Muxer) WriteAAC(ntp time.Time, pts time.Duration, aus [][]byte) error {
+	return m.tsGenerator.writeAAC(ntp, pts, aus)
 }
 
 // PrimaryPlaylist returns a reader to read the primary playlist.
@@ -75,6 +114,7 @@ func (m *Muxer) StreamPlaylist() io.Reader {
 }
 
 // Segment returns a reader to read a segment listed in the stream playlist.
+// When segments are stored on disk, the reader is also an io.Closer and must be closed.
 func (m *Muxer) Segment(fname string) io.Reader {
 	return m.streamPlaylist.segment(fname)
 }
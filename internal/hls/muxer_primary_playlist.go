@@ -8,13 +8,20 @@ import (
 	"strings"
 
 	"github.com/aler9/gortsplib"
+
+	"github.com/aler9/rtsp-simple-server/internal/h264sps"
 )
 
+// default bandwidth, used when it can't be measured.
+const defaultBandwidth = 200000
+
 type muxerPrimaryPlaylist struct {
 	videoTrack *gortsplib.TrackH264
 	audioTrack *gortsplib.TrackAAC
 
-	cnt []byte
+	codecs     []string
+	resolution string
+	cnt        []byte
 }
 
 func newMuxerPrimaryPlaylist(
@@ -26,19 +33,23 @@ func newMuxerPrimaryPlaylist(
 		audioTrack: audioTrack,
 	}
 
-	var codecs []string
-
 	if p.videoTrack != nil {
-		codecs = append(codecs, "avc1."+hex.EncodeToString(p.videoTrack.SPS()[1:4]))
+		p.codecs = append(p.codecs, "avc1."+hex.EncodeToString(p.videoTrack.SPS()[1:4]))
+
+		var sps h264sps.SPS
+		err := sps.Unmarshal(p.videoTrack.SPS())
+		if err == nil {
+			p.resolution = strconv.FormatInt(int64(sps.Width), 10) + "x" + strconv.FormatInt(int64(sps.Height), 10)
+		}
 	}
 
 	// https://developer.mozilla.org/en-US/docs/Web/Media/Formats/codecs_parameter
 	if p.audioTrack != nil {
-		codecs = append(codecs, "mp4a.40."+strconv.FormatInt(int64(p.audioTrack.Type()), 10))
+		p.codecs = append(p.codecs, "mp4a.40."+strconv.FormatInt(int64(p.audioTrack.Type()), 10))
 	}
 
 	p.cnt = []byte("#EXTM3U\n" +
-		"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"" + strings.Join(codecs, ",") + "\"\n" +
+		p.streamInf(defaultBandwidth) + "\n" +
 		"stream.m3u8\n")
 
 	return p
@@ -47,3 +58,16 @@ func newMuxerPrimaryPlaylist(
 func (p *muxerPrimaryPlaylist) reader() io.Reader {
 	return bytes.NewReader(p.cnt)
 }
+
+// streamInf returns the EXT-X-STREAM-INF tag that describes the stream.
+func (p *muxerPrimaryPlaylist) streamInf(bandwidth int) string {
+	ret := "#EXT-X-STREAM-INF:BANDWIDTH=" + strconv.FormatInt(int64(bandwidth), 10)
+
+	if p.resolution != "" {
+		ret += ",RESOLUTION=" + p.resolution
+	}
+
+	ret += ",CODECS=\"" + strings.Join(p.codecs, ",") + "\""
+
+	return ret
+}
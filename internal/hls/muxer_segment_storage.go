@@ -0,0 +1,145 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// segmentStorage stores the content of a segment.
+type segmentStorage interface {
+	write(p []byte) (int, error)
+	size() uint64
+	finalize()
+	reader() io.Reader
+	remove()
+}
+
+type segmentStorageRAM struct {
+	buf bytes.Buffer
+}
+
+func (s *segmentStorageRAM) write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+func (s *segmentStorageRAM) size() uint64 {
+	return uint64(s.buf.Len())
+}
+
+func (s *segmentStorageRAM) finalize() {
+}
+
+func (s *segmentStorageRAM) reader() io.Reader {
+	return bytes.NewReader(s.buf.Bytes())
+}
+
+func (s *segmentStorageRAM) remove() {
+}
+
+type segmentStorageDisk struct {
+	fpath string
+	f     *os.File
+	w     *bufio.Writer
+	sz    uint64
+
+	mutex   sync.Mutex
+	readers int
+	removed bool
+}
+
+func newSegmentStorageDisk(dir string) (*segmentStorageDisk, error) {
+	f, err := ioutil.TempFile(dir, "*.ts")
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentStorageDisk{
+		fpath: f.Name(),
+		f:     f,
+		w:     bufio.NewWriter(f),
+	}, nil
+}
+
+func (s *segmentStorageDisk) write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.sz += uint64(n)
+	return n, err
+}
+
+func (s *segmentStorageDisk) size() uint64 {
+	return s.sz
+}
+
+// finalize flushes buffered data and closes the file handle used for writing,
+// in order not to keep a file descriptor open for every segment.
+func (s *segmentStorageDisk) finalize() {
+	if s.f != nil {
+		s.w.Flush()
+		s.f.Close()
+		s.f = nil
+		s.w = nil
+	}
+}
+
+// reader returns a reader that must be closed after usage.
+func (s *segmentStorageDisk) reader() io.Reader {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.removed {
+		return nil
+	}
+
+	f, err := os.Open(s.fpath)
+	if err != nil {
+		return nil
+	}
+
+	s.readers++
+	return &segmentStorageDiskReader{File: f, s: s}
+}
+
+// remove removes the file, or schedules its removal after all readers are closed.
+func (s *segmentStorageDisk) remove() {
+	s.finalize()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.removed = true
+	if s.readers == 0 {
+		os.Remove(s.fpath)
+	}
+}
+
+func (s *segmentStorageDisk) onReaderClose() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.readers--
+	if s.removed && s.readers == 0 {
+		os.Remove(s.fpath)
+	}
+}
+
+type segmentStorageDiskReader struct {
+	*os.File
+	s      *segmentStorageDisk
+	closed bool
+}
+
+// Close implements io.Closer.
+func (r *segmentStorageDiskReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	err := r.File.Close()
+	r.s.onReaderClose()
+	return err
+}
@@ -27,6 +27,7 @@ type muxerStreamPlaylist struct {
 	mutex              sync.Mutex
 	cond               *sync.Cond
 	closed             bool
+	ended              bool
 	segments           []*muxerTSSegment
 	segmentByName      map[string]*muxerTSSegment
 	segmentDeleteCount int
@@ -46,6 +47,20 @@ func (p *muxerStreamPlaylist) close() {
 		p.mutex.Lock()
 		defer p.mutex.Unlock()
 		p.closed = true
+
+		for _, f := range p.segments {
+			f.storage.remove()
+		}
+	}()
+
+	p.cond.Broadcast()
+}
+
+func (p *muxerStreamPlaylist) end() {
+	func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.ended = true
 	}()
 
 	p.cond.Broadcast()
@@ -56,7 +71,7 @@ func (p *muxerStreamPlaylist) reader() io.Reader {
 		p.mutex.Lock()
 		defer p.mutex.Unlock()
 
-		if !p.closed && len(p.segments) == 0 {
+		if !p.closed && !p.ended && len(p.segments) == 0 {
 			p.cond.Wait()
 		}
 
@@ -86,25 +101,53 @@ func (p *muxerStreamPlaylist) reader() io.Reader {
 		cnt += "#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatInt(int64(p.segmentDeleteCount), 10) + "\n"
 
 		for _, f := range p.segments {
+			cnt += "#EXT-X-PROGRAM-DATE-TIME:" + f.startNTP.Format("2006-01-02T15:04:05.999Z07:00") + "\n"
 			cnt += "#EXTINF:" + strconv.FormatFloat(f.duration().Seconds(), 'f', -1, 64) + ",\n"
 			cnt += f.name + ".ts\n"
 		}
 
+		if p.ended {
+			cnt += "#EXT-X-ENDLIST\n"
+		}
+
 		return []byte(cnt)
 	}}
 }
 
+// peakBandwidth returns the highest bitrate among the available segments, in bits per second.
+func (p *muxerStreamPlaylist) peakBandwidth() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ret := 0
+
+	for _, f := range p.segments {
+		d := f.duration().Seconds()
+		if d <= 0 {
+			continue
+		}
+
+		v := int(float64(f.storage.size()*8) / d)
+		if v > ret {
+			ret = v
+		}
+	}
+
+	return ret
+}
+
 func (p *muxerStreamPlaylist) segment(fname string) io.Reader {
 	base := strings.TrimSuffix(fname, ".ts")
 
 	p.mutex.Lock()
-	f, ok := p.segmentByName[base]
-	p.mutex.Unlock()
+	defer p.mutex.Unlock()
 
+	f, ok := p.segmentByName[base]
 	if !ok {
 		return nil
 	}
 
+	// the reader is opened while the segment can't be removed
 	return f.reader()
 }
 
@@ -113,10 +156,19 @@ func (p *muxerStreamPlaylist) pushSegment(t *muxerTSSegment) {
 		p.mutex.Lock()
 		defer p.mutex.Unlock()
 
+		t.storage.finalize()
+
+		// the playlist of an ended stream must not change
+		if p.ended {
+			t.storage.remove()
+			return
+		}
+
 		p.segmentByName[t.name] = t
 		p.segments = append(p.segments, t)
 
 		if len(p.segments) > p.hlsSegmentCount {
+			p.segments[0].storage.remove()
 			delete(p.segmentByName, p.segments[0].name)
 			p.segments = p.segments[1:]
 			p.segmentDeleteCount++
@@ -1,7 +1,11 @@
 package hls
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 	"time"
@@ -11,6 +15,8 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+var testTime = time.Date(2010, 0o1, 0o1, 1, 1, 1, 0, time.UTC)
+
 func checkTSPacket(t *testing.T, byts []byte, pid int, afc int) {
 	require.Equal(t, byte(0x47), byts[0])                                      // sync bit
 	require.Equal(t, uint16(pid), (uint16(byts[1])<<8|uint16(byts[2]))&0x1fff) // PID
@@ -24,19 +30,19 @@ func TestMuxerVideoAudio(t *testing.T) {
 	audioTrack, err := gortsplib.NewTrackAAC(97, 2, 44100, 2, nil)
 	require.NoError(t, err)
 
-	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, videoTrack, audioTrack)
+	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, false, "", videoTrack, audioTrack)
 	require.NoError(t, err)
 	defer m.Close()
 
 	// group without IDR
-	err = m.WriteH264(1*time.Second, [][]byte{
+	err = m.WriteH264(testTime.Add(1*time.Second), 1*time.Second, [][]byte{
 		{0x06},
 		{0x07},
 	})
 	require.NoError(t, err)
 
 	// group with IDR
-	err = m.WriteH264(2*time.Second, [][]byte{
+	err = m.WriteH264(testTime.Add(2*time.Second), 2*time.Second, [][]byte{
 		{5}, // IDR
 		{9}, // AUD
 		{8}, // PPS
@@ -44,14 +50,14 @@ func TestMuxerVideoAudio(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	err = m.WriteAAC(3*time.Second, [][]byte{
+	err = m.WriteAAC(testTime.Add(3*time.Second), 3*time.Second, [][]byte{
 		{0x01, 0x02, 0x03, 0x04},
 		{0x05, 0x06, 0x07, 0x08},
 	})
 	require.NoError(t, err)
 
 	// group without IDR
-	err = m.WriteH264(4*time.Second, [][]byte{
+	err = m.WriteH264(testTime.Add(4*time.Second), 4*time.Second, [][]byte{
 		{6},
 		{7},
 	})
@@ -60,7 +66,7 @@ func TestMuxerVideoAudio(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	// group with IDR
-	err = m.WriteH264(6*time.Second, [][]byte{
+	err = m.WriteH264(testTime.Add(6*time.Second), 6*time.Second, [][]byte{
 		{5}, // IDR
 	})
 	require.NoError(t, err)
@@ -80,6 +86,7 @@ func TestMuxerVideoAudio(t *testing.T) {
 		`#EXT-X-ALLOW-CACHE:NO\n` +
 		`#EXT-X-TARGETDURATION:4\n` +
 		`#EXT-X-MEDIA-SEQUENCE:0\n` +
+		`#EXT-X-PROGRAM-DATE-TIME:2010-01-01T01:01:03Z\n` +
 		`#EXTINF:4,\n` +
 		`([0-9]+\.ts)\n$`)
 	ma := re.FindStringSubmatch(string(byts))
@@ -130,24 +137,24 @@ func TestMuxerAudio(t *testing.T) {
 	audioTrack, err := gortsplib.NewTrackAAC(97, 2, 44100, 2, nil)
 	require.NoError(t, err)
 
-	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, nil, audioTrack)
+	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, false, "", nil, audioTrack)
 	require.NoError(t, err)
 	defer m.Close()
 
 	for i := 0; i < 100; i++ {
-		err = m.WriteAAC(1*time.Second, [][]byte{
+		err = m.WriteAAC(testTime.Add(1*time.Second), 1*time.Second, [][]byte{
 			{0x01, 0x02, 0x03, 0x04},
 		})
 		require.NoError(t, err)
 	}
 
-	err = m.WriteAAC(2*time.Second, [][]byte{
+	err = m.WriteAAC(testTime.Add(2*time.Second), 2*time.Second, [][]byte{
 		{0x01, 0x02, 0x03, 0x04},
 		{0x05, 0x06, 0x07, 0x08},
 	})
 	require.NoError(t, err)
 
-	err = m.WriteAAC(3*time.Second, [][]byte{
+	err = m.WriteAAC(testTime.Add(3*time.Second), 3*time.Second, [][]byte{
 		{0x01, 0x02, 0x03, 0x04},
 		{0x05, 0x06, 0x07, 0x08},
 	})
@@ -168,6 +175,7 @@ func TestMuxerAudio(t *testing.T) {
 		`#EXT-X-ALLOW-CACHE:NO\n` +
 		`#EXT-X-TARGETDURATION:1\n` +
 		`#EXT-X-MEDIA-SEQUENCE:0\n` +
+		`#EXT-X-PROGRAM-DATE-TIME:2010-01-01T01:01:02Z\n` +
 		`#EXTINF:1,\n` +
 		`([0-9]+\.ts)\n$`)
 	ma := re.FindStringSubmatch(string(byts))
@@ -178,11 +186,11 @@ func TestMuxerCloseBeforeFirstSegment(t *testing.T) {
 	videoTrack, err := gortsplib.NewTrackH264(96, []byte{0x07, 0x01, 0x02, 0x03}, []byte{0x08}, nil)
 	require.NoError(t, err)
 
-	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, videoTrack, nil)
+	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, false, "", videoTrack, nil)
 	require.NoError(t, err)
 
 	// group with IDR
-	err = m.WriteH264(2*time.Second, [][]byte{
+	err = m.WriteH264(testTime.Add(2*time.Second), 2*time.Second, [][]byte{
 		{5}, // IDR
 		{9}, // AUD
 		{8}, // PPS
@@ -197,15 +205,59 @@ func TestMuxerCloseBeforeFirstSegment(t *testing.T) {
 	require.Equal(t, []byte{}, byts)
 }
 
+func TestMuxerEnd(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96, []byte{0x07, 0x01, 0x02, 0x03}, []byte{0x08}, nil)
+	require.NoError(t, err)
+
+	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, false, "", videoTrack, nil)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.WriteH264(testTime, 0, [][]byte{
+		{5},
+		{1},
+	})
+	require.NoError(t, err)
+
+	err = m.WriteH264(testTime.Add(2*time.Second), 2*time.Second, [][]byte{
+		{5},
+		{2},
+	})
+	require.NoError(t, err)
+
+	m.End()
+
+	// segments produced after the end are discarded
+	err = m.WriteH264(testTime.Add(4*time.Second), 4*time.Second, [][]byte{
+		{5},
+		{3},
+	})
+	require.NoError(t, err)
+
+	byts, err := ioutil.ReadAll(m.StreamPlaylist())
+	require.NoError(t, err)
+
+	re := regexp.MustCompile(`^#EXTM3U\n` +
+		`#EXT-X-VERSION:3\n` +
+		`#EXT-X-ALLOW-CACHE:NO\n` +
+		`#EXT-X-TARGETDURATION:2\n` +
+		`#EXT-X-MEDIA-SEQUENCE:0\n` +
+		`#EXT-X-PROGRAM-DATE-TIME:(.*?)\n` +
+		`#EXTINF:2,\n` +
+		`([0-9]+\.ts)\n` +
+		`#EXT-X-ENDLIST\n$`)
+	require.Regexp(t, re, string(byts))
+}
+
 func TestMuxerMaxSegmentSize(t *testing.T) {
 	videoTrack, err := gortsplib.NewTrackH264(96, []byte{0x07, 0x01, 0x02, 0x03}, []byte{0x08}, nil)
 	require.NoError(t, err)
 
-	m, err := NewMuxer(3, 1*time.Second, 0, videoTrack, nil)
+	m, err := NewMuxer(3, 1*time.Second, 0, false, "", videoTrack, nil)
 	require.NoError(t, err)
 	defer m.Close()
 
-	err = m.WriteH264(2*time.Second, [][]byte{
+	err = m.WriteH264(testTime.Add(2*time.Second), 2*time.Second, [][]byte{
 		{5},
 	})
 	require.EqualError(t, err, "reached maximum segment size")
@@ -215,17 +267,17 @@ func TestMuxerDoubleRead(t *testing.T) {
 	videoTrack, err := gortsplib.NewTrackH264(96, []byte{0x07, 0x01, 0x02, 0x03}, []byte{0x08}, nil)
 	require.NoError(t, err)
 
-	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, videoTrack, nil)
+	m, err := NewMuxer(3, 1*time.Second, 50*1024*1024, false, "", videoTrack, nil)
 	require.NoError(t, err)
 	defer m.Close()
 
-	err = m.WriteH264(0, [][]byte{
+	err = m.WriteH264(testTime, 0, [][]byte{
 		{5},
 		{1},
 	})
 	require.NoError(t, err)
 
-	err = m.WriteH264(2*time.Second, [][]byte{
+	err = m.WriteH264(testTime.Add(2*time.Second), 2*time.Second, [][]byte{
 		{5},
 		{2},
 	})
@@ -238,3 +290,148 @@ func TestMuxerDoubleRead(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, byts1, byts2)
 }
+
+func TestMuxerSegmentDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtsp-hls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	videoTrack, err := gortsplib.NewTrackH264(96, []byte{0x07, 0x01, 0x02, 0x03}, []byte{0x08}, nil)
+	require.NoError(t, err)
+
+	m, err := NewMuxer(1, 1*time.Second, 50*1024*1024, false, dir, videoTrack, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = m.WriteH264(testTime.Add(time.Duration(i)*2*time.Second), time.Duration(i)*2*time.Second, [][]byte{
+			{5},
+			{1},
+		})
+		require.NoError(t, err)
+	}
+
+	// one segment in the playlist, one being written
+	files, err := filepath.Glob(filepath.Join(m.segmentDir, "*.ts"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(files))
+
+	r := m.streamPlaylist.segments[0].reader()
+	byts, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(byts)), m.streamPlaylist.segments[0].storage.size())
+	r.(io.Closer).Close()
+
+	f := m.tsGenerator.currentSegment.storage.(*segmentStorageDisk).f
+
+	m.Close()
+
+	// the file of the segment being written must be closed
+	_, err = f.Write([]byte{1})
+	require.True(t, errors.Is(err, os.ErrClosed))
+
+	_, err = os.Stat(m.segmentDir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMuxerSegmentDirectoryRemoveAfterRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtsp-hls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	videoTrack, err := gortsplib.NewTrackH264(96, []byte{0x07, 0x01, 0x02, 0x03}, []byte{0x08}, nil)
+	require.NoError(t, err)
+
+	m, err := NewMuxer(1, 1*time.Second, 50*1024*1024, false, dir, videoTrack, nil)
+	require.NoError(t, err)
+	defer m.Close()
+
+	write := func(i int) {
+		err := m.WriteH264(testTime.Add(time.Duration(i)*2*time.Second), time.Duration(i)*2*time.Second, [][]byte{
+			{5},
+			{1},
+		})
+		require.NoError(t, err)
+	}
+
+	write(0)
+	write(1)
+
+	seg := m.streamPlaylist.segments[0]
+	fpath := seg.storage.(*segmentStorageDisk).fpath
+	r := m.streamPlaylist.segment(seg.name + ".ts")
+	require.NotNil(t, r)
+
+	// the segment is removed from the playlist while it's being read
+	write(2)
+	require.NotEqual(t, seg, m.streamPlaylist.segments[0])
+
+	_, err = os.Stat(fpath)
+	require.NoError(t, err)
+
+	byts, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(byts)), seg.storage.size())
+
+	r.(io.Closer).Close()
+
+	_, err = os.Stat(fpath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMuxerGroupPrimaryPlaylist(t *testing.T) {
+	sps := []byte{
+		0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x3d,
+		0xb0, 0x11, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00,
+		0x00, 0x03, 0x00, 0x32, 0x8f, 0x16, 0x2e, 0x48,
+	}
+
+	videoTrack, err := gortsplib.NewTrackH264(96, sps, []byte{0x08}, nil)
+	require.NoError(t, err)
+
+	m1, err := NewMuxer(3, 1*time.Second, 50*1024*1024, true, "", videoTrack, nil)
+	require.NoError(t, err)
+	defer m1.Close()
+
+	m2, err := NewMuxer(3, 1*time.Second, 50*1024*1024, true, "", videoTrack, nil)
+	require.NoError(t, err)
+	defer m2.Close()
+
+	for _, m := range []*Muxer{m1, m2} {
+		err = m.WriteH264(testTime, 0, [][]byte{
+			{5}, // IDR
+		})
+		require.NoError(t, err)
+
+		err = m.WriteH264(testTime.Add(500*time.Millisecond), 500*time.Millisecond, [][]byte{
+			{1}, // non-IDR
+		})
+		require.NoError(t, err)
+
+		// an IDR inside the same slot does not switch segment
+		err = m.WriteH264(testTime.Add(900*time.Millisecond), 900*time.Millisecond, [][]byte{
+			{5}, // IDR
+		})
+		require.NoError(t, err)
+
+		err = m.WriteH264(testTime.Add(1100*time.Millisecond), 1100*time.Millisecond, [][]byte{
+			{5}, // IDR
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 1, len(m1.streamPlaylist.segments))
+	require.Equal(t, 1100*time.Millisecond, m1.streamPlaylist.segments[0].duration())
+
+	byts, err := ioutil.ReadAll(GroupPrimaryPlaylist([]MuxerVariant{
+		{Muxer: m1, URI: "../high/stream.m3u8"},
+		{Muxer: m2, URI: "../low/stream.m3u8"},
+	}))
+	require.NoError(t, err)
+
+	re := regexp.MustCompile(`^#EXTM3U\n` +
+		`#EXT-X-STREAM-INF:BANDWIDTH=[0-9]+,RESOLUTION=640x480,CODECS="avc1.42c01e"\n` +
+		`\.\./high/stream\.m3u8\n` +
+		`#EXT-X-STREAM-INF:BANDWIDTH=[0-9]+,RESOLUTION=640x480,CODECS="avc1.42c01e"\n` +
+		`\.\./low/stream\.m3u8\n$`)
+	require.Regexp(t, re, string(byts))
+}
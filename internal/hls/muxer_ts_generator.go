@@ -29,6 +29,8 @@ type muxerTSGenerator struct {
 	hlsSegmentCount    int
 	hlsSegmentDuration time.Duration
 	hlsSegmentMaxSize  uint64
+	alignSegments      bool
+	segmentDir         string
 	videoTrack         *gortsplib.TrackH264
 	audioTrack         *gortsplib.TrackAAC
 	streamPlaylist     *muxerStreamPlaylist
@@ -44,6 +46,8 @@ func newMuxerTSGenerator(
 	hlsSegmentCount int,
 	hlsSegmentDuration time.Duration,
 	hlsSegmentMaxSize uint64,
+	alignSegments bool,
+	segmentDir string,
 	videoTrack *gortsplib.TrackH264,
 	audioTrack *gortsplib.TrackAAC,
 	streamPlaylist *muxerStreamPlaylist,
@@ -52,6 +56,8 @@ func newMuxerTSGenerator(
 		hlsSegmentCount:    hlsSegmentCount,
 		hlsSegmentDuration: hlsSegmentDuration,
 		hlsSegmentMaxSize:  hlsSegmentMaxSize,
+		alignSegments:      alignSegments,
+		segmentDir:         segmentDir,
 		videoTrack:         videoTrack,
 		audioTrack:         audioTrack,
 		streamPlaylist:     streamPlaylist,
@@ -61,7 +67,42 @@ func newMuxerTSGenerator(
 	return m
 }
 
-func (m *muxerTSGenerator) writeH264(pts time.Duration, nalus [][]byte) error {
+// close removes the segment that is being written, that is not part of the playlist.
+func (m *muxerTSGenerator) close() {
+	if m.currentSegment != nil {
+		m.currentSegment.storage.remove()
+		m.currentSegment = nil
+	}
+}
+
+func (m *muxerTSGenerator) segmentEnded(ntp time.Time, pts time.Duration) bool {
+	if m.alignSegments {
+		// switch segment when the wall-clock time enters a new slot.
+		// Muxers that receive IDRs at the same time produce the same boundaries.
+		slot := ntp.UnixNano() / int64(m.hlsSegmentDuration)
+		return slot != m.currentSegment.startNTP.UnixNano()/int64(m.hlsSegmentDuration)
+	}
+
+	return (pts - *m.currentSegment.startPTS) >= m.hlsSegmentDuration
+}
+
+func (m *muxerTSGenerator) newSegment(ntp time.Time) error {
+	var err error
+	m.currentSegment, err = newMuxerTSSegment(m.hlsSegmentMaxSize, m.videoTrack, m.writer, ntp, m.segmentDir)
+	return err
+}
+
+// abortSegment pushes the current segment if it contains data, otherwise discards it.
+func (m *muxerTSGenerator) abortSegment() {
+	if m.currentSegment.storage.size() > 0 {
+		m.streamPlaylist.pushSegment(m.currentSegment)
+	} else {
+		m.currentSegment.storage.remove()
+	}
+	m.currentSegment = nil
+}
+
+func (m *muxerTSGenerator) writeH264(ntp time.Time, pts time.Duration, nalus [][]byte) error {
 	idrPresent := idrPresent(nalus)
 
 	if m.currentSegment == nil {
@@ -71,7 +112,10 @@ func (m *muxerTSGenerator) writeH264(pts time.Duration, nalus [][]byte) error {
 		}
 
 		// create first segment
-		m.currentSegment = newMuxerTSSegment(m.hlsSegmentMaxSize, m.videoTrack, m.writer)
+		err := m.newSegment(ntp)
+		if err != nil {
+			return err
+		}
 		m.startPCR = time.Now()
 		m.startPTS = pts
 		m.videoDTSEst = h264.NewDTSEstimator()
@@ -82,10 +126,13 @@ func (m *muxerTSGenerator) writeH264(pts time.Duration, nalus [][]byte) error {
 		// switch segment
 		if idrPresent &&
 			m.currentSegment.startPTS != nil &&
-			(pts-*m.currentSegment.startPTS) >= m.hlsSegmentDuration {
+			m.segmentEnded(ntp, pts) {
 			m.currentSegment.endPTS = pts
 			m.streamPlaylist.pushSegment(m.currentSegment)
-			m.currentSegment = newMuxerTSSegment(m.hlsSegmentMaxSize, m.videoTrack, m.writer)
+			err := m.newSegment(ntp)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -113,30 +160,27 @@ func (m *muxerTSGenerator) writeH264(pts time.Duration, nalus [][]byte) error {
 
 	enc, err := h264.EncodeAnnexB(filteredNALUs)
 	if err != nil {
-		if m.currentSegment.buf.Len() > 0 {
-			m.streamPlaylist.pushSegment(m.currentSegment)
-		}
-		m.currentSegment = nil
+		m.abortSegment()
 		return err
 	}
 
 	err = m.currentSegment.writeH264(m.startPCR, dts, pts, idrPresent, enc)
 	if err != nil {
-		if m.currentSegment.buf.Len() > 0 {
-			m.streamPlaylist.pushSegment(m.currentSegment)
-		}
-		m.currentSegment = nil
+		m.abortSegment()
 		return err
 	}
 
 	return nil
 }
 
-func (m *muxerTSGenerator) writeAAC(pts time.Duration, aus [][]byte) error {
+func (m *muxerTSGenerator) writeAAC(ntp time.Time, pts time.Duration, aus [][]byte) error {
 	if m.videoTrack == nil {
 		if m.currentSegment == nil {
 			// create first segment
-			m.currentSegment = newMuxerTSSegment(m.hlsSegmentMaxSize, m.videoTrack, m.writer)
+			err := m.newSegment(ntp)
+			if err != nil {
+				return err
+			}
 			m.startPCR = time.Now()
 			m.startPTS = pts
 			pts = pcrOffset
@@ -149,7 +193,10 @@ func (m *muxerTSGenerator) writeAAC(pts time.Duration, aus [][]byte) error {
 				(pts-*m.currentSegment.startPTS) >= m.hlsSegmentDuration {
 				m.currentSegment.endPTS = pts
 				m.streamPlaylist.pushSegment(m.currentSegment)
-				m.currentSegment = newMuxerTSSegment(m.hlsSegmentMaxSize, m.videoTrack, m.writer)
+				err := m.newSegment(ntp)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	} else {
@@ -179,10 +226,7 @@ func (m *muxerTSGenerator) writeAAC(pts time.Duration, aus [][]byte) error {
 
 	err = m.currentSegment.writeAAC(m.startPCR, pts, enc, len(aus))
 	if err != nil {
-		if m.currentSegment.buf.Len() > 0 {
-			m.streamPlaylist.pushSegment(m.currentSegment)
-		}
-		m.currentSegment = nil
+		m.abortSegment()
 		return err
 	}
 
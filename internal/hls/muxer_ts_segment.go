@@ -1,7 +1,6 @@
 package hls
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"strconv"
@@ -17,7 +16,8 @@ type muxerTSSegment struct {
 	writer            *muxerTSWriter
 
 	name           string
-	buf            bytes.Buffer
+	startNTP       time.Time
+	storage        segmentStorage
 	startPTS       *time.Duration
 	endPTS         time.Duration
 	pcrSendCounter int
@@ -28,12 +28,25 @@ func newMuxerTSSegment(
 	hlsSegmentMaxSize uint64,
 	videoTrack *gortsplib.TrackH264,
 	writer *muxerTSWriter,
-) *muxerTSSegment {
+	startNTP time.Time,
+	segmentDir string,
+) (*muxerTSSegment, error) {
 	t := &muxerTSSegment{
 		hlsSegmentMaxSize: hlsSegmentMaxSize,
 		videoTrack:        videoTrack,
 		writer:            writer,
 		name:              strconv.FormatInt(time.Now().Unix(), 10),
+		startNTP:          startNTP,
+	}
+
+	if segmentDir != "" {
+		var err error
+		t.storage, err = newSegmentStorageDisk(segmentDir)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		t.storage = &segmentStorageRAM{}
 	}
 
 	// WriteTable() is called automatically when WriteData() is called with
@@ -43,7 +56,7 @@ func newMuxerTSSegment(
 
 	writer.currentSegment = t
 
-	return t
+	return t, nil
 }
 
 func (t *muxerTSSegment) duration() time.Duration {
@@ -51,15 +64,15 @@ func (t *muxerTSSegment) duration() time.Duration {
 }
 
 func (t *muxerTSSegment) write(p []byte) (int, error) {
-	if uint64(len(p)+t.buf.Len()) > t.hlsSegmentMaxSize {
+	if uint64(len(p))+t.storage.size() > t.hlsSegmentMaxSize {
 		return 0, fmt.Errorf("reached maximum segment size")
 	}
 
-	return t.buf.Write(p)
+	return t.storage.write(p)
 }
 
 func (t *muxerTSSegment) reader() io.Reader {
-	return bytes.NewReader(t.buf.Bytes())
+	return t.storage.reader()
 }
 
 func (t *muxerTSSegment) writeH264(
@@ -0,0 +1,208 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedFileTimeFormat = "2006-01-02T15-04-05.000"
+
+// file is a log file that is rotated when it exceeds a size or an age.
+// Rotated files are renamed by appending a timestamp, optionally compressed,
+// and deleted when they exceed the retention count.
+type file struct {
+	fpath      string
+	maxSize    uint64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	f            *os.File
+	size         uint64
+	openTime     time.Time
+	lastRotation time.Time
+
+	cleanupMutex sync.Mutex
+	cleanupWG    sync.WaitGroup
+}
+
+func newFile(
+	fpath string,
+	maxSize uint64,
+	maxAge time.Duration,
+	maxBackups int,
+	compress bool,
+) (*file, error) {
+	lf := &file{
+		fpath:      fpath,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+
+	err := lf.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return lf, nil
+}
+
+func (lf *file) open() error {
+	f, err := os.OpenFile(lf.fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	lf.f = f
+	lf.size = 0
+	lf.openTime = time.Now()
+
+	if fi, err := f.Stat(); err == nil {
+		lf.size = uint64(fi.Size())
+	}
+
+	return nil
+}
+
+func (lf *file) close() {
+	if lf.f != nil {
+		lf.f.Close()
+		lf.f = nil
+	}
+	lf.cleanupWG.Wait()
+}
+
+// reopen closes and reopens the file, in order to write into a new file
+// after the current one has been moved by an external tool.
+func (lf *file) reopen() error {
+	if lf.f != nil {
+		lf.f.Close()
+		lf.f = nil
+	}
+	return lf.open()
+}
+
+func (lf *file) write(p []byte) {
+	if lf.f != nil && lf.size > 0 &&
+		((lf.maxSize > 0 && lf.size+uint64(len(p)) > lf.maxSize) ||
+			(lf.maxAge > 0 && time.Since(lf.openTime) >= lf.maxAge)) {
+		lf.rotate()
+	}
+
+	if lf.f == nil {
+		err := lf.open()
+		if err != nil {
+			return
+		}
+	}
+
+	n, _ := lf.f.Write(p)
+	lf.size += uint64(n)
+}
+
+func (lf *file) rotate() {
+	lf.f.Close()
+	lf.f = nil
+
+	// rotated files must have distinct names
+	now := time.Now().Truncate(time.Millisecond)
+	if !now.After(lf.lastRotation) {
+		now = lf.lastRotation.Add(time.Millisecond)
+	}
+	lf.lastRotation = now
+
+	rotatedPath := lf.fpath + "." + now.Format(rotatedFileTimeFormat)
+	err := os.Rename(lf.fpath, rotatedPath)
+	if err != nil {
+		rotatedPath = ""
+	}
+
+	// if the file can't be reopened, logs are discarded until the next attempt
+	lf.open()
+
+	// compression can take some time, do not block the logger
+	lf.cleanupWG.Add(1)
+	go lf.cleanup(rotatedPath)
+}
+
+func (lf *file) cleanup(rotatedPath string) {
+	defer lf.cleanupWG.Done()
+
+	lf.cleanupMutex.Lock()
+	defer lf.cleanupMutex.Unlock()
+
+	if rotatedPath != "" && lf.compress {
+		err := compressFile(rotatedPath)
+		if err == nil {
+			os.Remove(rotatedPath)
+		}
+	}
+
+	if lf.maxBackups > 0 {
+		backups := lf.backups()
+		if len(backups) > lf.maxBackups {
+			for _, fpath := range backups[:len(backups)-lf.maxBackups] {
+				os.Remove(fpath)
+			}
+		}
+	}
+}
+
+// backups returns rotated files, sorted from the oldest to the newest.
+func (lf *file) backups() []string {
+	matches, err := filepath.Glob(lf.fpath + ".*")
+	if err != nil {
+		return nil
+	}
+
+	var ret []string
+	for _, fpath := range matches {
+		ts := strings.TrimSuffix(strings.TrimPrefix(fpath, lf.fpath+"."), ".gz")
+		if _, err := time.Parse(rotatedFileTimeFormat, ts); err == nil {
+			ret = append(ret, fpath)
+		}
+	}
+
+	// timestamps are sorted lexicographically
+	sort.Slice(ret, func(i, j int) bool {
+		return strings.TrimSuffix(ret[i], ".gz") < strings.TrimSuffix(ret[j], ".gz")
+	})
+
+	return ret
+}
+
+func compressFile(fpath string) error {
+	in, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(fpath+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(out)
+
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	out.Close()
+
+	if err != nil {
+		os.Remove(fpath + ".gz")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtsp-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "test.log")
+
+	lf, err := newFile(fpath, 10, 0, 2, true)
+	require.NoError(t, err)
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		lf.write([]byte(line))
+	}
+
+	lf.close()
+
+	byts, err := ioutil.ReadFile(fpath)
+	require.NoError(t, err)
+	require.Equal(t, "dddddddd\n", string(byts))
+
+	backups := lf.backups()
+	require.Equal(t, 2, len(backups))
+
+	for i, exp := range []string{"bbbbbbbb\n", "cccccccc\n"} {
+		require.Equal(t, ".gz", filepath.Ext(backups[i]))
+
+		f, err := os.Open(backups[i])
+		require.NoError(t, err)
+		defer f.Close()
+
+		r, err := gzip.NewReader(f)
+		require.NoError(t, err)
+
+		byts, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, exp, string(byts))
+	}
+}
+
+func TestFileRotationByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtsp-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "test.log")
+
+	lf, err := newFile(fpath, 0, 50*time.Millisecond, 0, false)
+	require.NoError(t, err)
+
+	lf.write([]byte("aaaa\n"))
+	time.Sleep(60 * time.Millisecond)
+	lf.write([]byte("bbbb\n"))
+
+	lf.close()
+
+	backups := lf.backups()
+	require.Equal(t, 1, len(backups))
+
+	byts, err := ioutil.ReadFile(backups[0])
+	require.NoError(t, err)
+	require.Equal(t, "aaaa\n", string(byts))
+}
+
+func TestFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtsp-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "test.log")
+
+	lf, err := newFile(fpath, 0, 0, 0, false)
+	require.NoError(t, err)
+	defer lf.close()
+
+	lf.write([]byte("aaaa\n"))
+
+	// simulate logrotate
+	err = os.Rename(fpath, fpath+".1")
+	require.NoError(t, err)
+
+	err = lf.reopen()
+	require.NoError(t, err)
+
+	lf.write([]byte("bbbb\n"))
+
+	byts, err := ioutil.ReadFile(fpath)
+	require.NoError(t, err)
+	require.Equal(t, "bbbb\n", string(byts))
+}
@@ -2,10 +2,12 @@ package logger
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gookit/color"
@@ -36,56 +38,263 @@ const (
 	DestinationSyslog
 )
 
+// Format is a log format.
+type Format int
+
+const (
+	// FormatText writes logs as human-readable lines.
+	FormatText Format = iota
+
+	// FormatJSON writes logs as JSON objects, one per line.
+	FormatJSON
+)
+
+// Field is a structured field of a log entry.
+// Fields can be passed to Log() before the arguments of the format.
+// In text format they are printed as prefixes of the message,
+// while in JSON format they are printed as properties of the entry.
+// If Level is not zero, it overrides the minimum level of entries that
+// contain the field.
+type Field struct {
+	Key    string
+	Value  string
+	Prefix string
+	Level  Level
+}
+
+// Component returns a field that contains the name of a component.
+func Component(name string) Field {
+	return Field{Key: "component", Value: strings.ToLower(name), Prefix: "[" + name + "]"}
+}
+
+// Path returns a field that contains a path name.
+func Path(name string) Field {
+	return Field{Key: "path", Value: name, Prefix: "[path " + name + "]"}
+}
+
+// Session returns a field that contains a session ID.
+func Session(id string) Field {
+	return Field{Key: "session", Value: id, Prefix: "[session " + id + "]"}
+}
+
+// RemoteAddr returns a field that contains the address of a remote client.
+func RemoteAddr(addr interface{}) Field {
+	v := fmt.Sprint(addr)
+	return Field{Key: "remoteAddr", Value: v, Prefix: "[conn " + v + "]"}
+}
+
+// number of entries that are kept in memory in order to be sent to new subscribers.
+const recentEntriesCount = 100
+
+// number of entries that can be queued for a subscriber before being discarded.
+const subscriberQueueSize = 256
+
 // Logger is a log handler.
 type Logger struct {
-	level        Level
-	destinations map[Destination]struct{}
+	componentLevels map[string]Level
+	format          Format
+	filePath        string
+	fileMaxSize     uint64
+	fileMaxAge      time.Duration
+	fileMaxBackups  int
+	fileCompress    bool
+	level           *int64
 
 	mutex        sync.Mutex
-	file         *os.File
+	destinations map[Destination]struct{}
+	file         *file
 	syslog       io.WriteCloser
+	stream       bool
 	stdoutBuffer bytes.Buffer
-	fileBuffer   bytes.Buffer
-	syslogBuffer bytes.Buffer
+	plainBuffer  bytes.Buffer
+	recent       []string
+	subscribers  map[chan string]struct{}
 }
 
 // New allocates a log handler.
-func New(level Level, destinations map[Destination]struct{}, filePath string) (*Logger, error) {
+// componentLevels overrides the level of entries that contain a component field.
+// Log files are rotated when they exceed fileMaxSize or fileMaxAge (if not zero),
+// and at most fileMaxBackups rotated files are kept (if not zero).
+// Recent entries are kept in memory for subscribers only if stream is true.
+func New(
+	level Level,
+	componentLevels map[string]Level,
+	format Format,
+	destinations map[Destination]struct{},
+	filePath string,
+	fileMaxSize uint64,
+	fileMaxAge time.Duration,
+	fileMaxBackups int,
+	fileCompress bool,
+	stream bool,
+) (*Logger, error) {
+	v := int64(level)
+
 	lh := &Logger{
-		level:        level,
-		destinations: destinations,
+		componentLevels: componentLevels,
+		format:          format,
+		filePath:        filePath,
+		fileMaxSize:     fileMaxSize,
+		fileMaxAge:      fileMaxAge,
+		fileMaxBackups:  fileMaxBackups,
+		fileCompress:    fileCompress,
+		level:           &v,
+		destinations:    make(map[Destination]struct{}),
+		stream:          stream,
+		subscribers:     make(map[chan string]struct{}),
+	}
+
+	err := lh.setDestinations(destinations)
+	if err != nil {
+		lh.Close()
+		return nil, err
+	}
+
+	return lh, nil
+}
+
+// Close closes a log handler.
+func (lh *Logger) Close() {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	lh.setDestinations(nil)
+
+	for ch := range lh.subscribers {
+		close(ch)
+	}
+	lh.subscribers = nil
+}
+
+// Level returns the log level.
+func (lh *Logger) Level() Level {
+	return Level(atomic.LoadInt64(lh.level))
+}
+
+// SetLevel sets the log level.
+func (lh *Logger) SetLevel(level Level) {
+	atomic.StoreInt64(lh.level, int64(level))
+}
+
+// SetStream enables or disables keeping recent entries for subscribers.
+func (lh *Logger) SetStream(stream bool) {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	lh.stream = stream
+	if !stream {
+		lh.recent = nil
+	}
+}
+
+// Destinations returns the log destinations.
+func (lh *Logger) Destinations() map[Destination]struct{} {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	ret := make(map[Destination]struct{})
+	for d := range lh.destinations {
+		ret[d] = struct{}{}
 	}
+	return ret
+}
 
-	if _, ok := destinations[DestinationFile]; ok {
+// SetDestinations sets the log destinations.
+func (lh *Logger) SetDestinations(destinations map[Destination]struct{}) error {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+	return lh.setDestinations(destinations)
+}
+
+// setDestinations opens the new destinations before closing the old ones,
+// in order to leave the current ones untouched in case of errors.
+func (lh *Logger) setDestinations(destinations map[Destination]struct{}) error {
+	_, wantFile := destinations[DestinationFile]
+	_, wantSyslog := destinations[DestinationSyslog]
+
+	var newFileDest *file
+	if wantFile && lh.file == nil {
 		var err error
-		lh.file, err = os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		newFileDest, err = newFile(lh.filePath, lh.fileMaxSize, lh.fileMaxAge, lh.fileMaxBackups, lh.fileCompress)
 		if err != nil {
-			lh.Close()
-			return nil, err
+			return err
 		}
 	}
 
-	if _, ok := destinations[DestinationSyslog]; ok {
+	var newSyslogDest io.WriteCloser
+	if wantSyslog && lh.syslog == nil {
 		var err error
-		lh.syslog, err = newSyslog("rtsp-simple-server")
+		newSyslogDest, err = newSyslog("rtsp-simple-server")
 		if err != nil {
-			lh.Close()
-			return nil, err
+			if newFileDest != nil {
+				newFileDest.close()
+			}
+			return err
 		}
 	}
 
-	return lh, nil
+	if newFileDest != nil {
+		lh.file = newFileDest
+	} else if !wantFile && lh.file != nil {
+		lh.file.close()
+		lh.file = nil
+	}
+
+	if newSyslogDest != nil {
+		lh.syslog = newSyslogDest
+	} else if !wantSyslog && lh.syslog != nil {
+		lh.syslog.Close()
+		lh.syslog = nil
+	}
+
+	lh.destinations = make(map[Destination]struct{})
+	for d := range destinations {
+		lh.destinations[d] = struct{}{}
+	}
+
+	return nil
 }
 
-// Close closes a log handler.
-func (lh *Logger) Close() {
-	if lh.file != nil {
-		lh.file.Close()
+// Subscribe returns recent log entries and a channel that receives new entries,
+// formatted without colors. Entries are discarded if the channel is full.
+// The channel is closed when the Logger is closed.
+func (lh *Logger) Subscribe() ([]string, chan string) {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	recent := append([]string(nil), lh.recent...)
+
+	ch := make(chan string, subscriberQueueSize)
+	if lh.subscribers != nil {
+		lh.subscribers[ch] = struct{}{}
+	} else {
+		close(ch)
 	}
 
-	if lh.syslog != nil {
-		lh.syslog.Close()
+	return recent, ch
+}
+
+// Unsubscribe releases a channel returned by Subscribe.
+func (lh *Logger) Unsubscribe(ch chan string) {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	if _, ok := lh.subscribers[ch]; ok {
+		delete(lh.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Reopen reopens the log file, in order to support external rotation tools.
+func (lh *Logger) Reopen() error {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	if lh.file == nil {
+		return nil
 	}
+
+	return lh.file.reopen()
 }
 
 // https://golang.org/src/log/log.go#L78
@@ -167,14 +376,117 @@ func writeLevel(buf *bytes.Buffer, level Level, doColor bool) {
 	buf.WriteByte(' ')
 }
 
+func writeFields(buf *bytes.Buffer, fields []Field) {
+	for _, f := range fields {
+		if f.Prefix != "" {
+			buf.WriteString(f.Prefix)
+			buf.WriteByte(' ')
+		}
+	}
+}
+
 func writeContent(buf *bytes.Buffer, format string, args []interface{}) {
 	buf.Write([]byte(fmt.Sprintf(format, args...)))
 	buf.WriteByte('\n')
 }
 
+func levelName(level Level) string {
+	switch level {
+	case Debug:
+		return "debug"
+
+	case Info:
+		return "info"
+
+	case Warn:
+		return "warn"
+	}
+	return "error"
+}
+
+func writeJSON(buf *bytes.Buffer, level Level, fields []Field, format string, args []interface{}) {
+	writeProp := func(key string, value string) {
+		buf.WriteByte(',')
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, _ := json.Marshal(value)
+		buf.Write(v)
+	}
+
+	buf.WriteString(`{"time":`)
+	t, _ := json.Marshal(time.Now().Format(time.RFC3339Nano))
+	buf.Write(t)
+	writeProp("level", levelName(level))
+
+	// fields of inner components override the ones of outer components
+	for i, f := range fields {
+		overridden := false
+		for _, f2 := range fields[i+1:] {
+			if f2.Key == f.Key {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			writeProp(f.Key, f.Value)
+		}
+	}
+
+	writeProp("message", fmt.Sprintf(format, args...))
+	buf.WriteString("}\n")
+}
+
+func (lh *Logger) writeEntry(buf *bytes.Buffer, level Level, doColor bool,
+	fields []Field, format string, args []interface{}) {
+	buf.Reset()
+
+	if lh.format == FormatJSON {
+		writeJSON(buf, level, fields, format, args)
+		return
+	}
+
+	writeTime(buf, doColor)
+	writeLevel(buf, level, doColor)
+	writeFields(buf, fields)
+	writeContent(buf, format, args)
+}
+
+// minLevel returns the minimum level of an entry.
+// Levels of fields have priority over component levels,
+// and inner fields have priority over outer ones.
+func (lh *Logger) minLevel(fields []Field) Level {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Level != 0 {
+			return fields[i].Level
+		}
+	}
+
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Key == "component" {
+			if l, ok := lh.componentLevels[fields[i].Value]; ok {
+				return l
+			}
+		}
+	}
+
+	return lh.Level()
+}
+
 // Log writes a log entry.
 func (lh *Logger) Log(level Level, format string, args ...interface{}) {
-	if level < lh.level {
+	// extract leading fields
+	var fields []Field
+	for len(args) > 0 {
+		f, ok := args[0].(Field)
+		if !ok {
+			break
+		}
+		fields = append(fields, f)
+		args = args[1:]
+	}
+
+	if level < lh.minLevel(fields) {
 		return
 	}
 
@@ -182,26 +494,40 @@ func (lh *Logger) Log(level Level, format string, args ...interface{}) {
 	defer lh.mutex.Unlock()
 
 	if _, ok := lh.destinations[DestinationStdout]; ok {
-		lh.stdoutBuffer.Reset()
-		writeTime(&lh.stdoutBuffer, true)
-		writeLevel(&lh.stdoutBuffer, level, true)
-		writeContent(&lh.stdoutBuffer, format, args)
+		lh.writeEntry(&lh.stdoutBuffer, level, true, fields, format, args)
 		print(lh.stdoutBuffer.String())
 	}
 
-	if _, ok := lh.destinations[DestinationFile]; ok {
-		lh.fileBuffer.Reset()
-		writeTime(&lh.fileBuffer, false)
-		writeLevel(&lh.fileBuffer, level, false)
-		writeContent(&lh.fileBuffer, format, args)
-		lh.file.Write(lh.fileBuffer.Bytes())
+	if lh.file == nil && lh.syslog == nil && !lh.stream {
+		return
 	}
 
-	if _, ok := lh.destinations[DestinationSyslog]; ok {
-		lh.syslogBuffer.Reset()
-		writeTime(&lh.syslogBuffer, false)
-		writeLevel(&lh.syslogBuffer, level, false)
-		writeContent(&lh.syslogBuffer, format, args)
-		lh.syslog.Write(lh.syslogBuffer.Bytes())
+	// entries without colors are shared by file, syslog and subscribers
+	lh.writeEntry(&lh.plainBuffer, level, false, fields, format, args)
+
+	if lh.file != nil {
+		lh.file.write(lh.plainBuffer.Bytes())
+	}
+
+	if lh.syslog != nil {
+		lh.syslog.Write(lh.plainBuffer.Bytes())
+	}
+
+	if !lh.stream {
+		return
+	}
+
+	entry := strings.TrimSuffix(lh.plainBuffer.String(), "\n")
+
+	if len(lh.recent) >= recentEntriesCount {
+		lh.recent = lh.recent[1:]
+	}
+	lh.recent = append(lh.recent, entry)
+
+	for ch := range lh.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
 	}
 }
@@ -0,0 +1,74 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtsp-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "test.log")
+
+	lh, err := New(Info, map[string]Level{"rtsp": Debug, "hls": Error}, FormatJSON,
+		map[Destination]struct{}{DestinationFile: {}}, fpath, 0, 0, 0, false, false)
+	require.NoError(t, err)
+
+	lh.Log(Debug, "global")
+	lh.Log(Debug, "rtsp", Component("RTSP"))
+	lh.Log(Warn, "hls", Component("HLS"))
+	lh.Log(Warn, "hls path", Component("HLS"), Field{Key: "path", Value: "cam", Level: Warn})
+	lh.Log(Debug, "rtsp path", Component("RTSP"), Field{Key: "path", Value: "cam", Level: Info})
+	lh.Close()
+
+	byts, err := ioutil.ReadFile(fpath)
+	require.NoError(t, err)
+	require.Regexp(t, `^\{"time":"[^"]+","level":"debug","component":"rtsp","message":"rtsp"\}\n`+
+		`\{"time":"[^"]+","level":"warn","component":"hls","path":"cam","message":"hls path"\}\n$`, string(byts))
+}
+
+func TestStream(t *testing.T) {
+	lh, err := New(Info, nil, FormatText, map[Destination]struct{}{}, "", 0, 0, 0, false, false)
+	require.NoError(t, err)
+	defer lh.Close()
+
+	lh.Log(Info, "first")
+
+	recent, ch := lh.Subscribe()
+	require.Equal(t, 0, len(recent))
+	lh.Unsubscribe(ch)
+
+	lh.SetStream(true)
+	lh.Log(Info, "second")
+
+	recent, ch = lh.Subscribe()
+	defer lh.Unsubscribe(ch)
+	require.Equal(t, 1, len(recent))
+	require.Regexp(t, `INF second$`, recent[0])
+
+	lh.Log(Info, "third")
+	require.Regexp(t, `INF third$`, <-ch)
+}
+
+func TestSetDestinationsError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtsp-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	lh, err := New(Info, nil, FormatText, map[Destination]struct{}{DestinationStdout: {}},
+		filepath.Join(dir, "missing", "test.log"), 0, 0, 0, false, false)
+	require.NoError(t, err)
+	defer lh.Close()
+
+	err = lh.SetDestinations(map[Destination]struct{}{DestinationFile: {}})
+	require.Error(t, err)
+
+	// the previous destinations are kept
+	require.Equal(t, map[Destination]struct{}{DestinationStdout: {}}, lh.Destinations())
+}
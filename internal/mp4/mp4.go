@@ -0,0 +1,192 @@
+// Package mp4 contains a MP4 writer that wraps single H264 access units.
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/aler9/gortsplib/pkg/h264"
+
+	"github.com/aler9/rtsp-simple-server/internal/h264sps"
+)
+
+const (
+	videoTimescale     = 90000
+	videoFrameDuration = videoTimescale / 30
+)
+
+// identity transformation matrix, used by mvhd and tkhd.
+var matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00,
+}
+
+func uint16Bytes(v uint16) []byte {
+	ret := make([]byte, 2)
+	binary.BigEndian.PutUint16(ret, v)
+	return ret
+}
+
+func uint32Bytes(v uint32) []byte {
+	ret := make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, v)
+	return ret
+}
+
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	ret := make([]byte, 0, size)
+	ret = append(ret, uint32Bytes(uint32(size))...)
+	ret = append(ret, typ...)
+	for _, p := range payloads {
+		ret = append(ret, p...)
+	}
+	return ret
+}
+
+func fullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	return box(typ, append([][]byte{uint32Bytes(uint32(version)<<24 | flags)}, payloads...)...)
+}
+
+func avcC(sps []byte, pps []byte) []byte {
+	return box("avcC",
+		[]byte{
+			1,      // configurationVersion
+			sps[1], // AVCProfileIndication
+			sps[2], // profile_compatibility
+			sps[3], // AVCLevelIndication
+			0xFF,   // lengthSizeMinusOne = 3
+			0xE1,   // numOfSequenceParameterSets = 1
+		},
+		uint16Bytes(uint16(len(sps))),
+		sps,
+		[]byte{1}, // numOfPictureParameterSets
+		uint16Bytes(uint16(len(pps))),
+		pps)
+}
+
+func moov(sps []byte, pps []byte, width int, height int, sampleSize int, sampleOffset int) []byte {
+	avc1 := box("avc1",
+		make([]byte, 6),  // reserved
+		uint16Bytes(1),   // data_reference_index
+		make([]byte, 16), // pre_defined, reserved
+		uint16Bytes(uint16(width)),
+		uint16Bytes(uint16(height)),
+		uint32Bytes(0x00480000), // horizresolution
+		uint32Bytes(0x00480000), // vertresolution
+		make([]byte, 4),         // reserved
+		uint16Bytes(1),          // frame_count
+		make([]byte, 32),        // compressorname
+		uint16Bytes(0x0018),     // depth
+		uint16Bytes(0xFFFF),     // pre_defined
+		avcC(sps, pps))
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, uint32Bytes(1), avc1),
+		fullBox("stts", 0, 0, uint32Bytes(1), uint32Bytes(1), uint32Bytes(videoFrameDuration)),
+		fullBox("stss", 0, 0, uint32Bytes(1), uint32Bytes(1)),
+		fullBox("stsc", 0, 0, uint32Bytes(1), uint32Bytes(1), uint32Bytes(1), uint32Bytes(1)),
+		fullBox("stsz", 0, 0, uint32Bytes(0), uint32Bytes(1), uint32Bytes(uint32(sampleSize))),
+		fullBox("stco", 0, 0, uint32Bytes(1), uint32Bytes(uint32(sampleOffset))))
+
+	minf := box("minf",
+		fullBox("vmhd", 0, 1, make([]byte, 8)),
+		box("dinf",
+			fullBox("dref", 0, 0, uint32Bytes(1),
+				fullBox("url ", 0, 1))),
+		stbl)
+
+	mdia := box("mdia",
+		fullBox("mdhd", 0, 0,
+			make([]byte, 8), // creation_time, modification_time
+			uint32Bytes(videoTimescale),
+			uint32Bytes(videoFrameDuration),
+			uint16Bytes(0x55C4), // language = und
+			uint16Bytes(0)),
+		fullBox("hdlr", 0, 0,
+			make([]byte, 4), // pre_defined
+			[]byte("vide"),
+			make([]byte, 12), // reserved
+			[]byte("VideoHandler\x00")),
+		minf)
+
+	trak := box("trak",
+		fullBox("tkhd", 0, 3,
+			make([]byte, 8), // creation_time, modification_time
+			uint32Bytes(1),  // track_ID
+			make([]byte, 4), // reserved
+			uint32Bytes(videoFrameDuration*1000/videoTimescale),
+			make([]byte, 16), // reserved, layer, alternate_group, volume, reserved
+			matrix,
+			uint32Bytes(uint32(width)<<16),
+			uint32Bytes(uint32(height)<<16)),
+		mdia)
+
+	return box("moov",
+		fullBox("mvhd", 0, 0,
+			make([]byte, 8),   // creation_time, modification_time
+			uint32Bytes(1000), // timescale
+			uint32Bytes(videoFrameDuration*1000/videoTimescale),
+			uint32Bytes(0x00010000), // rate
+			uint16Bytes(0x0100),     // volume
+			make([]byte, 10),        // reserved
+			matrix,
+			make([]byte, 24), // pre_defined
+			uint32Bytes(2)),  // next_track_ID
+		trak)
+}
+
+// WriteH264 writes a MP4 file that contains a single H264 access unit.
+// SPS, PPS and AUD NALUs are removed from the access unit.
+func WriteH264(sps []byte, pps []byte, nalus [][]byte) ([]byte, error) {
+	if len(sps) < 4 {
+		return nil, fmt.Errorf("invalid SPS")
+	}
+
+	if len(pps) == 0 {
+		return nil, fmt.Errorf("invalid PPS")
+	}
+
+	var s h264sps.SPS
+	err := s.Unmarshal(sps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPS: %s", err)
+	}
+
+	var filtered [][]byte
+	for _, nalu := range nalus {
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+			continue
+		}
+		filtered = append(filtered, nalu)
+	}
+
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("access unit is empty")
+	}
+
+	sample, err := h264.EncodeAVCC(filtered)
+	if err != nil {
+		return nil, err
+	}
+
+	ftyp := box("ftyp",
+		[]byte("isom"),
+		uint32Bytes(0x200),
+		[]byte("isom"), []byte("iso2"), []byte("avc1"), []byte("mp41"))
+
+	// compute the size of moov, that doesn't depend on the sample offset
+	moovSize := len(moov(sps, pps, s.Width, s.Height, len(sample), 0))
+
+	ret := ftyp
+	ret = append(ret, moov(sps, pps, s.Width, s.Height, len(sample), len(ftyp)+moovSize+8)...)
+	ret = append(ret, box("mdat", sample)...)
+
+	return ret, nil
+}
@@ -0,0 +1,68 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSPS = []byte{
+	0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78,
+	0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03,
+	0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+	0x60, 0xc6, 0x58,
+}
+
+var testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+
+func TestWriteH264(t *testing.T) {
+	byts, err := WriteH264(testSPS, testPPS, [][]byte{
+		{0x09, 0xf0},
+		testSPS,
+		testPPS,
+		{0x65, 0x88, 0x84, 0x00},
+	})
+	require.NoError(t, err)
+
+	var types []string
+	boxes := make(map[string][]byte)
+	pos := 0
+	for pos < len(byts) {
+		size := int(binary.BigEndian.Uint32(byts[pos:]))
+		typ := string(byts[pos+4 : pos+8])
+		types = append(types, typ)
+		boxes[typ] = byts[pos : pos+size]
+		pos += size
+	}
+	require.Equal(t, []string{"ftyp", "moov", "mdat"}, types)
+
+	// sample contains the IDR only, in AVCC format
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x04, 0x65, 0x88, 0x84, 0x00}, boxes["mdat"][8:])
+
+	// chunk offset points to the sample
+	i := bytes.Index(boxes["moov"], []byte("stco"))
+	require.NotEqual(t, -1, i)
+	offset := int(binary.BigEndian.Uint32(boxes["moov"][i+12:]))
+	require.Equal(t, len(boxes["ftyp"])+len(boxes["moov"])+8, offset)
+
+	// width and height are read from the SPS
+	i = bytes.Index(boxes["moov"], []byte("avc1"))
+	require.NotEqual(t, -1, i)
+	require.Equal(t, uint16(1920), binary.BigEndian.Uint16(boxes["moov"][i+4+24:]))
+	require.Equal(t, uint16(1080), binary.BigEndian.Uint16(boxes["moov"][i+4+26:]))
+
+	require.True(t, bytes.Contains(boxes["moov"], append([]byte("avcC"), 0x01, 0x64, 0x00, 0x28)))
+}
+
+func TestWriteH264Errors(t *testing.T) {
+	_, err := WriteH264([]byte{0x67}, testPPS, [][]byte{{0x65}})
+	require.EqualError(t, err, "invalid SPS")
+
+	_, err = WriteH264(testSPS, nil, [][]byte{{0x65}})
+	require.EqualError(t, err, "invalid PPS")
+
+	_, err = WriteH264(testSPS, testPPS, [][]byte{testSPS, testPPS})
+	require.EqualError(t, err, "access unit is empty")
+}